@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/4syedalihassan/workspaces-inventory/config"
+	"github.com/4syedalihassan/workspaces-inventory/database"
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
+)
+
+// runCommand runs a one-off subcommand against the configured database
+func runCommand(cfg *config.Config, name string, args []string) {
+	switch name {
+	case "import-cloudtrail":
+		importCloudTrail(cfg, args)
+	case "import-cur":
+		importCUR(cfg, args)
+	case "import-prices":
+		importPrices(cfg, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nCommands:\n"+
+			"  import-cloudtrail -dir <path>                               Import CloudTrail log files\n"+
+			"  import-cur -dir <path> [-cost-type unblended|amortized|net]  Import Cost and Usage Report files\n"+
+			"  import-prices -file <path>                                  Replace the WorkSpaces price table\n", name)
+		os.Exit(2)
+	}
+}
+
+// importCloudTrail imports the CloudTrail log files under a directory, e.g. a synced copy
+// of a trail's S3 bucket
+func importCloudTrail(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("import-cloudtrail", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of CloudTrail .json.gz log files, searched recursively")
+	flags.Parse(args)
+	if *dir == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db := database.Connect(cfg.DatabaseURL)
+	defer database.Close()
+
+	if err := database.RunMigrations(); err != nil {
+		log.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	importer := &services.CloudTrailImporter{DB: db}
+	result, err := importer.ImportDirectory(*dir)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	fmt.Printf("Files: %d, records: %d, WorkSpaces events imported: %d, failures: %d\n",
+		result.Files, result.Records, result.Imported, result.Failed)
+	for _, message := range result.Errors {
+		fmt.Println("  " + message)
+	}
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// importCUR imports the Cost and Usage Report files under a directory, e.g. a synced copy of
+// the report's S3 prefix
+func importCUR(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("import-cur", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of report .csv, .csv.gz or .parquet files, searched recursively")
+	costType := flags.String("cost-type", "unblended", "cost to record: unblended, amortized or net")
+	flags.Parse(args)
+	if *dir == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db := database.Connect(cfg.DatabaseURL)
+	defer database.Close()
+
+	if err := database.RunMigrations(); err != nil {
+		log.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	importer := &services.CURImporter{DB: db, CostType: *costType}
+	result, err := importer.ImportDirectory(*dir)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	fmt.Printf("Files: %d, WorkSpaces line items: %d, billing rows: %d, workspaces: %d, failures: %d\n",
+		result.Files, result.LineItems, result.Rows, result.Workspaces, result.Failed)
+	for _, message := range result.Errors {
+		fmt.Println("  " + message)
+	}
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// importPrices replaces the price table used for rightsizing recommendations with a CSV file
+func importPrices(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("import-prices", flag.ExitOnError)
+	file := flags.String("file", "", "CSV price table")
+	flags.Parse(args)
+	if *file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Failed to open price table: %v", err)
+	}
+	defer f.Close()
+
+	prices, err := services.ParseWorkspacePrices(f)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	db := database.Connect(cfg.DatabaseURL)
+	defer database.Close()
+
+	if err := database.RunMigrations(); err != nil {
+		log.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	if err := models.ReplaceWorkspacePrices(db, prices); err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	fmt.Printf("Prices imported: %d\n", len(prices))
+}
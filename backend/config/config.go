@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
@@ -37,6 +38,7 @@ type Config struct {
 
 	// Sync
 	SyncSchedule string
+	SyncWorkers  int
 }
 
 // Load reads configuration from environment variables
@@ -64,6 +66,7 @@ func Load() *Config {
 		AIServiceURL: getEnv("AI_SERVICE_URL", "http://localhost:8081"),
 
 		SyncSchedule: getEnv("SYNC_SCHEDULE", "0 */6 * * *"),
+		SyncWorkers:  getEnvInt("SYNC_WORKERS", 2),
 	}
 
 	// Validate required fields in production
@@ -85,3 +88,13 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+		log.Printf("Invalid value for %s: %q, using %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
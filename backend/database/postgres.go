@@ -479,6 +479,609 @@ func RunMigrations() error {
 					EXECUTE FUNCTION update_ldap_servers_updated_at();
 			`,
 		},
+		{
+			version: 13,
+			sql: `
+				-- Record what started each sync (manual trigger or built-in scheduler)
+				ALTER TABLE sync_history
+					ADD COLUMN IF NOT EXISTS trigger_source VARCHAR(20) DEFAULT 'manual';
+
+				-- Per sync type cron schedules (blank falls back to SYNC_SCHEDULE)
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('sync.schedule.workspaces', '', false, 'sync', 'Cron schedule for WorkSpaces sync (blank uses SYNC_SCHEDULE)'),
+					('sync.schedule.cloudtrail', '', false, 'sync', 'Cron schedule for CloudTrail sync (blank uses SYNC_SCHEDULE)'),
+					('sync.schedule.billing', '', false, 'sync', 'Cron schedule for billing sync (blank uses SYNC_SCHEDULE)'),
+					('sync.schedule.usage', '', false, 'sync', 'Cron schedule for usage calculation (blank uses SYNC_SCHEDULE)'),
+					('sync.schedule.ad', '', false, 'sync', 'Cron schedule for Active Directory sync (blank uses SYNC_SCHEDULE)')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 14,
+			sql: `
+				-- Sync jobs can target a single AWS account
+				ALTER TABLE sync_history
+					ADD COLUMN IF NOT EXISTS aws_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL;
+
+				CREATE INDEX IF NOT EXISTS idx_sync_history_status ON sync_history(status);
+			`,
+		},
+		{
+			version: 15,
+			sql: `
+				-- Per-stage and per-account progress of each sync
+				ALTER TABLE sync_history
+					ADD COLUMN IF NOT EXISTS progress JSONB;
+			`,
+		},
+		{
+			version: 16,
+			sql: `
+				-- Concurrency, timeout and retry tuning for multi-account syncs
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('sync.account_concurrency', '5', false, 'sync', 'Number of AWS accounts synced in parallel'),
+					('sync.account_timeout_minutes', '15', false, 'sync', 'Time limit for syncing a single AWS account'),
+					('sync.job_timeout_minutes', '60', false, 'sync', 'Time limit for a whole sync job'),
+					('aws.retry_max_attempts', '10', false, 'aws', 'Maximum attempts for throttled or failed AWS API calls'),
+					('aws.retry_max_backoff_seconds', '60', false, 'aws', 'Maximum backoff between AWS API retries')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 17,
+			sql: `
+				-- Allow AWS accounts to authenticate by assuming an IAM role instead of static keys
+				ALTER TABLE aws_accounts
+					ADD COLUMN IF NOT EXISTS auth_type VARCHAR(20) NOT NULL DEFAULT 'access_key',
+					ADD COLUMN IF NOT EXISTS role_arn TEXT,
+					ADD COLUMN IF NOT EXISTS external_id TEXT,
+					ADD COLUMN IF NOT EXISTS session_name VARCHAR(64),
+					ADD COLUMN IF NOT EXISTS mfa_serial TEXT,
+					ADD COLUMN IF NOT EXISTS source_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL;
+
+				-- Role-based accounts have no access keys
+				ALTER TABLE aws_accounts
+					ALTER COLUMN access_key_id SET DEFAULT '',
+					ALTER COLUMN secret_access_key SET DEFAULT '';
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('aws.assume_role_duration_minutes', '60', false, 'aws', 'Lifetime of assumed-role sessions before they are refreshed')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 18,
+			sql: `
+				-- Discover WorkSpaces in several regions per AWS account ('all' for every region)
+				ALTER TABLE aws_accounts
+					ADD COLUMN IF NOT EXISTS regions TEXT[];
+
+				-- Record the region each workspace was discovered in
+				ALTER TABLE workspaces
+					ADD COLUMN IF NOT EXISTS region VARCHAR(50);
+
+				UPDATE workspaces w SET region = a.region
+				FROM aws_accounts a
+				WHERE w.aws_account_id = a.id AND w.region IS NULL;
+
+				CREATE INDEX IF NOT EXISTS idx_workspaces_region ON workspaces(region);
+			`,
+		},
+		{
+			version: 19,
+			sql: `
+				-- Index workspace tags for tag:<key>=<value> filters (containment queries)
+				UPDATE workspaces SET tags = '{}'::jsonb WHERE tags IS NULL OR jsonb_typeof(tags) <> 'object';
+				CREATE INDEX IF NOT EXISTS idx_workspaces_tags ON workspaces USING GIN (tags jsonb_path_ops);
+			`,
+		},
+		{
+			version: 20,
+			sql: `
+				-- Inventory of bundles, directories and images referenced by workspaces
+				CREATE TABLE IF NOT EXISTS workspace_bundles (
+					bundle_id VARCHAR(255) PRIMARY KEY,
+					name VARCHAR(255),
+					description TEXT,
+					owner VARCHAR(255),
+					compute_type VARCHAR(100),
+					root_volume_size_gib INTEGER,
+					user_volume_size_gib INTEGER,
+					image_id VARCHAR(255),
+					state VARCHAR(50),
+					bundle_created_at TIMESTAMP,
+					bundle_updated_at TIMESTAMP,
+					aws_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL,
+					region VARCHAR(50),
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE TABLE IF NOT EXISTS workspace_directories (
+					directory_id VARCHAR(255) PRIMARY KEY,
+					alias VARCHAR(255),
+					directory_name VARCHAR(255),
+					directory_type VARCHAR(50),
+					registration_code VARCHAR(100),
+					state VARCHAR(50),
+					customer_user_name VARCHAR(255),
+					dns_ip_addresses TEXT[],
+					subnet_ids TEXT[],
+					security_group_id VARCHAR(255),
+					iam_role_id VARCHAR(255),
+					tenancy VARCHAR(50),
+					aws_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL,
+					region VARCHAR(50),
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE TABLE IF NOT EXISTS workspace_images (
+					image_id VARCHAR(255) PRIMARY KEY,
+					name VARCHAR(255),
+					description TEXT,
+					owner_account_id VARCHAR(12),
+					operating_system VARCHAR(50),
+					state VARCHAR(50),
+					required_tenancy VARCHAR(50),
+					error_message TEXT,
+					image_created_at TIMESTAMP,
+					aws_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL,
+					region VARCHAR(50),
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_bundles_account ON workspace_bundles(aws_account_id);
+				CREATE INDEX IF NOT EXISTS idx_workspace_directories_account ON workspace_directories(aws_account_id);
+				CREATE INDEX IF NOT EXISTS idx_workspace_images_account ON workspace_images(aws_account_id);
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('sync.schedule.bundles', '', false, 'sync', 'Cron schedule for bundle sync (blank uses SYNC_SCHEDULE)'),
+					('sync.schedule.directories', '', false, 'sync', 'Cron schedule for directory sync (blank uses SYNC_SCHEDULE)'),
+					('sync.schedule.images', '', false, 'sync', 'Cron schedule for image sync (blank uses SYNC_SCHEDULE)')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 21,
+			sql: `
+				-- Workspaces that no longer appear in DescribeWorkspaces are marked removed
+				ALTER TABLE workspaces
+					ADD COLUMN IF NOT EXISTS removed_at TIMESTAMP;
+
+				CREATE INDEX IF NOT EXISTS idx_workspaces_active ON workspaces(aws_account_id, region) WHERE removed_at IS NULL;
+			`,
+		},
+		{
+			version: 22,
+			sql: `
+				-- Versions of each workspace's inventory fields for point-in-time queries
+				CREATE TABLE IF NOT EXISTS workspace_history (
+					id SERIAL PRIMARY KEY,
+					workspace_id VARCHAR(255) NOT NULL,
+					user_name VARCHAR(255),
+					display_name VARCHAR(255),
+					directory_id VARCHAR(255),
+					ip_address VARCHAR(45),
+					state VARCHAR(50),
+					bundle_id VARCHAR(255),
+					subnet_id VARCHAR(255),
+					computer_name VARCHAR(255),
+					running_mode VARCHAR(50),
+					root_volume_size_gib INTEGER,
+					user_volume_size_gib INTEGER,
+					compute_type_name VARCHAR(100),
+					tags JSONB,
+					region VARCHAR(50),
+					aws_account_id INTEGER,
+					valid_from TIMESTAMP NOT NULL,
+					valid_to TIMESTAMP
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_history_workspace ON workspace_history(workspace_id, valid_from);
+				CREATE INDEX IF NOT EXISTS idx_workspace_history_valid ON workspace_history(valid_from, valid_to);
+				CREATE UNIQUE INDEX IF NOT EXISTS idx_workspace_history_current ON workspace_history(workspace_id) WHERE valid_to IS NULL;
+
+				-- Start each existing workspace's history from its last update
+				INSERT INTO workspace_history (
+					workspace_id, user_name, display_name, directory_id, ip_address, state,
+					bundle_id, subnet_id, computer_name, running_mode, root_volume_size_gib,
+					user_volume_size_gib, compute_type_name, tags, region, aws_account_id, valid_from
+				)
+				SELECT workspace_id, user_name, display_name, directory_id, ip_address, state,
+					bundle_id, subnet_id, computer_name, running_mode, root_volume_size_gib,
+					user_volume_size_gib, compute_type_name, tags, region, aws_account_id, updated_at
+				FROM workspaces
+				WHERE removed_at IS NULL
+				  AND NOT EXISTS (SELECT 1 FROM workspace_history h WHERE h.workspace_id = workspaces.workspace_id);
+			`,
+		},
+		{
+			version: 23,
+			sql: `
+				-- High-water mark of CloudTrail ingestion per account and region
+				CREATE TABLE IF NOT EXISTS cloudtrail_cursors (
+					aws_account_id INTEGER NOT NULL REFERENCES aws_accounts(id) ON DELETE CASCADE,
+					region VARCHAR(50) NOT NULL,
+					last_event_time TIMESTAMP,
+					last_run_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (aws_account_id, region)
+				);
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('cloudtrail.backfill_days', '7', false, 'cloudtrail', 'Days of CloudTrail history read on the first sync of a region (max 90)'),
+					('cloudtrail.overlap_minutes', '15', false, 'cloudtrail', 'Minutes reread before the last ingested event to catch late deliveries')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 24,
+			sql: `
+				-- Source IP of the caller, read from archived and looked-up events
+				ALTER TABLE cloudtrail_events
+					ADD COLUMN IF NOT EXISTS source_ip_address VARCHAR(255);
+			`,
+		},
+		{
+			version: 25,
+			sql: `
+				-- Fields parsed from the full CloudTrail record
+				ALTER TABLE cloudtrail_events
+					ADD COLUMN IF NOT EXISTS user_agent TEXT,
+					ADD COLUMN IF NOT EXISTS error_code VARCHAR(255),
+					ADD COLUMN IF NOT EXISTS error_message TEXT,
+					ADD COLUMN IF NOT EXISTS principal_arn TEXT,
+					ADD COLUMN IF NOT EXISTS principal_type VARCHAR(50),
+					ADD COLUMN IF NOT EXISTS read_only BOOLEAN,
+					ADD COLUMN IF NOT EXISTS workspace_ids TEXT[];
+
+				UPDATE cloudtrail_events
+				SET workspace_ids = ARRAY[workspace_id]
+				WHERE workspace_ids IS NULL AND COALESCE(workspace_id, '') <> '';
+
+				CREATE INDEX IF NOT EXISTS idx_cloudtrail_workspace_ids ON cloudtrail_events USING GIN (workspace_ids);
+				CREATE INDEX IF NOT EXISTS idx_cloudtrail_principal_arn ON cloudtrail_events(principal_arn);
+				CREATE INDEX IF NOT EXISTS idx_cloudtrail_error_code ON cloudtrail_events(error_code) WHERE error_code IS NOT NULL;
+			`,
+		},
+		{
+			version: 26,
+			sql: `
+				-- Cost and Usage Report rows sit beside Cost Explorer rows, in either cost type
+				ALTER TABLE billing_data
+					ADD COLUMN IF NOT EXISTS source VARCHAR(20) NOT NULL DEFAULT 'cost_explorer',
+					ADD COLUMN IF NOT EXISTS cost_type VARCHAR(20) NOT NULL DEFAULT 'unblended',
+					ALTER COLUMN amount TYPE NUMERIC(18, 6);
+
+				UPDATE billing_data SET workspace_id = '' WHERE workspace_id IS NULL;
+				UPDATE billing_data SET service = '' WHERE service IS NULL;
+				UPDATE billing_data SET usage_type = '' WHERE usage_type IS NULL;
+
+				-- Rows with NULL workspace IDs escaped the old constraint; keep the newest of each
+				DELETE FROM billing_data a
+				USING billing_data b
+				WHERE a.id < b.id
+				  AND a.source = b.source AND a.cost_type = b.cost_type
+				  AND COALESCE(a.aws_account_id, 0) = COALESCE(b.aws_account_id, 0)
+				  AND a.workspace_id = b.workspace_id AND a.service = b.service AND a.usage_type = b.usage_type
+				  AND a.start_date = b.start_date AND a.end_date = b.end_date;
+
+				ALTER TABLE billing_data ALTER COLUMN workspace_id SET DEFAULT '';
+
+				-- Postgres truncated the old constraint's generated name, so find it by its columns
+				DO $$
+				DECLARE
+					old_constraint TEXT;
+				BEGIN
+					FOR old_constraint IN
+						SELECT c.conname FROM pg_constraint c
+						WHERE c.conrelid = 'billing_data'::regclass AND c.contype = 'u'
+						  AND (SELECT array_agg(a.attname::TEXT ORDER BY a.attname)
+						       FROM pg_attribute a
+						       WHERE a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey))
+						      = ARRAY['end_date', 'service', 'start_date', 'usage_type', 'workspace_id']
+					LOOP
+						EXECUTE format('ALTER TABLE billing_data DROP CONSTRAINT %I', old_constraint);
+					END LOOP;
+				END
+				$$;
+
+				CREATE UNIQUE INDEX IF NOT EXISTS idx_billing_unique ON billing_data
+					(source, cost_type, COALESCE(aws_account_id, 0), workspace_id, service, usage_type, start_date, end_date);
+				CREATE INDEX IF NOT EXISTS idx_billing_source_month ON billing_data(source, cost_type, start_date);
+			`,
+		},
+		{
+			version: 27,
+			sql: `
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('billing.lookback_days', '30', false, 'billing', 'Days of Cost Explorer data refreshed on each billing sync'),
+					('billing.granularity', 'DAILY', false, 'billing', 'Cost Explorer granularity: DAILY or MONTHLY'),
+					('billing.metrics', 'unblended', false, 'billing', 'Comma-separated cost types to sync: unblended, amortized, net'),
+					('billing.payer_account_id', '', false, 'billing', '12-digit account number of a configured payer AWS account to fetch every linked account''s costs through; empty to query each account')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 28,
+			sql: `
+				-- AutoStop timeout, for how long a workspace keeps running after a session
+				ALTER TABLE workspaces
+					ADD COLUMN IF NOT EXISTS auto_stop_timeout_minutes INTEGER;
+
+				-- Connection state of each workspace as seen by each sync
+				CREATE TABLE IF NOT EXISTS workspace_connection_snapshots (
+					workspace_id VARCHAR(255) NOT NULL REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+					captured_at TIMESTAMP NOT NULL,
+					connection_state VARCHAR(20) NOT NULL,
+					PRIMARY KEY (workspace_id, captured_at)
+				);
+
+				-- Running and connected hours per workspace and UTC day
+				CREATE TABLE IF NOT EXISTS workspace_daily_usage (
+					workspace_id VARCHAR(255) NOT NULL REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+					usage_date DATE NOT NULL,
+					running_hours NUMERIC(4, 2) NOT NULL DEFAULT 0,
+					connected_hours NUMERIC(4, 2) NOT NULL DEFAULT 0,
+					sources VARCHAR(100) NOT NULL DEFAULT '',
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (workspace_id, usage_date)
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_daily_usage_date ON workspace_daily_usage(usage_date);
+
+				ALTER TABLE workspace_usage
+					ADD COLUMN IF NOT EXISTS connected_hours DECIMAL(10, 2) DEFAULT 0;
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('usage.backfill_months', '2', false, 'usage', 'Months before the current one whose usage is recomputed on each usage sync'),
+					('usage.auto_stop_timeout_minutes', '60', false, 'usage', 'AutoStop timeout assumed for workspaces that do not report one'),
+					('usage.snapshot_retention_days', '400', false, 'usage', 'Days of connection status snapshots kept')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 29,
+			sql: `
+				-- AWS/WorkSpaces CloudWatch metrics at 5 minute, hourly and daily resolution
+				CREATE TABLE IF NOT EXISTS workspace_metrics (
+					workspace_id VARCHAR(255) NOT NULL REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+					metric_name VARCHAR(100) NOT NULL,
+					stat VARCHAR(20) NOT NULL,
+					resolution INTEGER NOT NULL,
+					period_start TIMESTAMP NOT NULL,
+					value DOUBLE PRECISION NOT NULL,
+					PRIMARY KEY (workspace_id, metric_name, resolution, period_start)
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_metrics_period ON workspace_metrics(resolution, period_start);
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('metrics.backfill_hours', '24', false, 'metrics', 'Hours of CloudWatch metrics read when a region has none stored (max 1512)'),
+					('metrics.raw_retention_days', '7', false, 'metrics', 'Days 5 minute metrics are kept'),
+					('metrics.hourly_retention_days', '90', false, 'metrics', 'Days hourly metrics are kept'),
+					('metrics.daily_retention_days', '730', false, 'metrics', 'Days daily metrics are kept'),
+					('sync.schedule.metrics', '', false, 'sync', 'Cron schedule for CloudWatch metrics sync (blank uses SYNC_SCHEDULE)')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 30,
+			sql: `
+				-- WorkSpaces prices used for rightsizing recommendations. Blank or zero key
+				-- columns match any value; the most specific matching row wins.
+				CREATE TABLE IF NOT EXISTS workspace_prices (
+					id SERIAL PRIMARY KEY,
+					region VARCHAR(50) NOT NULL DEFAULT '',
+					bundle_id VARCHAR(255) NOT NULL DEFAULT '',
+					compute_type VARCHAR(100) NOT NULL DEFAULT '',
+					root_volume_size_gib INTEGER NOT NULL DEFAULT 0,
+					user_volume_size_gib INTEGER NOT NULL DEFAULT 0,
+					always_on_monthly NUMERIC(12,4) NOT NULL,
+					auto_stop_monthly NUMERIC(12,4) NOT NULL,
+					auto_stop_hourly NUMERIC(12,4) NOT NULL,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					UNIQUE (region, bundle_id, compute_type, root_volume_size_gib, user_volume_size_gib)
+				);
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('recommendations.lookback_months', '3', false, 'recommendations', 'Whole months of usage averaged for recommendations'),
+					('recommendations.switch_margin_percent', '10', false, 'recommendations', 'How far past the break-even usage must be before a running mode switch is recommended'),
+					('recommendations.downsize_cpu_percent', '30', false, 'recommendations', 'Downsize when 95th percentile hourly CPU usage is below this'),
+					('recommendations.downsize_memory_percent', '50', false, 'recommendations', 'Downsize when 95th percentile hourly memory usage is below this'),
+					('recommendations.min_metric_days', '7', false, 'recommendations', 'Days of CPU and memory metrics needed before downsizing is recommended')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 31,
+			sql: `
+				-- Directory account status and the manager's email, for idle workspace notices
+				ALTER TABLE workspaces
+					ADD COLUMN IF NOT EXISTS ad_status VARCHAR(20),
+					ADD COLUMN IF NOT EXISTS ad_manager_email VARCHAR(255);
+
+				-- Reclamation of idle and abandoned workspaces
+				CREATE TABLE IF NOT EXISTS workspace_reclamations (
+					workspace_id VARCHAR(255) PRIMARY KEY REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+					state VARCHAR(20) NOT NULL,
+					classification VARCHAR(20),
+					reasons TEXT,
+					warned_at TIMESTAMP,
+					notified TEXT[],
+					exempt_until TIMESTAMP,
+					note TEXT,
+					updated_by VARCHAR(255),
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_reclamations_state ON workspace_reclamations(state);
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('idle.days', '30', false, 'idle', 'Days without a connection after which a workspace is idle'),
+					('idle.min_connected_hours', '2', false, 'idle', 'Workspaces connected fewer hours than this over idle.days are idle'),
+					('idle.notify_enabled', 'true', false, 'idle', 'Email the owner and their manager when a workspace is found idle'),
+					('sync.schedule.idle', '', false, 'sync', 'Cron schedule for idle workspace detection (blank uses SYNC_SCHEDULE)')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 32,
+			sql: `
+				-- Audit record of lifecycle actions run from the app
+				CREATE TABLE IF NOT EXISTS workspace_actions (
+					id SERIAL PRIMARY KEY,
+					workspace_id VARCHAR(255) NOT NULL,
+					aws_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL,
+					region VARCHAR(50),
+					action VARCHAR(20) NOT NULL,
+					status VARCHAR(20) NOT NULL,
+					error TEXT,
+					parameters JSONB,
+					requested_by VARCHAR(255) NOT NULL,
+					bulk BOOLEAN NOT NULL DEFAULT false,
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_actions_workspace ON workspace_actions(workspace_id, created_at DESC);
+				CREATE INDEX IF NOT EXISTS idx_workspace_actions_created ON workspace_actions(created_at DESC);
+
+				-- Single-use tokens confirming destructive actions
+				CREATE TABLE IF NOT EXISTS workspace_action_confirmations (
+					token VARCHAR(64) PRIMARY KEY,
+					username VARCHAR(255) NOT NULL,
+					action VARCHAR(20) NOT NULL,
+					workspace_ids TEXT[] NOT NULL,
+					parameters JSONB,
+					expires_at TIMESTAMP NOT NULL
+				);
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('actions.confirmation_ttl_minutes', '5', false, 'actions', 'Minutes a destructive action confirmation token stays valid'),
+					('actions.bulk_max_workspaces', '50', false, 'actions', 'Most workspaces a single bulk action may target')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 33,
+			sql: `
+				-- Change requests awaiting a second person's approval before they run
+				CREATE TABLE IF NOT EXISTS change_requests (
+					id SERIAL PRIMARY KEY,
+					action VARCHAR(20) NOT NULL,
+					workspace_ids TEXT[] NOT NULL,
+					parameters JSONB,
+					justification TEXT NOT NULL,
+					requested_by VARCHAR(255) NOT NULL,
+					status VARCHAR(20) NOT NULL DEFAULT 'pending',
+					decided_by VARCHAR(255),
+					decided_at TIMESTAMP,
+					decision_note TEXT,
+					expires_at TIMESTAMP NOT NULL,
+					executed_at TIMESTAMP,
+					results JSONB,
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_change_requests_status ON change_requests(status, created_at);
+
+				-- Who may approve which actions, optionally only for workspaces in one AD department
+				CREATE TABLE IF NOT EXISTS change_approval_rules (
+					id SERIAL PRIMARY KEY,
+					action VARCHAR(20) NOT NULL DEFAULT '*',
+					department VARCHAR(255) NOT NULL DEFAULT '',
+					approver_role VARCHAR(50) NOT NULL,
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					UNIQUE (action, department, approver_role)
+				);
+
+				INSERT INTO change_approval_rules (action, department, approver_role) VALUES ('*', '', 'ADMIN')
+				ON CONFLICT DO NOTHING;
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('approvals.required_for', 'terminate,compute_upgrade', false, 'approvals', 'Comma-separated actions that need an approved change request (workspace actions, modify or compute_upgrade)'),
+					('approvals.expiry_hours', '72', false, 'approvals', 'Hours a change request waits for approval before it expires'),
+					('sync.schedule.changes', '', false, 'sync', 'Cron schedule for running approved change requests (blank uses SYNC_SCHEDULE)')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 34,
+			sql: `
+				-- Workspaces requested by users through the self-service portal
+				CREATE TABLE IF NOT EXISTS workspace_requests (
+					id SERIAL PRIMARY KEY,
+					requested_by VARCHAR(255) NOT NULL,
+					user_name VARCHAR(255) NOT NULL,
+					bundle_id VARCHAR(255) NOT NULL,
+					directory_id VARCHAR(255) NOT NULL,
+					aws_account_id INTEGER REFERENCES aws_accounts(id) ON DELETE SET NULL,
+					region VARCHAR(50),
+					running_mode VARCHAR(50) NOT NULL,
+					justification TEXT NOT NULL,
+					department VARCHAR(255),
+					manager VARCHAR(255),
+					manager_email VARCHAR(255),
+					status VARCHAR(20) NOT NULL DEFAULT 'pending',
+					decided_by VARCHAR(255),
+					decided_at TIMESTAMP,
+					decision_note TEXT,
+					expires_at TIMESTAMP NOT NULL,
+					workspace_id VARCHAR(255),
+					error TEXT,
+					provisioned_at TIMESTAMP,
+					completed_at TIMESTAMP,
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_workspace_requests_status ON workspace_requests(status, created_at);
+				CREATE INDEX IF NOT EXISTS idx_workspace_requests_workspace_id ON workspace_requests(workspace_id);
+
+				-- A user has at most one open request per directory
+				CREATE UNIQUE INDEX IF NOT EXISTS idx_workspace_requests_open
+					ON workspace_requests(user_name, directory_id)
+					WHERE status IN ('pending', 'approved', 'provisioning');
+
+				INSERT INTO settings (key, value, encrypted, category, description) VALUES
+					('portal.expiry_hours', '168', false, 'portal', 'Hours a workspace request waits for approval before it expires'),
+					('portal.default_running_mode', 'AUTO_STOP', false, 'portal', 'Running mode of requested workspaces unless the request names one'),
+					('portal.provisioning_timeout_hours', '24', false, 'portal', 'Hours to wait for a created workspace to appear in a sync before the request fails'),
+					('portal.tags', '', false, 'portal', 'Extra tags for requested workspaces, as comma-separated Key=Value pairs'),
+					('sync.schedule.requests', '', false, 'sync', 'Cron schedule for provisioning approved workspace requests (blank uses SYNC_SCHEDULE)')
+				ON CONFLICT (key) DO NOTHING;
+			`,
+		},
+		{
+			version: 35,
+			sql: `
+				-- The usage account of Cost and Usage Report rows, so importing one account's
+				-- report only replaces that account's rows, configured or not
+				ALTER TABLE billing_data
+					ADD COLUMN IF NOT EXISTS usage_account_id VARCHAR(20) NOT NULL DEFAULT '';
+
+				UPDATE billing_data b SET usage_account_id = a.account_id
+				FROM aws_accounts a
+				WHERE b.source = 'cur' AND b.aws_account_id = a.id AND a.account_id IS NOT NULL;
+
+				DROP INDEX IF EXISTS idx_billing_unique;
+				CREATE UNIQUE INDEX idx_billing_unique ON billing_data
+					(source, cost_type, COALESCE(aws_account_id, 0), usage_account_id, workspace_id, service, usage_type, start_date, end_date);
+			`,
+		},
+		{
+			version: 36,
+			sql: `
+				-- The scheduler runs sync types without their own schedule every
+				-- sync.interval_minutes; clear the never-edited default so installs keep
+				-- following SYNC_SCHEDULE
+				UPDATE settings SET value = '' WHERE key = 'sync.interval_minutes' AND value = '60' AND updated_at = created_at;
+				UPDATE settings SET description = 'Minutes between syncs without their own schedule (blank uses SYNC_SCHEDULE)'
+				WHERE key = 'sync.interval_minutes';
+				UPDATE settings SET description = replace(description, '(blank uses SYNC_SCHEDULE)', '(blank uses sync.interval_minutes)')
+				WHERE key LIKE 'sync.schedule.%';
+			`,
+		},
 	}
 
 	for _, migration := range migrations {
@@ -155,7 +155,11 @@ func (h *AdminHandler) CreateUser(c *gin.Context) {
 
 	// Set default role if not provided
 	if req.Role == "" {
-		req.Role = "USER"
+		req.Role = models.RoleUser
+	}
+	if !models.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role: use ADMIN, OPERATOR or USER"})
+		return
 	}
 
 	// Hash password
@@ -205,6 +209,10 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 		updates["email"] = req.Email
 	}
 	if req.Role != "" {
+		if !models.ValidRole(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role: use ADMIN, OPERATOR or USER"})
+			return
+		}
 		updates["role"] = req.Role
 	}
 	if req.Password != "" {
@@ -3,22 +3,25 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
-	"time"
 
 	"github.com/4syedalihassan/workspaces-inventory/models"
 	"github.com/4syedalihassan/workspaces-inventory/services"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
-	"github.com/aws/aws-sdk-go/service/workspaces"
 	"github.com/gin-gonic/gin"
 )
 
+var (
+	roleARNPattern     = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/.+$`)
+	sessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+)
+
 type AWSAccountHandler struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Queue *services.SyncQueue
 }
 
 // ListAWSAccounts returns all AWS accounts
@@ -76,16 +79,34 @@ func (h *AWSAccountHandler) CreateAWSAccount(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid AWS region"})
 		return
 	}
+	if err := validateWorkSpacesRegions(req.Regions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	account := &models.AWSAccount{
 		Name:            req.Name,
 		Region:          req.Region,
+		Regions:         req.Regions,
+		AuthType:        req.AuthType,
 		AccessKeyID:     req.AccessKeyID,
 		SecretAccessKey: req.SecretAccessKey,
+		RoleARN:         optionalString(req.RoleARN),
+		ExternalID:      req.ExternalID,
+		SessionName:     optionalString(req.SessionName),
+		MFASerial:       optionalString(req.MFASerial),
+		SourceAccountID: req.SourceAccountID,
 		IsDefault:       req.IsDefault,
 		IsActive:        true,
 		Status:          "pending",
 	}
+	if account.AuthType == "" {
+		account.AuthType = models.AuthTypeAccessKey
+	}
+	if err := h.validateAccountAuth(account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	if err := models.CreateAWSAccount(h.DB, account); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create AWS account"})
@@ -93,7 +114,7 @@ func (h *AWSAccountHandler) CreateAWSAccount(c *gin.Context) {
 	}
 
 	// Try to fetch account ID from AWS
-	go h.fetchAndUpdateAccountID(account.ID, account.Region, account.AccessKeyID, account.SecretAccessKey)
+	go h.verifyAccount(account.ID)
 
 	c.JSON(http.StatusCreated, account)
 }
@@ -111,9 +132,13 @@ func (h *AWSAccountHandler) UpdateAWSAccount(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := validateWorkSpacesRegions(req.Regions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Verify account exists
-	_, err = models.GetAWSAccountByID(h.DB, id)
+	account, err := models.GetAWSAccountByID(h.DB, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "AWS account not found"})
@@ -123,22 +148,45 @@ func (h *AWSAccountHandler) UpdateAWSAccount(c *gin.Context) {
 		return
 	}
 
+	// Validate the account as it will look after the update
+	if req.AuthType != "" {
+		account.AuthType = req.AuthType
+	}
+	if req.AccessKeyID != "" {
+		account.AccessKeyID = req.AccessKeyID
+	}
+	if req.SecretAccessKey != "" {
+		account.SecretAccessKey = req.SecretAccessKey
+	}
+	if req.RoleARN != nil {
+		account.RoleARN = optionalString(*req.RoleARN)
+	}
+	if req.SessionName != nil {
+		account.SessionName = optionalString(*req.SessionName)
+	}
+	if req.SourceAccountID != nil {
+		account.SourceAccountID = req.SourceAccountID
+		if *req.SourceAccountID == 0 {
+			account.SourceAccountID = nil
+		}
+	}
+	if err := h.validateAccountAuth(account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	if err := models.UpdateAWSAccount(h.DB, id, req); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update AWS account"})
 		return
 	}
 
-	// If credentials were updated, fetch account ID
-	if req.AccessKeyID != "" && req.SecretAccessKey != "" {
-		region := req.Region
-		if region == "" {
-			// Get current region from DB
-			account, _ := models.GetAWSAccountByID(h.DB, id)
-			if account != nil {
-				region = account.Region
-			}
-		}
-		go h.fetchAndUpdateAccountID(id, region, req.AccessKeyID, req.SecretAccessKey)
+	// If credentials were updated, drop cached role sessions and fetch account ID
+	credentialsChanged := (req.AccessKeyID != "" && req.SecretAccessKey != "") ||
+		req.AuthType != "" || req.RoleARN != nil || req.ExternalID != nil ||
+		req.SessionName != nil || req.MFASerial != nil || req.SourceAccountID != nil
+	if credentialsChanged {
+		services.ResetRoleSessions()
+		go h.verifyAccount(id)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "AWS account updated successfully"})
@@ -156,11 +204,13 @@ func (h *AWSAccountHandler) DeleteAWSAccount(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete AWS account"})
 		return
 	}
+	services.ResetRoleSessions()
 
 	c.JSON(http.StatusOK, gin.H{"message": "AWS account deleted successfully"})
 }
 
-// TestAWSConnection tests the AWS credentials
+// TestAWSConnection validates the account's credential chain end to end. Accounts whose
+// role requires MFA pass the current code as the mfa_token query parameter.
 func (h *AWSAccountHandler) TestAWSConnection(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -178,93 +228,107 @@ func (h *AWSAccountHandler) TestAWSConnection(c *gin.Context) {
 		return
 	}
 
-	// Test connection
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(account.Region),
-		Credentials: credentials.NewStaticCredentials(account.AccessKeyID, account.SecretAccessKey, ""),
-	})
-	if err != nil {
-		models.UpdateAWSAccountStatus(h.DB, id, "error")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to create AWS session", "details": err.Error()})
-		return
-	}
-
-	// Try to call STS GetCallerIdentity to verify credentials
-	stsClient := sts.New(sess)
-	identity, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
-	if err != nil {
-		models.UpdateAWSAccountStatus(h.DB, id, "error")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid AWS credentials", "details": err.Error()})
-		return
-	}
-
-	// Update account ID if we got it
-	if identity.Account != nil {
-		models.UpdateAWSAccountID(h.DB, id, *identity.Account)
-	}
-
-	// Try to list WorkSpaces to verify permissions
-	wsClient := workspaces.New(sess)
-	_, err = wsClient.DescribeWorkspaces(&workspaces.DescribeWorkspacesInput{
-		Limit: aws.Int64(1),
-	})
-	if err != nil {
-		models.UpdateAWSAccountStatus(h.DB, id, "limited")
+	awsService := &services.AWSService{DB: h.DB}
+	result := awsService.TestAccountConnection(c.Request.Context(), account, c.Query("mfa_token"))
+
+	switch result.Status {
+	case "error":
+		message := "Invalid AWS credentials"
+		if result.Step == services.TestStepSource {
+			message = "Source credentials could not be used to assume the role"
+		} else if account.AuthType == models.AuthTypeAssumeRole {
+			message = "Failed to assume role"
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": message, "step": result.Step, "details": result.Details})
+	case "limited":
 		c.JSON(http.StatusOK, gin.H{
 			"status":    "limited",
 			"message":   "Connection successful but limited WorkSpaces permissions",
-			"accountId": identity.Account,
-			"details":   err.Error(),
+			"accountId": result.AccountID,
+			"arn":       result.ARN,
+			"sourceArn": result.SourceARN,
+			"details":   result.Details,
+		})
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"status":    "connected",
+			"message":   "Connection successful",
+			"accountId": result.AccountID,
+			"arn":       result.ARN,
+			"sourceArn": result.SourceARN,
 		})
-		return
 	}
-
-	// Update status to connected
-	models.UpdateAWSAccountStatus(h.DB, id, "connected")
-
-	c.JSON(http.StatusOK, gin.H{
-		"status":    "connected",
-		"message":   "Connection successful",
-		"accountId": identity.Account,
-		"arn":       identity.Arn,
-	})
 }
 
-// fetchAndUpdateAccountID fetches the AWS account ID using STS and updates it in the database
-func (h *AWSAccountHandler) fetchAndUpdateAccountID(id int, region, accessKeyID, secretAccessKey string) {
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
-	})
-	if err != nil {
-		models.UpdateAWSAccountStatus(h.DB, id, "error")
+// verifyAccount tests a new or updated account in the background to fill in its AWS
+// account ID and status. Roles that require MFA wait for an explicit test with a code.
+func (h *AWSAccountHandler) verifyAccount(id int) {
+	account, err := models.GetAWSAccountByID(h.DB, id)
+	if err != nil || (account.MFASerial != nil && *account.MFASerial != "") {
 		return
 	}
 
-	stsClient := sts.New(sess)
-	identity, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
-	if err != nil {
-		models.UpdateAWSAccountStatus(h.DB, id, "error")
-		return
+	awsService := &services.AWSService{DB: h.DB}
+	awsService.TestAccountConnection(context.Background(), account, "")
+}
+
+// validateAccountAuth checks that an account has the settings its auth type needs
+func (h *AWSAccountHandler) validateAccountAuth(account *models.AWSAccount) error {
+	switch account.AuthType {
+	case models.AuthTypeAccessKey:
+		if account.AccessKeyID == "" || account.SecretAccessKey == "" {
+			return fmt.Errorf("accessKeyId and secretAccessKey are required")
+		}
+	case models.AuthTypeAssumeRole:
+		if account.RoleARN == nil || !roleARNPattern.MatchString(*account.RoleARN) {
+			return fmt.Errorf("a valid roleArn is required")
+		}
+		if account.SessionName != nil && *account.SessionName != "" && !sessionNamePattern.MatchString(*account.SessionName) {
+			return fmt.Errorf("sessionName must be 2-64 characters of letters, digits and +=,.@_-")
+		}
+		if account.SourceAccountID != nil {
+			if *account.SourceAccountID == account.ID {
+				return fmt.Errorf("an account cannot be its own source account")
+			}
+			if _, err := models.GetAWSAccountByID(h.DB, *account.SourceAccountID); err != nil {
+				return fmt.Errorf("source account not found")
+			}
+		}
+	default:
+		return fmt.Errorf("authType must be %s or %s", models.AuthTypeAccessKey, models.AuthTypeAssumeRole)
 	}
+	return nil
+}
 
-	if identity.Account != nil {
-		models.UpdateAWSAccountID(h.DB, id, *identity.Account)
+// validateWorkSpacesRegions checks that every region in an account's region list supports WorkSpaces
+func validateWorkSpacesRegions(regions []string) error {
+	for _, region := range regions {
+		if region == models.AllRegions {
+			continue
+		}
+		supported := false
+		for _, workspacesRegion := range models.WorkSpacesRegions {
+			if region == workspacesRegion {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("WorkSpaces is not available in region %q", region)
+		}
 	}
+	return nil
+}
 
-	// Test WorkSpaces permissions
-	wsClient := workspaces.New(sess)
-	_, err = wsClient.DescribeWorkspaces(&workspaces.DescribeWorkspacesInput{
-		Limit: aws.Int64(1),
-	})
-	if err != nil {
-		models.UpdateAWSAccountStatus(h.DB, id, "limited")
-	} else {
-		models.UpdateAWSAccountStatus(h.DB, id, "connected")
+// optionalString returns nil for an empty string
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
 	}
+	return &value
 }
 
-// SyncAWSAccount triggers a sync for a specific AWS account
+// SyncAWSAccount queues a WorkSpaces sync for a specific AWS account
 func (h *AWSAccountHandler) SyncAWSAccount(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -283,36 +347,20 @@ func (h *AWSAccountHandler) SyncAWSAccount(c *gin.Context) {
 		return
 	}
 
-	// Run sync asynchronously
-	go h.syncAccount(id, account.Name)
+	syncHistory, err := h.Queue.Enqueue(c.Request.Context(), "workspaces", id, models.SyncTriggerManual)
+	if errors.Is(err, services.ErrSyncInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync for this account is already queued or running"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue sync"})
+		return
+	}
 
 	c.JSON(http.StatusAccepted, gin.H{
-		"message":     "Sync started",
-		"account_id":  id,
+		"message":      "Sync queued",
+		"sync_id":      syncHistory.ID,
+		"account_id":   id,
 		"account_name": account.Name,
 	})
 }
-
-// syncAccount performs the actual sync operation for an account
-func (h *AWSAccountHandler) syncAccount(accountID int, accountName string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
-
-	awsService := &services.AWSService{DB: h.DB}
-	notificationService := &services.NotificationService{DB: h.DB}
-
-	// Sync WorkSpaces for this account
-	recordsProcessed, err := awsService.SyncWorkSpacesForAccount(ctx, accountID)
-	
-	if err != nil {
-		// Update account status to error
-		models.UpdateAWSAccountStatus(h.DB, accountID, "error")
-		// Send failure notification
-		notificationService.NotifySyncFailed(accountName, err.Error())
-	} else {
-		// Update account status to connected
-		models.UpdateAWSAccountStatus(h.DB, accountID, "connected")
-		// Send success notification
-		notificationService.NotifySyncCompleted(accountName, recordsProcessed)
-	}
-}
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
 	"github.com/gin-gonic/gin"
 )
 
@@ -23,26 +25,10 @@ func (h *BillingHandler) ListBilling(c *gin.Context) {
 	offset, _ := strconv.Atoi(offsetStr)
 
 	// Build filters
-	filters := make(map[string]interface{})
-
-	if workspaceID := c.Query("workspace_id"); workspaceID != "" {
-		filters["workspace_id"] = workspaceID
-	}
-
-	if userName := c.Query("user_name"); userName != "" {
-		filters["user_name"] = userName
-	}
-
-	if startDate := c.Query("start_date"); startDate != "" {
-		filters["start_date"] = startDate
-	}
-
-	if endDate := c.Query("end_date"); endDate != "" {
-		filters["end_date"] = endDate
-	}
-
-	if service := c.Query("service"); service != "" {
-		filters["service"] = service
+	filters, err := billingFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Get billing data
@@ -64,56 +50,20 @@ func (h *BillingHandler) ListBilling(c *gin.Context) {
 func (h *BillingHandler) getBillingDataWithUserInfo(filters map[string]interface{}, limit, offset int) ([]map[string]interface{}, int, error) {
 	baseQuery := `
 		SELECT b.id, b.workspace_id, b.service, b.usage_type, b.start_date, b.end_date,
-		       b.amount, b.unit, b.created_at, w.user_name, w.ad_full_name
+		       b.amount, b.unit, b.source, b.cost_type, b.aws_account_id, b.created_at,
+		       w.user_name, w.ad_full_name
 		FROM billing_data b
 		LEFT JOIN workspaces w ON b.workspace_id = w.workspace_id
 		WHERE 1=1
 	`
 
 	countQuery := "SELECT COUNT(*) FROM billing_data b LEFT JOIN workspaces w ON b.workspace_id = w.workspace_id WHERE 1=1"
-	args := []interface{}{}
-	argPos := 1
 
 	// Apply filters
-	if workspaceID, ok := filters["workspace_id"].(string); ok && workspaceID != "" {
-		filterClause := fmt.Sprintf(" AND b.workspace_id = $%d", argPos)
-		baseQuery += filterClause
-		countQuery += filterClause
-		args = append(args, workspaceID)
-		argPos++
-	}
-
-	if userName, ok := filters["user_name"].(string); ok && userName != "" {
-		filterClause := fmt.Sprintf(" AND w.user_name ILIKE $%d", argPos)
-		baseQuery += filterClause
-		countQuery += filterClause
-		args = append(args, "%"+userName+"%")
-		argPos++
-	}
-
-	if startDate, ok := filters["start_date"].(string); ok && startDate != "" {
-		filterClause := fmt.Sprintf(" AND b.start_date >= $%d", argPos)
-		baseQuery += filterClause
-		countQuery += filterClause
-		args = append(args, startDate)
-		argPos++
-	}
-
-	if endDate, ok := filters["end_date"].(string); ok && endDate != "" {
-		filterClause := fmt.Sprintf(" AND b.end_date <= $%d", argPos)
-		baseQuery += filterClause
-		countQuery += filterClause
-		args = append(args, endDate)
-		argPos++
-	}
-
-	if service, ok := filters["service"].(string); ok && service != "" {
-		filterClause := fmt.Sprintf(" AND b.service = $%d", argPos)
-		baseQuery += filterClause
-		countQuery += filterClause
-		args = append(args, service)
-		argPos++
-	}
+	filterClause, args := billingFilterClause(filters, 1)
+	baseQuery += filterClause
+	countQuery += filterClause
+	argPos := len(args) + 1
 
 	// Get total count
 	var total int
@@ -135,13 +85,14 @@ func (h *BillingHandler) getBillingDataWithUserInfo(filters map[string]interface
 	billing := []map[string]interface{}{}
 	for rows.Next() {
 		var id int
-		var workspaceID, service, usageType, unit string
+		var workspaceID, service, usageType, unit, source, costType string
+		var accountID *int
 		var userName, adFullName sql.NullString
 		var startDate, endDate, createdAt interface{}
 		var amount float64
 
 		err := rows.Scan(&id, &workspaceID, &service, &usageType, &startDate, &endDate,
-			&amount, &unit, &createdAt, &userName, &adFullName)
+			&amount, &unit, &source, &costType, &accountID, &createdAt, &userName, &adFullName)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -152,45 +103,180 @@ func (h *BillingHandler) getBillingDataWithUserInfo(filters map[string]interface
 		}
 
 		billing = append(billing, map[string]interface{}{
-			"id":           id,
-			"workspace_id": workspaceID,
-			"service":      service,
-			"usage_type":   usageType,
-			"start_date":   startDate,
-			"end_date":     endDate,
-			"amount":       amount,
-			"unit":         unit,
-			"currency":     "USD",
-			"created_at":   createdAt,
-			"user_name":    userName.String,
-			"full_name":    displayName,
+			"id":             id,
+			"workspace_id":   workspaceID,
+			"service":        service,
+			"usage_type":     usageType,
+			"start_date":     startDate,
+			"end_date":       endDate,
+			"amount":         amount,
+			"unit":           unit,
+			"currency":       "USD",
+			"source":         source,
+			"cost_type":      costType,
+			"aws_account_id": accountID,
+			"created_at":     createdAt,
+			"user_name":      userName.String,
+			"full_name":      displayName,
 		})
 	}
 
 	return billing, total, nil
 }
 
-// ExportBilling exports billing data to CSV or Excel
-func (h *BillingHandler) ExportBilling(c *gin.Context) {
-	format := c.DefaultQuery("format", "csv")
+// GetBillingSummary returns total cost per workspace group (group_by is a workspace
+// attribute or tag:<key>), honouring the same filters as ListBilling
+func (h *BillingHandler) GetBillingSummary(c *gin.Context) {
+	groupBy := c.Query("group_by")
+	if groupBy == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by parameter is required"})
+		return
+	}
 
-	// Build filters
+	filters, err := billingFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filterClause, args := billingFilterClause(filters, 1)
+	groupExpr, groupArgs, err := models.WorkspaceGroupExpr(groupBy, len(args)+1)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	args = append(args, groupArgs...)
+
+	query := `
+		SELECT ` + groupExpr + ` AS group_value,
+		       COUNT(DISTINCT b.workspace_id) AS workspace_count,
+		       COALESCE(SUM(b.amount), 0) AS total_amount
+		FROM billing_data b
+		LEFT JOIN workspaces w ON b.workspace_id = w.workspace_id
+		WHERE 1=1` + filterClause + `
+		GROUP BY 1
+		ORDER BY total_amount DESC
+	`
+
+	rows, err := h.DB.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve billing summary"})
+		return
+	}
+	defer rows.Close()
+
+	groups := []map[string]interface{}{}
+	for rows.Next() {
+		var group string
+		var workspaceCount int
+		var totalAmount float64
+		if err := rows.Scan(&group, &workspaceCount, &totalAmount); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve billing summary"})
+			return
+		}
+		groups = append(groups, map[string]interface{}{
+			"group":           group,
+			"workspace_count": workspaceCount,
+			"total_amount":    totalAmount,
+			"currency":        "USD",
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group_by": groupBy, "groups": groups})
+}
+
+// billingFilters builds the billing filters shared by the list, summary and export endpoints
+func billingFilters(c *gin.Context) (map[string]interface{}, error) {
 	filters := make(map[string]interface{})
+	for _, name := range []string{"workspace_id", "user_name", "start_date", "end_date", "service"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+	if tags := models.ParseTagFilters(c.Request.URL.Query()); len(tags) > 0 {
+		filters["tags"] = tags
+	}
+	if value := c.Query("aws_account_id"); value != "" {
+		accountID, err := strconv.Atoi(value)
+		if err != nil || accountID <= 0 {
+			return nil, fmt.Errorf("invalid aws_account_id %q", value)
+		}
+		filters["aws_account_id"] = accountID
+	}
+	costType := c.DefaultQuery("cost_type", models.CostTypeUnblended)
+	if !models.ValidCostType(costType) {
+		return nil, fmt.Errorf("invalid cost_type %q: use unblended, amortized or net", costType)
+	}
+	filters["cost_type"] = costType
+	return filters, nil
+}
+
+// billingFilterClause turns billing filters into conditions on billing_data b joined to
+// workspaces w, with placeholders numbered from argPos
+func billingFilterClause(filters map[string]interface{}, argPos int) (string, []interface{}) {
+	// One cost type at a time, preferring Cost and Usage Report rows where they exist
+	clause := fmt.Sprintf(" AND b.cost_type = $%d", argPos) + models.BillingSourceClause()
+	costType, _ := filters["cost_type"].(string)
+	if costType == "" {
+		costType = models.CostTypeUnblended
+	}
+	args := []interface{}{costType}
+	argPos++
 
-	if workspaceID := c.Query("workspace_id"); workspaceID != "" {
-		filters["workspace_id"] = workspaceID
+	if workspaceID, ok := filters["workspace_id"].(string); ok && workspaceID != "" {
+		clause += fmt.Sprintf(" AND b.workspace_id = $%d", argPos)
+		args = append(args, workspaceID)
+		argPos++
+	}
+
+	if accountID, ok := filters["aws_account_id"].(int); ok && accountID > 0 {
+		clause += fmt.Sprintf(" AND b.aws_account_id = $%d", argPos)
+		args = append(args, accountID)
+		argPos++
+	}
+
+	if userName, ok := filters["user_name"].(string); ok && userName != "" {
+		clause += fmt.Sprintf(" AND w.user_name ILIKE $%d", argPos)
+		args = append(args, "%"+userName+"%")
+		argPos++
+	}
+
+	if startDate, ok := filters["start_date"].(string); ok && startDate != "" {
+		clause += fmt.Sprintf(" AND b.start_date >= $%d", argPos)
+		args = append(args, startDate)
+		argPos++
+	}
+
+	if endDate, ok := filters["end_date"].(string); ok && endDate != "" {
+		clause += fmt.Sprintf(" AND b.end_date <= $%d", argPos)
+		args = append(args, endDate)
+		argPos++
 	}
 
-	if userName := c.Query("user_name"); userName != "" {
-		filters["user_name"] = userName
+	if service, ok := filters["service"].(string); ok && service != "" {
+		clause += fmt.Sprintf(" AND b.service = $%d", argPos)
+		args = append(args, service)
+		argPos++
 	}
 
-	if startDate := c.Query("start_date"); startDate != "" {
-		filters["start_date"] = startDate
+	if tags, ok := filters["tags"].(map[string]string); ok && len(tags) > 0 {
+		tagClause, arg := models.TagFilterClause("w.tags", tags, argPos)
+		clause += tagClause
+		args = append(args, arg)
 	}
 
-	if endDate := c.Query("end_date"); endDate != "" {
-		filters["end_date"] = endDate
+	return clause, args
+}
+
+// ExportBilling exports billing data to CSV or Excel
+func (h *BillingHandler) ExportBilling(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+
+	// Build filters
+	filters, err := billingFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Get all billing data (no pagination for export)
@@ -203,3 +289,35 @@ func (h *BillingHandler) ExportBilling(c *gin.Context) {
 	// Export using the export handler
 	ExportData(c, billing, format, "billing")
 }
+
+// ImportCUR loads an uploaded Cost and Usage Report file or archive of report files
+// (multipart field "file"). The cost_type form field picks unblended (default), amortized or net.
+func (h *BillingHandler) ImportCUR(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A Cost and Usage Report file or archive is required in the file field"})
+		return
+	}
+
+	costType := c.DefaultPostForm("cost_type", models.CostTypeUnblended)
+	if !models.ValidCostType(costType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cost_type must be unblended, amortized or net"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer file.Close()
+
+	importer := &services.CURImporter{DB: h.DB, CostType: costType}
+	result, err := importer.ImportArchive(header.Filename, file, header.Size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
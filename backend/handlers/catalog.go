@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/gin-gonic/gin"
+)
+
+type CatalogHandler struct {
+	DB *sql.DB
+}
+
+// catalogFilters builds the account, region and state filters shared by catalog listings
+func catalogFilters(c *gin.Context) map[string]interface{} {
+	filters := make(map[string]interface{})
+	if accountID, err := strconv.Atoi(c.Query("aws_account_id")); err == nil {
+		filters["aws_account_id"] = accountID
+	}
+	if region := c.Query("region"); region != "" {
+		filters["region"] = region
+	}
+	if state := c.Query("state"); state != "" {
+		filters["state"] = state
+	}
+	return filters
+}
+
+// ListBundles returns WorkSpaces bundles
+func (h *CatalogHandler) ListBundles(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	bundles, total, err := models.ListWorkspaceBundles(h.DB, catalogFilters(c), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve bundles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   bundles,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// ListDirectories returns directories registered with WorkSpaces
+func (h *CatalogHandler) ListDirectories(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	directories, total, err := models.ListWorkspaceDirectories(h.DB, catalogFilters(c), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve directories"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   directories,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// ListImages returns custom WorkSpaces images
+func (h *CatalogHandler) ListImages(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	images, total, err := models.ListWorkspaceImages(h.DB, catalogFilters(c), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve images"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   images,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
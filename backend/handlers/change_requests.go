@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ChangeRequestsHandler handles change requests and the rules for approving them
+type ChangeRequestsHandler struct {
+	DB    *sql.DB
+	Queue *services.SyncQueue
+}
+
+// CreateChangeRequestRequest is the body of a new change request
+type CreateChangeRequestRequest struct {
+	Action        string          `json:"action" binding:"required"`
+	WorkspaceIDs  []string        `json:"workspace_ids" binding:"required"`
+	Parameters    json.RawMessage `json:"parameters"` // bundle_id for migrate; the property change for modify
+	Justification string          `json:"justification" binding:"required"`
+}
+
+// DecideChangeRequestRequest is the optional body of an approval, rejection or cancellation
+type DecideChangeRequestRequest struct {
+	Note string `json:"note"`
+}
+
+// ListChangeRequests returns change requests, newest first. Filters: status, action,
+// requested_by and workspace_id. Users whose role approves nothing only see their own.
+func (h *ChangeRequestsHandler) ListChangeRequests(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	filters := make(map[string]interface{})
+	for _, name := range []string{"status", "action", "requested_by", "workspace_id"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+
+	approver, err := h.isApprover(c.GetString("role"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve approval rules"})
+		return
+	}
+	if !approver {
+		filters["requested_by"] = c.GetString("username")
+	}
+
+	requests, total, err := models.ListChangeRequests(h.DB, filters, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve change requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   requests,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// GetChangeRequest returns a change request with the roles that may approve it
+func (h *ChangeRequestsHandler) GetChangeRequest(c *gin.Context) {
+	cr, ok := h.loadChangeRequest(c)
+	if !ok {
+		return
+	}
+
+	approver, err := h.isApprover(c.GetString("role"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve approval rules"})
+		return
+	}
+	if !approver && cr.RequestedBy != c.GetString("username") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Change request not found"})
+		return
+	}
+
+	changes := &services.ChangeRequestService{DB: h.DB}
+	roles, err := changes.ApproverRoles(cr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve approval rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"change_request": cr,
+		"approver_roles": roles,
+	})
+}
+
+// CreateChangeRequest submits an action on workspaces for approval
+func (h *ChangeRequestsHandler) CreateChangeRequest(c *gin.Context) {
+	var req CreateChangeRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Justification) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A justification is required"})
+		return
+	}
+	if len(req.WorkspaceIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one workspace is required"})
+		return
+	}
+
+	maxWorkspaces := models.GetSettingInt(h.DB, "actions.bulk_max_workspaces", 50)
+	if len(req.WorkspaceIDs) > maxWorkspaces {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Change requests are limited to %d workspaces", maxWorkspaces)})
+		return
+	}
+
+	targets := []models.Workspace{}
+	seen := make(map[string]bool)
+	for _, id := range req.WorkspaceIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		ws, err := models.GetWorkspaceByID(h.DB, id)
+		if err == sql.ErrNoRows || (err == nil && ws.RemovedAt != nil) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Workspace %s not found", id)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspaces"})
+			return
+		}
+		targets = append(targets, *ws)
+	}
+
+	cr := &models.ChangeRequest{
+		Action:        req.Action,
+		Parameters:    req.Parameters,
+		Justification: strings.TrimSpace(req.Justification),
+		RequestedBy:   c.GetString("username"),
+	}
+	for _, ws := range targets {
+		cr.WorkspaceIDs = append(cr.WorkspaceIDs, ws.WorkspaceID)
+	}
+	if string(cr.Parameters) == "null" {
+		cr.Parameters = nil
+	}
+
+	changes := &services.ChangeRequestService{DB: h.DB}
+	if err := changes.Validate(cr, targets); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := changes.Create(cr); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create change request"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, cr)
+}
+
+// ApproveChangeRequest approves a pending change request and queues the sync worker to run it
+func (h *ChangeRequestsHandler) ApproveChangeRequest(c *gin.Context) {
+	cr, ok := h.decideChangeRequest(c, models.ChangeApproved)
+	if !ok {
+		return
+	}
+
+	// A sync already queued or running for every account runs the changes stage itself
+	_, err := h.Queue.Enqueue(c.Request.Context(), "changes", 0, models.SyncTriggerChangeRequest)
+	if err != nil && !errors.Is(err, services.ErrSyncInProgress) {
+		log.Printf("Failed to queue change request %d: %v", cr.ID, err)
+	}
+
+	c.JSON(http.StatusOK, cr)
+}
+
+// RejectChangeRequest rejects a pending change request
+func (h *ChangeRequestsHandler) RejectChangeRequest(c *gin.Context) {
+	cr, ok := h.decideChangeRequest(c, models.ChangeRejected)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, cr)
+}
+
+// CancelChangeRequest withdraws a pending change request. Only its requester or an admin may
+// cancel it.
+func (h *ChangeRequestsHandler) CancelChangeRequest(c *gin.Context) {
+	cr, ok := h.decideChangeRequest(c, models.ChangeCancelled)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, cr)
+}
+
+// decideChangeRequest moves the :id change request to status once the user is allowed to
+func (h *ChangeRequestsHandler) decideChangeRequest(c *gin.Context, status string) (*models.ChangeRequest, bool) {
+	var req DecideChangeRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	cr, ok := h.loadChangeRequest(c)
+	if !ok {
+		return nil, false
+	}
+
+	username, role := c.GetString("username"), c.GetString("role")
+	changes := &services.ChangeRequestService{DB: h.DB}
+
+	if status == models.ChangeCancelled {
+		if username != cr.RequestedBy && role != "ADMIN" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the requester or an admin can cancel a change request"})
+			return nil, false
+		}
+	} else {
+		allowed, err := changes.CanApprove(cr, username, role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve approval rules"})
+			return nil, false
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You may not decide on this change request"})
+			return nil, false
+		}
+	}
+
+	if cr.Status != models.ChangePending || cr.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Change request is no longer pending"})
+		return nil, false
+	}
+
+	decided, err := changes.Decide(cr.ID, status, username, req.Note)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Change request is no longer pending"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update change request"})
+		return nil, false
+	}
+	return decided, true
+}
+
+func (h *ChangeRequestsHandler) loadChangeRequest(c *gin.Context) (*models.ChangeRequest, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid change request ID"})
+		return nil, false
+	}
+
+	cr, err := models.GetChangeRequest(h.DB, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Change request not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve change request"})
+		return nil, false
+	}
+	return cr, true
+}
+
+// isApprover reports whether any approval rule names role
+func (h *ChangeRequestsHandler) isApprover(role string) (bool, error) {
+	rules, err := models.ListApprovalRules(h.DB)
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if rule.ApproverRole == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListApprovalRules returns the rules for who may approve change requests
+func (h *ChangeRequestsHandler) ListApprovalRules(c *gin.Context) {
+	rules, err := models.ListApprovalRules(h.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve approval rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+// CreateApprovalRule lets a role approve an action ("*" for any) on workspaces in an AD
+// department (blank for any)
+func (h *ChangeRequestsHandler) CreateApprovalRule(c *gin.Context) {
+	var rule models.ApprovalRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if rule.Action == "" {
+		rule.Action = "*"
+	}
+	if rule.Action != "*" && rule.Action != services.WorkspaceActionModify && !services.IsWorkspaceAction(rule.Action) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown action " + rule.Action})
+		return
+	}
+	rule.ApproverRole = strings.ToUpper(strings.TrimSpace(rule.ApproverRole))
+	if rule.ApproverRole == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "approver_role is required"})
+		return
+	}
+	rule.Department = strings.TrimSpace(rule.Department)
+
+	if err := models.CreateApprovalRule(h.DB, &rule); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusConflict, gin.H{"error": "Approval rule already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create approval rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// DeleteApprovalRule removes an approval rule
+func (h *ChangeRequestsHandler) DeleteApprovalRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid approval rule ID"})
+		return
+	}
+
+	if err := models.DeleteApprovalRule(h.DB, id); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Approval rule not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete approval rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Approval rule deleted successfully"})
+}
@@ -2,10 +2,12 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
 	"github.com/gin-gonic/gin"
 )
 
@@ -22,27 +24,10 @@ func (h *CloudTrailHandler) ListEvents(c *gin.Context) {
 	limit, _ := strconv.Atoi(limitStr)
 	offset, _ := strconv.Atoi(offsetStr)
 
-	// Build filters
-	filters := make(map[string]interface{})
-
-	if workspaceID := c.Query("workspace_id"); workspaceID != "" {
-		filters["workspace_id"] = workspaceID
-	}
-
-	if eventName := c.Query("event_name"); eventName != "" {
-		filters["event_name"] = eventName
-	}
-
-	if username := c.Query("username"); username != "" {
-		filters["username"] = username
-	}
-
-	if startTime := c.Query("start_time"); startTime != "" {
-		filters["start_time"] = startTime
-	}
-
-	if endTime := c.Query("end_time"); endTime != "" {
-		filters["end_time"] = endTime
+	filters, err := cloudTrailFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Get CloudTrail events
@@ -62,23 +47,13 @@ func (h *CloudTrailHandler) ListEvents(c *gin.Context) {
 
 // GetEvent returns a single CloudTrail event by ID
 func (h *CloudTrailHandler) GetEvent(c *gin.Context) {
-	eventIDStr := c.Param("id")
-
-	query := `
-		SELECT id, event_id, event_name, event_time, event_source, username,
-		       user_identity, workspace_id, request_parameters, response_elements,
-		       event_region, created_at
-		FROM cloudtrail_events
-		WHERE id = $1
-	`
-
-	var event models.CloudTrailEvent
-	err := h.DB.QueryRow(query, eventIDStr).Scan(
-		&event.ID, &event.EventID, &event.EventName, &event.EventTime, &event.EventSource,
-		&event.Username, &event.UserIdentity, &event.WorkspaceID, &event.RequestParameters,
-		&event.ResponseElements, &event.EventRegion, &event.CreatedAt,
-	)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
 
+	event, err := models.GetCloudTrailEvent(h.DB, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
@@ -91,31 +66,56 @@ func (h *CloudTrailHandler) GetEvent(c *gin.Context) {
 	c.JSON(http.StatusOK, event)
 }
 
-// ExportCloudTrail exports CloudTrail events to CSV or Excel
-func (h *CloudTrailHandler) ExportCloudTrail(c *gin.Context) {
-	format := c.DefaultQuery("format", "xlsx")
-
-	// Build filters
+// cloudTrailFilters builds the event filters shared by the list and export endpoints
+func cloudTrailFilters(c *gin.Context) (map[string]interface{}, error) {
 	filters := make(map[string]interface{})
 
-	if workspaceID := c.Query("workspace_id"); workspaceID != "" {
-		filters["workspace_id"] = workspaceID
+	for _, name := range []string{
+		"workspace_id", "event_name", "username", "region", "source_ip_address",
+		"principal_arn", "principal_type", "error_code",
+	} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
 	}
 
-	if eventName := c.Query("event_name"); eventName != "" {
-		filters["event_name"] = eventName
+	if startTime := c.Query("start_time"); startTime != "" {
+		t, err := parseTimeParam("start_time", startTime, false)
+		if err != nil {
+			return nil, err
+		}
+		filters["start_time"] = t
 	}
 
-	if username := c.Query("username"); username != "" {
-		filters["username"] = username
+	if endTime := c.Query("end_time"); endTime != "" {
+		t, err := parseTimeParam("end_time", endTime, true)
+		if err != nil {
+			return nil, err
+		}
+		filters["end_time"] = t
 	}
 
-	if startTime := c.Query("start_time"); startTime != "" {
-		filters["start_time"] = startTime
+	for _, name := range []string{"read_only", "has_error"} {
+		if value := c.Query(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: use true or false", name, value)
+			}
+			filters[name] = b
+		}
 	}
 
-	if endTime := c.Query("end_time"); endTime != "" {
-		filters["end_time"] = endTime
+	return filters, nil
+}
+
+// ExportCloudTrail exports CloudTrail events to CSV or Excel
+func (h *CloudTrailHandler) ExportCloudTrail(c *gin.Context) {
+	format := c.DefaultQuery("format", "xlsx")
+
+	filters, err := cloudTrailFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Get all events (no pagination for export)
@@ -128,3 +128,28 @@ func (h *CloudTrailHandler) ExportCloudTrail(c *gin.Context) {
 	// Export using the export handler
 	ExportData(c, events, format, "cloudtrail")
 }
+
+// ImportEvents loads an uploaded archive of CloudTrail log files (multipart field "file")
+func (h *CloudTrailHandler) ImportEvents(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An archive of CloudTrail log files is required in the file field"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer file.Close()
+
+	importer := &services.CloudTrailImporter{DB: h.DB}
+	result, err := importer.ImportArchive(header.Filename, file, header.Size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -17,6 +17,7 @@ type DashboardStats struct {
 	ActiveWorkspaces    int     `json:"active_workspaces"`
 	StoppedWorkspaces   int     `json:"stopped_workspaces"`
 	TerminatedWorkspaces int    `json:"terminated_workspaces"`
+	RemovedWorkspaces   int     `json:"removed_workspaces"`
 	TotalMonthlyCost    float64 `json:"total_monthly_cost"`
 	RecentActivity      []models.SyncHistory `json:"recent_activity"`
 }
@@ -25,20 +26,22 @@ type DashboardStats struct {
 func (h *DashboardHandler) GetStats(c *gin.Context) {
 	var stats DashboardStats
 
-	// Get total workspaces
-	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces").Scan(&stats.TotalWorkspaces)
+	// Get total workspaces (excluding those no longer in AWS)
+	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE removed_at IS NULL").Scan(&stats.TotalWorkspaces)
 
 	// Get workspaces by state
-	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE state = 'AVAILABLE'").Scan(&stats.ActiveWorkspaces)
-	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE state = 'STOPPED'").Scan(&stats.StoppedWorkspaces)
-	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE state = 'TERMINATED'").Scan(&stats.TerminatedWorkspaces)
+	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE state = 'AVAILABLE' AND removed_at IS NULL").Scan(&stats.ActiveWorkspaces)
+	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE state = 'STOPPED' AND removed_at IS NULL").Scan(&stats.StoppedWorkspaces)
+	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE state = 'TERMINATED' AND removed_at IS NULL").Scan(&stats.TerminatedWorkspaces)
+	h.DB.QueryRow("SELECT COUNT(*) FROM workspaces WHERE removed_at IS NOT NULL").Scan(&stats.RemovedWorkspaces)
 
 	// Get total monthly cost (current month)
 	h.DB.QueryRow(`
 		SELECT COALESCE(SUM(amount), 0)
-		FROM billing_data
+		FROM billing_data b
 		WHERE start_date >= DATE_TRUNC('month', CURRENT_DATE)
-	`).Scan(&stats.TotalMonthlyCost)
+		  AND cost_type = '` + models.CostTypeUnblended + `'` + models.BillingSourceClause(),
+	).Scan(&stats.TotalMonthlyCost)
 
 	// Get recent activity
 	history, _ := models.ListSyncHistory(h.DB, 10)
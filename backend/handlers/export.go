@@ -195,19 +195,10 @@ func getExcelColumn(index int) string {
 func (h *WorkspacesHandler) ExportWorkspaces(c *gin.Context) {
 	format := c.DefaultQuery("format", "csv")
 
-	// Build filters
-	filters := make(map[string]interface{})
-	if userName := c.Query("user_name"); userName != "" {
-		filters["user_name"] = userName
-	}
-	if state := c.Query("state"); state != "" {
-		filters["state"] = state
-	}
-	if runningMode := c.Query("running_mode"); runningMode != "" {
-		filters["running_mode"] = runningMode
-	}
-	if bundleID := c.Query("bundle_id"); bundleID != "" {
-		filters["bundle_id"] = bundleID
+	filters, err := workspaceFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Get all workspaces (no pagination for export)
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ListIdleWorkspaces returns idle and abandoned workspaces, longest idle first. Filters:
+// classification, reclamation_state (none for workspaces not yet warned), region, user_name
+// and ad_department.
+func (h *WorkspacesHandler) ListIdleWorkspaces(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	detector := &services.IdleDetector{DB: h.DB}
+	idle, err := detector.Detect(time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to detect idle workspaces"})
+		return
+	}
+
+	classification := c.Query("classification")
+	reclamationState := c.Query("reclamation_state")
+	region := c.Query("region")
+	userName := strings.ToLower(c.Query("user_name"))
+	department := c.Query("ad_department")
+
+	filtered := []services.IdleWorkspace{}
+	for _, ws := range idle {
+		if classification != "" && ws.Classification != classification {
+			continue
+		}
+		if reclamationState == "none" && ws.ReclamationState != "" ||
+			reclamationState != "" && reclamationState != "none" && ws.ReclamationState != reclamationState {
+			continue
+		}
+		if region != "" && ws.Region != region {
+			continue
+		}
+		if userName != "" && !strings.Contains(strings.ToLower(ws.UserName), userName) {
+			continue
+		}
+		if department != "" && ws.Department != department {
+			continue
+		}
+		filtered = append(filtered, ws)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].IdleDays > filtered[j].IdleDays
+	})
+
+	page := []services.IdleWorkspace{}
+	if offset < len(filtered) {
+		end := offset + limit
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		page = filtered[offset:end]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   page,
+		"total":  len(filtered),
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// UpdateReclamationRequest moves an idle workspace through reclamation
+type UpdateReclamationRequest struct {
+	State       string     `json:"state" binding:"required"` // approved, reclaimed or exempt
+	Note        string     `json:"note"`
+	ExemptUntil *time.Time `json:"exempt_until"` // Exemptions without an end last until cleared
+}
+
+// UpdateReclamation approves a warned workspace for reclamation, marks an approved one
+// reclaimed, or exempts a workspace from idle detection
+func (h *WorkspacesHandler) UpdateReclamation(c *gin.Context) {
+	workspaceID := c.Param("id")
+
+	var req UpdateReclamationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := models.GetWorkspaceByID(h.DB, workspaceID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspace"})
+		return
+	}
+
+	reclamation, err := models.GetReclamation(h.DB, workspaceID)
+	if err == sql.ErrNoRows {
+		reclamation = &models.Reclamation{WorkspaceID: workspaceID}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reclamation"})
+		return
+	}
+
+	switch req.State {
+	case models.ReclamationApproved:
+		if reclamation.State != models.ReclamationWarned {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only warned workspaces can be approved for reclamation"})
+			return
+		}
+	case models.ReclamationReclaimed:
+		if reclamation.State != models.ReclamationApproved {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only approved workspaces can be marked reclaimed"})
+			return
+		}
+	case models.ReclamationExempt:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be approved, reclaimed or exempt"})
+		return
+	}
+
+	reclamation.State = req.State
+	reclamation.ExemptUntil = nil
+	if req.State == models.ReclamationExempt {
+		reclamation.ExemptUntil = req.ExemptUntil
+	}
+	if req.Note != "" {
+		reclamation.Note = req.Note
+	}
+	reclamation.UpdatedBy = c.GetString("username")
+
+	if err := models.UpsertReclamation(h.DB, reclamation); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reclamation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reclamation)
+}
+
+// DeleteReclamation clears a workspace's reclamation, so the next idle check starts over
+func (h *WorkspacesHandler) DeleteReclamation(c *gin.Context) {
+	if err := models.DeleteReclamation(h.DB, c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear reclamation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reclamation cleared"})
+}
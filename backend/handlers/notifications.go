@@ -45,6 +45,9 @@ func (h *NotificationsHandler) ListNotifications(c *gin.Context) {
 		filters["severity"] = severity
 	}
 
+	// Only show the event types the user's preferences opt into
+	filters["user_id"] = c.GetInt("user_id")
+
 	// Get notifications
 	notifications, total, err := models.ListNotifications(h.DB, filters, limit, offset)
 	if err != nil {
@@ -60,9 +63,9 @@ func (h *NotificationsHandler) ListNotifications(c *gin.Context) {
 	})
 }
 
-// GetUnreadCount returns count of unread notifications
+// GetUnreadCount returns count of unread notifications the user's preferences opt into
 func (h *NotificationsHandler) GetUnreadCount(c *gin.Context) {
-	count, err := models.GetUnreadCount(h.DB)
+	count, err := models.GetUnreadCount(h.DB, c.GetInt("user_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get unread count"})
 		return
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
+	"github.com/gin-gonic/gin"
+)
+
+type RecommendationsHandler struct {
+	DB *sql.DB
+}
+
+// recommendationFilters builds recommendation filters from query parameters: aws_account_id,
+// region, running_mode, workspace_id and user_name
+func recommendationFilters(c *gin.Context) (map[string]interface{}, error) {
+	filters := make(map[string]interface{})
+	for _, name := range []string{"region", "running_mode", "workspace_id", "user_name"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+	if value := c.Query("aws_account_id"); value != "" {
+		accountID, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		filters["aws_account_id"] = accountID
+	}
+	return filters, nil
+}
+
+// recommend runs the recommendation engine for the request's filters; ?all=true includes
+// workspaces that are already rightsized
+func (h *RecommendationsHandler) recommend(c *gin.Context) (*services.RecommendationResult, bool) {
+	filters, err := recommendationFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid aws_account_id"})
+		return nil, false
+	}
+
+	engine := &services.RecommendationEngine{DB: h.DB}
+	result, err := engine.Recommend(filters, c.Query("all") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute recommendations"})
+		return nil, false
+	}
+	return result, true
+}
+
+// ListRecommendations returns running mode and compute type recommendations, most savings
+// first, with the total estimated monthly savings
+func (h *RecommendationsHandler) ListRecommendations(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	result, ok := h.recommend(c)
+	if !ok {
+		return
+	}
+
+	savings := 0.0
+	for _, r := range result.Recommendations {
+		savings += r.EstimatedMonthlySavings
+	}
+
+	page := []services.Recommendation{}
+	if offset < len(result.Recommendations) {
+		end := offset + limit
+		if end > len(result.Recommendations) {
+			end = len(result.Recommendations)
+		}
+		page = result.Recommendations[offset:end]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":                  page,
+		"total":                 len(result.Recommendations),
+		"limit":                 limit,
+		"offset":                offset,
+		"total_monthly_savings": math.Round(savings*100) / 100,
+		"unpriced_workspaces":   result.Unpriced,
+		"unmeasured_workspaces": result.Unmeasured,
+	})
+}
+
+// ExportRecommendations exports recommendations to CSV or Excel
+func (h *RecommendationsHandler) ExportRecommendations(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+
+	result, ok := h.recommend(c)
+	if !ok {
+		return
+	}
+
+	ExportData(c, result.Recommendations, format, "recommendations")
+}
+
+// ListPrices returns the price table recommendations are computed from
+func (h *RecommendationsHandler) ListPrices(c *gin.Context) {
+	prices, err := models.ListWorkspacePrices(h.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve prices"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": prices, "total": len(prices)})
+}
+
+// ImportPrices replaces the price table with an uploaded CSV file (multipart field "file")
+func (h *RecommendationsHandler) ImportPrices(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A price table CSV file is required in the file field"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer file.Close()
+
+	prices, err := services.ParseWorkspacePrices(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.ReplaceWorkspacePrices(h.DB, prices); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imported": len(prices)})
+}
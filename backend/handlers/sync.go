@@ -3,7 +3,11 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/4syedalihassan/workspaces-inventory/models"
@@ -12,114 +16,182 @@ import (
 )
 
 type SyncHandler struct {
-	DB *sql.DB
+	DB        *sql.DB
+	Queue     *services.SyncQueue
+	Scheduler *services.SyncScheduler
+}
+
+// validSyncTypes lists the sync types accepted by TriggerSync
+var validSyncTypes = map[string]bool{
+	"all":              true,
+	"workspaces":       true,
+	"bundles":          true,
+	"directories":      true,
+	"images":           true,
+	"cloudtrail":       true,
+	"billing":          true,
+	"metrics":          true,
+	"usage":            true,
+	"ad":               true,
+	"active_directory": true,
+	"idle":             true,
+	"changes":          true,
+	"requests":         true,
 }
 
 // TriggerSync triggers a manual sync of all data sources
 func (h *SyncHandler) TriggerSync(c *gin.Context) {
 	syncType := c.DefaultQuery("type", "all")
+	if !validSyncTypes[syncType] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync type"})
+		return
+	}
 
-	// Create sync history record
-	syncHistory, err := models.CreateSyncHistory(h.DB, syncType)
+	syncHistory, err := h.StartSync(syncType, models.SyncTriggerManual)
+	if errors.Is(err, services.ErrSyncInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync of this type is already queued or running"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sync record"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue sync"})
 		return
 	}
 
-	// Run sync asynchronously
-	go h.runSync(syncHistory.ID, syncType)
-
 	c.JSON(http.StatusAccepted, gin.H{
-		"message":   "Sync started",
+		"message":   "Sync queued",
 		"sync_id":   syncHistory.ID,
 		"sync_type": syncType,
 	})
 }
 
-// runSync performs the actual sync operation
-func (h *SyncHandler) runSync(syncID int, syncType string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+// StartSync queues a sync of the given type across all accounts
+func (h *SyncHandler) StartSync(syncType, triggerSource string) (*models.SyncHistory, error) {
+	return h.Queue.Enqueue(context.Background(), syncType, 0, triggerSource)
+}
 
-	awsService := &services.AWSService{DB: h.DB}
-	notificationService := &services.NotificationService{DB: h.DB}
+// ProcessJob runs a sync job taken from the queue
+func (h *SyncHandler) ProcessJob(ctx context.Context, job *services.SyncJob) {
+	h.runSync(ctx, job)
+}
 
-	var recordsProcessed int
-	var err error
+// runSync performs the actual sync operation, one stage at a time
+func (h *SyncHandler) runSync(parent context.Context, job *services.SyncJob) {
+	timeout := time.Duration(models.GetSettingInt(h.DB, "sync.job_timeout_minutes", 60)) * time.Minute
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
 
-	switch syncType {
-	case "workspaces":
-		// Sync WorkSpaces from all active AWS accounts
-		recordsProcessed, err = awsService.SyncAllAccounts(ctx)
-	case "cloudtrail":
-		recordsProcessed, err = awsService.SyncCloudTrail(ctx)
-	case "billing":
-		recordsProcessed, err = awsService.SyncBillingData(ctx)
-	case "usage":
-		recordsProcessed, err = awsService.CalculateUsageHours(ctx)
-	case "active_directory", "ad":
-		recordsProcessed, err = awsService.SyncActiveDirectoryUsers(ctx)
-	case "all":
-		// Run all syncs sequentially
-		var totalRecords int
-		var lastErr error
-
-		// Sync WorkSpaces from all AWS accounts
-		if count, e := awsService.SyncAllAccounts(ctx); e != nil {
-			lastErr = e
-		} else {
-			totalRecords += count
-		}
+	syncType := services.NormalizeSyncType(job.SyncType)
+	stages := []string{syncType}
+	if syncType == "all" {
+		stages = services.SyncStages
+	}
 
-		// Sync CloudTrail
-		if count, e := awsService.SyncCloudTrail(ctx); e != nil {
-			lastErr = e
-		} else {
-			totalRecords += count
-		}
+	progress := services.NewSyncProgress(h.DB, job.ID, stages)
+	awsService := &services.AWSService{DB: h.DB, Progress: progress}
+	notificationService := &services.NotificationService{DB: h.DB}
 
-		// Sync Billing
-		if count, e := awsService.SyncBillingData(ctx); e != nil {
-			lastErr = e
-		} else {
-			totalRecords += count
+	// Account jobs are labelled by account name in notifications
+	label := job.SyncType
+	if job.AccountID > 0 {
+		if account, err := models.GetAWSAccountByID(h.DB, job.AccountID); err == nil {
+			label = account.Name
 		}
+	}
 
-		// Calculate Usage
-		if count, e := awsService.CalculateUsageHours(ctx); e != nil {
-			lastErr = e
-		} else {
-			totalRecords += count
+	recordsProcessed := 0
+	errs := []error{}
+	for _, stage := range stages {
+		if ctx.Err() != nil {
+			break
 		}
 
-		// Sync Active Directory
-		if count, e := awsService.SyncActiveDirectoryUsers(ctx); e != nil {
-			lastErr = e
-		} else {
-			totalRecords += count
-		}
+		progress.StartStage(stage)
+		count, err := h.runStage(ctx, awsService, stage, job.AccountID)
+		progress.CompleteStage(stage, count, err)
 
-		recordsProcessed = totalRecords
-		err = lastErr
-	default:
-		err = nil
-		recordsProcessed = 0
+		recordsProcessed += count
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", stage, err))
+		}
 	}
 
 	// Update sync history
+	if errors.Is(context.Cause(ctx), services.ErrSyncCancelled) {
+		progress.CancelPending()
+		models.UpdateSyncHistory(h.DB, job.ID, "cancelled", recordsProcessed, "")
+		log.Printf("Sync %d cancelled after %d records", job.ID, recordsProcessed)
+		return
+	}
+	if ctx.Err() != nil {
+		progress.CancelPending()
+		errs = append(errs, fmt.Errorf("sync timed out: %w", ctx.Err()))
+	}
+
 	status := "completed"
 	errorMsg := ""
-	if err != nil {
+	if err := errors.Join(errs...); err != nil {
 		status = "failed"
 		errorMsg = err.Error()
 		// Send failure notification
-		notificationService.NotifySyncFailed(syncType, errorMsg)
+		notificationService.NotifySyncFailed(label, errorMsg)
 	} else {
 		// Send success notification
-		notificationService.NotifySyncCompleted(syncType, recordsProcessed)
+		notificationService.NotifySyncCompleted(label, recordsProcessed)
 	}
 
-	models.UpdateSyncHistory(h.DB, syncID, status, recordsProcessed, errorMsg)
+	models.UpdateSyncHistory(h.DB, job.ID, status, recordsProcessed, errorMsg)
+}
+
+// runStage runs a single sync stage, limited to one AWS account when accountID is set
+func (h *SyncHandler) runStage(ctx context.Context, awsService *services.AWSService, stage string, accountID int) (int, error) {
+	switch stage {
+	case "workspaces":
+		var count int
+		var err error
+		if accountID > 0 {
+			count, err = awsService.SyncSingleAccount(ctx, accountID)
+		} else {
+			// Sync WorkSpaces from all active AWS accounts
+			count, err = awsService.SyncAllAccounts(ctx)
+		}
+
+		// Fill in creation/termination details for new workspaces from stored CloudTrail
+		// events, once for every account synced
+		if _, err := models.ApplyWorkspaceLifecycleEvents(h.DB); err != nil {
+			log.Printf("Failed to apply workspace lifecycle events: %v", err)
+		}
+
+		// Workspaces requested through the portal are provisioned once a sync has seen them
+		requests := &services.WorkspaceRequestService{DB: h.DB}
+		requests.TrackProvisioning()
+		return count, err
+	case "bundles":
+		return awsService.SyncBundles(ctx, accountID)
+	case "directories":
+		return awsService.SyncDirectories(ctx, accountID)
+	case "images":
+		return awsService.SyncImages(ctx, accountID)
+	case "cloudtrail":
+		return awsService.SyncCloudTrail(ctx, accountID)
+	case "billing":
+		return awsService.SyncBillingData(ctx, accountID)
+	case "metrics":
+		return awsService.SyncWorkspaceMetrics(ctx, accountID)
+	case "usage":
+		return awsService.CalculateUsageHours(ctx, accountID)
+	case "ad":
+		return awsService.SyncActiveDirectoryUsers(ctx)
+	case "idle":
+		detector := &services.IdleDetector{DB: h.DB}
+		return detector.Run(ctx)
+	case "changes":
+		changes := &services.ChangeRequestService{DB: h.DB}
+		return changes.RunApproved(ctx)
+	case "requests":
+		requests := &services.WorkspaceRequestService{DB: h.DB}
+		return requests.Run(ctx)
+	}
+	return 0, fmt.Errorf("unknown sync stage %q", stage)
 }
 
 // GetSyncHistory returns sync history records
@@ -132,3 +204,83 @@ func (h *SyncHandler) GetSyncHistory(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"data": history})
 }
+
+// GetSync returns a sync with its per-stage progress
+func (h *SyncHandler) GetSync(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync ID"})
+		return
+	}
+
+	syncHistory, err := models.GetSyncHistory(h.DB, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Sync not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sync"})
+		return
+	}
+
+	c.JSON(http.StatusOK, syncHistory)
+}
+
+// CancelSync cancels a queued or running sync
+func (h *SyncHandler) CancelSync(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync ID"})
+		return
+	}
+
+	syncHistory, err := models.GetSyncHistory(h.DB, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Sync not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sync"})
+		return
+	}
+
+	if syncHistory.Status != "queued" && syncHistory.Status != "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sync is not queued or running", "status": syncHistory.Status})
+		return
+	}
+
+	wasQueued, err := h.Queue.Cancel(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel sync"})
+		return
+	}
+
+	if wasQueued {
+		models.UpdateSyncHistory(h.DB, id, "cancelled", 0, "")
+		c.JSON(http.StatusOK, gin.H{"message": "Sync cancelled", "sync_id": id})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Cancellation requested", "sync_id": id})
+}
+
+// GetSchedule returns the automatic sync configuration and upcoming run times
+func (h *SyncHandler) GetSchedule(c *gin.Context) {
+	enabled := false
+	if setting, err := models.GetSetting(h.DB, "sync.auto_sync_enabled"); err == nil {
+		enabled = setting.Value == "true"
+	}
+
+	defaultSchedule := ""
+	nextRuns := map[string]time.Time{}
+	if h.Scheduler != nil {
+		defaultSchedule = h.Scheduler.CurrentDefaultSchedule()
+		nextRuns = h.Scheduler.NextRuns()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":          enabled,
+		"default_schedule": defaultSchedule,
+		"next_runs":        nextRuns,
+	})
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"net/http"
 
 	"github.com/4syedalihassan/workspaces-inventory/models"
@@ -43,6 +44,22 @@ func (h *UsageHandler) GetUsageSummary(c *gin.Context) {
 		return
 	}
 
+	// Optionally break the summary down by a workspace attribute or tag:<key>
+	if groupBy := c.Query("group_by"); groupBy != "" {
+		tags := models.ParseTagFilters(c.Request.URL.Query())
+		groups, err := models.GetMonthlyUsageSummaryByGroup(h.DB, month, groupBy, tags)
+		if errors.Is(err, models.ErrInvalidGroupBy) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage summary"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"month": month, "group_by": groupBy, "groups": groups})
+		return
+	}
+
 	summary, err := models.GetMonthlyUsageSummary(h.DB, month)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage summary"})
@@ -69,3 +86,39 @@ func (h *UsageHandler) ExportUsage(c *gin.Context) {
 	// Export using the export handler
 	ExportData(c, usage, format, "usage")
 }
+
+// ListDailyUsage returns running and connected hours per workspace and day. Filters:
+// workspace_id, user_name, start_date, end_date.
+func (h *UsageHandler) ListDailyUsage(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	filters := make(map[string]interface{})
+	for _, name := range []string{"workspace_id", "user_name"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+	for _, name := range []string{"start_date", "end_date"} {
+		if value := c.Query(name); value != "" {
+			t, err := parseTimeParam(name, value, false)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			filters[name] = t
+		}
+	}
+
+	usage, total, err := models.ListDailyUsage(h.DB, filters, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve daily usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   usage,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
+	"github.com/gin-gonic/gin"
+)
+
+// WorkspaceActionRequest is the optional body of an action request
+type WorkspaceActionRequest struct {
+	ConfirmationToken string   `json:"confirmation_token"` // Confirms a destructive action
+	BundleID          string   `json:"bundle_id"`          // Target bundle, for migrate
+	WorkspaceIDs      []string `json:"workspace_ids"`      // Bulk actions only; otherwise the query filters select workspaces
+}
+
+// RunWorkspaceAction runs a lifecycle action on one workspace
+func (h *WorkspacesHandler) RunWorkspaceAction(c *gin.Context) {
+	action, req, ok := h.bindWorkspaceAction(c)
+	if !ok {
+		return
+	}
+
+	workspaceID := c.Param("id")
+	ws, err := models.GetWorkspaceByID(h.DB, workspaceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspace"})
+		return
+	}
+	if ws.RemovedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workspace no longer exists in AWS"})
+		return
+	}
+
+	h.runWorkspaceAction(c, action, req, []models.Workspace{*ws}, false)
+}
+
+// RunBulkWorkspaceAction runs a lifecycle action on the workspaces listed in workspace_ids,
+// or else on those matching the workspace list filters in the query string
+func (h *WorkspacesHandler) RunBulkWorkspaceAction(c *gin.Context) {
+	action, req, ok := h.bindWorkspaceAction(c)
+	if !ok {
+		return
+	}
+
+	maxWorkspaces := models.GetSettingInt(h.DB, "actions.bulk_max_workspaces", 50)
+	targets := []models.Workspace{}
+
+	// A confirmed action runs on the workspaces it was confirmed for, so the filters aren't
+	// evaluated again
+	if req.ConfirmationToken == "" {
+		if len(req.WorkspaceIDs) > 0 {
+			if len(req.WorkspaceIDs) > maxWorkspaces {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bulk actions are limited to %d workspaces", maxWorkspaces)})
+				return
+			}
+			for _, id := range req.WorkspaceIDs {
+				ws, err := models.GetWorkspaceByID(h.DB, id)
+				if err == sql.ErrNoRows || (err == nil && ws.RemovedAt != nil) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Workspace %s not found", id)})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspaces"})
+					return
+				}
+				targets = append(targets, *ws)
+			}
+		} else {
+			filters, err := workspaceFilters(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			delete(filters, "as_of")
+			delete(filters, "include_removed")
+			if len(filters) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Bulk actions need workspace_ids or at least one filter"})
+				return
+			}
+
+			var total int
+			targets, total, err = models.ListWorkspaces(h.DB, filters, maxWorkspaces, 0)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspaces"})
+				return
+			}
+			if total > maxWorkspaces {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%d workspaces match; bulk actions are limited to %d", total, maxWorkspaces)})
+				return
+			}
+		}
+		if len(targets) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No workspaces match"})
+			return
+		}
+	}
+
+	h.runWorkspaceAction(c, action, req, targets, true)
+}
+
+// bindWorkspaceAction checks the action exists and the user's role may run it, and reads the
+// optional request body
+func (h *WorkspacesHandler) bindWorkspaceAction(c *gin.Context) (string, WorkspaceActionRequest, bool) {
+	var req WorkspaceActionRequest
+	action := c.Param("action")
+
+	if !services.IsWorkspaceAction(action) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown action " + action})
+		return "", req, false
+	}
+	if !services.WorkspaceActionAllowed(action, c.GetString("role")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		return "", req, false
+	}
+	changes := &services.ChangeRequestService{DB: h.DB}
+	if changes.RequiresApproval(action, nil, nil) {
+		changeRequestRequired(c, action)
+		return "", req, false
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", req, false
+	}
+	return action, req, true
+}
+
+// changeRequestRequired answers that action can only run through an approved change request
+func changeRequestRequired(c *gin.Context, action string) {
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":                   fmt.Sprintf("%s needs an approved change request; submit one to /api/v1/change-requests", action),
+		"change_request_required": true,
+	})
+}
+
+// runWorkspaceAction runs an action on targets. Destructive actions first answer 428 with a
+// confirmation token; the same request with that token then runs the action on the
+// workspaces it was issued for.
+func (h *WorkspacesHandler) runWorkspaceAction(c *gin.Context, action string, req WorkspaceActionRequest, targets []models.Workspace, bulk bool) {
+	username := c.GetString("username")
+	awsService := &services.AWSService{DB: h.DB}
+	params := services.WorkspaceActionParams{BundleID: req.BundleID}
+
+	if services.WorkspaceActionDestructive(action) {
+		if req.ConfirmationToken == "" {
+			if err := params.Validate(action); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			ids := make([]string, len(targets))
+			for i, ws := range targets {
+				ids[i] = ws.WorkspaceID
+			}
+			confirmation, err := awsService.RequestActionConfirmation(username, action, ids, params)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create confirmation"})
+				return
+			}
+
+			c.JSON(http.StatusPreconditionRequired, gin.H{
+				"message":            fmt.Sprintf("Repeat the request with confirmation_token to %s %d workspace(s)", action, len(ids)),
+				"confirmation_token": confirmation.Token,
+				"expires_at":         confirmation.ExpiresAt,
+				"action":             action,
+				"workspace_ids":      ids,
+			})
+			return
+		}
+
+		ids, confirmedParams, err := awsService.ConfirmWorkspaceAction(req.ConfirmationToken, username, action)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired confirmation token"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check confirmation"})
+			return
+		}
+		if !bulk && (len(ids) != 1 || ids[0] != targets[0].WorkspaceID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Confirmation token was issued for other workspaces"})
+			return
+		}
+		params = confirmedParams
+
+		targets = targets[:0]
+		for _, id := range ids {
+			ws, err := models.GetWorkspaceByID(h.DB, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspaces"})
+				return
+			}
+			targets = append(targets, *ws)
+		}
+	} else if err := params.Validate(action); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := awsService.RunWorkspaceAction(c.Request.Context(), action, targets, params, username, bulk)
+
+	if !bulk {
+		result := results[0]
+		if result.Status != models.ActionSucceeded {
+			c.JSON(http.StatusBadGateway, gin.H{"error": result.Error, "result": result})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	succeeded := 0
+	for _, result := range results {
+		if result.Status == models.ActionSucceeded {
+			succeeded++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"action":    action,
+		"results":   results,
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+	})
+}
+
+// ListWorkspaceActions returns the recorded actions, newest first, of one workspace (:id) or
+// of all of them. Filters: workspace_id, action, status and requested_by.
+func (h *WorkspacesHandler) ListWorkspaceActions(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	filters := make(map[string]interface{})
+	for _, name := range []string{"workspace_id", "action", "status", "requested_by"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+	if id := c.Param("id"); id != "" {
+		filters["workspace_id"] = id
+	}
+
+	actions, total, err := models.ListWorkspaceActions(h.DB, filters, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve actions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   actions,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// UpdateWorkspace changes a workspace's running mode, compute type, volume sizes or AutoStop
+// timeout in AWS and returns the updated workspace
+func (h *WorkspacesHandler) UpdateWorkspace(c *gin.Context) {
+	var change services.WorkspacePropertyChange
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ws, err := models.GetWorkspaceByID(h.DB, c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspace"})
+		return
+	}
+	if ws.RemovedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workspace no longer exists in AWS"})
+		return
+	}
+
+	if err := change.Validate(ws); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	changes := &services.ChangeRequestService{DB: h.DB}
+	if changes.RequiresApproval(services.WorkspaceActionModify, ws, &change) {
+		changeRequestRequired(c, services.WorkspaceActionModify)
+		return
+	}
+
+	awsService := &services.AWSService{DB: h.DB}
+	modified, err := awsService.ModifyWorkspaceProperties(c.Request.Context(), ws, change, c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to modify workspace: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, modified)
+}
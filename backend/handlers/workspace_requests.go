@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/4syedalihassan/workspaces-inventory/services"
+	"github.com/gin-gonic/gin"
+)
+
+// WorkspaceRequestsHandler handles the self-service workspace request portal
+type WorkspaceRequestsHandler struct {
+	DB    *sql.DB
+	Queue *services.SyncQueue
+}
+
+// CreateWorkspaceRequestRequest is the body of a new workspace request
+type CreateWorkspaceRequestRequest struct {
+	BundleID      string `json:"bundle_id" binding:"required"`
+	DirectoryID   string `json:"directory_id" binding:"required"`
+	RunningMode   string `json:"running_mode"` // Defaults to portal.default_running_mode
+	Justification string `json:"justification" binding:"required"`
+	UserName      string `json:"user_name"` // ADMIN only; everyone else requests for themselves
+}
+
+// DecideWorkspaceRequestRequest is the optional body of an approval, rejection or cancellation
+type DecideWorkspaceRequestRequest struct {
+	Note string `json:"note"`
+}
+
+// ListWorkspaceRequests returns workspace requests, newest first. Filters: status, user_name
+// and requested_by. Admins see every request; everyone else sees their own and those
+// awaiting them as manager.
+func (h *WorkspaceRequestsHandler) ListWorkspaceRequests(c *gin.Context) {
+	limit, offset := models.ParsePagination(c.Request.URL.Query())
+
+	filters := make(map[string]interface{})
+	for _, name := range []string{"status", "user_name", "requested_by"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+	if c.GetString("role") != "ADMIN" {
+		filters["visible_to"] = c.GetString("username")
+		filters["visible_to_email"] = h.currentUserEmail(c)
+	}
+
+	requests, total, err := models.ListWorkspaceRequests(h.DB, filters, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspace requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   requests,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// GetWorkspaceRequest returns a workspace request
+func (h *WorkspaceRequestsHandler) GetWorkspaceRequest(c *gin.Context) {
+	wr, ok := h.loadWorkspaceRequest(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, wr)
+}
+
+// CreateWorkspaceRequest asks for a workspace from a synced bundle and directory. The request
+// goes to the user's manager for approval.
+func (h *WorkspaceRequestsHandler) CreateWorkspaceRequest(c *gin.Context) {
+	var req CreateWorkspaceRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Justification) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A justification is required"})
+		return
+	}
+
+	username := c.GetString("username")
+	userName := username
+	if req.UserName != "" && req.UserName != username {
+		if c.GetString("role") != "ADMIN" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can only request a workspace for yourself"})
+			return
+		}
+		userName = req.UserName
+	}
+
+	bundle, err := models.GetWorkspaceBundle(h.DB, req.BundleID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bundle " + req.BundleID + " not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve bundle"})
+		return
+	}
+	directory, err := models.GetWorkspaceDirectory(h.DB, req.DirectoryID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Directory " + req.DirectoryID + " not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve directory"})
+		return
+	}
+
+	wr := &models.WorkspaceRequest{
+		RequestedBy:   username,
+		UserName:      userName,
+		BundleID:      bundle.BundleID,
+		DirectoryID:   directory.DirectoryID,
+		AWSAccountID:  directory.AWSAccountID,
+		Region:        directory.Region,
+		RunningMode:   req.RunningMode,
+		Justification: strings.TrimSpace(req.Justification),
+	}
+	if wr.RunningMode == "" {
+		wr.RunningMode = models.GetSettingString(h.DB, "portal.default_running_mode", "AUTO_STOP")
+	}
+
+	requests := &services.WorkspaceRequestService{DB: h.DB}
+	if err := requests.Validate(wr, bundle, directory); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	exists, err := models.HasWorkspaceInDirectory(h.DB, userName, directory.DirectoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing workspaces"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": userName + " already has a workspace in this directory"})
+		return
+	}
+
+	if err := requests.Create(wr); err != nil {
+		if errors.Is(err, services.ErrWorkspaceRequestOpen) {
+			c.JSON(http.StatusConflict, gin.H{"error": userName + " already has an open request for this directory"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace request"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, wr)
+}
+
+// ApproveWorkspaceRequest approves a pending request and queues the sync worker to create the
+// workspace
+func (h *WorkspaceRequestsHandler) ApproveWorkspaceRequest(c *gin.Context) {
+	wr, ok := h.decideWorkspaceRequest(c, models.RequestApproved)
+	if !ok {
+		return
+	}
+
+	// A sync already queued or running for every account runs the requests stage itself
+	_, err := h.Queue.Enqueue(c.Request.Context(), "requests", 0, models.SyncTriggerWorkspaceRequest)
+	if err != nil && !errors.Is(err, services.ErrSyncInProgress) {
+		log.Printf("Failed to queue workspace request %d: %v", wr.ID, err)
+	}
+
+	c.JSON(http.StatusOK, wr)
+}
+
+// RejectWorkspaceRequest rejects a pending request
+func (h *WorkspaceRequestsHandler) RejectWorkspaceRequest(c *gin.Context) {
+	wr, ok := h.decideWorkspaceRequest(c, models.RequestRejected)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, wr)
+}
+
+// CancelWorkspaceRequest withdraws a pending request. Only its requester or an admin may
+// cancel it.
+func (h *WorkspaceRequestsHandler) CancelWorkspaceRequest(c *gin.Context) {
+	wr, ok := h.decideWorkspaceRequest(c, models.RequestCancelled)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, wr)
+}
+
+// decideWorkspaceRequest moves the :id request to status once the user is allowed to
+func (h *WorkspaceRequestsHandler) decideWorkspaceRequest(c *gin.Context, status string) (*models.WorkspaceRequest, bool) {
+	var req DecideWorkspaceRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	wr, ok := h.loadWorkspaceRequest(c)
+	if !ok {
+		return nil, false
+	}
+
+	username, role := c.GetString("username"), c.GetString("role")
+	requests := &services.WorkspaceRequestService{DB: h.DB}
+
+	if status == models.RequestCancelled {
+		if username != wr.RequestedBy && role != "ADMIN" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the requester or an admin can cancel a workspace request"})
+			return nil, false
+		}
+	} else if !requests.CanDecide(wr, username, role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the requester's manager or an admin can decide on this request"})
+		return nil, false
+	}
+
+	if wr.Status != models.RequestPending || wr.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workspace request is no longer pending"})
+		return nil, false
+	}
+
+	decided, err := requests.Decide(wr.ID, status, username, req.Note)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workspace request is no longer pending"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workspace request"})
+		return nil, false
+	}
+	return decided, true
+}
+
+// loadWorkspaceRequest reads the :id request, answering 404 to users who may not see it
+func (h *WorkspaceRequestsHandler) loadWorkspaceRequest(c *gin.Context) (*models.WorkspaceRequest, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace request ID"})
+		return nil, false
+	}
+
+	wr, err := models.GetWorkspaceRequest(h.DB, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace request not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspace request"})
+		return nil, false
+	}
+
+	if c.GetString("role") != "ADMIN" && wr.RequestedBy != c.GetString("username") {
+		email := h.currentUserEmail(c)
+		if email == "" || !strings.EqualFold(email, wr.ManagerEmail) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace request not found"})
+			return nil, false
+		}
+	}
+	return wr, true
+}
+
+func (h *WorkspaceRequestsHandler) currentUserEmail(c *gin.Context) string {
+	user, err := models.GetUserByUsername(h.DB, c.GetString("username"))
+	if err != nil {
+		return ""
+	}
+	return user.Email
+}
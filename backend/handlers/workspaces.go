@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/4syedalihassan/workspaces-inventory/models"
 	"github.com/gin-gonic/gin"
@@ -22,13 +25,10 @@ func (h *WorkspacesHandler) ListWorkspaces(c *gin.Context) {
 	limit, _ := strconv.Atoi(limitStr)
 	offset, _ := strconv.Atoi(offsetStr)
 
-	// Build filters
-	filters := make(map[string]interface{})
-	if userName := c.Query("user_name"); userName != "" {
-		filters["user_name"] = userName
-	}
-	if state := c.Query("state"); state != "" {
-		filters["state"] = state
+	filters, err := workspaceFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Get workspaces
@@ -46,6 +46,45 @@ func (h *WorkspacesHandler) ListWorkspaces(c *gin.Context) {
 	})
 }
 
+// workspaceFilters builds the workspace list filters shared by the list and export endpoints
+func workspaceFilters(c *gin.Context) (map[string]interface{}, error) {
+	filters := make(map[string]interface{})
+	for _, name := range []string{"user_name", "state", "running_mode", "bundle_id", "region"} {
+		if value := c.Query(name); value != "" {
+			filters[name] = value
+		}
+	}
+	if tags := models.ParseTagFilters(c.Request.URL.Query()); len(tags) > 0 {
+		filters["tags"] = tags
+	}
+	if c.Query("include_removed") == "true" {
+		filters["include_removed"] = true
+	}
+	if value := c.Query("as_of"); value != "" {
+		asOf, err := parseTimeParam("as_of", value, true)
+		if err != nil {
+			return nil, err
+		}
+		filters["as_of"] = asOf
+	}
+	return filters, nil
+}
+
+// parseTimeParam accepts an RFC 3339 timestamp or a YYYY-MM-DD date. A date means the
+// start of that day (UTC), or its end when endOfDay is set.
+func parseTimeParam(name, value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q: use an RFC 3339 timestamp or YYYY-MM-DD date", name, value)
+}
+
 // GetWorkspace returns a single workspace by ID
 func (h *WorkspacesHandler) GetWorkspace(c *gin.Context) {
 	workspaceID := c.Param("id")
@@ -63,10 +102,86 @@ func (h *WorkspacesHandler) GetWorkspace(c *gin.Context) {
 	c.JSON(http.StatusOK, workspace)
 }
 
-// GetWorkspaceMetrics returns usage and billing data for a workspace
+// GetWorkspaceHistory returns the recorded versions of a workspace, newest first
+func (h *WorkspacesHandler) GetWorkspaceHistory(c *gin.Context) {
+	workspaceID := c.Param("id")
+
+	versions, err := models.ListWorkspaceHistory(h.DB, workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workspace history"})
+		return
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No history for workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"workspace_id": workspaceID,
+		"data":         versions,
+		"total":        len(versions),
+	})
+}
+
+// metricResolutions maps the resolution query parameter to stored resolutions
+var metricResolutions = map[string]int{
+	"5m": models.MetricResolutionRaw,
+	"1h": models.MetricResolutionHourly,
+	"1d": models.MetricResolutionDaily,
+}
+
+// GetWorkspaceMetrics returns CloudWatch metrics and billing data for a workspace. start and
+// end default to the last 24 hours; resolution is 5m, 1h, 1d or auto (the default), and
+// metric limits the series returned, comma-separated.
 func (h *WorkspacesHandler) GetWorkspaceMetrics(c *gin.Context) {
 	workspaceID := c.Param("id")
 
+	end := time.Now().UTC()
+	if value := c.Query("end"); value != "" {
+		t, err := parseTimeParam("end", value, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		end = t
+	}
+	start := end.Add(-24 * time.Hour)
+	if value := c.Query("start"); value != "" {
+		t, err := parseTimeParam("start", value, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		start = t
+	}
+	if !end.After(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must be after start"})
+		return
+	}
+
+	resolutionName := c.DefaultQuery("resolution", "auto")
+	if resolutionName == "auto" {
+		resolutionName = h.autoMetricResolution(start, end)
+	}
+	resolution, ok := metricResolutions[resolutionName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid resolution: use 5m, 1h, 1d or auto"})
+		return
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(c.Query("metric"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	metrics, err := models.ListWorkspaceMetrics(h.DB, workspaceID, names, resolution, start, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve metrics"})
+		return
+	}
+
 	// Get usage data
 	usageFilters := map[string]interface{}{"workspace_id": workspaceID}
 	// TODO: Implement GetWorkspaceUsage function
@@ -81,10 +196,31 @@ func (h *WorkspacesHandler) GetWorkspaceMetrics(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"workspace_id": workspaceID,
+		"start":        start,
+		"end":          end,
+		"resolution":   resolutionName,
+		"metrics":      metrics,
 		"billing":      billingData,
 	})
 }
 
+// autoMetricResolution picks the finest resolution that is still retained for all of
+// start to end and keeps the series to a few hundred points
+func (h *WorkspacesHandler) autoMetricResolution(start, end time.Time) string {
+	now := time.Now().UTC()
+	span := end.Sub(start)
+
+	rawRetention := models.GetSettingInt(h.DB, "metrics.raw_retention_days", 7)
+	if span <= 24*time.Hour && start.After(now.AddDate(0, 0, -rawRetention)) {
+		return "5m"
+	}
+	hourlyRetention := models.GetSettingInt(h.DB, "metrics.hourly_retention_days", 90)
+	if span <= 14*24*time.Hour && start.After(now.AddDate(0, 0, -hourlyRetention)) {
+		return "1h"
+	}
+	return "1d"
+}
+
 // GetFilterOptions returns available filter values
 func (h *WorkspacesHandler) GetFilterOptions(c *gin.Context) {
 	// Get distinct states
@@ -111,8 +247,29 @@ func (h *WorkspacesHandler) GetFilterOptions(c *gin.Context) {
 		modes = append(modes, mode)
 	}
 
+	// Get distinct regions
+	regionsQuery := "SELECT DISTINCT region FROM workspaces WHERE region IS NOT NULL ORDER BY region"
+	regionRows, err := h.DB.Query(regionsQuery)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve regions"})
+		return
+	}
+	defer regionRows.Close()
+
+	regions := []string{}
+	for regionRows.Next() {
+		var region string
+		regionRows.Scan(&region)
+		regions = append(regions, region)
+	}
+
+	// Get tag keys in use
+	tagKeys, _ := models.ListWorkspaceTagKeys(h.DB)
+
 	c.JSON(http.StatusOK, gin.H{
 		"states":       states,
 		"runningModes": modes,
+		"regions":      regions,
+		"tagKeys":      tagKeys,
 	})
 }
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
 
 	"github.com/4syedalihassan/workspaces-inventory/config"
 	"github.com/4syedalihassan/workspaces-inventory/database"
 	"github.com/4syedalihassan/workspaces-inventory/handlers"
 	"github.com/4syedalihassan/workspaces-inventory/middleware"
+	"github.com/4syedalihassan/workspaces-inventory/services"
 	"github.com/gin-gonic/gin"
 )
 
@@ -14,6 +17,12 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
+	// Subcommands run once and exit instead of starting the server
+	if len(os.Args) > 1 {
+		runCommand(cfg, os.Args[1], os.Args[2:])
+		return
+	}
+
 	// Initialize JWT
 	middleware.InitJWT(cfg.JWTSecret)
 
@@ -45,16 +54,40 @@ func main() {
 	// Initialize handlers
 	authHandler := &handlers.AuthHandler{DB: db}
 	workspacesHandler := &handlers.WorkspacesHandler{DB: db}
+	catalogHandler := &handlers.CatalogHandler{DB: db}
 	aiHandler := &handlers.AIHandler{AIServiceURL: cfg.AIServiceURL}
-	syncHandler := &handlers.SyncHandler{DB: db}
+	syncQueue := &services.SyncQueue{DB: db, Redis: redisClient, Workers: cfg.SyncWorkers}
+	syncHandler := &handlers.SyncHandler{DB: db, Queue: syncQueue}
 	dashboardHandler := &handlers.DashboardHandler{DB: db}
 	adminHandler := &handlers.AdminHandler{DB: db}
 	usageHandler := &handlers.UsageHandler{DB: db}
 	billingHandler := &handlers.BillingHandler{DB: db}
+	recommendationsHandler := &handlers.RecommendationsHandler{DB: db}
 	cloudtrailHandler := &handlers.CloudTrailHandler{DB: db}
 	notificationsHandler := &handlers.NotificationsHandler{DB: db}
-	awsAccountHandler := &handlers.AWSAccountHandler{DB: db}
+	awsAccountHandler := &handlers.AWSAccountHandler{DB: db, Queue: syncQueue}
 	ldapServerHandler := &handlers.LDAPServerHandler{DB: db}
+	changeRequestsHandler := &handlers.ChangeRequestsHandler{DB: db, Queue: syncQueue}
+	workspaceRequestsHandler := &handlers.WorkspaceRequestsHandler{DB: db, Queue: syncQueue}
+
+	// Start the sync workers
+	syncQueue.Handler = syncHandler.ProcessJob
+	syncQueue.Start(context.Background())
+
+	// Start the built-in sync scheduler
+	if err := services.ValidateSchedule(cfg.SyncSchedule); err != nil {
+		log.Printf("Invalid SYNC_SCHEDULE %q: %v", cfg.SyncSchedule, err)
+	}
+	syncScheduler := &services.SyncScheduler{
+		DB:              db,
+		DefaultSchedule: cfg.SyncSchedule,
+		Trigger: func(syncType, triggerSource string) error {
+			_, err := syncHandler.StartSync(syncType, triggerSource)
+			return err
+		},
+	}
+	syncHandler.Scheduler = syncScheduler
+	syncScheduler.Start(context.Background())
 
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
@@ -83,16 +116,53 @@ func main() {
 		{
 			workspaces.GET("", workspacesHandler.ListWorkspaces)
 			workspaces.GET("/:id", workspacesHandler.GetWorkspace)
+			workspaces.PATCH("/:id", middleware.RequireRole("ADMIN"), workspacesHandler.UpdateWorkspace)
 			workspaces.GET("/:id/metrics", workspacesHandler.GetWorkspaceMetrics)
+			workspaces.GET("/:id/history", workspacesHandler.GetWorkspaceHistory)
 			workspaces.GET("/filters/options", workspacesHandler.GetFilterOptions)
 			workspaces.GET("/export", workspacesHandler.ExportWorkspaces)
+			workspaces.GET("/idle", workspacesHandler.ListIdleWorkspaces)
+			workspaces.PUT("/:id/reclamation", middleware.RequireRole("ADMIN"), workspacesHandler.UpdateReclamation)
+			workspaces.DELETE("/:id/reclamation", middleware.RequireRole("ADMIN"), workspacesHandler.DeleteReclamation)
+			workspaces.GET("/actions", workspacesHandler.ListWorkspaceActions)
+			workspaces.POST("/actions/:action", workspacesHandler.RunBulkWorkspaceAction)
+			workspaces.GET("/:id/actions", workspacesHandler.ListWorkspaceActions)
+			workspaces.POST("/:id/actions/:action", workspacesHandler.RunWorkspaceAction)
 		}
 
+		// Change requests
+		changeRequests := api.Group("/change-requests")
+		{
+			changeRequests.GET("", changeRequestsHandler.ListChangeRequests)
+			changeRequests.POST("", changeRequestsHandler.CreateChangeRequest)
+			changeRequests.GET("/:id", changeRequestsHandler.GetChangeRequest)
+			changeRequests.POST("/:id/approve", changeRequestsHandler.ApproveChangeRequest)
+			changeRequests.POST("/:id/reject", changeRequestsHandler.RejectChangeRequest)
+			changeRequests.POST("/:id/cancel", changeRequestsHandler.CancelChangeRequest)
+		}
+
+		// Self-service workspace requests
+		workspaceRequests := api.Group("/workspace-requests")
+		{
+			workspaceRequests.GET("", workspaceRequestsHandler.ListWorkspaceRequests)
+			workspaceRequests.POST("", workspaceRequestsHandler.CreateWorkspaceRequest)
+			workspaceRequests.GET("/:id", workspaceRequestsHandler.GetWorkspaceRequest)
+			workspaceRequests.POST("/:id/approve", workspaceRequestsHandler.ApproveWorkspaceRequest)
+			workspaceRequests.POST("/:id/reject", workspaceRequestsHandler.RejectWorkspaceRequest)
+			workspaceRequests.POST("/:id/cancel", workspaceRequestsHandler.CancelWorkspaceRequest)
+		}
+
+		// Bundles, directories and images
+		api.GET("/bundles", catalogHandler.ListBundles)
+		api.GET("/directories", catalogHandler.ListDirectories)
+		api.GET("/images", catalogHandler.ListImages)
+
 		// Usage
 		usage := api.Group("/usage")
 		{
 			usage.GET("", usageHandler.ListUsage)
 			usage.GET("/summary", usageHandler.GetUsageSummary)
+			usage.GET("/daily", usageHandler.ListDailyUsage)
 			usage.GET("/export", usageHandler.ExportUsage)
 		}
 
@@ -100,9 +170,18 @@ func main() {
 		billing := api.Group("/billing")
 		{
 			billing.GET("", billingHandler.ListBilling)
+			billing.GET("/summary", billingHandler.GetBillingSummary)
 			billing.GET("/export", billingHandler.ExportBilling)
 		}
 
+		// Rightsizing recommendations
+		recommendations := api.Group("/recommendations")
+		{
+			recommendations.GET("", recommendationsHandler.ListRecommendations)
+			recommendations.GET("/export", recommendationsHandler.ExportRecommendations)
+			recommendations.GET("/prices", recommendationsHandler.ListPrices)
+		}
+
 		// CloudTrail
 		cloudtrail := api.Group("/cloudtrail")
 		{
@@ -135,6 +214,9 @@ func main() {
 		{
 			sync.POST("/trigger", syncHandler.TriggerSync)
 			sync.GET("/history", syncHandler.GetSyncHistory)
+			sync.GET("/schedule", syncHandler.GetSchedule)
+			sync.GET("/:id", syncHandler.GetSync)
+			sync.POST("/:id/cancel", syncHandler.CancelSync)
 		}
 
 		// Admin routes (require ADMIN role)
@@ -171,6 +253,20 @@ func main() {
 			admin.GET("/ldap-servers/:id/test", ldapServerHandler.TestLDAPConnection)
 			admin.POST("/ldap-servers/:id/sync", ldapServerHandler.SyncLDAPServer)
 
+			// Change request approval rules
+			admin.GET("/change-approval-rules", changeRequestsHandler.ListApprovalRules)
+			admin.POST("/change-approval-rules", changeRequestsHandler.CreateApprovalRule)
+			admin.DELETE("/change-approval-rules/:id", changeRequestsHandler.DeleteApprovalRule)
+
+			// CloudTrail log archive import
+			admin.POST("/cloudtrail/import", cloudtrailHandler.ImportEvents)
+
+			// Cost and Usage Report import
+			admin.POST("/billing/cur/import", billingHandler.ImportCUR)
+
+			// Price table for recommendations
+			admin.POST("/recommendations/prices/import", recommendationsHandler.ImportPrices)
+
 			// Integration tests (legacy)
 			admin.POST("/test/aws", adminHandler.TestAWSConnection)
 
@@ -189,7 +285,4 @@ func main() {
 	if err := r.Run(":" + cfg.Port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
-
-	// Suppress unused variable warning
-	_ = redisClient
 }
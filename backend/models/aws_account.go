@@ -3,16 +3,90 @@ package models
 import (
 	"database/sql"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// AllRegions in an account's region list syncs every WorkSpaces-enabled region
+const AllRegions = "all"
+
+// WorkSpacesRegions lists the commercial regions where Amazon WorkSpaces is available
+var WorkSpacesRegions = []string{
+	"us-east-1", "us-west-2", "ca-central-1", "sa-east-1",
+	"eu-central-1", "eu-west-1", "eu-west-2", "eu-west-3",
+	"af-south-1", "il-central-1", "ap-south-1", "ap-northeast-1",
+	"ap-northeast-2", "ap-southeast-1", "ap-southeast-2",
+}
+
+// AWS account authentication modes
+const (
+	AuthTypeAccessKey  = "access_key"  // Static access key pair stored on the account
+	AuthTypeAssumeRole = "assume_role" // Role assumed from a source account or the default credential chain
+)
+
+const awsAccountColumns = `
+	id, name, account_id, region, COALESCE(regions, '{}'), access_key_id, secret_access_key,
+	auth_type, role_arn, COALESCE(external_id, ''), session_name, mfa_serial, source_account_id,
+	is_default, is_active, status, last_sync, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAWSAccount(row rowScanner) (*AWSAccount, error) {
+	var account AWSAccount
+	err := row.Scan(
+		&account.ID, &account.Name, &account.AccountID, &account.Region, pq.Array(&account.Regions),
+		&account.AccessKeyID, &account.SecretAccessKey,
+		&account.AuthType, &account.RoleARN, &account.ExternalID, &account.SessionName,
+		&account.MFASerial, &account.SourceAccountID,
+		&account.IsDefault, &account.IsActive, &account.Status, &account.LastSync,
+		&account.CreatedAt, &account.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// SyncRegions returns the regions to discover WorkSpaces in, defaulting to the primary region
+func (a *AWSAccount) SyncRegions() []string {
+	if len(a.Regions) == 0 {
+		return []string{a.Region}
+	}
+	for _, region := range a.Regions {
+		if region == AllRegions {
+			return WorkSpacesRegions
+		}
+	}
+	return a.Regions
+}
+
+// DiscoversAllRegions reports whether the account syncs every WorkSpaces-enabled region
+func (a *AWSAccount) DiscoversAllRegions() bool {
+	for _, region := range a.Regions {
+		if region == AllRegions {
+			return true
+		}
+	}
+	return false
+}
+
 // AWSAccount represents an AWS account configuration
 type AWSAccount struct {
 	ID              int        `json:"id" db:"id"`
 	Name            string     `json:"name" db:"name"`
 	AccountID       *string    `json:"accountId,omitempty" db:"account_id"`
-	Region          string     `json:"region" db:"region"`
-	AccessKeyID     string     `json:"-" db:"access_key_id"`                    // Never expose in JSON
-	SecretAccessKey string     `json:"-" db:"secret_access_key"`                // Never expose in JSON
+	Region          string     `json:"region" db:"region"`       // Primary region, used for STS, CloudTrail and billing
+	Regions         []string   `json:"regions" db:"regions"`     // Regions to discover WorkSpaces in; "all" for every region
+	AccessKeyID     string     `json:"-" db:"access_key_id"`     // Never expose in JSON
+	SecretAccessKey string     `json:"-" db:"secret_access_key"` // Never expose in JSON
+	AuthType        string     `json:"authType" db:"auth_type"`
+	RoleARN         *string    `json:"roleArn,omitempty" db:"role_arn"`
+	ExternalID      string     `json:"-" db:"external_id"` // Never expose in JSON
+	SessionName     *string    `json:"sessionName,omitempty" db:"session_name"`
+	MFASerial       *string    `json:"mfaSerial,omitempty" db:"mfa_serial"`
+	SourceAccountID *int       `json:"sourceAccountId,omitempty" db:"source_account_id"`
 	IsDefault       bool       `json:"isDefault" db:"is_default"`
 	IsActive        bool       `json:"isActive" db:"is_active"`
 	Status          string     `json:"status" db:"status"`
@@ -23,27 +97,39 @@ type AWSAccount struct {
 
 // CreateAWSAccountRequest is the request payload for creating an AWS account
 type CreateAWSAccountRequest struct {
-	Name            string `json:"name" binding:"required"`
-	Region          string `json:"region" binding:"required"`
-	AccessKeyID     string `json:"accessKeyId" binding:"required"`
-	SecretAccessKey string `json:"secretAccessKey" binding:"required"`
-	IsDefault       bool   `json:"isDefault"`
+	Name            string   `json:"name" binding:"required"`
+	Region          string   `json:"region" binding:"required"`
+	Regions         []string `json:"regions"`  // Defaults to the primary region; ["all"] for every WorkSpaces region
+	AuthType        string   `json:"authType"` // access_key (default) or assume_role
+	AccessKeyID     string   `json:"accessKeyId"`
+	SecretAccessKey string   `json:"secretAccessKey"`
+	RoleARN         string   `json:"roleArn"`
+	ExternalID      string   `json:"externalId"`
+	SessionName     string   `json:"sessionName"`
+	MFASerial       string   `json:"mfaSerial"`
+	SourceAccountID *int     `json:"sourceAccountId"` // Hub account whose credentials assume the role; default credential chain if empty
+	IsDefault       bool     `json:"isDefault"`
 }
 
 // UpdateAWSAccountRequest is the request payload for updating an AWS account
 type UpdateAWSAccountRequest struct {
-	Name            string `json:"name"`
-	Region          string `json:"region"`
-	AccessKeyID     string `json:"accessKeyId"`     // Optional - only update if provided
-	SecretAccessKey string `json:"secretAccessKey"` // Optional - only update if provided
-	IsDefault       bool   `json:"isDefault"`
+	Name            string   `json:"name"`
+	Region          string   `json:"region"`
+	Regions         []string `json:"regions"`         // Optional - only update if provided
+	AccessKeyID     string   `json:"accessKeyId"`     // Optional - only update if provided
+	SecretAccessKey string   `json:"secretAccessKey"` // Optional - only update if provided
+	AuthType        string   `json:"authType"`        // Optional - only update if provided
+	RoleARN         *string  `json:"roleArn"`         // Optional - only update if provided; "" clears it
+	ExternalID      *string  `json:"externalId"`      // Optional - only update if provided; "" clears it
+	SessionName     *string  `json:"sessionName"`     // Optional - only update if provided; "" clears it
+	MFASerial       *string  `json:"mfaSerial"`       // Optional - only update if provided; "" clears it
+	SourceAccountID *int     `json:"sourceAccountId"` // Optional - 0 switches to the default credential chain
+	IsDefault       bool     `json:"isDefault"`
 }
 
 // GetAllAWSAccounts retrieves all AWS accounts
 func GetAllAWSAccounts(db *sql.DB) ([]AWSAccount, error) {
-	query := `
-		SELECT id, name, account_id, region, access_key_id, secret_access_key,
-		       is_default, is_active, status, last_sync, created_at, updated_at
+	query := `SELECT ` + awsAccountColumns + `
 		FROM aws_accounts
 		WHERE is_active = true
 		ORDER BY is_default DESC, name ASC
@@ -56,62 +142,43 @@ func GetAllAWSAccounts(db *sql.DB) ([]AWSAccount, error) {
 
 	var accounts []AWSAccount
 	for rows.Next() {
-		var account AWSAccount
-		err := rows.Scan(
-			&account.ID, &account.Name, &account.AccountID, &account.Region,
-			&account.AccessKeyID, &account.SecretAccessKey, &account.IsDefault,
-			&account.IsActive, &account.Status, &account.LastSync,
-			&account.CreatedAt, &account.UpdatedAt,
-		)
+		account, err := scanAWSAccount(rows)
 		if err != nil {
 			return nil, err
 		}
-		accounts = append(accounts, account)
+		accounts = append(accounts, *account)
 	}
 	return accounts, nil
 }
 
 // GetAWSAccountByID retrieves an AWS account by ID
 func GetAWSAccountByID(db *sql.DB, id int) (*AWSAccount, error) {
-	query := `
-		SELECT id, name, account_id, region, access_key_id, secret_access_key,
-		       is_default, is_active, status, last_sync, created_at, updated_at
+	query := `SELECT ` + awsAccountColumns + `
 		FROM aws_accounts
 		WHERE id = $1 AND is_active = true
 	`
-	var account AWSAccount
-	err := db.QueryRow(query, id).Scan(
-		&account.ID, &account.Name, &account.AccountID, &account.Region,
-		&account.AccessKeyID, &account.SecretAccessKey, &account.IsDefault,
-		&account.IsActive, &account.Status, &account.LastSync,
-		&account.CreatedAt, &account.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &account, nil
+	return scanAWSAccount(db.QueryRow(query, id))
+}
+
+// GetAWSAccountByAccountID retrieves an AWS account by its 12-digit AWS account number
+func GetAWSAccountByAccountID(db *sql.DB, accountID string) (*AWSAccount, error) {
+	query := `SELECT ` + awsAccountColumns + `
+		FROM aws_accounts
+		WHERE account_id = $1 AND is_active = true
+		ORDER BY id
+		LIMIT 1
+	`
+	return scanAWSAccount(db.QueryRow(query, accountID))
 }
 
 // GetDefaultAWSAccount retrieves the default AWS account
 func GetDefaultAWSAccount(db *sql.DB) (*AWSAccount, error) {
-	query := `
-		SELECT id, name, account_id, region, access_key_id, secret_access_key,
-		       is_default, is_active, status, last_sync, created_at, updated_at
+	query := `SELECT ` + awsAccountColumns + `
 		FROM aws_accounts
 		WHERE is_default = true AND is_active = true
 		LIMIT 1
 	`
-	var account AWSAccount
-	err := db.QueryRow(query).Scan(
-		&account.ID, &account.Name, &account.AccountID, &account.Region,
-		&account.AccessKeyID, &account.SecretAccessKey, &account.IsDefault,
-		&account.IsActive, &account.Status, &account.LastSync,
-		&account.CreatedAt, &account.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &account, nil
+	return scanAWSAccount(db.QueryRow(query))
 }
 
 // CreateAWSAccount creates a new AWS account
@@ -125,16 +192,24 @@ func CreateAWSAccount(db *sql.DB, account *AWSAccount) error {
 	}
 
 	query := `
-		INSERT INTO aws_accounts (name, region, access_key_id, secret_access_key, is_default, status)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO aws_accounts (name, region, regions, access_key_id, secret_access_key, auth_type,
+			role_arn, external_id, session_name, mfa_serial, source_account_id, is_default, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11, $12, $13)
 		RETURNING id, created_at, updated_at
 	`
 	return db.QueryRow(
 		query,
 		account.Name,
 		account.Region,
+		pq.Array(account.Regions),
 		account.AccessKeyID,
 		account.SecretAccessKey,
+		account.AuthType,
+		account.RoleARN,
+		account.ExternalID,
+		account.SessionName,
+		account.MFASerial,
+		account.SourceAccountID,
 		account.IsDefault,
 		"pending",
 	).Scan(&account.ID, &account.CreatedAt, &account.UpdatedAt)
@@ -155,13 +230,22 @@ func UpdateAWSAccount(db *sql.DB, id int, req UpdateAWSAccountRequest) error {
 		UPDATE aws_accounts
 		SET name = COALESCE(NULLIF($1, ''), name),
 		    region = COALESCE(NULLIF($2, ''), region),
+		    regions = CASE WHEN cardinality($13::text[]) > 0 THEN $13::text[] ELSE regions END,
 		    access_key_id = COALESCE(NULLIF($3, ''), access_key_id),
 		    secret_access_key = COALESCE(NULLIF($4, ''), secret_access_key),
-		    is_default = $5,
+		    auth_type = COALESCE(NULLIF($5, ''), auth_type),
+		    role_arn = CASE WHEN $6::text IS NULL THEN role_arn ELSE NULLIF($6::text, '') END,
+		    external_id = CASE WHEN $7::text IS NULL THEN external_id ELSE NULLIF($7::text, '') END,
+		    session_name = CASE WHEN $8::text IS NULL THEN session_name ELSE NULLIF($8::text, '') END,
+		    mfa_serial = CASE WHEN $9::text IS NULL THEN mfa_serial ELSE NULLIF($9::text, '') END,
+		    source_account_id = CASE WHEN $10::int IS NULL THEN source_account_id ELSE NULLIF($10::int, 0) END,
+		    is_default = $11,
 		    updated_at = CURRENT_TIMESTAMP
-		WHERE id = $6 AND is_active = true
+		WHERE id = $12 AND is_active = true
 	`
-	_, err := db.Exec(query, req.Name, req.Region, req.AccessKeyID, req.SecretAccessKey, req.IsDefault, id)
+	_, err := db.Exec(query, req.Name, req.Region, req.AccessKeyID, req.SecretAccessKey,
+		req.AuthType, req.RoleARN, req.ExternalID, req.SessionName, req.MFASerial, req.SourceAccountID,
+		req.IsDefault, id, pq.Array(req.Regions))
 	return err
 }
 
@@ -2,54 +2,118 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
 // BillingData represents AWS billing/cost data
 type BillingData struct {
-	ID          int       `json:"id" db:"id"`
-	WorkspaceID string    `json:"workspace_id" db:"workspace_id"`
-	Service     string    `json:"service" db:"service"`
-	UsageType   string    `json:"usage_type" db:"usage_type"`
-	StartDate   time.Time `json:"start_date" db:"start_date"`
-	EndDate     time.Time `json:"end_date" db:"end_date"`
-	Amount      float64   `json:"amount" db:"amount"`
-	Unit        string    `json:"unit" db:"unit"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID           int       `json:"id" db:"id"`
+	WorkspaceID  string    `json:"workspace_id" db:"workspace_id"`
+	Service      string    `json:"service" db:"service"`
+	UsageType    string    `json:"usage_type" db:"usage_type"`
+	StartDate    time.Time `json:"start_date" db:"start_date"`
+	EndDate      time.Time `json:"end_date" db:"end_date"`
+	Amount       float64   `json:"amount" db:"amount"`
+	Unit         string    `json:"unit" db:"unit"`
+	Source       string    `json:"source" db:"source"`       // cost_explorer or cur
+	CostType     string    `json:"cost_type" db:"cost_type"` // unblended or amortized
+	AWSAccountID *int      `json:"aws_account_id" db:"aws_account_id"`
+	// UsageAccountID is the AWS account number a Cost and Usage Report row was charged to
+	UsageAccountID string    `json:"usage_account_id,omitempty" db:"usage_account_id"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+// Billing data sources
+const (
+	BillingSourceCostExplorer = "cost_explorer"
+	BillingSourceCUR          = "cur"
+)
+
+// Cost types, i.e. how charges for commitments and discounts are spread over usage
+const (
+	CostTypeUnblended = "unblended"
+	CostTypeAmortized = "amortized"
+	CostTypeNet       = "net" // Unblended, after discounts such as EDP and private pricing
+)
+
+// ValidCostType reports whether costType is a supported cost type
+func ValidCostType(costType string) bool {
+	return costType == CostTypeUnblended || costType == CostTypeAmortized || costType == CostTypeNet
+}
+
+// BillingSourceClause keeps Cost Explorer rows (alias b) out of the accounts' months that have
+// Cost and Usage Report data, which is more detailed, so the same spend isn't counted twice
+func BillingSourceClause() string {
+	return ` AND NOT (b.source = '` + BillingSourceCostExplorer + `' AND EXISTS (
+		SELECT 1 FROM billing_data cur
+		WHERE cur.source = '` + BillingSourceCUR + `' AND cur.cost_type = b.cost_type
+		  AND COALESCE(cur.aws_account_id, 0) = COALESCE(b.aws_account_id, 0)
+		  AND date_trunc('month', cur.start_date) = date_trunc('month', b.start_date)
+	))`
 }
 
 // SyncHistory represents a sync job record
 type SyncHistory struct {
-	ID               int        `json:"id" db:"id"`
-	SyncType         string     `json:"sync_type" db:"sync_type"`
-	Status           string     `json:"status" db:"status"`
-	RecordsProcessed int        `json:"records_processed" db:"records_processed"`
-	ErrorMessage     string     `json:"error_message" db:"error_message"`
-	StartedAt        time.Time  `json:"started_at" db:"started_at"`
-	CompletedAt      *time.Time `json:"completed_at" db:"completed_at"`
-	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+	ID               int             `json:"id" db:"id"`
+	SyncType         string          `json:"sync_type" db:"sync_type"`
+	Status           string          `json:"status" db:"status"`
+	RecordsProcessed int             `json:"records_processed" db:"records_processed"`
+	ErrorMessage     string          `json:"error_message" db:"error_message"`
+	TriggerSource    string          `json:"trigger_source" db:"trigger_source"`
+	AWSAccountID     *int            `json:"aws_account_id,omitempty" db:"aws_account_id"`
+	StartedAt        time.Time       `json:"started_at" db:"started_at"`
+	CompletedAt      *time.Time      `json:"completed_at" db:"completed_at"`
+	CreatedAt        time.Time       `json:"created_at" db:"created_at"`
+	Progress         json.RawMessage `json:"progress,omitempty" db:"progress"`
 }
 
-// ListBillingData retrieves billing data with filtering
+// billingColumns selects a billing_data row
+const billingColumns = `
+	id, COALESCE(workspace_id, ''), COALESCE(service, ''), COALESCE(usage_type, ''),
+	start_date, end_date, COALESCE(amount, 0), COALESCE(unit, ''), source, cost_type,
+	aws_account_id, usage_account_id, created_at`
+
+// ListBillingData retrieves billing data with filtering. Only the cost type in
+// filters["cost_type"] is returned, unblended by default.
 func ListBillingData(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]BillingData, int, error) {
-	baseQuery := `
-		SELECT id, workspace_id, service, usage_type, start_date, end_date, amount, unit, created_at
-		FROM billing_data
+	baseQuery := `SELECT ` + billingColumns + `
+		FROM billing_data b
 		WHERE 1=1
 	`
 
-	countQuery := "SELECT COUNT(*) FROM billing_data WHERE 1=1"
+	countQuery := "SELECT COUNT(*) FROM billing_data b WHERE 1=1"
 	args := []interface{}{}
 	argPos := 1
 
 	// Apply filters
 	if workspaceID, ok := filters["workspace_id"].(string); ok && workspaceID != "" {
-		baseQuery += " AND workspace_id = $" + string(rune(argPos+'0'))
-		countQuery += " AND workspace_id = $" + string(rune(argPos+'0'))
+		filterClause := fmt.Sprintf(" AND workspace_id = $%d", argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
 		args = append(args, workspaceID)
 		argPos++
 	}
 
+	if accountID, ok := filters["aws_account_id"].(int); ok && accountID > 0 {
+		filterClause := fmt.Sprintf(" AND aws_account_id = $%d", argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, accountID)
+		argPos++
+	}
+
+	costType, _ := filters["cost_type"].(string)
+	if costType == "" {
+		costType = CostTypeUnblended
+	}
+	filterClause := fmt.Sprintf(" AND cost_type = $%d", argPos) + BillingSourceClause()
+	baseQuery += filterClause
+	countQuery += filterClause
+	args = append(args, costType)
+	argPos++
+
 	// Get total count
 	var total int
 	err := db.QueryRow(countQuery, args...).Scan(&total)
@@ -58,7 +122,7 @@ func ListBillingData(db *sql.DB, filters map[string]interface{}, limit, offset i
 	}
 
 	// Add pagination
-	baseQuery += " ORDER BY start_date DESC LIMIT $" + string(rune(argPos+'0')) + " OFFSET $" + string(rune(argPos+1+'0'))
+	baseQuery += fmt.Sprintf(" ORDER BY start_date DESC LIMIT $%d OFFSET $%d", argPos, argPos+1)
 	args = append(args, limit, offset)
 
 	rows, err := db.Query(baseQuery, args...)
@@ -71,7 +135,8 @@ func ListBillingData(db *sql.DB, filters map[string]interface{}, limit, offset i
 	for rows.Next() {
 		var bd BillingData
 		err := rows.Scan(&bd.ID, &bd.WorkspaceID, &bd.Service, &bd.UsageType,
-			&bd.StartDate, &bd.EndDate, &bd.Amount, &bd.Unit, &bd.CreatedAt)
+			&bd.StartDate, &bd.EndDate, &bd.Amount, &bd.Unit, &bd.Source, &bd.CostType,
+			&bd.AWSAccountID, &bd.UsageAccountID, &bd.CreatedAt)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -81,34 +146,141 @@ func ListBillingData(db *sql.DB, filters map[string]interface{}, limit, offset i
 	return billingData, total, nil
 }
 
-// UpsertBillingData inserts or updates billing data
+// billingConflictTarget matches the unique index on billing_data
+const billingConflictTarget = `(source, cost_type, COALESCE(aws_account_id, 0), usage_account_id, workspace_id, service, usage_type, start_date, end_date)`
+
+// upsertBillingQuery inserts a billing_data row or updates the amount of an existing one
+const upsertBillingQuery = `
+	INSERT INTO billing_data (workspace_id, service, usage_type, start_date, end_date, amount, unit, source, cost_type, aws_account_id, usage_account_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	ON CONFLICT ` + billingConflictTarget + ` DO UPDATE SET
+		amount = EXCLUDED.amount,
+		unit = EXCLUDED.unit
+`
+
+// UpsertBillingData inserts or updates billing data. Source and cost type default to
+// Cost Explorer and unblended.
 func UpsertBillingData(db *sql.DB, bd *BillingData) error {
+	_, err := db.Exec(upsertBillingQuery, billingArgs(bd)...)
+	return err
+}
+
+func billingArgs(bd *BillingData) []interface{} {
+	source, costType := bd.Source, bd.CostType
+	if source == "" {
+		source = BillingSourceCostExplorer
+	}
+	if costType == "" {
+		costType = CostTypeUnblended
+	}
+	return []interface{}{bd.WorkspaceID, bd.Service, bd.UsageType,
+		bd.StartDate, bd.EndDate, bd.Amount, bd.Unit, source, costType, bd.AWSAccountID, bd.UsageAccountID}
+}
+
+// CURPeriod is the billing period of one usage account found in a Cost and Usage Report
+type CURPeriod struct {
+	Start          time.Time
+	UsageAccountID string
+}
+
+// ReplaceCURBillingData swaps the Cost and Usage Report rows of a cost type for each usage
+// account's billing period in periods with rows, so re-imported reports replace older
+// versions without touching the periods and accounts the import didn't cover. Rows stored
+// before usage accounts were recorded are replaced along with every account's period.
+func ReplaceCURBillingData(db *sql.DB, costType string, periods []CURPeriod, rows []BillingData) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, period := range periods {
+		_, err := tx.Exec(`
+			DELETE FROM billing_data
+			WHERE source = $1 AND cost_type = $2 AND usage_account_id IN ($4, '')
+			  AND start_date >= $3 AND start_date < ($3::date + INTERVAL '1 month')
+		`, BillingSourceCUR, costType, period.Start, period.UsageAccountID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range rows {
+		rows[i].Source = BillingSourceCUR
+		rows[i].CostType = costType
+		if _, err := tx.Exec(upsertBillingQuery, billingArgs(&rows[i])...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceCostExplorerBillingData swaps the Cost Explorer rows of a cost type dated from start
+// up to end with rows. accountID limits the swap to one account's rows; 0 swaps the rows of
+// every account. withUnassigned also swaps rows with no account, which older single-account
+// syncs wrote. Payer syncs store unconfigured linked accounts that way, so they leave it off.
+func ReplaceCostExplorerBillingData(db *sql.DB, costType string, accountID int, withUnassigned bool, start, end time.Time, rows []BillingData) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO billing_data (workspace_id, service, usage_type, start_date, end_date, amount, unit)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT (workspace_id, service, usage_type, start_date, end_date) DO UPDATE SET
-			amount = EXCLUDED.amount,
-			unit = EXCLUDED.unit
+		DELETE FROM billing_data
+		WHERE source = $1 AND cost_type = $2 AND start_date >= $3 AND start_date < $4
 	`
+	args := []interface{}{BillingSourceCostExplorer, costType, start, end}
+	if accountID > 0 && withUnassigned {
+		query += " AND (aws_account_id = $5 OR aws_account_id IS NULL)"
+		args = append(args, accountID)
+	} else if accountID > 0 {
+		query += " AND aws_account_id = $5"
+		args = append(args, accountID)
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
 
-	_, err := db.Exec(query, bd.WorkspaceID, bd.Service, bd.UsageType,
-		bd.StartDate, bd.EndDate, bd.Amount, bd.Unit)
+	for i := range rows {
+		rows[i].Source = BillingSourceCostExplorer
+		rows[i].CostType = costType
+		if _, err := tx.Exec(upsertBillingQuery, billingArgs(&rows[i])...); err != nil {
+			return err
+		}
+	}
 
-	return err
+	return tx.Commit()
 }
 
-// CreateSyncHistory creates a new sync history record
-func CreateSyncHistory(db *sql.DB, syncType string) (*SyncHistory, error) {
+// Sync trigger sources recorded on sync history records
+const (
+	SyncTriggerManual           = "manual"
+	SyncTriggerScheduled        = "scheduled"
+	SyncTriggerChangeRequest    = "change_request"    // Queued to run an approved change request
+	SyncTriggerWorkspaceRequest = "workspace_request" // Queued to create an approved workspace request
+)
+
+// CreateSyncHistory creates a new queued sync history record.
+// accountID limits the sync to a single AWS account (0 for all accounts).
+func CreateSyncHistory(db *sql.DB, syncType, triggerSource string, accountID int) (*SyncHistory, error) {
 	query := `
-		INSERT INTO sync_history (sync_type, status, started_at)
-		VALUES ($1, 'running', CURRENT_TIMESTAMP)
-		RETURNING id, sync_type, status, records_processed, error_message, started_at, completed_at, created_at
+		INSERT INTO sync_history (sync_type, status, trigger_source, aws_account_id, started_at)
+		VALUES ($1, 'queued', $2, $3, CURRENT_TIMESTAMP)
+		RETURNING id, sync_type, status, records_processed, COALESCE(error_message, ''),
+		          trigger_source, aws_account_id, started_at, completed_at, created_at
 	`
 
+	var accountIDPtr *int
+	if accountID > 0 {
+		accountIDPtr = &accountID
+	}
+
 	var sh SyncHistory
-	err := db.QueryRow(query, syncType).Scan(
+	err := db.QueryRow(query, syncType, triggerSource, accountIDPtr).Scan(
 		&sh.ID, &sh.SyncType, &sh.Status, &sh.RecordsProcessed,
-		&sh.ErrorMessage, &sh.StartedAt, &sh.CompletedAt, &sh.CreatedAt,
+		&sh.ErrorMessage, &sh.TriggerSource, &sh.AWSAccountID, &sh.StartedAt, &sh.CompletedAt, &sh.CreatedAt,
 	)
 
 	return &sh, err
@@ -126,10 +298,50 @@ func UpdateSyncHistory(db *sql.DB, id int, status string, recordsProcessed int,
 	return err
 }
 
+// MarkSyncHistoryRunning flags a queued sync as picked up by a worker
+func MarkSyncHistoryRunning(db *sql.DB, id int) error {
+	query := `UPDATE sync_history SET status = 'running', started_at = CURRENT_TIMESTAMP WHERE id = $1`
+	_, err := db.Exec(query, id)
+	return err
+}
+
+// UpdateSyncProgress stores the per-stage progress document of a sync
+func UpdateSyncProgress(db *sql.DB, id int, progress json.RawMessage) error {
+	query := `UPDATE sync_history SET progress = $1 WHERE id = $2`
+	_, err := db.Exec(query, progress, id)
+	return err
+}
+
+// GetSyncHistory retrieves a single sync history record including its progress
+func GetSyncHistory(db *sql.DB, id int) (*SyncHistory, error) {
+	query := `
+		SELECT id, sync_type, status, records_processed, COALESCE(error_message, ''),
+		       COALESCE(trigger_source, 'manual'), aws_account_id, started_at, completed_at, created_at,
+		       progress
+		FROM sync_history
+		WHERE id = $1
+	`
+
+	var sh SyncHistory
+	var progress []byte
+	err := db.QueryRow(query, id).Scan(&sh.ID, &sh.SyncType, &sh.Status, &sh.RecordsProcessed,
+		&sh.ErrorMessage, &sh.TriggerSource, &sh.AWSAccountID, &sh.StartedAt, &sh.CompletedAt, &sh.CreatedAt,
+		&progress)
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil {
+		sh.Progress = progress
+	}
+
+	return &sh, nil
+}
+
 // ListSyncHistory retrieves sync history records
 func ListSyncHistory(db *sql.DB, limit int) ([]SyncHistory, error) {
 	query := `
-		SELECT id, sync_type, status, records_processed, error_message, started_at, completed_at, created_at
+		SELECT id, sync_type, status, records_processed, COALESCE(error_message, ''),
+		       COALESCE(trigger_source, 'manual'), aws_account_id, started_at, completed_at, created_at
 		FROM sync_history
 		ORDER BY created_at DESC
 		LIMIT $1
@@ -145,7 +357,7 @@ func ListSyncHistory(db *sql.DB, limit int) ([]SyncHistory, error) {
 	for rows.Next() {
 		var sh SyncHistory
 		err := rows.Scan(&sh.ID, &sh.SyncType, &sh.Status, &sh.RecordsProcessed,
-			&sh.ErrorMessage, &sh.StartedAt, &sh.CompletedAt, &sh.CreatedAt)
+			&sh.ErrorMessage, &sh.TriggerSource, &sh.AWSAccountID, &sh.StartedAt, &sh.CompletedAt, &sh.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,351 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WorkspaceBundle represents a WorkSpaces bundle (hardware and software template)
+type WorkspaceBundle struct {
+	BundleID          string     `json:"bundle_id" db:"bundle_id"`
+	Name              string     `json:"name" db:"name"`
+	Description       string     `json:"description" db:"description"`
+	Owner             string     `json:"owner" db:"owner"`
+	ComputeType       string     `json:"compute_type" db:"compute_type"`
+	RootVolumeSizeGib int        `json:"root_volume_size_gib" db:"root_volume_size_gib"`
+	UserVolumeSizeGib int        `json:"user_volume_size_gib" db:"user_volume_size_gib"`
+	ImageID           string     `json:"image_id" db:"image_id"`
+	State             string     `json:"state" db:"state"`
+	BundleCreatedAt   *time.Time `json:"bundle_created_at" db:"bundle_created_at"`
+	BundleUpdatedAt   *time.Time `json:"bundle_updated_at" db:"bundle_updated_at"`
+	AWSAccountID      *int       `json:"aws_account_id" db:"aws_account_id"`
+	Region            string     `json:"region" db:"region"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// WorkspaceDirectory represents a directory registered with WorkSpaces
+type WorkspaceDirectory struct {
+	DirectoryID      string    `json:"directory_id" db:"directory_id"`
+	Alias            string    `json:"alias" db:"alias"`
+	DirectoryName    string    `json:"directory_name" db:"directory_name"`
+	DirectoryType    string    `json:"directory_type" db:"directory_type"`
+	RegistrationCode string    `json:"registration_code" db:"registration_code"`
+	State            string    `json:"state" db:"state"`
+	CustomerUserName string    `json:"customer_user_name" db:"customer_user_name"`
+	DNSIPAddresses   []string  `json:"dns_ip_addresses" db:"dns_ip_addresses"`
+	SubnetIDs        []string  `json:"subnet_ids" db:"subnet_ids"`
+	SecurityGroupID  string    `json:"security_group_id" db:"security_group_id"`
+	IAMRoleID        string    `json:"iam_role_id" db:"iam_role_id"`
+	Tenancy          string    `json:"tenancy" db:"tenancy"`
+	AWSAccountID     *int      `json:"aws_account_id" db:"aws_account_id"`
+	Region           string    `json:"region" db:"region"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// WorkspaceImage represents a custom WorkSpaces image
+type WorkspaceImage struct {
+	ImageID         string     `json:"image_id" db:"image_id"`
+	Name            string     `json:"name" db:"name"`
+	Description     string     `json:"description" db:"description"`
+	OwnerAccountID  string     `json:"owner_account_id" db:"owner_account_id"`
+	OperatingSystem string     `json:"operating_system" db:"operating_system"`
+	State           string     `json:"state" db:"state"`
+	RequiredTenancy string     `json:"required_tenancy" db:"required_tenancy"`
+	ErrorMessage    string     `json:"error_message,omitempty" db:"error_message"`
+	ImageCreatedAt  *time.Time `json:"image_created_at" db:"image_created_at"`
+	AWSAccountID    *int       `json:"aws_account_id" db:"aws_account_id"`
+	Region          string     `json:"region" db:"region"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// UpsertWorkspaceBundle inserts or updates a bundle
+func UpsertWorkspaceBundle(db *sql.DB, b *WorkspaceBundle) error {
+	query := `
+		INSERT INTO workspace_bundles (
+			bundle_id, name, description, owner, compute_type,
+			root_volume_size_gib, user_volume_size_gib, image_id, state,
+			bundle_created_at, bundle_updated_at, aws_account_id, region, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, CURRENT_TIMESTAMP)
+		ON CONFLICT (bundle_id) DO UPDATE SET
+			name = EXCLUDED.name,
+			description = EXCLUDED.description,
+			owner = EXCLUDED.owner,
+			compute_type = EXCLUDED.compute_type,
+			root_volume_size_gib = EXCLUDED.root_volume_size_gib,
+			user_volume_size_gib = EXCLUDED.user_volume_size_gib,
+			image_id = EXCLUDED.image_id,
+			state = EXCLUDED.state,
+			bundle_created_at = EXCLUDED.bundle_created_at,
+			bundle_updated_at = EXCLUDED.bundle_updated_at,
+			aws_account_id = EXCLUDED.aws_account_id,
+			region = EXCLUDED.region,
+			updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := db.Exec(query,
+		b.BundleID, b.Name, b.Description, b.Owner, b.ComputeType,
+		b.RootVolumeSizeGib, b.UserVolumeSizeGib, b.ImageID, b.State,
+		b.BundleCreatedAt, b.BundleUpdatedAt, b.AWSAccountID, b.Region,
+	)
+	return err
+}
+
+// UpsertWorkspaceDirectory inserts or updates a directory
+func UpsertWorkspaceDirectory(db *sql.DB, d *WorkspaceDirectory) error {
+	query := `
+		INSERT INTO workspace_directories (
+			directory_id, alias, directory_name, directory_type, registration_code,
+			state, customer_user_name, dns_ip_addresses, subnet_ids, security_group_id,
+			iam_role_id, tenancy, aws_account_id, region, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, CURRENT_TIMESTAMP)
+		ON CONFLICT (directory_id) DO UPDATE SET
+			alias = EXCLUDED.alias,
+			directory_name = EXCLUDED.directory_name,
+			directory_type = EXCLUDED.directory_type,
+			registration_code = EXCLUDED.registration_code,
+			state = EXCLUDED.state,
+			customer_user_name = EXCLUDED.customer_user_name,
+			dns_ip_addresses = EXCLUDED.dns_ip_addresses,
+			subnet_ids = EXCLUDED.subnet_ids,
+			security_group_id = EXCLUDED.security_group_id,
+			iam_role_id = EXCLUDED.iam_role_id,
+			tenancy = EXCLUDED.tenancy,
+			aws_account_id = EXCLUDED.aws_account_id,
+			region = EXCLUDED.region,
+			updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := db.Exec(query,
+		d.DirectoryID, d.Alias, d.DirectoryName, d.DirectoryType, d.RegistrationCode,
+		d.State, d.CustomerUserName, pq.Array(d.DNSIPAddresses), pq.Array(d.SubnetIDs), d.SecurityGroupID,
+		d.IAMRoleID, d.Tenancy, d.AWSAccountID, d.Region,
+	)
+	return err
+}
+
+// UpsertWorkspaceImage inserts or updates an image
+func UpsertWorkspaceImage(db *sql.DB, i *WorkspaceImage) error {
+	query := `
+		INSERT INTO workspace_images (
+			image_id, name, description, owner_account_id, operating_system, state,
+			required_tenancy, error_message, image_created_at, aws_account_id, region, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, CURRENT_TIMESTAMP)
+		ON CONFLICT (image_id) DO UPDATE SET
+			name = EXCLUDED.name,
+			description = EXCLUDED.description,
+			owner_account_id = EXCLUDED.owner_account_id,
+			operating_system = EXCLUDED.operating_system,
+			state = EXCLUDED.state,
+			required_tenancy = EXCLUDED.required_tenancy,
+			error_message = EXCLUDED.error_message,
+			image_created_at = EXCLUDED.image_created_at,
+			aws_account_id = EXCLUDED.aws_account_id,
+			region = EXCLUDED.region,
+			updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := db.Exec(query,
+		i.ImageID, i.Name, i.Description, i.OwnerAccountID, i.OperatingSystem, i.State,
+		i.RequiredTenancy, i.ErrorMessage, i.ImageCreatedAt, i.AWSAccountID, i.Region,
+	)
+	return err
+}
+
+// ListUnknownBundleIDs returns bundle IDs used by an account's workspaces in a region that
+// aren't in workspace_bundles yet, typically Amazon-owned public bundles
+func ListUnknownBundleIDs(db *sql.DB, accountID int, region string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT w.bundle_id
+		FROM workspaces w
+		LEFT JOIN workspace_bundles b ON b.bundle_id = w.bundle_id
+		WHERE w.aws_account_id = $1 AND w.region = $2
+		  AND w.bundle_id IS NOT NULL AND b.bundle_id IS NULL
+	`, accountID, region)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// catalogFilterClause applies the account and region filters shared by catalog listings
+func catalogFilterClause(filters map[string]interface{}) (string, []interface{}) {
+	clause := ""
+	args := []interface{}{}
+	argPos := 1
+
+	if accountID, ok := filters["aws_account_id"].(int); ok && accountID > 0 {
+		clause += fmt.Sprintf(" AND aws_account_id = $%d", argPos)
+		args = append(args, accountID)
+		argPos++
+	}
+
+	if region, ok := filters["region"].(string); ok && region != "" {
+		clause += fmt.Sprintf(" AND region = $%d", argPos)
+		args = append(args, region)
+		argPos++
+	}
+
+	if state, ok := filters["state"].(string); ok && state != "" {
+		clause += fmt.Sprintf(" AND state = $%d", argPos)
+		args = append(args, state)
+	}
+
+	return clause, args
+}
+
+const workspaceBundleColumns = `
+	bundle_id, COALESCE(name, ''), COALESCE(description, ''), COALESCE(owner, ''),
+	COALESCE(compute_type, ''), COALESCE(root_volume_size_gib, 0), COALESCE(user_volume_size_gib, 0),
+	COALESCE(image_id, ''), COALESCE(state, ''), bundle_created_at, bundle_updated_at,
+	aws_account_id, COALESCE(region, ''), updated_at`
+
+func scanWorkspaceBundle(row rowScanner) (*WorkspaceBundle, error) {
+	var b WorkspaceBundle
+	err := row.Scan(&b.BundleID, &b.Name, &b.Description, &b.Owner,
+		&b.ComputeType, &b.RootVolumeSizeGib, &b.UserVolumeSizeGib,
+		&b.ImageID, &b.State, &b.BundleCreatedAt, &b.BundleUpdatedAt,
+		&b.AWSAccountID, &b.Region, &b.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetWorkspaceBundle retrieves a bundle by ID
+func GetWorkspaceBundle(db *sql.DB, bundleID string) (*WorkspaceBundle, error) {
+	return scanWorkspaceBundle(db.QueryRow(`SELECT `+workspaceBundleColumns+` FROM workspace_bundles WHERE bundle_id = $1`, bundleID))
+}
+
+// ListWorkspaceBundles retrieves bundles with filtering and pagination
+func ListWorkspaceBundles(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]WorkspaceBundle, int, error) {
+	filterClause, args := catalogFilterClause(filters)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM workspace_bundles WHERE 1=1"+filterClause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + workspaceBundleColumns + ` FROM workspace_bundles WHERE 1=1` + filterClause +
+		fmt.Sprintf(" ORDER BY name, bundle_id LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	bundles := []WorkspaceBundle{}
+	for rows.Next() {
+		b, err := scanWorkspaceBundle(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		bundles = append(bundles, *b)
+	}
+
+	return bundles, total, nil
+}
+
+const workspaceDirectoryColumns = `
+	directory_id, COALESCE(alias, ''), COALESCE(directory_name, ''), COALESCE(directory_type, ''),
+	COALESCE(registration_code, ''), COALESCE(state, ''), COALESCE(customer_user_name, ''),
+	COALESCE(dns_ip_addresses, '{}'), COALESCE(subnet_ids, '{}'), COALESCE(security_group_id, ''),
+	COALESCE(iam_role_id, ''), COALESCE(tenancy, ''), aws_account_id, COALESCE(region, ''), updated_at`
+
+func scanWorkspaceDirectory(row rowScanner) (*WorkspaceDirectory, error) {
+	var d WorkspaceDirectory
+	err := row.Scan(&d.DirectoryID, &d.Alias, &d.DirectoryName, &d.DirectoryType,
+		&d.RegistrationCode, &d.State, &d.CustomerUserName,
+		pq.Array(&d.DNSIPAddresses), pq.Array(&d.SubnetIDs), &d.SecurityGroupID,
+		&d.IAMRoleID, &d.Tenancy, &d.AWSAccountID, &d.Region, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetWorkspaceDirectory retrieves a directory by ID
+func GetWorkspaceDirectory(db *sql.DB, directoryID string) (*WorkspaceDirectory, error) {
+	return scanWorkspaceDirectory(db.QueryRow(`SELECT `+workspaceDirectoryColumns+` FROM workspace_directories WHERE directory_id = $1`, directoryID))
+}
+
+// ListWorkspaceDirectories retrieves directories with filtering and pagination
+func ListWorkspaceDirectories(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]WorkspaceDirectory, int, error) {
+	filterClause, args := catalogFilterClause(filters)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM workspace_directories WHERE 1=1"+filterClause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + workspaceDirectoryColumns + ` FROM workspace_directories WHERE 1=1` + filterClause +
+		fmt.Sprintf(" ORDER BY directory_name, directory_id LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	directories := []WorkspaceDirectory{}
+	for rows.Next() {
+		d, err := scanWorkspaceDirectory(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		directories = append(directories, *d)
+	}
+
+	return directories, total, nil
+}
+
+// ListWorkspaceImages retrieves images with filtering and pagination
+func ListWorkspaceImages(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]WorkspaceImage, int, error) {
+	filterClause, args := catalogFilterClause(filters)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM workspace_images WHERE 1=1"+filterClause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT image_id, COALESCE(name, ''), COALESCE(description, ''), COALESCE(owner_account_id, ''),
+		       COALESCE(operating_system, ''), COALESCE(state, ''), COALESCE(required_tenancy, ''),
+		       COALESCE(error_message, ''), image_created_at, aws_account_id, COALESCE(region, ''), updated_at
+		FROM workspace_images
+		WHERE 1=1` + filterClause +
+		fmt.Sprintf(" ORDER BY name, image_id LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	images := []WorkspaceImage{}
+	for rows.Next() {
+		var i WorkspaceImage
+		err := rows.Scan(&i.ImageID, &i.Name, &i.Description, &i.OwnerAccountID,
+			&i.OperatingSystem, &i.State, &i.RequiredTenancy,
+			&i.ErrorMessage, &i.ImageCreatedAt, &i.AWSAccountID, &i.Region, &i.UpdatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		images = append(images, i)
+	}
+
+	return images, total, nil
+}
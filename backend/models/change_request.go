@@ -0,0 +1,319 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Change request statuses
+const (
+	ChangePending   = "pending"   // Awaiting approval
+	ChangeApproved  = "approved"  // Approved, waiting for the sync worker
+	ChangeRejected  = "rejected"  // Rejected by an approver
+	ChangeExpired   = "expired"   // Not decided before expires_at
+	ChangeCancelled = "cancelled" // Withdrawn before a decision
+	ChangeExecuting = "executing" // Being run by the sync worker
+	ChangeCompleted = "completed" // Run, and every workspace succeeded
+	ChangeFailed    = "failed"    // Run, and at least one workspace failed
+)
+
+// ChangeRequest is an action on workspaces that needs a second person's approval
+type ChangeRequest struct {
+	ID            int             `json:"id" db:"id"`
+	Action        string          `json:"action" db:"action"`
+	WorkspaceIDs  []string        `json:"workspace_ids" db:"workspace_ids"`
+	Parameters    json.RawMessage `json:"parameters,omitempty" db:"parameters"`
+	Justification string          `json:"justification" db:"justification"`
+	RequestedBy   string          `json:"requested_by" db:"requested_by"`
+	Status        string          `json:"status" db:"status"`
+	DecidedBy     string          `json:"decided_by,omitempty" db:"decided_by"`
+	DecidedAt     *time.Time      `json:"decided_at,omitempty" db:"decided_at"`
+	DecisionNote  string          `json:"decision_note,omitempty" db:"decision_note"`
+	ExpiresAt     time.Time       `json:"expires_at" db:"expires_at"`
+	ExecutedAt    *time.Time      `json:"executed_at,omitempty" db:"executed_at"`
+	Results       json.RawMessage `json:"results,omitempty" db:"results"`
+	CreatedAt     time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// ApprovalRule lets a role approve an action ("*" for any) on workspaces in a department
+// (blank for any)
+type ApprovalRule struct {
+	ID           int       `json:"id" db:"id"`
+	Action       string    `json:"action" db:"action"`
+	Department   string    `json:"department" db:"department"`
+	ApproverRole string    `json:"approver_role" db:"approver_role"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+const changeRequestColumns = `
+	id, action, workspace_ids, COALESCE(parameters, 'null'), justification, requested_by, status,
+	COALESCE(decided_by, ''), decided_at, COALESCE(decision_note, ''), expires_at, executed_at,
+	COALESCE(results, 'null'), created_at, updated_at`
+
+func scanChangeRequest(row rowScanner) (*ChangeRequest, error) {
+	var cr ChangeRequest
+	err := row.Scan(&cr.ID, &cr.Action, pq.Array(&cr.WorkspaceIDs), &cr.Parameters, &cr.Justification,
+		&cr.RequestedBy, &cr.Status, &cr.DecidedBy, &cr.DecidedAt, &cr.DecisionNote, &cr.ExpiresAt,
+		&cr.ExecutedAt, &cr.Results, &cr.CreatedAt, &cr.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if string(cr.Parameters) == "null" {
+		cr.Parameters = nil
+	}
+	if string(cr.Results) == "null" {
+		cr.Results = nil
+	}
+	return &cr, nil
+}
+
+// CreateChangeRequest stores a pending change request that expires after ttl
+func CreateChangeRequest(db *sql.DB, cr *ChangeRequest, ttl time.Duration) error {
+	var parameters interface{}
+	if len(cr.Parameters) > 0 {
+		parameters = []byte(cr.Parameters)
+	}
+	cr.Status = ChangePending
+	return db.QueryRow(`
+		INSERT INTO change_requests (action, workspace_ids, parameters, justification, requested_by, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + make_interval(secs => $7))
+		RETURNING id, expires_at, created_at, updated_at
+	`, cr.Action, pq.Array(cr.WorkspaceIDs), parameters, cr.Justification, cr.RequestedBy, cr.Status,
+		ttl.Seconds()).Scan(&cr.ID, &cr.ExpiresAt, &cr.CreatedAt, &cr.UpdatedAt)
+}
+
+// GetChangeRequest returns a change request by ID
+func GetChangeRequest(db *sql.DB, id int) (*ChangeRequest, error) {
+	return scanChangeRequest(db.QueryRow(`SELECT `+changeRequestColumns+` FROM change_requests WHERE id = $1`, id))
+}
+
+// ListChangeRequests returns change requests, newest first. Filters: status, action,
+// requested_by and workspace_id.
+func ListChangeRequests(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]ChangeRequest, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	argPos := 1
+
+	for _, column := range []string{"status", "action", "requested_by"} {
+		if value, ok := filters[column].(string); ok && value != "" {
+			where += fmt.Sprintf(" AND %s = $%d", column, argPos)
+			args = append(args, value)
+			argPos++
+		}
+	}
+	if value, ok := filters["workspace_id"].(string); ok && value != "" {
+		where += fmt.Sprintf(" AND $%d = ANY(workspace_ids)", argPos)
+		args = append(args, value)
+		argPos++
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM change_requests"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + changeRequestColumns + ` FROM change_requests` + where +
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d", argPos, argPos+1)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	requests := []ChangeRequest{}
+	for rows.Next() {
+		cr, err := scanChangeRequest(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		requests = append(requests, *cr)
+	}
+	return requests, total, rows.Err()
+}
+
+// DecideChangeRequest moves a pending, unexpired change request to status (approved,
+// rejected or cancelled). It returns sql.ErrNoRows if the request is no longer pending.
+func DecideChangeRequest(db *sql.DB, id int, status, decidedBy, note string) (*ChangeRequest, error) {
+	return scanChangeRequest(db.QueryRow(`
+		UPDATE change_requests
+		SET status = $2, decided_by = $3, decided_at = NOW(), decision_note = NULLIF($4, ''), updated_at = NOW()
+		WHERE id = $1 AND status = $5 AND expires_at >= NOW()
+		RETURNING `+changeRequestColumns, id, status, decidedBy, note, ChangePending))
+}
+
+// ExpireChangeRequests moves pending change requests past their expiry to expired and
+// returns them
+func ExpireChangeRequests(db *sql.DB) ([]ChangeRequest, error) {
+	rows, err := db.Query(`
+		UPDATE change_requests SET status = $1, updated_at = NOW()
+		WHERE status = $2 AND expires_at < NOW()
+		RETURNING `+changeRequestColumns, ChangeExpired, ChangePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expired := []ChangeRequest{}
+	for rows.Next() {
+		cr, err := scanChangeRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, *cr)
+	}
+	return expired, rows.Err()
+}
+
+// ClaimApprovedChangeRequest marks the oldest approved change request executing and returns
+// it, or sql.ErrNoRows if none is waiting. Concurrent workers never claim the same request.
+func ClaimApprovedChangeRequest(db *sql.DB) (*ChangeRequest, error) {
+	return scanChangeRequest(db.QueryRow(`
+		UPDATE change_requests SET status = $1, updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM change_requests
+			WHERE status = $2
+			ORDER BY decided_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+changeRequestColumns, ChangeExecuting, ChangeApproved))
+}
+
+// ListStaleChangeRequests returns the change requests claimed for execution before
+// claimedBefore that never recorded an outcome
+func ListStaleChangeRequests(db *sql.DB, claimedBefore time.Time) ([]ChangeRequest, error) {
+	rows, err := db.Query(`
+		SELECT `+changeRequestColumns+` FROM change_requests
+		WHERE status = $1 AND updated_at < $2
+		ORDER BY id
+	`, ChangeExecuting, claimedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stale := []ChangeRequest{}
+	for rows.Next() {
+		cr, err := scanChangeRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, *cr)
+	}
+	return stale, rows.Err()
+}
+
+// CompleteChangeRequest records the outcome of an executing change request. It returns
+// sql.ErrNoRows if the request is no longer executing.
+func CompleteChangeRequest(db *sql.DB, id int, status string, results json.RawMessage) error {
+	result, err := db.Exec(`
+		UPDATE change_requests
+		SET status = $2, results = $3, executed_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = $4
+	`, id, status, []byte(results), ChangeExecuting)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListApprovalRules returns every approval rule
+func ListApprovalRules(db *sql.DB) ([]ApprovalRule, error) {
+	rows, err := db.Query(`
+		SELECT id, action, department, approver_role, created_at
+		FROM change_approval_rules
+		ORDER BY action, department, approver_role
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []ApprovalRule{}
+	for rows.Next() {
+		var r ApprovalRule
+		if err := rows.Scan(&r.ID, &r.Action, &r.Department, &r.ApproverRole, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// CreateApprovalRule adds an approval rule, returning sql.ErrNoRows if it already exists
+func CreateApprovalRule(db *sql.DB, rule *ApprovalRule) error {
+	return db.QueryRow(`
+		INSERT INTO change_approval_rules (action, department, approver_role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		RETURNING id, created_at
+	`, rule.Action, rule.Department, rule.ApproverRole).Scan(&rule.ID, &rule.CreatedAt)
+}
+
+// DeleteApprovalRule removes an approval rule, returning sql.ErrNoRows if it doesn't exist
+func DeleteApprovalRule(db *sql.DB, id int) error {
+	result, err := db.Exec(`DELETE FROM change_approval_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListUserEmailsByRole returns the email addresses of users with any of the roles
+func ListUserEmailsByRole(db *sql.DB, roles []string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT email FROM users
+		WHERE role = ANY($1) AND email IS NOT NULL AND email != ''
+		ORDER BY email
+	`, pq.Array(roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []string{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// ListWorkspaceDepartments returns the AD department of each workspace, blank when unknown
+func ListWorkspaceDepartments(db *sql.DB, workspaceIDs []string) (map[string]string, error) {
+	rows, err := db.Query(`
+		SELECT workspace_id, COALESCE(ad_department, '')
+		FROM workspaces
+		WHERE workspace_id = ANY($1)
+	`, pq.Array(workspaceIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	departments := make(map[string]string)
+	for rows.Next() {
+		var id, department string
+		if err := rows.Scan(&id, &department); err != nil {
+			return nil, err
+		}
+		departments[id] = department
+	}
+	return departments, rows.Err()
+}
@@ -3,7 +3,10 @@ package models
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // CloudTrailEvent represents an AWS CloudTrail event
@@ -19,15 +22,50 @@ type CloudTrailEvent struct {
 	RequestParameters  json.RawMessage `json:"request_parameters" db:"request_parameters"`
 	ResponseElements   json.RawMessage `json:"response_elements" db:"response_elements"`
 	EventRegion        string          `json:"event_region" db:"event_region"`
+	SourceIPAddress    string          `json:"source_ip_address" db:"source_ip_address"`
+	UserAgent          string          `json:"user_agent" db:"user_agent"`
+	ErrorCode          string          `json:"error_code" db:"error_code"`
+	ErrorMessage       string          `json:"error_message" db:"error_message"`
+	PrincipalARN       string          `json:"principal_arn" db:"principal_arn"`
+	PrincipalType      string          `json:"principal_type" db:"principal_type"`
+	ReadOnly           *bool           `json:"read_only" db:"read_only"`
+	WorkspaceIDs       []string        `json:"workspace_ids" db:"workspace_ids"` // Every workspace a batch call touched
 	CreatedAt          time.Time       `json:"created_at" db:"created_at"`
 }
 
+// cloudTrailEventColumns selects an event; nullable text columns are coalesced
+const cloudTrailEventColumns = `
+	id, event_id, COALESCE(event_name, ''), event_time, COALESCE(event_source, ''),
+	COALESCE(username, ''), COALESCE(user_identity, '{}'), COALESCE(workspace_id, ''),
+	COALESCE(request_parameters, '{}'), COALESCE(response_elements, '{}'),
+	COALESCE(event_region, ''), COALESCE(source_ip_address, ''), COALESCE(user_agent, ''),
+	COALESCE(error_code, ''), COALESCE(error_message, ''), COALESCE(principal_arn, ''),
+	COALESCE(principal_type, ''), read_only, COALESCE(workspace_ids, '{}'), created_at`
+
+func scanCloudTrailEvent(row rowScanner) (*CloudTrailEvent, error) {
+	var evt CloudTrailEvent
+	err := row.Scan(
+		&evt.ID, &evt.EventID, &evt.EventName, &evt.EventTime, &evt.EventSource,
+		&evt.Username, &evt.UserIdentity, &evt.WorkspaceID, &evt.RequestParameters,
+		&evt.ResponseElements, &evt.EventRegion, &evt.SourceIPAddress, &evt.UserAgent,
+		&evt.ErrorCode, &evt.ErrorMessage, &evt.PrincipalARN, &evt.PrincipalType,
+		&evt.ReadOnly, pq.Array(&evt.WorkspaceIDs), &evt.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
+
+// GetCloudTrailEvent retrieves an event by its row ID
+func GetCloudTrailEvent(db *sql.DB, id int) (*CloudTrailEvent, error) {
+	query := `SELECT ` + cloudTrailEventColumns + ` FROM cloudtrail_events WHERE id = $1`
+	return scanCloudTrailEvent(db.QueryRow(query, id))
+}
+
 // ListCloudTrailEvents retrieves CloudTrail events with filtering
 func ListCloudTrailEvents(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]CloudTrailEvent, int, error) {
-	baseQuery := `
-		SELECT id, event_id, event_name, event_time, event_source, username,
-		       user_identity, workspace_id, request_parameters, response_elements,
-		       event_region, created_at
+	baseQuery := `SELECT ` + cloudTrailEventColumns + `
 		FROM cloudtrail_events
 		WHERE 1=1
 	`
@@ -38,12 +76,66 @@ func ListCloudTrailEvents(db *sql.DB, filters map[string]interface{}, limit, off
 
 	// Apply filters
 	if workspaceID, ok := filters["workspace_id"].(string); ok && workspaceID != "" {
-		baseQuery += " AND workspace_id = $" + string(rune(argPos+'0'))
-		countQuery += " AND workspace_id = $" + string(rune(argPos+'0'))
+		// Batch calls list every workspace they touched
+		filterClause := fmt.Sprintf(" AND (workspace_id = $%d OR $%d = ANY(workspace_ids))", argPos, argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
 		args = append(args, workspaceID)
 		argPos++
 	}
 
+	exactFilters := []struct{ filter, column string }{
+		{"event_name", "event_name"},
+		{"username", "username"},
+		{"region", "event_region"},
+		{"source_ip_address", "source_ip_address"},
+		{"principal_arn", "principal_arn"},
+		{"principal_type", "principal_type"},
+		{"error_code", "error_code"},
+	}
+	for _, f := range exactFilters {
+		if value, ok := filters[f.filter].(string); ok && value != "" {
+			filterClause := fmt.Sprintf(" AND %s = $%d", f.column, argPos)
+			baseQuery += filterClause
+			countQuery += filterClause
+			args = append(args, value)
+			argPos++
+		}
+	}
+
+	if startTime, ok := filters["start_time"].(time.Time); ok {
+		filterClause := fmt.Sprintf(" AND event_time >= $%d", argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, startTime)
+		argPos++
+	}
+
+	if endTime, ok := filters["end_time"].(time.Time); ok {
+		filterClause := fmt.Sprintf(" AND event_time <= $%d", argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, endTime)
+		argPos++
+	}
+
+	if readOnly, ok := filters["read_only"].(bool); ok {
+		filterClause := fmt.Sprintf(" AND read_only = $%d", argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, readOnly)
+		argPos++
+	}
+
+	if hasError, ok := filters["has_error"].(bool); ok {
+		filterClause := " AND COALESCE(error_code, '') = ''"
+		if hasError {
+			filterClause = " AND COALESCE(error_code, '') <> ''"
+		}
+		baseQuery += filterClause
+		countQuery += filterClause
+	}
+
 	// Get total count
 	var total int
 	err := db.QueryRow(countQuery, args...).Scan(&total)
@@ -52,7 +144,7 @@ func ListCloudTrailEvents(db *sql.DB, filters map[string]interface{}, limit, off
 	}
 
 	// Add pagination
-	baseQuery += " ORDER BY event_time DESC LIMIT $" + string(rune(argPos+'0')) + " OFFSET $" + string(rune(argPos+1+'0'))
+	baseQuery += fmt.Sprintf(" ORDER BY event_time DESC LIMIT $%d OFFSET $%d", argPos, argPos+1)
 	args = append(args, limit, offset)
 
 	rows, err := db.Query(baseQuery, args...)
@@ -63,36 +155,48 @@ func ListCloudTrailEvents(db *sql.DB, filters map[string]interface{}, limit, off
 
 	events := []CloudTrailEvent{}
 	for rows.Next() {
-		var evt CloudTrailEvent
-		err := rows.Scan(
-			&evt.ID, &evt.EventID, &evt.EventName, &evt.EventTime, &evt.EventSource,
-			&evt.Username, &evt.UserIdentity, &evt.WorkspaceID, &evt.RequestParameters,
-			&evt.ResponseElements, &evt.EventRegion, &evt.CreatedAt,
-		)
+		evt, err := scanCloudTrailEvent(rows)
 		if err != nil {
 			return nil, 0, err
 		}
-		events = append(events, evt)
+		events = append(events, *evt)
 	}
 
 	return events, total, nil
 }
 
-// InsertCloudTrailEvent inserts a new CloudTrail event
+// InsertCloudTrailEvent inserts a CloudTrail event, refreshing the parsed fields of one already stored
 func InsertCloudTrailEvent(db *sql.DB, event *CloudTrailEvent) error {
 	query := `
 		INSERT INTO cloudtrail_events (
 			event_id, event_name, event_time, event_source, username,
 			user_identity, workspace_id, request_parameters, response_elements,
-			event_region
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		ON CONFLICT (event_id) DO NOTHING
+			event_region, source_ip_address, user_agent, error_code, error_message,
+			principal_arn, principal_type, read_only, workspace_ids
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		ON CONFLICT (event_id) DO UPDATE SET
+			username = EXCLUDED.username,
+			user_identity = EXCLUDED.user_identity,
+			workspace_id = EXCLUDED.workspace_id,
+			request_parameters = EXCLUDED.request_parameters,
+			response_elements = EXCLUDED.response_elements,
+			event_region = EXCLUDED.event_region,
+			source_ip_address = EXCLUDED.source_ip_address,
+			user_agent = EXCLUDED.user_agent,
+			error_code = EXCLUDED.error_code,
+			error_message = EXCLUDED.error_message,
+			principal_arn = EXCLUDED.principal_arn,
+			principal_type = EXCLUDED.principal_type,
+			read_only = EXCLUDED.read_only,
+			workspace_ids = EXCLUDED.workspace_ids
 	`
 
 	_, err := db.Exec(query,
 		event.EventID, event.EventName, event.EventTime, event.EventSource,
 		event.Username, event.UserIdentity, event.WorkspaceID, event.RequestParameters,
-		event.ResponseElements, event.EventRegion,
+		event.ResponseElements, event.EventRegion, event.SourceIPAddress, event.UserAgent,
+		event.ErrorCode, event.ErrorMessage, event.PrincipalARN, event.PrincipalType,
+		event.ReadOnly, pq.Array(event.WorkspaceIDs),
 	)
 
 	return err
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetCloudTrailCursor returns the time of the latest event ingested for an account and
+// region, or nil when nothing has been ingested yet
+func GetCloudTrailCursor(db *sql.DB, accountID int, region string) (*time.Time, error) {
+	var lastEventTime *time.Time
+	err := db.QueryRow(`
+		SELECT last_event_time FROM cloudtrail_cursors
+		WHERE aws_account_id = $1 AND region = $2
+	`, accountID, region).Scan(&lastEventTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return lastEventTime, err
+}
+
+// SaveCloudTrailCursor records a completed ingestion run for an account and region
+func SaveCloudTrailCursor(db *sql.DB, accountID int, region string, lastEventTime *time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO cloudtrail_cursors (aws_account_id, region, last_event_time, last_run_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (aws_account_id, region) DO UPDATE SET
+			last_event_time = EXCLUDED.last_event_time,
+			last_run_at = CURRENT_TIMESTAMP
+	`, accountID, region, lastEventTime)
+	return err
+}
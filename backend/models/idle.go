@@ -0,0 +1,188 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Directory status of a workspace's user, recorded by the AD sync
+const (
+	ADStatusActive   = "active"
+	ADStatusDisabled = "disabled"
+	ADStatusNotFound = "not_found"
+)
+
+// Reclamation states of an idle workspace
+const (
+	ReclamationWarned    = "warned"    // Owner and manager notified
+	ReclamationApproved  = "approved"  // Approved for reclamation by an admin
+	ReclamationReclaimed = "reclaimed" // Terminated after approval
+	ReclamationExempt    = "exempt"    // Kept on purpose, until exempt_until if set
+)
+
+// Idle classifications
+const (
+	IdleClassIdle      = "idle"      // Not used recently
+	IdleClassAbandoned = "abandoned" // The owner's directory account is disabled or gone
+)
+
+// Reclamation tracks what is being done about an idle workspace
+type Reclamation struct {
+	WorkspaceID    string     `json:"workspace_id" db:"workspace_id"`
+	State          string     `json:"state" db:"state"`
+	Classification string     `json:"classification" db:"classification"`
+	Reasons        string     `json:"reasons" db:"reasons"`
+	WarnedAt       *time.Time `json:"warned_at" db:"warned_at"`
+	Notified       []string   `json:"notified" db:"notified"` // Addresses the warning was emailed to
+	ExemptUntil    *time.Time `json:"exempt_until" db:"exempt_until"`
+	Note           string     `json:"note" db:"note"`
+	UpdatedBy      string     `json:"updated_by" db:"updated_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// IdleCandidate is an active workspace with the activity idle detection is based on
+type IdleCandidate struct {
+	WorkspaceID    string
+	UserName       string
+	ADFullName     string
+	ADEmail        string
+	ADManager      string
+	ADManagerEmail string
+	ADStatus       string
+	ADDepartment   string
+	AWSAccountID   *int
+	Region         string
+	RunningMode    string
+	State          string
+	CreatedAt      *time.Time
+	LastConnection *time.Time
+	ConnectedHours float64 // Connected hours since the start of the window
+	MeasuredDays   int     // Days in the window whose connections were measured, not assumed
+	Reclamation    *Reclamation
+}
+
+// reclamationColumns selects a workspace_reclamations row (aliased r). Every column is
+// coalesced, so a LEFT JOIN without a reclamation scans with an empty state.
+const reclamationColumns = `
+	COALESCE(r.workspace_id, ''), COALESCE(r.state, ''), COALESCE(r.classification, ''),
+	COALESCE(r.reasons, ''), r.warned_at, COALESCE(r.notified, '{}'), r.exempt_until,
+	COALESCE(r.note, ''), COALESCE(r.updated_by, ''),
+	COALESCE(r.created_at, CURRENT_TIMESTAMP), COALESCE(r.updated_at, CURRENT_TIMESTAMP)`
+
+// reclamationFields are the scan destinations for reclamationColumns
+func reclamationFields(r *Reclamation) []interface{} {
+	return []interface{}{
+		&r.WorkspaceID, &r.State, &r.Classification, &r.Reasons, &r.WarnedAt, pq.Array(&r.Notified),
+		&r.ExemptUntil, &r.Note, &r.UpdatedBy, &r.CreatedAt, &r.UpdatedAt,
+	}
+}
+
+// ListIdleCandidates returns every active workspace with its connected hours since since and
+// its reclamation, if any
+func ListIdleCandidates(db *sql.DB, since time.Time) ([]IdleCandidate, error) {
+	rows, err := db.Query(`
+		WITH usage AS (
+			SELECT workspace_id, SUM(connected_hours) AS connected_hours,
+			       COUNT(*) FILTER (WHERE sources LIKE '%cloudwatch%' OR sources LIKE '%connection_status%') AS measured_days
+			FROM workspace_daily_usage
+			WHERE usage_date >= $1::date
+			GROUP BY workspace_id
+		)
+		SELECT w.workspace_id, COALESCE(w.user_name, ''), COALESCE(w.ad_full_name, ''), COALESCE(w.ad_email, ''),
+		       COALESCE(w.ad_manager, ''), COALESCE(w.ad_manager_email, ''), COALESCE(w.ad_status, ''),
+		       COALESCE(w.ad_department, ''), w.aws_account_id, COALESCE(w.region, ''),
+		       COALESCE(w.running_mode, ''), COALESCE(w.state, ''), w.created_at,
+		       w.last_known_user_connection_timestamp,
+		       COALESCE(u.connected_hours, 0), COALESCE(u.measured_days, 0),
+		       `+reclamationColumns+`
+		FROM workspaces w
+		LEFT JOIN usage u ON u.workspace_id = w.workspace_id
+		LEFT JOIN workspace_reclamations r ON r.workspace_id = w.workspace_id
+		WHERE w.removed_at IS NULL AND w.terminated_at IS NULL
+		  AND COALESCE(w.state, '') NOT IN ('TERMINATING', 'TERMINATED')
+		ORDER BY w.workspace_id
+	`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []IdleCandidate{}
+	for rows.Next() {
+		var c IdleCandidate
+		var r Reclamation
+		fields := []interface{}{
+			&c.WorkspaceID, &c.UserName, &c.ADFullName, &c.ADEmail, &c.ADManager, &c.ADManagerEmail,
+			&c.ADStatus, &c.ADDepartment, &c.AWSAccountID, &c.Region, &c.RunningMode, &c.State, &c.CreatedAt,
+			&c.LastConnection, &c.ConnectedHours, &c.MeasuredDays,
+		}
+		if err := rows.Scan(append(fields, reclamationFields(&r)...)...); err != nil {
+			return nil, err
+		}
+		if r.State != "" {
+			c.Reclamation = &r
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// GetReclamation returns a workspace's reclamation, or sql.ErrNoRows if it has none
+func GetReclamation(db *sql.DB, workspaceID string) (*Reclamation, error) {
+	var r Reclamation
+	err := db.QueryRow(`
+		SELECT `+reclamationColumns+`
+		FROM workspace_reclamations r
+		WHERE r.workspace_id = $1
+	`, workspaceID).Scan(reclamationFields(&r)...)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// UpsertReclamation creates or replaces a workspace's reclamation
+func UpsertReclamation(db *sql.DB, r *Reclamation) error {
+	return db.QueryRow(`
+		INSERT INTO workspace_reclamations (workspace_id, state, classification, reasons, warned_at, notified,
+		                                    exempt_until, note, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, CURRENT_TIMESTAMP)
+		ON CONFLICT (workspace_id) DO UPDATE SET
+			state = EXCLUDED.state,
+			classification = EXCLUDED.classification,
+			reasons = EXCLUDED.reasons,
+			warned_at = EXCLUDED.warned_at,
+			notified = EXCLUDED.notified,
+			exempt_until = EXCLUDED.exempt_until,
+			note = EXCLUDED.note,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING created_at, updated_at
+	`, r.WorkspaceID, r.State, r.Classification, r.Reasons, r.WarnedAt, pq.Array(r.Notified),
+		r.ExemptUntil, r.Note, r.UpdatedBy).Scan(&r.CreatedAt, &r.UpdatedAt)
+}
+
+// DeleteReclamation clears a workspace's reclamation
+func DeleteReclamation(db *sql.DB, workspaceID string) error {
+	_, err := db.Exec(`DELETE FROM workspace_reclamations WHERE workspace_id = $1`, workspaceID)
+	return err
+}
+
+// MarkReclaimedWorkspaces moves approved reclamations of workspaces that have since been
+// terminated or removed to reclaimed
+func MarkReclaimedWorkspaces(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`
+		UPDATE workspace_reclamations r
+		SET state = $1, updated_at = CURRENT_TIMESTAMP
+		FROM workspaces w
+		WHERE w.workspace_id = r.workspace_id AND r.state = $2
+		  AND (w.terminated_at IS NOT NULL OR w.removed_at IS NOT NULL OR w.state = 'TERMINATED')
+	`, ReclamationReclaimed, ReclamationApproved)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
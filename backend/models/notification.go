@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -42,6 +44,15 @@ const (
 	EventWorkspaceStateChange = "workspace_state_change"
 	EventSyncCompleted       = "sync_completed"
 	EventSyncFailed          = "sync_failed"
+	EventWorkspaceIdle       = "workspace_idle"
+	EventChangeRequested     = "change_requested"
+	EventChangeDecided       = "change_decided"
+	EventChangeExecuted      = "change_executed"
+	EventChangeExpired       = "change_expired"
+	EventWorkspaceRequested  = "workspace_requested"
+	EventWorkspaceRequestDecided = "workspace_request_decided"
+	EventWorkspaceRequestExpired = "workspace_request_expired"
+	EventWorkspaceProvisioned = "workspace_provisioned"
 )
 
 // Severity constants
@@ -73,7 +84,8 @@ func CreateNotification(db *sql.DB, notification *Notification) error {
 	return err
 }
 
-// ListNotifications retrieves notifications with filtering
+// ListNotifications retrieves notifications with filtering. The user_id filter leaves out the
+// event types that user has opted out of.
 func ListNotifications(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]Notification, int, error) {
 	baseQuery := `
 		SELECT id, event_type, workspace_id, workspace_user, title, message, severity, read, created_at, metadata
@@ -118,6 +130,14 @@ func ListNotifications(db *sql.DB, filters map[string]interface{}, limit, offset
 		argPos++
 	}
 
+	if userID, ok := filters["user_id"].(int); ok && userID > 0 {
+		filterClause := preferenceFilter(argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, userID)
+		argPos++
+	}
+
 	// Get total count
 	var total int
 	err := db.QueryRow(countQuery, args...).Scan(&total)
@@ -170,11 +190,12 @@ func DeleteNotification(db *sql.DB, id int) error {
 	return err
 }
 
-// GetUnreadCount gets count of unread notifications
-func GetUnreadCount(db *sql.DB) (int, error) {
-	query := "SELECT COUNT(*) FROM notifications WHERE read = false"
+// GetUnreadCount gets count of unread notifications, leaving out the event types the user
+// has opted out of
+func GetUnreadCount(db *sql.DB, userID int) (int, error) {
+	query := "SELECT COUNT(*) FROM notifications WHERE read = false" + preferenceFilter(1)
 	var count int
-	err := db.QueryRow(query).Scan(&count)
+	err := db.QueryRow(query, userID).Scan(&count)
 	return count, err
 }
 
@@ -249,3 +270,62 @@ func DeleteOldNotifications(db *sql.DB, olderThan time.Duration) (int64, error)
 
 	return result.RowsAffected()
 }
+
+// preferenceColumns maps workspace event types to the notification_preferences flag that opts into them
+var preferenceColumns = map[string]string{
+	EventWorkspaceCreated:     "notify_on_create",
+	EventWorkspaceTerminated:  "notify_on_terminate",
+	EventWorkspaceModified:    "notify_on_modify",
+	EventWorkspaceStateChange: "notify_on_state_change",
+}
+
+// preferenceFilter returns a WHERE clause hiding notifications of the event types that the
+// user whose ID is parameter $argPos has turned off. Users without saved preferences see
+// everything.
+func preferenceFilter(argPos int) string {
+	eventTypes := make([]string, 0, len(preferenceColumns))
+	for eventType := range preferenceColumns {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+
+	conditions := make([]string, len(eventTypes))
+	for i, eventType := range eventTypes {
+		conditions[i] = fmt.Sprintf("(event_type = '%s' AND NOT p.%s)", eventType, preferenceColumns[eventType])
+	}
+	return fmt.Sprintf(` AND NOT EXISTS (
+		SELECT 1 FROM notification_preferences p
+		WHERE p.user_id = $%d AND (%s)
+	)`, argPos, strings.Join(conditions, " OR "))
+}
+
+// ListNotificationEmailRecipients returns the admin emails that should be emailed about an event.
+// Admins without saved preferences get the defaults, which enable everything.
+func ListNotificationEmailRecipients(db *sql.DB, eventType string) ([]string, error) {
+	query := `
+		SELECT u.email
+		FROM users u
+		LEFT JOIN notification_preferences p ON p.user_id = u.id
+		WHERE u.role = 'ADMIN' AND u.email IS NOT NULL AND u.email != ''
+		  AND COALESCE(p.email_enabled, true)
+	`
+	if column, ok := preferenceColumns[eventType]; ok {
+		query += fmt.Sprintf(" AND COALESCE(p.%s, true)", column)
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []string{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, email)
+	}
+	return recipients, rows.Err()
+}
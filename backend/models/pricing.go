@@ -0,0 +1,75 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// WorkspacePrice is a row of the WorkSpaces price table. Blank or zero key fields match any
+// workspace; the most specific matching row applies.
+type WorkspacePrice struct {
+	ID                int       `json:"id" db:"id"`
+	Region            string    `json:"region" db:"region"`
+	BundleID          string    `json:"bundle_id" db:"bundle_id"`
+	ComputeType       string    `json:"compute_type" db:"compute_type"`
+	RootVolumeSizeGib int       `json:"root_volume_size_gib" db:"root_volume_size_gib"`
+	UserVolumeSizeGib int       `json:"user_volume_size_gib" db:"user_volume_size_gib"`
+	AlwaysOnMonthly   float64   `json:"always_on_monthly" db:"always_on_monthly"` // Flat monthly price when AlwaysOn
+	AutoStopMonthly   float64   `json:"auto_stop_monthly" db:"auto_stop_monthly"` // Monthly base fee when AutoStop
+	AutoStopHourly    float64   `json:"auto_stop_hourly" db:"auto_stop_hourly"`   // Price per running hour when AutoStop
+	UpdatedAt         time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ListWorkspacePrices returns the whole price table
+func ListWorkspacePrices(db *sql.DB) ([]WorkspacePrice, error) {
+	rows, err := db.Query(`
+		SELECT id, region, bundle_id, compute_type, root_volume_size_gib, user_volume_size_gib,
+		       always_on_monthly, auto_stop_monthly, auto_stop_hourly, updated_at
+		FROM workspace_prices
+		ORDER BY region, bundle_id, compute_type, root_volume_size_gib, user_volume_size_gib
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []WorkspacePrice{}
+	for rows.Next() {
+		var p WorkspacePrice
+		err := rows.Scan(&p.ID, &p.Region, &p.BundleID, &p.ComputeType, &p.RootVolumeSizeGib, &p.UserVolumeSizeGib,
+			&p.AlwaysOnMonthly, &p.AutoStopMonthly, &p.AutoStopHourly, &p.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, p)
+	}
+	return prices, rows.Err()
+}
+
+// ReplaceWorkspacePrices swaps the whole price table for prices
+func ReplaceWorkspacePrices(db *sql.DB, prices []WorkspacePrice) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM workspace_prices`); err != nil {
+		return err
+	}
+
+	for _, p := range prices {
+		_, err := tx.Exec(`
+			INSERT INTO workspace_prices (region, bundle_id, compute_type, root_volume_size_gib, user_volume_size_gib,
+			                              always_on_monthly, auto_stop_monthly, auto_stop_hourly, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)
+		`, p.Region, p.BundleID, p.ComputeType, p.RootVolumeSizeGib, p.UserVolumeSizeGib,
+			p.AlwaysOnMonthly, p.AutoStopMonthly, p.AutoStopHourly)
+		if err != nil {
+			return fmt.Errorf("price for %s %s %s: %w", p.Region, p.BundleID, p.ComputeType, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RecommendationCandidate is an active workspace with the usage, metrics and costs its
+// rightsizing recommendation is based on. Hours and costs are averages per measured month.
+type RecommendationCandidate struct {
+	WorkspaceID            string
+	UserName               string
+	AWSAccountID           *int
+	Region                 string
+	BundleID               string
+	RunningMode            string
+	ComputeType            string
+	RootVolumeSizeGib      int
+	UserVolumeSizeGib      int
+	AutoStopTimeoutMinutes int
+	MonthsMeasured         int     // Months of workspace_usage in the window
+	RunningHours           float64 // Average running hours per month
+	ConnectedHours         float64 // Average connected hours per month
+	ConnectedDays          float64 // Average days per month with a connection
+	ConnectionDays         int     // Days whose connections were measured, not assumed
+	CPUP95                 *float64
+	MemoryP95              *float64
+	MetricDays             int      // Days with both CPU and memory metrics
+	ActualMonthlyCost      *float64 // From Cost and Usage Reports, unblended
+}
+
+// ListRecommendationCandidates returns active workspaces matching filters (aws_account_id,
+// region, running_mode, workspace_id, user_name) with their usage in the months from
+// monthFrom up to but excluding monthTo (YYYY-MM), and their hourly CPU and memory metrics
+// since metricsSince
+func ListRecommendationCandidates(db *sql.DB, filters map[string]interface{}, monthFrom, monthTo string, metricsSince time.Time) ([]RecommendationCandidate, error) {
+	query := `
+		WITH usage AS (
+			SELECT workspace_id, COUNT(*) AS months,
+			       AVG(usage_hours) AS running_hours, AVG(COALESCE(connected_hours, 0)) AS connected_hours
+			FROM workspace_usage
+			WHERE month >= $1 AND month < $2
+			GROUP BY workspace_id
+		), days AS (
+			SELECT workspace_id,
+			       COUNT(*) FILTER (WHERE connected_hours > 0) AS connected_days,
+			       COUNT(*) FILTER (WHERE sources LIKE '%cloudwatch%' OR sources LIKE '%connection_status%') AS measured_days
+			FROM workspace_daily_usage
+			WHERE usage_date >= to_date($1, 'YYYY-MM') AND usage_date < to_date($2, 'YYYY-MM')
+			GROUP BY workspace_id
+		), metrics AS (
+			SELECT workspace_id,
+			       percentile_cont(0.95) WITHIN GROUP (ORDER BY value) FILTER (WHERE metric_name = 'CPUUsage') AS cpu_p95,
+			       percentile_cont(0.95) WITHIN GROUP (ORDER BY value) FILTER (WHERE metric_name = 'MemoryUsage') AS memory_p95,
+			       LEAST(
+			           COUNT(DISTINCT date_trunc('day', period_start)) FILTER (WHERE metric_name = 'CPUUsage'),
+			           COUNT(DISTINCT date_trunc('day', period_start)) FILTER (WHERE metric_name = 'MemoryUsage')
+			       ) AS metric_days
+			FROM workspace_metrics
+			WHERE resolution = $3 AND metric_name IN ('CPUUsage', 'MemoryUsage') AND period_start >= $4
+			GROUP BY workspace_id
+		), costs AS (
+			SELECT workspace_id, SUM(amount) AS amount
+			FROM billing_data
+			WHERE source = $5 AND cost_type = $6 AND workspace_id <> ''
+			  AND start_date >= to_date($1, 'YYYY-MM') AND start_date < to_date($2, 'YYYY-MM')
+			GROUP BY workspace_id
+		)
+		SELECT w.workspace_id, COALESCE(w.user_name, ''), w.aws_account_id, COALESCE(w.region, ''),
+		       COALESCE(w.bundle_id, ''), COALESCE(w.running_mode, ''),
+		       COALESCE(NULLIF(w.compute_type_name, ''), b.compute_type, ''),
+		       COALESCE(w.root_volume_size_gib, 0), COALESCE(w.user_volume_size_gib, 0),
+		       COALESCE(w.auto_stop_timeout_minutes, 0),
+		       COALESCE(u.months, 0), COALESCE(u.running_hours, 0), COALESCE(u.connected_hours, 0),
+		       COALESCE(d.connected_days::float / NULLIF(u.months, 0), 0), COALESCE(d.measured_days, 0),
+		       m.cpu_p95, m.memory_p95, COALESCE(m.metric_days, 0),
+		       c.amount / NULLIF(u.months, 0)
+		FROM workspaces w
+		LEFT JOIN workspace_bundles b ON b.bundle_id = w.bundle_id
+		LEFT JOIN usage u ON u.workspace_id = w.workspace_id
+		LEFT JOIN days d ON d.workspace_id = w.workspace_id
+		LEFT JOIN metrics m ON m.workspace_id = w.workspace_id
+		LEFT JOIN costs c ON c.workspace_id = w.workspace_id
+		WHERE w.removed_at IS NULL AND w.terminated_at IS NULL
+		  AND COALESCE(w.state, '') NOT IN ('TERMINATING', 'TERMINATED')`
+	args := []interface{}{monthFrom, monthTo, MetricResolutionHourly, metricsSince.UTC(), BillingSourceCUR, CostTypeUnblended}
+	argPos := len(args) + 1
+
+	if accountID, ok := filters["aws_account_id"].(int); ok {
+		query += fmt.Sprintf(" AND w.aws_account_id = $%d", argPos)
+		args = append(args, accountID)
+		argPos++
+	}
+
+	for _, column := range []string{"region", "running_mode", "workspace_id"} {
+		if value, ok := filters[column].(string); ok && value != "" {
+			query += fmt.Sprintf(" AND w.%s = $%d", column, argPos)
+			args = append(args, value)
+			argPos++
+		}
+	}
+
+	if userName, ok := filters["user_name"].(string); ok && userName != "" {
+		query += fmt.Sprintf(" AND w.user_name ILIKE $%d", argPos)
+		args = append(args, "%"+userName+"%")
+		argPos++
+	}
+
+	query += " ORDER BY w.workspace_id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []RecommendationCandidate{}
+	for rows.Next() {
+		var c RecommendationCandidate
+		err := rows.Scan(&c.WorkspaceID, &c.UserName, &c.AWSAccountID, &c.Region, &c.BundleID, &c.RunningMode,
+			&c.ComputeType, &c.RootVolumeSizeGib, &c.UserVolumeSizeGib, &c.AutoStopTimeoutMinutes,
+			&c.MonthsMeasured, &c.RunningHours, &c.ConnectedHours, &c.ConnectedDays, &c.ConnectionDays,
+			&c.CPUP95, &c.MemoryP95, &c.MetricDays, &c.ActualMonthlyCost)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"strconv"
 	"time"
 )
 
@@ -51,6 +52,29 @@ func GetSetting(db *sql.DB, key string) (*Setting, error) {
 	return setting, nil
 }
 
+// GetSettingInt returns a positive integer setting, or defaultValue if it is missing or invalid
+func GetSettingInt(db *sql.DB, key string, defaultValue int) int {
+	setting, err := GetSetting(db, key)
+	if err != nil {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(setting.Value)
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// GetSettingString returns a setting, or defaultValue if it is missing or empty
+func GetSettingString(db *sql.DB, key, defaultValue string) string {
+	setting, err := GetSetting(db, key)
+	if err != nil || setting.Value == "" {
+		return defaultValue
+	}
+	return setting.Value
+}
+
 // ListSettings retrieves all settings, optionally filtered by category
 func ListSettings(db *sql.DB, category string) ([]Setting, error) {
 	var rows *sql.Rows
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidGroupBy is returned for group_by values that aren't supported
+var ErrInvalidGroupBy = errors.New("invalid group_by")
+
+// TagFilterPrefix marks query parameters that filter by workspace tag, e.g. tag:CostCenter=1234
+const TagFilterPrefix = "tag:"
+
+// UntaggedGroup labels workspaces without the tag being grouped by
+const UntaggedGroup = "(untagged)"
+
+// workspaceGroupColumns are the workspace columns billing and usage can be grouped by
+var workspaceGroupColumns = map[string]string{
+	"region":       "w.region",
+	"bundle_id":    "w.bundle_id",
+	"running_mode": "w.running_mode",
+	"user_name":    "w.user_name",
+}
+
+// ParseTagFilters collects tag:<key>=<value> query parameters
+func ParseTagFilters(queryParams map[string][]string) map[string]string {
+	tags := make(map[string]string)
+	for param, values := range queryParams {
+		key := strings.TrimPrefix(param, TagFilterPrefix)
+		if key == param || key == "" || len(values) == 0 {
+			continue
+		}
+		tags[key] = values[0]
+	}
+	return tags
+}
+
+// TagFilterClause returns a condition matching workspaces (aliased by column) that carry
+// every tag, and the argument for its placeholder. It uses the GIN index on tags.
+func TagFilterClause(column string, tags map[string]string, argPos int) (string, interface{}) {
+	tagsJSON, _ := json.Marshal(tags)
+	return fmt.Sprintf(" AND %s @> $%d::jsonb", column, argPos), string(tagsJSON)
+}
+
+// WorkspaceGroupExpr returns the SQL expression for a group_by value against workspaces
+// aliased w: a workspace column, or tag:<key> to group by a tag's value
+func WorkspaceGroupExpr(groupBy string, argPos int) (string, []interface{}, error) {
+	if key := strings.TrimPrefix(groupBy, TagFilterPrefix); key != groupBy {
+		if key == "" {
+			return "", nil, fmt.Errorf("%w: tag key is empty", ErrInvalidGroupBy)
+		}
+		return fmt.Sprintf("COALESCE(w.tags->>$%d::text, '%s')", argPos, UntaggedGroup), []interface{}{key}, nil
+	}
+
+	column, ok := workspaceGroupColumns[groupBy]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidGroupBy, groupBy)
+	}
+	return fmt.Sprintf("COALESCE(%s, '')", column), nil, nil
+}
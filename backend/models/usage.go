@@ -9,22 +9,23 @@ import (
 
 // WorkspaceUsage represents monthly usage tracking
 type WorkspaceUsage struct {
-	ID          int       `json:"id" db:"id"`
-	WorkspaceID string    `json:"workspace_id" db:"workspace_id"`
-	Month       string    `json:"month" db:"month"`
-	UsageHours  float64   `json:"usage_hours" db:"usage_hours"`
-	UserName    string    `json:"user_name,omitempty" db:"user_name"`
-	BundleID    string    `json:"bundle_id,omitempty" db:"bundle_id"`
-	RunningMode string    `json:"running_mode,omitempty" db:"running_mode"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID             int       `json:"id" db:"id"`
+	WorkspaceID    string    `json:"workspace_id" db:"workspace_id"`
+	Month          string    `json:"month" db:"month"`
+	UsageHours     float64   `json:"usage_hours" db:"usage_hours"`         // Hours running
+	ConnectedHours float64   `json:"connected_hours" db:"connected_hours"` // Hours a user was connected
+	UserName       string    `json:"user_name,omitempty" db:"user_name"`
+	BundleID       string    `json:"bundle_id,omitempty" db:"bundle_id"`
+	RunningMode    string    `json:"running_mode,omitempty" db:"running_mode"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
 }
 
 // ListWorkspaceUsage retrieves usage data with filtering and pagination
 func ListWorkspaceUsage(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]WorkspaceUsage, int, error) {
 	baseQuery := `
-		SELECT wu.id, wu.workspace_id, wu.month, wu.usage_hours, wu.created_at, wu.updated_at,
-		       w.user_name, w.bundle_id, w.running_mode
+		SELECT wu.id, wu.workspace_id, wu.month, wu.usage_hours, COALESCE(wu.connected_hours, 0),
+		       wu.created_at, wu.updated_at, w.user_name, w.bundle_id, w.running_mode
 		FROM workspace_usage wu
 		LEFT JOIN workspaces w ON wu.workspace_id = w.workspace_id
 		WHERE 1=1
@@ -73,6 +74,14 @@ func ListWorkspaceUsage(db *sql.DB, filters map[string]interface{}, limit, offse
 		argPos++
 	}
 
+	if tags, ok := filters["tags"].(map[string]string); ok && len(tags) > 0 {
+		filterClause, arg := TagFilterClause("w.tags", tags, argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, arg)
+		argPos++
+	}
+
 	// Get total count
 	var total int
 	err := db.QueryRow(countQuery, args...).Scan(&total)
@@ -93,7 +102,7 @@ func ListWorkspaceUsage(db *sql.DB, filters map[string]interface{}, limit, offse
 	usage := []WorkspaceUsage{}
 	for rows.Next() {
 		var u WorkspaceUsage
-		err := rows.Scan(&u.ID, &u.WorkspaceID, &u.Month, &u.UsageHours, &u.CreatedAt, &u.UpdatedAt,
+		err := rows.Scan(&u.ID, &u.WorkspaceID, &u.Month, &u.UsageHours, &u.ConnectedHours, &u.CreatedAt, &u.UpdatedAt,
 			&u.UserName, &u.BundleID, &u.RunningMode)
 		if err != nil {
 			return nil, 0, err
@@ -107,14 +116,14 @@ func ListWorkspaceUsage(db *sql.DB, filters map[string]interface{}, limit, offse
 // GetWorkspaceUsage retrieves usage for a specific workspace and month
 func GetWorkspaceUsage(db *sql.DB, workspaceID, month string) (*WorkspaceUsage, error) {
 	query := `
-		SELECT id, workspace_id, month, usage_hours, created_at, updated_at
+		SELECT id, workspace_id, month, usage_hours, COALESCE(connected_hours, 0), created_at, updated_at
 		FROM workspace_usage
 		WHERE workspace_id = $1 AND month = $2
 	`
 
 	var u WorkspaceUsage
 	err := db.QueryRow(query, workspaceID, month).Scan(
-		&u.ID, &u.WorkspaceID, &u.Month, &u.UsageHours, &u.CreatedAt, &u.UpdatedAt,
+		&u.ID, &u.WorkspaceID, &u.Month, &u.UsageHours, &u.ConnectedHours, &u.CreatedAt, &u.UpdatedAt,
 	)
 
 	if err != nil {
@@ -158,6 +167,7 @@ func GetMonthlyUsageSummary(db *sql.DB, month string) (map[string]interface{}, e
 		SELECT
 			COUNT(*) as workspace_count,
 			COALESCE(SUM(usage_hours), 0) as total_hours,
+			COALESCE(SUM(connected_hours), 0) as connected_hours,
 			COALESCE(AVG(usage_hours), 0) as avg_hours,
 			COALESCE(MAX(usage_hours), 0) as max_hours,
 			COALESCE(MIN(usage_hours), 0) as min_hours
@@ -166,9 +176,9 @@ func GetMonthlyUsageSummary(db *sql.DB, month string) (map[string]interface{}, e
 	`
 
 	var count int
-	var totalHours, avgHours, maxHours, minHours float64
+	var totalHours, connectedHours, avgHours, maxHours, minHours float64
 
-	err := db.QueryRow(query, month).Scan(&count, &totalHours, &avgHours, &maxHours, &minHours)
+	err := db.QueryRow(query, month).Scan(&count, &totalHours, &connectedHours, &avgHours, &maxHours, &minHours)
 	if err != nil {
 		return nil, err
 	}
@@ -176,12 +186,63 @@ func GetMonthlyUsageSummary(db *sql.DB, month string) (map[string]interface{}, e
 	return map[string]interface{}{
 		"workspace_count": count,
 		"total_hours":     totalHours,
+		"connected_hours": connectedHours,
 		"avg_hours":       avgHours,
 		"max_hours":       maxHours,
 		"min_hours":       minHours,
 	}, nil
 }
 
+// GetMonthlyUsageSummaryByGroup aggregates usage for a month per workspace group
+// (see WorkspaceGroupExpr), optionally restricted to workspaces with the given tags
+func GetMonthlyUsageSummaryByGroup(db *sql.DB, month, groupBy string, tags map[string]string) ([]map[string]interface{}, error) {
+	args := []interface{}{month}
+	groupExpr, groupArgs, err := WorkspaceGroupExpr(groupBy, len(args)+1)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, groupArgs...)
+
+	query := `
+		SELECT ` + groupExpr + ` AS group_value,
+			COUNT(*) as workspace_count,
+			COALESCE(SUM(wu.usage_hours), 0) as total_hours,
+			COALESCE(AVG(wu.usage_hours), 0) as avg_hours
+		FROM workspace_usage wu
+		LEFT JOIN workspaces w ON wu.workspace_id = w.workspace_id
+		WHERE wu.month = $1
+	`
+	if len(tags) > 0 {
+		filterClause, arg := TagFilterClause("w.tags", tags, len(args)+1)
+		query += filterClause
+		args = append(args, arg)
+	}
+	query += " GROUP BY 1 ORDER BY total_hours DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []map[string]interface{}{}
+	for rows.Next() {
+		var group string
+		var count int
+		var totalHours, avgHours float64
+		if err := rows.Scan(&group, &count, &totalHours, &avgHours); err != nil {
+			return nil, err
+		}
+		groups = append(groups, map[string]interface{}{
+			"group":           group,
+			"workspace_count": count,
+			"total_hours":     totalHours,
+			"avg_hours":       avgHours,
+		})
+	}
+	return groups, nil
+}
+
 // BuildUsageFilters parses query parameters into filters map
 func BuildUsageFilters(queryParams map[string][]string) map[string]interface{} {
 	filters := make(map[string]interface{})
@@ -202,6 +263,10 @@ func BuildUsageFilters(queryParams map[string][]string) map[string]interface{} {
 		filters["month_to"] = monthTo
 	}
 
+	if tags := ParseTagFilters(queryParams); len(tags) > 0 {
+		filters["tags"] = tags
+	}
+
 	return filters
 }
 
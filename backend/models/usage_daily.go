@@ -0,0 +1,266 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DailyUsage is a workspace's running and connected hours on one UTC day
+type DailyUsage struct {
+	WorkspaceID    string    `json:"workspace_id" db:"workspace_id"`
+	UsageDate      time.Time `json:"usage_date" db:"usage_date"`
+	RunningHours   float64   `json:"running_hours" db:"running_hours"`
+	ConnectedHours float64   `json:"connected_hours" db:"connected_hours"`
+	Sources        string    `json:"sources" db:"sources"` // Signals the hours were derived from, comma-separated
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+	UserName       string    `json:"user_name,omitempty" db:"user_name"`
+}
+
+// UsageWorkspace is a workspace whose usage is computed, with the fields that affect it
+type UsageWorkspace struct {
+	WorkspaceID            string
+	RunningMode            string
+	AutoStopTimeoutMinutes int
+	CreatedAt              *time.Time
+	EndedAt                *time.Time // Terminated or removed
+}
+
+// PowerEvent is a successful CloudTrail call that started or stopped a workspace
+type PowerEvent struct {
+	WorkspaceID string
+	EventName   string
+	EventTime   time.Time
+}
+
+// ConnectionSnapshot is a workspace's connection state at the time of a sync
+type ConnectionSnapshot struct {
+	WorkspaceID     string
+	CapturedAt      time.Time
+	ConnectionState string
+}
+
+// PowerEventNames are the CloudTrail events that start or stop a workspace
+var PowerEventNames = []string{
+	"StartWorkspaces", "StopWorkspaces", "RebootWorkspaces", "RebuildWorkspaces",
+	"RestoreWorkspace", "TerminateWorkspaces",
+}
+
+// ListUsageWorkspaces returns the workspaces of an account and region that existed at
+// some point since since
+func ListUsageWorkspaces(db *sql.DB, accountID int, region string, since time.Time) ([]UsageWorkspace, error) {
+	rows, err := db.Query(`
+		SELECT workspace_id, COALESCE(running_mode, ''), COALESCE(auto_stop_timeout_minutes, 0),
+		       created_at, COALESCE(terminated_at, removed_at)
+		FROM workspaces
+		WHERE aws_account_id = $1 AND region = $2
+		  AND COALESCE(terminated_at, removed_at, 'infinity'::timestamp) >= $3
+		ORDER BY workspace_id
+	`, accountID, region, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []UsageWorkspace{}
+	for rows.Next() {
+		var ws UsageWorkspace
+		if err := rows.Scan(&ws.WorkspaceID, &ws.RunningMode, &ws.AutoStopTimeoutMinutes, &ws.CreatedAt, &ws.EndedAt); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+// ListPowerEvents returns the start and stop events of the given workspaces since since,
+// oldest first
+func ListPowerEvents(db *sql.DB, workspaceIDs []string, since time.Time) ([]PowerEvent, error) {
+	rows, err := db.Query(`
+		SELECT ids.workspace_id, e.event_name, e.event_time
+		FROM cloudtrail_events e
+		CROSS JOIN LATERAL unnest(COALESCE(e.workspace_ids, ARRAY[e.workspace_id]::text[])) AS ids(workspace_id)
+		WHERE e.event_name = ANY($1) AND e.error_code IS NULL
+		  AND e.event_time >= $2 AND ids.workspace_id = ANY($3)
+		ORDER BY e.event_time
+	`, pq.Array(PowerEventNames), since, pq.Array(workspaceIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []PowerEvent{}
+	for rows.Next() {
+		var e PowerEvent
+		if err := rows.Scan(&e.WorkspaceID, &e.EventName, &e.EventTime); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// InsertConnectionSnapshot records a workspace's connection state at capturedAt
+func InsertConnectionSnapshot(db *sql.DB, workspaceID, state string, capturedAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO workspace_connection_snapshots (workspace_id, captured_at, connection_state)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, captured_at) DO UPDATE SET connection_state = EXCLUDED.connection_state
+	`, workspaceID, capturedAt, state)
+	return err
+}
+
+// ListConnectionSnapshots returns the snapshots of the given workspaces since since,
+// oldest first
+func ListConnectionSnapshots(db *sql.DB, workspaceIDs []string, since time.Time) ([]ConnectionSnapshot, error) {
+	rows, err := db.Query(`
+		SELECT workspace_id, captured_at, connection_state
+		FROM workspace_connection_snapshots
+		WHERE workspace_id = ANY($1) AND captured_at >= $2
+		ORDER BY captured_at
+	`, pq.Array(workspaceIDs), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []ConnectionSnapshot{}
+	for rows.Next() {
+		var s ConnectionSnapshot
+		if err := rows.Scan(&s.WorkspaceID, &s.CapturedAt, &s.ConnectionState); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
+}
+
+// PruneConnectionSnapshots deletes snapshots captured before before
+func PruneConnectionSnapshots(db *sql.DB, before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM workspace_connection_snapshots WHERE captured_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ReplaceDailyUsage swaps the daily usage of the given workspaces from since onwards with
+// usage, then recomputes their monthly totals in workspace_usage from the first month touched
+func ReplaceDailyUsage(db *sql.DB, workspaceIDs []string, since time.Time, usage []DailyUsage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM workspace_daily_usage WHERE workspace_id = ANY($1) AND usage_date >= $2
+	`, pq.Array(workspaceIDs), since)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range usage {
+		_, err := tx.Exec(`
+			INSERT INTO workspace_daily_usage (workspace_id, usage_date, running_hours, connected_hours, sources, updated_at)
+			VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+		`, u.WorkspaceID, u.UsageDate, u.RunningHours, u.ConnectedHours, u.Sources)
+		if err != nil {
+			return fmt.Errorf("workspace %s on %s: %w", u.WorkspaceID, u.UsageDate.Format("2006-01-02"), err)
+		}
+	}
+
+	// Months are rebuilt whole, so a window starting mid-month still totals correctly.
+	// Months without daily rows are dropped, replacing estimates from before usage was
+	// measured.
+	_, err = tx.Exec(`
+		DELETE FROM workspace_usage
+		WHERE workspace_id = ANY($1) AND month >= to_char($2::date, 'YYYY-MM')
+	`, pq.Array(workspaceIDs), since)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO workspace_usage (workspace_id, month, usage_hours, connected_hours, updated_at)
+		SELECT workspace_id, to_char(usage_date, 'YYYY-MM'),
+		       SUM(running_hours), SUM(connected_hours), CURRENT_TIMESTAMP
+		FROM workspace_daily_usage
+		WHERE workspace_id = ANY($1) AND usage_date >= date_trunc('month', $2::date)
+		GROUP BY 1, 2
+		ON CONFLICT (workspace_id, month) DO UPDATE SET
+			usage_hours = EXCLUDED.usage_hours,
+			connected_hours = EXCLUDED.connected_hours,
+			updated_at = CURRENT_TIMESTAMP
+	`, pq.Array(workspaceIDs), since)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListDailyUsage retrieves daily usage with filtering and pagination. filters may hold
+// workspace_id, user_name, and start_date/end_date as time.Time.
+func ListDailyUsage(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]DailyUsage, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	argPos := 1
+
+	if workspaceID, ok := filters["workspace_id"].(string); ok && workspaceID != "" {
+		where += fmt.Sprintf(" AND d.workspace_id = $%d", argPos)
+		args = append(args, workspaceID)
+		argPos++
+	}
+
+	if userName, ok := filters["user_name"].(string); ok && userName != "" {
+		where += fmt.Sprintf(" AND w.user_name ILIKE $%d", argPos)
+		args = append(args, "%"+userName+"%")
+		argPos++
+	}
+
+	if startDate, ok := filters["start_date"].(time.Time); ok {
+		where += fmt.Sprintf(" AND d.usage_date >= $%d", argPos)
+		args = append(args, startDate)
+		argPos++
+	}
+
+	if endDate, ok := filters["end_date"].(time.Time); ok {
+		where += fmt.Sprintf(" AND d.usage_date <= $%d", argPos)
+		args = append(args, endDate)
+		argPos++
+	}
+
+	from := " FROM workspace_daily_usage d LEFT JOIN workspaces w ON w.workspace_id = d.workspace_id"
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*)"+from+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT d.workspace_id, d.usage_date, d.running_hours, d.connected_hours, d.sources,
+		d.updated_at, COALESCE(w.user_name, '')` + from + where +
+		fmt.Sprintf(" ORDER BY d.usage_date DESC, d.workspace_id LIMIT $%d OFFSET $%d", argPos, argPos+1)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	usage := []DailyUsage{}
+	for rows.Next() {
+		var u DailyUsage
+		err := rows.Scan(&u.WorkspaceID, &u.UsageDate, &u.RunningHours, &u.ConnectedHours, &u.Sources,
+			&u.UpdatedAt, &u.UserName)
+		if err != nil {
+			return nil, 0, err
+		}
+		usage = append(usage, u)
+	}
+
+	return usage, total, nil
+}
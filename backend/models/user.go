@@ -20,6 +20,18 @@ type User struct {
 	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// User roles
+const (
+	RoleAdmin    = "ADMIN"
+	RoleOperator = "OPERATOR" // Can start, stop and reboot workspaces
+	RoleUser     = "USER"
+)
+
+// ValidRole reports whether role is a known user role
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleOperator || role == RoleUser
+}
+
 // HashPassword generates a bcrypt hash of the password
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -3,51 +3,75 @@ package models
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // Workspace represents an AWS WorkSpace
 type Workspace struct {
-	WorkspaceID                         string          `json:"workspace_id" db:"workspace_id"`
-	UserName                            string          `json:"user_name" db:"user_name"`
-	DisplayName                         string          `json:"user_display_name" db:"display_name"`
-	DirectoryID                         string          `json:"directory_id" db:"directory_id"`
-	IPAddress                           string          `json:"ip_address" db:"ip_address"`
-	State                               string          `json:"state" db:"state"`
-	BundleID                            string          `json:"bundle_id" db:"bundle_id"`
-	SubnetID                            string          `json:"subnet_id" db:"subnet_id"`
-	ComputerName                        string          `json:"computer_name" db:"computer_name"`
-	RunningMode                         string          `json:"running_mode" db:"running_mode"`
-	RootVolumeSizeGib                   int             `json:"root_volume_size_gib" db:"root_volume_size_gib"`
-	UserVolumeSizeGib                   int             `json:"user_volume_size_gib" db:"user_volume_size_gib"`
-	ComputeTypeName                     string          `json:"compute_type" db:"compute_type_name"`
-	CreatedAt                           *time.Time      `json:"created_at" db:"created_at"`
-	TerminatedAt                        *time.Time      `json:"terminated_at" db:"terminated_at"`
-	LastKnownUserConnectionTimestamp    *time.Time      `json:"last_known_user_connection_timestamp" db:"last_known_user_connection_timestamp"`
-	CreatedByUser                       string          `json:"created_by" db:"created_by_user"`
-	TerminatedByUser                    string          `json:"terminated_by" db:"terminated_by_user"`
-	Tags                                json.RawMessage `json:"tags" db:"tags"`
-	UpdatedAt                           time.Time       `json:"updated_at" db:"updated_at"`
+	WorkspaceID                      string          `json:"workspace_id" db:"workspace_id"`
+	UserName                         string          `json:"user_name" db:"user_name"`
+	DisplayName                      string          `json:"user_display_name" db:"display_name"`
+	DirectoryID                      string          `json:"directory_id" db:"directory_id"`
+	IPAddress                        string          `json:"ip_address" db:"ip_address"`
+	State                            string          `json:"state" db:"state"`
+	BundleID                         string          `json:"bundle_id" db:"bundle_id"`
+	SubnetID                         string          `json:"subnet_id" db:"subnet_id"`
+	ComputerName                     string          `json:"computer_name" db:"computer_name"`
+	RunningMode                      string          `json:"running_mode" db:"running_mode"`
+	AutoStopTimeoutMinutes           int             `json:"auto_stop_timeout_minutes" db:"auto_stop_timeout_minutes"`
+	RootVolumeSizeGib                int             `json:"root_volume_size_gib" db:"root_volume_size_gib"`
+	UserVolumeSizeGib                int             `json:"user_volume_size_gib" db:"user_volume_size_gib"`
+	ComputeTypeName                  string          `json:"compute_type" db:"compute_type_name"`
+	CreatedAt                        *time.Time      `json:"created_at" db:"created_at"`
+	TerminatedAt                     *time.Time      `json:"terminated_at" db:"terminated_at"`
+	LastKnownUserConnectionTimestamp *time.Time      `json:"last_known_user_connection_timestamp" db:"last_known_user_connection_timestamp"`
+	CreatedByUser                    string          `json:"created_by" db:"created_by_user"`
+	TerminatedByUser                 string          `json:"terminated_by" db:"terminated_by_user"`
+	Tags                             json.RawMessage `json:"tags" db:"tags"`
+	Region                           string          `json:"region" db:"region"`
+	AWSAccountID                     *int            `json:"aws_account_id" db:"aws_account_id"`
+	RemovedAt                        *time.Time      `json:"removed_at,omitempty" db:"removed_at"`
+	ADFullName                       string          `json:"ad_full_name" db:"ad_full_name"`
+	UpdatedAt                        time.Time       `json:"updated_at" db:"updated_at"`
+
+	// Joined from workspace_bundles and workspace_directories
+	BundleName        string `json:"bundle_name" db:"bundle_name"`
+	BundleComputeType string `json:"bundle_compute_type" db:"bundle_compute_type"`
+	DirectoryName     string `json:"directory_name" db:"directory_name"`
+	RegistrationCode  string `json:"registration_code" db:"registration_code"`
 }
 
-// GetWorkspaceByID retrieves a workspace by ID
-func GetWorkspaceByID(db *sql.DB, workspaceID string) (*Workspace, error) {
+// workspaceColumns selects a workspace row (aliased w) with its bundle (b) and directory (d)
+// details; nullable text columns are coalesced so they scan into plain strings
+const workspaceColumns = `
+	w.workspace_id, COALESCE(w.user_name, ''), COALESCE(w.display_name, ''), COALESCE(w.directory_id, ''),
+	COALESCE(w.ip_address, ''), COALESCE(w.state, ''), COALESCE(w.bundle_id, ''), COALESCE(w.subnet_id, ''),
+	COALESCE(w.computer_name, ''), COALESCE(w.running_mode, ''), COALESCE(w.auto_stop_timeout_minutes, 0),
+	COALESCE(w.root_volume_size_gib, 0), COALESCE(w.user_volume_size_gib, 0), COALESCE(w.compute_type_name, ''),
+	w.created_at, w.terminated_at, w.last_known_user_connection_timestamp,
+	COALESCE(w.created_by_user, ''), COALESCE(w.terminated_by_user, ''), COALESCE(w.tags, '{}'),
+	COALESCE(w.region, ''), w.aws_account_id, w.removed_at, COALESCE(w.ad_full_name, ''), w.updated_at,
+	COALESCE(b.name, ''), COALESCE(b.compute_type, ''),
+	COALESCE(NULLIF(d.directory_name, ''), d.alias, ''), COALESCE(d.registration_code, '')`
+
+// workspaceTables joins workspaces to the bundle and directory inventory
+const workspaceTables = `
+	workspaces w
+	LEFT JOIN workspace_bundles b ON b.bundle_id = w.bundle_id
+	LEFT JOIN workspace_directories d ON d.directory_id = w.directory_id`
+
+func scanWorkspace(row rowScanner) (*Workspace, error) {
 	var ws Workspace
-	query := `
-		SELECT workspace_id, user_name, display_name, directory_id, ip_address,
-		       state, bundle_id, subnet_id, computer_name, running_mode,
-		       root_volume_size_gib, user_volume_size_gib, compute_type_name,
-		       created_at, terminated_at, last_known_user_connection_timestamp,
-		       created_by_user, terminated_by_user, tags, updated_at
-		FROM workspaces
-		WHERE workspace_id = $1
-	`
-	err := db.QueryRow(query, workspaceID).Scan(
+	err := row.Scan(
 		&ws.WorkspaceID, &ws.UserName, &ws.DisplayName, &ws.DirectoryID, &ws.IPAddress,
-		&ws.State, &ws.BundleID, &ws.SubnetID, &ws.ComputerName, &ws.RunningMode,
+		&ws.State, &ws.BundleID, &ws.SubnetID, &ws.ComputerName, &ws.RunningMode, &ws.AutoStopTimeoutMinutes,
 		&ws.RootVolumeSizeGib, &ws.UserVolumeSizeGib, &ws.ComputeTypeName,
 		&ws.CreatedAt, &ws.TerminatedAt, &ws.LastKnownUserConnectionTimestamp,
-		&ws.CreatedByUser, &ws.TerminatedByUser, &ws.Tags, &ws.UpdatedAt,
+		&ws.CreatedByUser, &ws.TerminatedByUser, &ws.Tags, &ws.Region, &ws.AWSAccountID, &ws.RemovedAt, &ws.ADFullName, &ws.UpdatedAt,
+		&ws.BundleName, &ws.BundleComputeType, &ws.DirectoryName, &ws.RegistrationCode,
 	)
 	if err != nil {
 		return nil, err
@@ -55,35 +79,85 @@ func GetWorkspaceByID(db *sql.DB, workspaceID string) (*Workspace, error) {
 	return &ws, nil
 }
 
+// GetWorkspaceByID retrieves a workspace by ID
+func GetWorkspaceByID(db *sql.DB, workspaceID string) (*Workspace, error) {
+	query := `SELECT ` + workspaceColumns + `
+		FROM ` + workspaceTables + `
+		WHERE w.workspace_id = $1
+	`
+	return scanWorkspace(db.QueryRow(query, workspaceID))
+}
+
+// GetWorkspacesByIDs retrieves the stored workspaces among workspaceIDs, keyed by ID
+func GetWorkspacesByIDs(db *sql.DB, workspaceIDs []string) (map[string]*Workspace, error) {
+	query := `SELECT ` + workspaceColumns + `
+		FROM ` + workspaceTables + `
+		WHERE w.workspace_id = ANY($1)
+	`
+	rows, err := db.Query(query, pq.Array(workspaceIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]*Workspace, len(workspaceIDs))
+	for rows.Next() {
+		ws, err := scanWorkspace(rows)
+		if err != nil {
+			return nil, err
+		}
+		stored[ws.WorkspaceID] = ws
+	}
+	return stored, rows.Err()
+}
+
 // ListWorkspaces retrieves workspaces with filtering and pagination
 func ListWorkspaces(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]Workspace, int, error) {
 	// Build query with filters
-	baseQuery := `
-		SELECT workspace_id, user_name, display_name, directory_id, ip_address,
-		       state, bundle_id, subnet_id, computer_name, running_mode,
-		       root_volume_size_gib, user_volume_size_gib, compute_type_name,
-		       created_at, terminated_at, last_known_user_connection_timestamp,
-		       created_by_user, terminated_by_user, tags, updated_at
-		FROM workspaces
-		WHERE 1=1
-	`
-
-	countQuery := "SELECT COUNT(*) FROM workspaces WHERE 1=1"
+	tables, countTable := workspaceTables, "workspaces w"
 	args := []interface{}{}
 	argPos := 1
 
-	// Apply filters
-	if userName, ok := filters["user_name"].(string); ok && userName != "" {
-		baseQuery += " AND user_name = $" + string(rune(argPos+'0'))
-		countQuery += " AND user_name = $" + string(rune(argPos+'0'))
-		args = append(args, userName)
+	// as_of reads the inventory as it was at that time from the version history
+	asOf, historical := filters["as_of"].(time.Time)
+	if historical {
+		countTable = workspacesAsOf(argPos)
+		tables = countTable + `
+	LEFT JOIN workspace_bundles b ON b.bundle_id = w.bundle_id
+	LEFT JOIN workspace_directories d ON d.directory_id = w.directory_id`
+		args = append(args, asOf)
 		argPos++
 	}
 
-	if state, ok := filters["state"].(string); ok && state != "" {
-		baseQuery += " AND state = $" + string(rune(argPos+'0'))
-		countQuery += " AND state = $" + string(rune(argPos+'0'))
-		args = append(args, state)
+	baseQuery := `SELECT ` + workspaceColumns + `
+		FROM ` + tables + `
+		WHERE 1=1
+	`
+
+	countQuery := "SELECT COUNT(*) FROM " + countTable + " WHERE 1=1"
+
+	// Apply exact-match filters
+	for _, column := range []string{"user_name", "state", "running_mode", "bundle_id", "region"} {
+		if value, ok := filters[column].(string); ok && value != "" {
+			filterClause := fmt.Sprintf(" AND w.%s = $%d", column, argPos)
+			baseQuery += filterClause
+			countQuery += filterClause
+			args = append(args, value)
+			argPos++
+		}
+	}
+
+	// Workspaces that disappeared from AWS are hidden unless asked for
+	if includeRemoved, _ := filters["include_removed"].(bool); !includeRemoved && !historical {
+		baseQuery += " AND w.removed_at IS NULL"
+		countQuery += " AND w.removed_at IS NULL"
+	}
+
+	if tags, ok := filters["tags"].(map[string]string); ok && len(tags) > 0 {
+		filterClause, arg := TagFilterClause("w.tags", tags, argPos)
+		baseQuery += filterClause
+		countQuery += filterClause
+		args = append(args, arg)
 		argPos++
 	}
 
@@ -95,7 +169,7 @@ func ListWorkspaces(db *sql.DB, filters map[string]interface{}, limit, offset in
 	}
 
 	// Add pagination
-	baseQuery += " ORDER BY created_at DESC LIMIT $" + string(rune(argPos+'0')) + " OFFSET $" + string(rune(argPos+1+'0'))
+	baseQuery += fmt.Sprintf(" ORDER BY w.created_at DESC NULLS LAST, w.workspace_id LIMIT $%d OFFSET $%d", argPos, argPos+1)
 	args = append(args, limit, offset)
 
 	rows, err := db.Query(baseQuery, args...)
@@ -106,18 +180,11 @@ func ListWorkspaces(db *sql.DB, filters map[string]interface{}, limit, offset in
 
 	workspaces := []Workspace{}
 	for rows.Next() {
-		var ws Workspace
-		err := rows.Scan(
-			&ws.WorkspaceID, &ws.UserName, &ws.DisplayName, &ws.DirectoryID, &ws.IPAddress,
-			&ws.State, &ws.BundleID, &ws.SubnetID, &ws.ComputerName, &ws.RunningMode,
-			&ws.RootVolumeSizeGib, &ws.UserVolumeSizeGib, &ws.ComputeTypeName,
-			&ws.CreatedAt, &ws.TerminatedAt, &ws.LastKnownUserConnectionTimestamp,
-			&ws.CreatedByUser, &ws.TerminatedByUser, &ws.Tags, &ws.UpdatedAt,
-		)
+		ws, err := scanWorkspace(rows)
 		if err != nil {
 			return nil, 0, err
 		}
-		workspaces = append(workspaces, ws)
+		workspaces = append(workspaces, *ws)
 	}
 
 	return workspaces, total, nil
@@ -131,8 +198,8 @@ func UpsertWorkspace(db *sql.DB, ws *Workspace) error {
 			state, bundle_id, subnet_id, computer_name, running_mode,
 			root_volume_size_gib, user_volume_size_gib, compute_type_name,
 			created_at, terminated_at, last_known_user_connection_timestamp,
-			created_by_user, terminated_by_user, tags, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, CURRENT_TIMESTAMP)
+			created_by_user, terminated_by_user, tags, region, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, NULLIF($20, ''), CURRENT_TIMESTAMP)
 		ON CONFLICT (workspace_id) DO UPDATE SET
 			user_name = EXCLUDED.user_name,
 			display_name = EXCLUDED.display_name,
@@ -152,6 +219,7 @@ func UpsertWorkspace(db *sql.DB, ws *Workspace) error {
 			created_by_user = EXCLUDED.created_by_user,
 			terminated_by_user = EXCLUDED.terminated_by_user,
 			tags = EXCLUDED.tags,
+			region = COALESCE(EXCLUDED.region, workspaces.region),
 			updated_at = CURRENT_TIMESTAMP
 	`
 
@@ -160,8 +228,210 @@ func UpsertWorkspace(db *sql.DB, ws *Workspace) error {
 		ws.State, ws.BundleID, ws.SubnetID, ws.ComputerName, ws.RunningMode,
 		ws.RootVolumeSizeGib, ws.UserVolumeSizeGib, ws.ComputeTypeName,
 		ws.CreatedAt, ws.TerminatedAt, ws.LastKnownUserConnectionTimestamp,
-		ws.CreatedByUser, ws.TerminatedByUser, ws.Tags,
+		ws.CreatedByUser, ws.TerminatedByUser, ws.Tags, ws.Region,
 	)
 
 	return err
 }
+
+// UpdateWorkspaceLastConnection records the last time a user connected to a workspace
+func UpdateWorkspaceLastConnection(db *sql.DB, workspaceID string, connectedAt time.Time) error {
+	query := `
+		UPDATE workspaces
+		SET last_known_user_connection_timestamp = $2
+		WHERE workspace_id = $1
+		  AND last_known_user_connection_timestamp IS DISTINCT FROM $2
+	`
+	_, err := db.Exec(query, workspaceID, connectedAt)
+	return err
+}
+
+// UpdateWorkspaceProperties stores a workspace's running mode, compute type, volume sizes and
+// AutoStop timeout after they were changed in AWS
+func UpdateWorkspaceProperties(db *sql.DB, ws *Workspace) error {
+	_, err := db.Exec(`
+		UPDATE workspaces
+		SET running_mode = $2, compute_type_name = $3, root_volume_size_gib = $4,
+		    user_volume_size_gib = $5, auto_stop_timeout_minutes = $6, updated_at = NOW()
+		WHERE workspace_id = $1
+	`, ws.WorkspaceID, ws.RunningMode, ws.ComputeTypeName, ws.RootVolumeSizeGib, ws.UserVolumeSizeGib,
+		ws.AutoStopTimeoutMinutes)
+	return err
+}
+
+// ApplyWorkspaceLifecycleEvents derives creation and termination times (and who performed
+// them) from stored CreateWorkspaces/TerminateWorkspaces CloudTrail events. A single call can
+// create or terminate several workspaces, so IDs are read from the request and response
+// bodies as well as the event's workspace_id. Returns the number of workspaces updated.
+func ApplyWorkspaceLifecycleEvents(db *sql.DB) (int64, error) {
+	createdQuery := `
+		WITH created AS (
+			SELECT DISTINCT ON (workspace_id) workspace_id, event_time, username
+			FROM (
+				SELECT e.workspace_id, e.event_time, e.username
+				FROM cloudtrail_events e
+				WHERE e.event_name = 'CreateWorkspaces' AND e.workspace_id <> ''
+				UNION ALL
+				SELECT r->>'workspaceId', e.event_time, e.username
+				FROM cloudtrail_events e
+				CROSS JOIN LATERAL jsonb_array_elements(
+					CASE WHEN jsonb_typeof(e.response_elements->'pendingRequests') = 'array'
+					     THEN e.response_elements->'pendingRequests' ELSE '[]'::jsonb END
+				) r
+				WHERE e.event_name = 'CreateWorkspaces'
+			) c
+			WHERE workspace_id IS NOT NULL
+			ORDER BY workspace_id, event_time
+		)
+		UPDATE workspaces w
+		SET created_at = c.event_time, created_by_user = c.username
+		FROM created c
+		WHERE w.workspace_id = c.workspace_id
+		  AND (w.created_at IS DISTINCT FROM c.event_time OR w.created_by_user IS DISTINCT FROM c.username)
+	`
+	result, err := db.Exec(createdQuery)
+	if err != nil {
+		return 0, fmt.Errorf("failed to apply creation events: %w", err)
+	}
+	created, _ := result.RowsAffected()
+
+	terminatedQuery := `
+		WITH terminated AS (
+			SELECT DISTINCT ON (workspace_id) workspace_id, event_time, username
+			FROM (
+				SELECT r->>'workspaceId' AS workspace_id, e.event_time, e.username, e.response_elements
+				FROM cloudtrail_events e
+				CROSS JOIN LATERAL jsonb_array_elements(
+					CASE WHEN jsonb_typeof(e.request_parameters->'terminateWorkspaceRequests') = 'array'
+					     THEN e.request_parameters->'terminateWorkspaceRequests' ELSE '[]'::jsonb END
+				) r
+				WHERE e.event_name = 'TerminateWorkspaces'
+				UNION ALL
+				SELECT e.workspace_id, e.event_time, e.username, e.response_elements
+				FROM cloudtrail_events e
+				WHERE e.event_name = 'TerminateWorkspaces' AND e.workspace_id <> ''
+			) t
+			WHERE workspace_id IS NOT NULL
+			  -- Skip workspaces AWS reported as failing to terminate
+			  AND NOT COALESCE(response_elements->'failedRequests', '[]'::jsonb)
+			      @> jsonb_build_array(jsonb_build_object('workspaceId', workspace_id))
+			ORDER BY workspace_id, event_time
+		)
+		UPDATE workspaces w
+		SET terminated_at = t.event_time, terminated_by_user = t.username
+		FROM terminated t
+		WHERE w.workspace_id = t.workspace_id
+		  AND (w.terminated_at IS DISTINCT FROM t.event_time OR w.terminated_by_user IS DISTINCT FROM t.username)
+	`
+	result, err = db.Exec(terminatedQuery)
+	if err != nil {
+		return created, fmt.Errorf("failed to apply termination events: %w", err)
+	}
+	terminated, _ := result.RowsAffected()
+
+	return created + terminated, nil
+}
+
+// UpdateWorkspaceTags replaces the tags stored for a workspace
+func UpdateWorkspaceTags(db *sql.DB, workspaceID string, tags map[string]string) error {
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE workspaces SET tags = $2 WHERE workspace_id = $1 AND tags IS DISTINCT FROM $2::jsonb`
+	_, err = db.Exec(query, workspaceID, string(tagsJSON))
+	return err
+}
+
+// ListWorkspaceTagKeys returns every tag key in use, for filter and group-by options
+func ListWorkspaceTagKeys(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT jsonb_object_keys(tags) AS tag_key
+		FROM workspaces
+		WHERE jsonb_typeof(tags) = 'object'
+		ORDER BY tag_key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RemovedWorkspace identifies a workspace marked as removed by MarkRemovedWorkspaces or
+// MarkRemovedOutsideRegions
+type RemovedWorkspace struct {
+	WorkspaceID string
+	UserName    string
+	DisplayName string // AD full name when known
+	State       string // Last state seen in AWS
+}
+
+// MarkRemovedWorkspaces stamps removed_at on the account's workspaces in a region that
+// weren't in the latest DescribeWorkspaces results, returning the newly removed ones
+func MarkRemovedWorkspaces(db *sql.DB, accountID int, region string, seenIDs []string) ([]RemovedWorkspace, error) {
+	return markRemovedWorkspaces(db, `region = $2 AND NOT (workspace_id = ANY($3))`,
+		accountID, region, pq.Array(seenIDs))
+}
+
+// MarkRemovedOutsideRegions stamps removed_at on the account's workspaces in regions it no
+// longer syncs, returning the newly removed ones
+func MarkRemovedOutsideRegions(db *sql.DB, accountID int, regions []string) ([]RemovedWorkspace, error) {
+	return markRemovedWorkspaces(db, `NOT (region = ANY($2))`, accountID, pq.Array(regions))
+}
+
+// markRemovedWorkspaces stamps removed_at on the account's ($1) workspaces matching
+// condition and closes their history
+func markRemovedWorkspaces(db *sql.DB, condition string, args ...interface{}) ([]RemovedWorkspace, error) {
+	rows, err := db.Query(`
+		WITH removed AS (
+			UPDATE workspaces
+			SET removed_at = CURRENT_TIMESTAMP
+			WHERE aws_account_id = $1 AND removed_at IS NULL AND `+condition+`
+			RETURNING workspace_id, user_name, ad_full_name, state
+		), closed AS (
+			-- Removed workspaces drop out of the point-in-time inventory from now on
+			UPDATE workspace_history h
+			SET valid_to = CURRENT_TIMESTAMP
+			FROM removed r
+			WHERE h.workspace_id = r.workspace_id AND h.valid_to IS NULL
+		)
+		SELECT workspace_id, COALESCE(user_name, ''), COALESCE(ad_full_name, ''), COALESCE(state, '')
+		FROM removed
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	removed := []RemovedWorkspace{}
+	for rows.Next() {
+		var ws RemovedWorkspace
+		if err := rows.Scan(&ws.WorkspaceID, &ws.UserName, &ws.DisplayName, &ws.State); err != nil {
+			return nil, err
+		}
+		removed = append(removed, ws)
+	}
+	return removed, rows.Err()
+}
+
+// HasWorkspaces reports whether any workspaces are stored for an account (0 for the legacy
+// single account) in a region
+func HasWorkspaces(db *sql.DB, accountID int, region string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM workspaces WHERE COALESCE(aws_account_id, 0) = $1 AND region = $2
+		)
+	`, accountID, region).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Outcomes of a workspace action
+const (
+	ActionSucceeded = "succeeded"
+	ActionFailed    = "failed"
+)
+
+// WorkspaceAction is the audit record of a lifecycle action run against a workspace
+type WorkspaceAction struct {
+	ID           int             `json:"id" db:"id"`
+	WorkspaceID  string          `json:"workspace_id" db:"workspace_id"`
+	AWSAccountID *int            `json:"aws_account_id" db:"aws_account_id"`
+	Region       string          `json:"region" db:"region"`
+	Action       string          `json:"action" db:"action"`
+	Status       string          `json:"status" db:"status"`
+	Error        string          `json:"error,omitempty" db:"error"`
+	Parameters   json.RawMessage `json:"parameters,omitempty" db:"parameters"`
+	RequestedBy  string          `json:"requested_by" db:"requested_by"`
+	Bulk         bool            `json:"bulk" db:"bulk"`
+	CreatedAt    time.Time       `json:"created_at" db:"created_at"`
+}
+
+// ActionConfirmation is a pending destructive action awaiting its confirmation token
+type ActionConfirmation struct {
+	Token        string          `json:"confirmation_token"`
+	Username     string          `json:"-"`
+	Action       string          `json:"action"`
+	WorkspaceIDs []string        `json:"workspace_ids"`
+	Parameters   json.RawMessage `json:"parameters,omitempty"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+}
+
+// CreateWorkspaceAction records an action's outcome
+func CreateWorkspaceAction(db *sql.DB, action *WorkspaceAction) error {
+	var parameters interface{}
+	if len(action.Parameters) > 0 {
+		parameters = []byte(action.Parameters)
+	}
+	return db.QueryRow(`
+		INSERT INTO workspace_actions (workspace_id, aws_account_id, region, action, status, error,
+		                               parameters, requested_by, bulk)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7, $8, $9)
+		RETURNING id, created_at
+	`, action.WorkspaceID, action.AWSAccountID, action.Region, action.Action, action.Status, action.Error,
+		parameters, action.RequestedBy, action.Bulk).Scan(&action.ID, &action.CreatedAt)
+}
+
+// ListWorkspaceActions returns recorded actions, newest first. Filters: workspace_id, action,
+// status and requested_by.
+func ListWorkspaceActions(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]WorkspaceAction, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	argPos := 1
+
+	for _, column := range []string{"workspace_id", "action", "status", "requested_by"} {
+		if value, ok := filters[column].(string); ok && value != "" {
+			where += fmt.Sprintf(" AND %s = $%d", column, argPos)
+			args = append(args, value)
+			argPos++
+		}
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM workspace_actions"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, workspace_id, aws_account_id, COALESCE(region, ''), action, status, COALESCE(error, ''),
+		       COALESCE(parameters, 'null'), requested_by, bulk, created_at
+		FROM workspace_actions` + where +
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d", argPos, argPos+1)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	actions := []WorkspaceAction{}
+	for rows.Next() {
+		var a WorkspaceAction
+		if err := rows.Scan(&a.ID, &a.WorkspaceID, &a.AWSAccountID, &a.Region, &a.Action, &a.Status, &a.Error,
+			&a.Parameters, &a.RequestedBy, &a.Bulk, &a.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		if string(a.Parameters) == "null" {
+			a.Parameters = nil
+		}
+		actions = append(actions, a)
+	}
+	return actions, total, rows.Err()
+}
+
+// UpdateWorkspaceState sets a workspace's state ahead of the next sync, after an action
+// AWS has accepted
+func UpdateWorkspaceState(db *sql.DB, workspaceID, state string) error {
+	_, err := db.Exec(`
+		UPDATE workspaces SET state = $1, updated_at = NOW()
+		WHERE workspace_id = $2
+	`, state, workspaceID)
+	return err
+}
+
+// CreateActionConfirmation stores a pending destructive action that expires after ttl,
+// clearing expired ones
+func CreateActionConfirmation(db *sql.DB, confirmation *ActionConfirmation, ttl time.Duration) error {
+	if _, err := db.Exec(`DELETE FROM workspace_action_confirmations WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+
+	var parameters interface{}
+	if len(confirmation.Parameters) > 0 {
+		parameters = []byte(confirmation.Parameters)
+	}
+	return db.QueryRow(`
+		INSERT INTO workspace_action_confirmations (token, username, action, workspace_ids, parameters, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6))
+		RETURNING expires_at
+	`, confirmation.Token, confirmation.Username, confirmation.Action, pq.Array(confirmation.WorkspaceIDs),
+		parameters, ttl.Seconds()).Scan(&confirmation.ExpiresAt)
+}
+
+// ConsumeActionConfirmation returns and deletes the pending action a token confirms. Tokens
+// only confirm the action they were issued for, to the user they were issued to, before they
+// expire; otherwise sql.ErrNoRows is returned.
+func ConsumeActionConfirmation(db *sql.DB, token, username, action string) (*ActionConfirmation, error) {
+	c := ActionConfirmation{Token: token}
+	err := db.QueryRow(`
+		DELETE FROM workspace_action_confirmations
+		WHERE token = $1 AND username = $2 AND action = $3 AND expires_at >= NOW()
+		RETURNING username, action, workspace_ids, COALESCE(parameters, 'null'), expires_at
+	`, token, username, action).Scan(&c.Username, &c.Action, pq.Array(&c.WorkspaceIDs), &c.Parameters, &c.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if string(c.Parameters) == "null" {
+		c.Parameters = nil
+	}
+	return &c, nil
+}
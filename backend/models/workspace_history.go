@@ -0,0 +1,199 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WorkspaceVersion is one version of a workspace's inventory fields, valid from ValidFrom
+// until ValidTo (nil for the current version)
+type WorkspaceVersion struct {
+	ID                int             `json:"id" db:"id"`
+	WorkspaceID       string          `json:"workspace_id" db:"workspace_id"`
+	UserName          string          `json:"user_name" db:"user_name"`
+	DisplayName       string          `json:"user_display_name" db:"display_name"`
+	DirectoryID       string          `json:"directory_id" db:"directory_id"`
+	IPAddress         string          `json:"ip_address" db:"ip_address"`
+	State             string          `json:"state" db:"state"`
+	BundleID          string          `json:"bundle_id" db:"bundle_id"`
+	SubnetID          string          `json:"subnet_id" db:"subnet_id"`
+	ComputerName      string          `json:"computer_name" db:"computer_name"`
+	RunningMode       string          `json:"running_mode" db:"running_mode"`
+	RootVolumeSizeGib int             `json:"root_volume_size_gib" db:"root_volume_size_gib"`
+	UserVolumeSizeGib int             `json:"user_volume_size_gib" db:"user_volume_size_gib"`
+	ComputeTypeName   string          `json:"compute_type" db:"compute_type_name"`
+	Tags              json.RawMessage `json:"tags" db:"tags"`
+	Region            string          `json:"region" db:"region"`
+	AWSAccountID      *int            `json:"aws_account_id" db:"aws_account_id"`
+	ValidFrom         time.Time       `json:"valid_from" db:"valid_from"`
+	ValidTo           *time.Time      `json:"valid_to" db:"valid_to"`
+
+	// Fields that differ from the previous version; empty for the first one
+	Changes []string `json:"changes"`
+}
+
+// workspaceHistoryFields are the versioned columns, shared by workspaces and workspace_history.
+// Connection and lifecycle timestamps aren't versioned since they change on their own.
+const workspaceHistoryFields = `user_name, display_name, directory_id, ip_address, state,
+	bundle_id, subnet_id, computer_name, running_mode, root_volume_size_gib,
+	user_volume_size_gib, compute_type_name, tags, region, aws_account_id`
+
+// RecordWorkspaceVersion stores the workspace's current row as a new version when it differs
+// from the latest stored version, closing that version
+func RecordWorkspaceVersion(db *sql.DB, workspaceID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var unchanged bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM workspace_history h
+			JOIN workspaces w ON w.workspace_id = h.workspace_id
+			WHERE h.workspace_id = $1 AND h.valid_to IS NULL
+			  AND (`+prefixColumns("h", workspaceHistoryFields)+`)
+			      IS NOT DISTINCT FROM (`+prefixColumns("w", workspaceHistoryFields)+`)
+		)
+	`, workspaceID).Scan(&unchanged)
+	if err != nil || unchanged {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE workspace_history SET valid_to = CURRENT_TIMESTAMP
+		WHERE workspace_id = $1 AND valid_to IS NULL
+	`, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO workspace_history (workspace_id, `+workspaceHistoryFields+`, valid_from)
+		SELECT workspace_id, `+workspaceHistoryFields+`, CURRENT_TIMESTAMP
+		FROM workspaces
+		WHERE workspace_id = $1 AND removed_at IS NULL
+	`, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListWorkspaceHistory returns a workspace's versions, newest first, each with the fields
+// that changed from the version before it
+func ListWorkspaceHistory(db *sql.DB, workspaceID string) ([]WorkspaceVersion, error) {
+	rows, err := db.Query(`
+		SELECT id, workspace_id, COALESCE(user_name, ''), COALESCE(display_name, ''),
+		       COALESCE(directory_id, ''), COALESCE(ip_address, ''), COALESCE(state, ''),
+		       COALESCE(bundle_id, ''), COALESCE(subnet_id, ''), COALESCE(computer_name, ''),
+		       COALESCE(running_mode, ''), COALESCE(root_volume_size_gib, 0),
+		       COALESCE(user_volume_size_gib, 0), COALESCE(compute_type_name, ''),
+		       COALESCE(tags, '{}'), COALESCE(region, ''), aws_account_id, valid_from, valid_to
+		FROM workspace_history
+		WHERE workspace_id = $1
+		ORDER BY valid_from, id
+	`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []WorkspaceVersion{}
+	for rows.Next() {
+		var v WorkspaceVersion
+		err := rows.Scan(
+			&v.ID, &v.WorkspaceID, &v.UserName, &v.DisplayName, &v.DirectoryID, &v.IPAddress,
+			&v.State, &v.BundleID, &v.SubnetID, &v.ComputerName, &v.RunningMode,
+			&v.RootVolumeSizeGib, &v.UserVolumeSizeGib, &v.ComputeTypeName, &v.Tags,
+			&v.Region, &v.AWSAccountID, &v.ValidFrom, &v.ValidTo,
+		)
+		if err != nil {
+			return nil, err
+		}
+		v.Changes = []string{}
+		if len(versions) > 0 {
+			v.Changes = versionChanges(&versions[len(versions)-1], &v)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// versionChanges lists the fields that differ between two consecutive versions
+func versionChanges(prev, next *WorkspaceVersion) []string {
+	changes := []string{}
+	compare := []struct {
+		field   string
+		changed bool
+	}{
+		{"user_name", prev.UserName != next.UserName},
+		{"display_name", prev.DisplayName != next.DisplayName},
+		{"directory_id", prev.DirectoryID != next.DirectoryID},
+		{"ip_address", prev.IPAddress != next.IPAddress},
+		{"state", prev.State != next.State},
+		{"bundle_id", prev.BundleID != next.BundleID},
+		{"subnet_id", prev.SubnetID != next.SubnetID},
+		{"computer_name", prev.ComputerName != next.ComputerName},
+		{"running_mode", prev.RunningMode != next.RunningMode},
+		{"root_volume_size_gib", prev.RootVolumeSizeGib != next.RootVolumeSizeGib},
+		{"user_volume_size_gib", prev.UserVolumeSizeGib != next.UserVolumeSizeGib},
+		{"compute_type_name", prev.ComputeTypeName != next.ComputeTypeName},
+		{"tags", string(prev.Tags) != string(next.Tags)}, // jsonb output is normalized
+		{"region", prev.Region != next.Region},
+		{"aws_account_id", !intPtrEqual(prev.AWSAccountID, next.AWSAccountID)},
+	}
+	for _, c := range compare {
+		if c.changed {
+			changes = append(changes, c.field)
+		}
+	}
+	return changes
+}
+
+func intPtrEqual(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// workspacesAsOf is a derived table aliased w with the columns of workspaces as they were
+// at the time in placeholder argPos, so workspaceColumns and the list filters apply unchanged.
+// Lifecycle fields and the AutoStop timeout come from the current row; connection times
+// aren't versioned.
+func workspacesAsOf(argPos int) string {
+	return fmt.Sprintf(`(
+		SELECT h.workspace_id, `+prefixColumns("h", workspaceHistoryFields)+`,
+		       cur.auto_stop_timeout_minutes, cur.created_at, cur.terminated_at,
+		       NULL::timestamp AS last_known_user_connection_timestamp,
+		       cur.created_by_user, cur.terminated_by_user, cur.ad_full_name,
+		       NULL::timestamp AS removed_at, h.valid_from AS updated_at
+		FROM workspace_history h
+		JOIN workspaces cur ON cur.workspace_id = h.workspace_id
+		WHERE h.valid_from <= $%[1]d AND (h.valid_to IS NULL OR h.valid_to > $%[1]d)
+	) w`, argPos)
+}
+
+// prefixColumns qualifies each column in a comma-separated list with a table alias
+func prefixColumns(alias, columns string) string {
+	parts := strings.Split(columns, ",")
+	for i, column := range parts {
+		parts[i] = alias + "." + strings.TrimSpace(column)
+	}
+	return strings.Join(parts, ", ")
+}
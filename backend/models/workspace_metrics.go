@@ -0,0 +1,179 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Resolutions metrics are stored at, in seconds
+const (
+	MetricResolutionRaw    = 300
+	MetricResolutionHourly = 3600
+	MetricResolutionDaily  = 86400
+)
+
+// MetricSample is one CloudWatch datapoint of a workspace metric
+type MetricSample struct {
+	WorkspaceID string
+	MetricName  string
+	Stat        string // CloudWatch statistic, which also decides how samples are rolled up
+	PeriodStart time.Time
+	Value       float64
+}
+
+// MetricPoint is a datapoint in a metric series
+type MetricPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// MetricSeries is one metric of a workspace over time
+type MetricSeries struct {
+	Stat   string        `json:"stat"`
+	Points []MetricPoint `json:"points"`
+}
+
+// UpsertMetricSamples stores 5 minute samples, replacing any already stored for the same period
+func UpsertMetricSamples(db *sql.DB, samples []MetricSample) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO workspace_metrics (workspace_id, metric_name, stat, resolution, period_start, value)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (workspace_id, metric_name, resolution, period_start) DO UPDATE SET
+			stat = EXCLUDED.stat,
+			value = EXCLUDED.value
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range samples {
+		_, err := stmt.Exec(s.WorkspaceID, s.MetricName, s.Stat, MetricResolutionRaw, s.PeriodStart.UTC(), s.Value)
+		if err != nil {
+			return fmt.Errorf("workspace %s metric %s: %w", s.WorkspaceID, s.MetricName, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// LatestMetricSamples returns the newest 5 minute sample stored for each workspace of an
+// account and region, by workspace ID. Workspaces without samples are left out.
+func LatestMetricSamples(db *sql.DB, accountID int, region string) (map[string]time.Time, error) {
+	rows, err := db.Query(`
+		SELECT m.workspace_id, MAX(m.period_start)
+		FROM workspace_metrics m
+		JOIN workspaces w ON w.workspace_id = m.workspace_id
+		WHERE w.aws_account_id = $1 AND w.region = $2 AND m.resolution = $3
+		GROUP BY m.workspace_id
+	`, accountID, region, MetricResolutionRaw)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latest := map[string]time.Time{}
+	for rows.Next() {
+		var workspaceID string
+		var periodStart time.Time
+		if err := rows.Scan(&workspaceID, &periodStart); err != nil {
+			return nil, err
+		}
+		latest[workspaceID] = periodStart
+	}
+	return latest, rows.Err()
+}
+
+// RollUpMetrics rebuilds hourly metrics from 5 minute samples, and daily metrics from hourly
+// ones, for every hour and day from since onwards. Samples are combined according to their
+// statistic: sums are added, maximums and minimums kept, and anything else averaged.
+func RollUpMetrics(db *sql.DB, since time.Time) error {
+	rollups := []struct {
+		from, to int
+		unit     string
+	}{
+		{MetricResolutionRaw, MetricResolutionHourly, "hour"},
+		{MetricResolutionHourly, MetricResolutionDaily, "day"},
+	}
+
+	for _, r := range rollups {
+		_, err := db.Exec(fmt.Sprintf(`
+			INSERT INTO workspace_metrics (workspace_id, metric_name, stat, resolution, period_start, value)
+			SELECT workspace_id, metric_name, stat, $2, date_trunc('%[1]s', period_start),
+			       CASE stat
+			           WHEN 'Sum' THEN SUM(value)
+			           WHEN 'SampleCount' THEN SUM(value)
+			           WHEN 'Maximum' THEN MAX(value)
+			           WHEN 'Minimum' THEN MIN(value)
+			           ELSE AVG(value)
+			       END
+			FROM workspace_metrics
+			WHERE resolution = $1 AND period_start >= date_trunc('%[1]s', $3::timestamp)
+			GROUP BY workspace_id, metric_name, stat, date_trunc('%[1]s', period_start)
+			ON CONFLICT (workspace_id, metric_name, resolution, period_start) DO UPDATE SET
+				stat = EXCLUDED.stat,
+				value = EXCLUDED.value
+		`, r.unit), r.from, r.to, since.UTC())
+		if err != nil {
+			return fmt.Errorf("failed to roll up %s metrics: %w", r.unit, err)
+		}
+	}
+	return nil
+}
+
+// PruneMetrics deletes metrics of a resolution from periods before before
+func PruneMetrics(db *sql.DB, resolution int, before time.Time) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM workspace_metrics WHERE resolution = $1 AND period_start < $2
+	`, resolution, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListWorkspaceMetrics returns a workspace's metrics at a resolution between start and end,
+// keyed by metric name. An empty names returns every metric stored.
+func ListWorkspaceMetrics(db *sql.DB, workspaceID string, names []string, resolution int, start, end time.Time) (map[string]*MetricSeries, error) {
+	query := `
+		SELECT metric_name, stat, period_start, value
+		FROM workspace_metrics
+		WHERE workspace_id = $1 AND resolution = $2 AND period_start >= $3 AND period_start <= $4`
+	args := []interface{}{workspaceID, resolution, start.UTC(), end.UTC()}
+	if len(names) > 0 {
+		query += " AND metric_name = ANY($5)"
+		args = append(args, pq.Array(names))
+	}
+	query += " ORDER BY metric_name, period_start"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := map[string]*MetricSeries{}
+	for rows.Next() {
+		var name, stat string
+		var point MetricPoint
+		if err := rows.Scan(&name, &stat, &point.Timestamp, &point.Value); err != nil {
+			return nil, err
+		}
+		series, ok := metrics[name]
+		if !ok {
+			series = &MetricSeries{Stat: stat, Points: []MetricPoint{}}
+			metrics[name] = series
+		}
+		series.Points = append(series.Points, point)
+	}
+	return metrics, rows.Err()
+}
@@ -0,0 +1,287 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Workspace request statuses
+const (
+	RequestPending      = "pending"      // Awaiting the manager's approval
+	RequestApproved     = "approved"     // Approved, waiting for the sync worker
+	RequestRejected     = "rejected"     // Rejected by the manager or an admin
+	RequestCancelled    = "cancelled"    // Withdrawn before a decision
+	RequestExpired      = "expired"      // Not decided before expires_at
+	RequestProvisioning = "provisioning" // Created in AWS, waiting to appear in a sync
+	RequestCompleted    = "completed"    // The workspace has appeared in a sync
+	RequestFailed       = "failed"       // AWS refused the workspace, or it never appeared
+)
+
+// WorkspaceRequest is a workspace a user asked for through the self-service portal
+type WorkspaceRequest struct {
+	ID            int        `json:"id" db:"id"`
+	RequestedBy   string     `json:"requested_by" db:"requested_by"`
+	UserName      string     `json:"user_name" db:"user_name"` // Directory user the workspace is for
+	BundleID      string     `json:"bundle_id" db:"bundle_id"`
+	DirectoryID   string     `json:"directory_id" db:"directory_id"`
+	AWSAccountID  *int       `json:"aws_account_id" db:"aws_account_id"`
+	Region        string     `json:"region" db:"region"`
+	RunningMode   string     `json:"running_mode" db:"running_mode"`
+	Justification string     `json:"justification" db:"justification"`
+	Department    string     `json:"department,omitempty" db:"department"`
+	Manager       string     `json:"manager,omitempty" db:"manager"` // Manager's DN, from the AD sync
+	ManagerEmail  string     `json:"manager_email,omitempty" db:"manager_email"`
+	Status        string     `json:"status" db:"status"`
+	DecidedBy     string     `json:"decided_by,omitempty" db:"decided_by"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty" db:"decided_at"`
+	DecisionNote  string     `json:"decision_note,omitempty" db:"decision_note"`
+	ExpiresAt     time.Time  `json:"expires_at" db:"expires_at"`
+	WorkspaceID   string     `json:"workspace_id,omitempty" db:"workspace_id"`
+	Error         string     `json:"error,omitempty" db:"error"`
+	ProvisionedAt *time.Time `json:"provisioned_at,omitempty" db:"provisioned_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// UserADInfo is what the AD sync last recorded about a directory user
+type UserADInfo struct {
+	Department   string
+	Manager      string
+	ManagerEmail string
+}
+
+const workspaceRequestColumns = `
+	id, requested_by, user_name, bundle_id, directory_id, aws_account_id, COALESCE(region, ''), running_mode,
+	justification, COALESCE(department, ''), COALESCE(manager, ''), COALESCE(manager_email, ''), status,
+	COALESCE(decided_by, ''), decided_at, COALESCE(decision_note, ''), expires_at, COALESCE(workspace_id, ''),
+	COALESCE(error, ''), provisioned_at, completed_at, created_at, updated_at`
+
+func scanWorkspaceRequest(row rowScanner) (*WorkspaceRequest, error) {
+	var wr WorkspaceRequest
+	err := row.Scan(&wr.ID, &wr.RequestedBy, &wr.UserName, &wr.BundleID, &wr.DirectoryID, &wr.AWSAccountID,
+		&wr.Region, &wr.RunningMode, &wr.Justification, &wr.Department, &wr.Manager, &wr.ManagerEmail,
+		&wr.Status, &wr.DecidedBy, &wr.DecidedAt, &wr.DecisionNote, &wr.ExpiresAt, &wr.WorkspaceID,
+		&wr.Error, &wr.ProvisionedAt, &wr.CompletedAt, &wr.CreatedAt, &wr.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &wr, nil
+}
+
+func scanWorkspaceRequests(rows *sql.Rows) ([]WorkspaceRequest, error) {
+	defer rows.Close()
+
+	requests := []WorkspaceRequest{}
+	for rows.Next() {
+		wr, err := scanWorkspaceRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *wr)
+	}
+	return requests, rows.Err()
+}
+
+// CreateWorkspaceRequest stores a pending workspace request that expires after ttl. It
+// returns sql.ErrNoRows if the user already has an open request for the directory.
+func CreateWorkspaceRequest(db *sql.DB, wr *WorkspaceRequest, ttl time.Duration) error {
+	wr.Status = RequestPending
+	return db.QueryRow(`
+		INSERT INTO workspace_requests (requested_by, user_name, bundle_id, directory_id, aws_account_id, region,
+		                                running_mode, justification, department, manager, manager_email, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''), $12,
+		        NOW() + make_interval(secs => $13))
+		ON CONFLICT DO NOTHING
+		RETURNING id, expires_at, created_at, updated_at
+	`, wr.RequestedBy, wr.UserName, wr.BundleID, wr.DirectoryID, wr.AWSAccountID, wr.Region, wr.RunningMode,
+		wr.Justification, wr.Department, wr.Manager, wr.ManagerEmail, wr.Status,
+		ttl.Seconds()).Scan(&wr.ID, &wr.ExpiresAt, &wr.CreatedAt, &wr.UpdatedAt)
+}
+
+// GetWorkspaceRequest returns a workspace request by ID
+func GetWorkspaceRequest(db *sql.DB, id int) (*WorkspaceRequest, error) {
+	return scanWorkspaceRequest(db.QueryRow(`SELECT `+workspaceRequestColumns+` FROM workspace_requests WHERE id = $1`, id))
+}
+
+// ListWorkspaceRequests returns workspace requests, newest first. Filters: status, user_name
+// and requested_by. visible_to limits the list to requests made by that username or awaiting
+// the manager with visible_to_email.
+func ListWorkspaceRequests(db *sql.DB, filters map[string]interface{}, limit, offset int) ([]WorkspaceRequest, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	argPos := 1
+
+	for _, column := range []string{"status", "user_name", "requested_by"} {
+		if value, ok := filters[column].(string); ok && value != "" {
+			where += fmt.Sprintf(" AND %s = $%d", column, argPos)
+			args = append(args, value)
+			argPos++
+		}
+	}
+	if username, ok := filters["visible_to"].(string); ok && username != "" {
+		email, _ := filters["visible_to_email"].(string)
+		where += fmt.Sprintf(" AND (requested_by = $%d OR ($%d != '' AND LOWER(manager_email) = LOWER($%d)))",
+			argPos, argPos+1, argPos+1)
+		args = append(args, username, email)
+		argPos += 2
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM workspace_requests"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + workspaceRequestColumns + ` FROM workspace_requests` + where +
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d", argPos, argPos+1)
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	requests, err := scanWorkspaceRequests(rows)
+	return requests, total, err
+}
+
+// DecideWorkspaceRequest moves a pending, unexpired workspace request to status (approved,
+// rejected or cancelled). It returns sql.ErrNoRows if the request is no longer pending.
+func DecideWorkspaceRequest(db *sql.DB, id int, status, decidedBy, note string) (*WorkspaceRequest, error) {
+	return scanWorkspaceRequest(db.QueryRow(`
+		UPDATE workspace_requests
+		SET status = $2, decided_by = $3, decided_at = NOW(), decision_note = NULLIF($4, ''), updated_at = NOW()
+		WHERE id = $1 AND status = $5 AND expires_at >= NOW()
+		RETURNING `+workspaceRequestColumns, id, status, decidedBy, note, RequestPending))
+}
+
+// ExpireWorkspaceRequests moves pending workspace requests past their expiry to expired and
+// returns them
+func ExpireWorkspaceRequests(db *sql.DB) ([]WorkspaceRequest, error) {
+	rows, err := db.Query(`
+		UPDATE workspace_requests SET status = $1, updated_at = NOW()
+		WHERE status = $2 AND expires_at < NOW()
+		RETURNING `+workspaceRequestColumns, RequestExpired, RequestPending)
+	if err != nil {
+		return nil, err
+	}
+	return scanWorkspaceRequests(rows)
+}
+
+// ClaimApprovedWorkspaceRequest marks the oldest approved workspace request provisioning and
+// returns it, or sql.ErrNoRows if none is waiting. Requests claimed before orphanedBefore that
+// never got a workspace ID, because their run stopped while creating it, are claimed again.
+// Concurrent workers never claim the same request.
+func ClaimApprovedWorkspaceRequest(db *sql.DB, orphanedBefore time.Time) (*WorkspaceRequest, error) {
+	return scanWorkspaceRequest(db.QueryRow(`
+		UPDATE workspace_requests SET status = $1, updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM workspace_requests
+			WHERE status = $2 OR (status = $1 AND workspace_id IS NULL AND updated_at < $3)
+			ORDER BY decided_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+workspaceRequestColumns, RequestProvisioning, RequestApproved, orphanedBefore))
+}
+
+// MarkWorkspaceRequestProvisioned records the workspace AWS is creating for a provisioning
+// request
+func MarkWorkspaceRequestProvisioned(db *sql.DB, id int, workspaceID string) (*WorkspaceRequest, error) {
+	return scanWorkspaceRequest(db.QueryRow(`
+		UPDATE workspace_requests
+		SET workspace_id = $2, provisioned_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = $3
+		RETURNING `+workspaceRequestColumns, id, workspaceID, RequestProvisioning))
+}
+
+// FailWorkspaceRequest marks a provisioning workspace request failed with the reason
+func FailWorkspaceRequest(db *sql.DB, id int, reason string) (*WorkspaceRequest, error) {
+	return scanWorkspaceRequest(db.QueryRow(`
+		UPDATE workspace_requests
+		SET status = $2, error = $3, updated_at = NOW()
+		WHERE id = $1 AND status = $4
+		RETURNING `+workspaceRequestColumns, id, RequestFailed, reason, RequestProvisioning))
+}
+
+// CompleteSyncedWorkspaceRequests finishes the provisioning requests whose workspace has been
+// synced: completed, or failed if AWS put it in the ERROR state. It returns those requests;
+// concurrent callers never finish the same request twice.
+func CompleteSyncedWorkspaceRequests(db *sql.DB) ([]WorkspaceRequest, error) {
+	rows, err := db.Query(`
+		WITH synced AS (
+			SELECT r.id AS request_id, w.state = 'ERROR' AS errored
+			FROM workspace_requests r
+			JOIN workspaces w ON w.workspace_id = r.workspace_id
+			WHERE r.status = $3
+		)
+		UPDATE workspace_requests
+		SET status = CASE WHEN synced.errored THEN $1 ELSE $2 END,
+		    error = CASE WHEN synced.errored THEN 'AWS could not create the workspace' END,
+		    completed_at = NOW(), updated_at = NOW()
+		FROM synced
+		WHERE id = synced.request_id AND workspace_requests.status = $3
+		RETURNING `+workspaceRequestColumns, RequestFailed, RequestCompleted, RequestProvisioning)
+	if err != nil {
+		return nil, err
+	}
+	return scanWorkspaceRequests(rows)
+}
+
+// FailStalledWorkspaceRequests fails provisioning requests whose workspace hasn't appeared
+// within timeout, and returns them
+func FailStalledWorkspaceRequests(db *sql.DB, timeout time.Duration) ([]WorkspaceRequest, error) {
+	rows, err := db.Query(`
+		UPDATE workspace_requests
+		SET status = $1, error = $2, updated_at = NOW()
+		WHERE status = $3 AND COALESCE(provisioned_at, updated_at) < NOW() - make_interval(secs => $4)
+		RETURNING `+workspaceRequestColumns,
+		RequestFailed, "the workspace did not appear in a sync in time", RequestProvisioning, timeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanWorkspaceRequests(rows)
+}
+
+// SetWorkspaceRequestManager fills in the department and manager of a user's pending requests
+// that were made before the AD sync knew their manager, and returns those requests
+func SetWorkspaceRequestManager(db *sql.DB, userName string, info UserADInfo) ([]WorkspaceRequest, error) {
+	rows, err := db.Query(`
+		UPDATE workspace_requests
+		SET department = NULLIF($2, ''), manager = NULLIF($3, ''), manager_email = NULLIF($4, ''), updated_at = NOW()
+		WHERE user_name = $1 AND status = $5 AND COALESCE(manager_email, '') = '' AND $4 != ''
+		RETURNING `+workspaceRequestColumns, userName, info.Department, info.Manager, info.ManagerEmail, RequestPending)
+	if err != nil {
+		return nil, err
+	}
+	return scanWorkspaceRequests(rows)
+}
+
+// GetUserADInfo returns what the AD sync last stored about a user on their workspaces, or
+// sql.ErrNoRows if it has nothing
+func GetUserADInfo(db *sql.DB, userName string) (*UserADInfo, error) {
+	var info UserADInfo
+	err := db.QueryRow(`
+		SELECT COALESCE(ad_department, ''), COALESCE(ad_manager, ''), COALESCE(ad_manager_email, '')
+		FROM workspaces
+		WHERE user_name = $1 AND ad_last_sync IS NOT NULL
+		ORDER BY ad_last_sync DESC
+		LIMIT 1
+	`, userName).Scan(&info.Department, &info.Manager, &info.ManagerEmail)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// HasWorkspaceInDirectory reports whether a user already has a workspace in a directory
+func HasWorkspaceInDirectory(db *sql.DB, userName, directoryID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM workspaces
+			WHERE user_name = $1 AND directory_id = $2 AND removed_at IS NULL AND state != 'TERMINATED'
+		)
+	`, userName, directoryID).Scan(&exists)
+	return exists, err
+}
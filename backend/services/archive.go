@@ -0,0 +1,93 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFileFunc handles one matching file found in a directory or archive
+type archiveFileFunc func(name string, r io.Reader) error
+
+// walkDirectory calls fn for every file under dir that match accepts
+func walkDirectory(dir string, match func(name string) bool, fn archiveFileFunc) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !match(d.Name()) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(path, f)
+	})
+}
+
+// walkArchive calls fn for every file that match accepts in an uploaded .zip, .tar.gz/.tgz
+// or .tar archive, or for the upload itself when it is a matching file
+func walkArchive(name string, r io.ReaderAt, size int64, match func(name string) bool, fn archiveFileFunc) error {
+	lower := strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		archive, err := zip.NewReader(r, size)
+		if err != nil {
+			return fmt.Errorf("failed to read zip archive: %w", err)
+		}
+		for _, file := range archive.File {
+			if file.FileInfo().IsDir() || !match(file.Name) {
+				continue
+			}
+			f, err := file.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Name, err)
+			}
+			err = fn(file.Name, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"), strings.HasSuffix(lower, ".tar"):
+		var stream io.Reader = io.NewSectionReader(r, 0, size)
+		if !strings.HasSuffix(lower, ".tar") {
+			gz, err := gzip.NewReader(stream)
+			if err != nil {
+				return fmt.Errorf("failed to read tar archive: %w", err)
+			}
+			defer gz.Close()
+			stream = gz
+		}
+		archive := tar.NewReader(stream)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read tar archive: %w", err)
+			}
+			if header.Typeflag != tar.TypeReg || !match(header.Name) {
+				continue
+			}
+			if err := fn(header.Name, archive); err != nil {
+				return err
+			}
+		}
+	case match(lower):
+		return fn(name, io.NewSectionReader(r, 0, size))
+	}
+	return fmt.Errorf("unsupported file %q: expected a .zip, .tar.gz, .tgz or .tar archive, or a single data file", name)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,19 +13,23 @@ import (
 
 	"github.com/4syedalihassan/workspaces-inventory/models"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
 	cttypes "github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
-	"github.com/aws/aws-sdk-go-v2/service/costexplorer"
-	cetypes "github.com/aws/aws-sdk-go-v2/service/costexplorer/types"
 	"github.com/aws/aws-sdk-go-v2/service/workspaces"
 	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+	"github.com/aws/smithy-go"
 	"github.com/go-ldap/ldap/v3"
 )
 
 type AWSService struct {
 	DB *sql.DB
+
+	// Progress receives per-account outcomes when the service runs inside a tracked sync
+	Progress *SyncProgress
 }
 
 // GetAWSConfig creates AWS config from database settings (legacy - for backwards compatibility)
@@ -57,6 +62,7 @@ func (s *AWSService) GetAWSConfig(ctx context.Context) (aws.Config, error) {
 			secretKey.Value,
 			"",
 		)),
+		s.retryerOption(),
 	)
 
 	return cfg, err
@@ -70,21 +76,25 @@ func (s *AWSService) GetAWSConfigForAccount(ctx context.Context, accountID int)
 		return aws.Config{}, fmt.Errorf("failed to get AWS account: %w", err)
 	}
 
-	if account.AccessKeyID == "" || account.SecretAccessKey == "" {
-		return aws.Config{}, fmt.Errorf("AWS credentials not configured for account %s", account.Name)
-	}
-
-	// Create config with credentials
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(account.Region),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			account.AccessKeyID,
-			account.SecretAccessKey,
-			"",
-		)),
-	)
+	return s.accountConfig(ctx, account, "", 0)
+}
 
-	return cfg, err
+// retryerOption configures adaptive retries so WorkSpaces, CloudTrail and Cost Explorer
+// throttling errors back off and slow the client down instead of failing the sync
+func (s *AWSService) retryerOption() config.LoadOptionsFunc {
+	maxAttempts := models.GetSettingInt(s.DB, "aws.retry_max_attempts", 10)
+	maxBackoff := time.Duration(models.GetSettingInt(s.DB, "aws.retry_max_backoff_seconds", 60)) * time.Second
+
+	return config.WithRetryer(func() aws.Retryer {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, func(so *retry.StandardOptions) {
+				so.MaxAttempts = maxAttempts
+				so.MaxBackoff = maxBackoff
+				// Long syncs hit many throttles; don't let the retry quota fail them early
+				so.RateLimiter = ratelimit.None
+			})
+		})
+	})
 }
 
 // SyncWorkSpaces fetches all WorkSpaces from AWS and stores them (legacy - uses default account)
@@ -92,7 +102,11 @@ func (s *AWSService) SyncWorkSpaces(ctx context.Context) (int, error) {
 	// Try to get default account first
 	defaultAccount, err := models.GetDefaultAWSAccount(s.DB)
 	if err == nil && defaultAccount != nil {
-		return s.SyncWorkSpacesForAccount(ctx, defaultAccount.ID)
+		count, err := s.SyncWorkSpacesForAccount(ctx, defaultAccount.ID)
+		if _, applyErr := models.ApplyWorkspaceLifecycleEvents(s.DB); applyErr != nil {
+			log.Printf("Failed to apply workspace lifecycle events: %v", applyErr)
+		}
+		return count, err
 	}
 
 	// Fallback to legacy settings-based config
@@ -101,31 +115,14 @@ func (s *AWSService) SyncWorkSpaces(ctx context.Context) (int, error) {
 		return 0, err
 	}
 
-	// Create WorkSpaces client
-	client := workspaces.NewFromConfig(cfg)
-
-	// Describe all workspaces using pagination
 	log.Println("Fetching WorkSpaces from AWS (legacy mode)...")
-	input := &workspaces.DescribeWorkspacesInput{}
-
-	count := 0
-	paginator := workspaces.NewDescribeWorkspacesPaginator(client, input)
-
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return count, fmt.Errorf("failed to get page: %w", err)
-		}
+	count, err := s.syncWorkSpacesInRegion(ctx, cfg, 0)
+	if err != nil {
+		return count, err
+	}
 
-		for _, ws := range page.Workspaces {
-			// Upsert workspace without account ID (legacy)
-			err := s.upsertWorkspace(ws, 0)
-			if err != nil {
-				log.Printf("Failed to upsert workspace %s: %v", *ws.WorkspaceId, err)
-				continue
-			}
-			count++
-		}
+	if _, err := models.ApplyWorkspaceLifecycleEvents(s.DB); err != nil {
+		log.Printf("Failed to apply workspace lifecycle events: %v", err)
 	}
 
 	log.Printf("Successfully synced %d workspaces", count)
@@ -134,46 +131,230 @@ func (s *AWSService) SyncWorkSpaces(ctx context.Context) (int, error) {
 
 // SyncWorkSpacesForAccount fetches all WorkSpaces from AWS for a specific account
 func (s *AWSService) SyncWorkSpacesForAccount(ctx context.Context, accountID int) (int, error) {
+	account, err := models.GetAWSAccountByID(s.DB, accountID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get AWS account: %w", err)
+	}
+
 	cfg, err := s.GetAWSConfigForAccount(ctx, accountID)
 	if err != nil {
 		return 0, err
 	}
 
+	count := 0
+	var regionErrs []error
+	for _, region := range account.SyncRegions() {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		regionCfg := cfg.Copy()
+		regionCfg.Region = region
+
+		regionCount, err := s.syncWorkSpacesInRegion(ctx, regionCfg, accountID)
+		count += regionCount
+		if err != nil {
+			// Opt-in regions that aren't enabled for the account reject our credentials
+			if account.DiscoversAllRegions() && isRegionDisabledError(err) {
+				log.Printf("Skipping region %s for account ID %d: not enabled", region, accountID)
+				continue
+			}
+			regionErrs = append(regionErrs, fmt.Errorf("%s: %w", region, err))
+		}
+	}
+
+	// Workspaces in regions dropped from the account's configuration are no longer tracked
+	removed, err := models.MarkRemovedOutsideRegions(s.DB, accountID, account.SyncRegions())
+	if err != nil {
+		regionErrs = append(regionErrs, fmt.Errorf("removed workspaces outside synced regions: %w", err))
+	} else if len(removed) > 0 {
+		log.Printf("Marked %d workspaces of account ID %d in regions no longer synced as removed", len(removed), accountID)
+	}
+
+	// Update last sync timestamp for the account
+	if len(regionErrs) == 0 {
+		models.UpdateAWSAccountLastSync(s.DB, accountID)
+	}
+
+	log.Printf("Successfully synced %d workspaces for account ID %d", count, accountID)
+	return count, errors.Join(regionErrs...)
+}
+
+// syncWorkSpacesInRegion upserts every WorkSpace in the config's region
+func (s *AWSService) syncWorkSpacesInRegion(ctx context.Context, cfg aws.Config, accountID int) (int, error) {
 	// Create WorkSpaces client
 	client := workspaces.NewFromConfig(cfg)
 
 	// Describe all workspaces using pagination
-	log.Printf("Fetching WorkSpaces from AWS for account ID %d...", accountID)
+	log.Printf("Fetching WorkSpaces from AWS for account ID %d in %s...", accountID, cfg.Region)
 	input := &workspaces.DescribeWorkspacesInput{}
 
-	count := 0
+	count, tagErrors := 0, 0
+	var lastTagErr error
+	seen := []string{}
 	paginator := workspaces.NewDescribeWorkspacesPaginator(client, input)
 
+	// Creation notifications are held back until the region has been synced once, otherwise
+	// adding an account would announce every existing workspace
+	notifyCreated, err := models.HasWorkspaces(s.DB, accountID, cfg.Region)
+	if err != nil {
+		log.Printf("Failed to check for known workspaces in %s: %v", cfg.Region, err)
+	}
+
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(ctx)
 		if err != nil {
 			return count, fmt.Errorf("failed to get page: %w", err)
 		}
 
+		// Load the page's stored rows first so changes can be detected
+		pageIDs := make([]string, len(page.Workspaces))
+		for i, ws := range page.Workspaces {
+			pageIDs[i] = aws.ToString(ws.WorkspaceId)
+		}
+		stored, loadErr := models.GetWorkspacesByIDs(s.DB, pageIDs)
+		if loadErr != nil {
+			log.Printf("Failed to load stored workspaces in %s: %v", cfg.Region, loadErr)
+		}
+
 		for _, ws := range page.Workspaces {
+			seen = append(seen, aws.ToString(ws.WorkspaceId))
+
 			// Upsert workspace with account ID
-			err := s.upsertWorkspace(ws, accountID)
+			err := s.upsertWorkspace(ws, accountID, cfg.Region)
 			if err != nil {
 				log.Printf("Failed to upsert workspace %s: %v", *ws.WorkspaceId, err)
 				continue
 			}
 			count++
+
+			// Skip notifications when the previous row couldn't be read rather than
+			// announcing an existing workspace as new
+			if loadErr == nil {
+				s.notifyWorkspaceChanges(stored[aws.ToString(ws.WorkspaceId)], ws, notifyCreated)
+			}
+
+			if err := s.syncWorkspaceTags(ctx, client, aws.ToString(ws.WorkspaceId)); err != nil {
+				if ctx.Err() != nil {
+					return count, ctx.Err()
+				}
+				tagErrors++
+				lastTagErr = err
+			}
+
+			// Version the row once its tags are current
+			if err := models.RecordWorkspaceVersion(s.DB, aws.ToString(ws.WorkspaceId)); err != nil {
+				log.Printf("Failed to record history for workspace %s: %v", *ws.WorkspaceId, err)
+			}
 		}
 	}
 
-	// Update last sync timestamp for the account
-	models.UpdateAWSAccountLastSync(s.DB, accountID)
+	// Report tag failures once per region rather than once per workspace
+	if tagErrors > 0 {
+		log.Printf("Failed to fetch tags for %d workspaces in %s: %v", tagErrors, cfg.Region, lastTagErr)
+		s.Progress.AddError(fmt.Sprintf("tags for %d workspaces in %s: %v", tagErrors, cfg.Region, lastTagErr))
+	}
+
+	// Last-known connection times are only available from the connection status API.
+	// Missing permissions for it shouldn't fail the inventory sync.
+	if err := s.syncConnectionStatus(ctx, client); err != nil {
+		log.Printf("Failed to fetch connection status in %s: %v", cfg.Region, err)
+		s.Progress.AddError(fmt.Sprintf("connection status in %s: %v", cfg.Region, err))
+	}
+
+	// Every page was read, so anything stored for this account and region that AWS
+	// no longer returns has been removed
+	if accountID > 0 {
+		s.reconcileRemovedWorkspaces(accountID, cfg.Region, seen)
+	}
 
-	log.Printf("Successfully synced %d workspaces for account ID %d", count, accountID)
 	return count, nil
 }
 
-// SyncAllAccounts syncs WorkSpaces from all active AWS accounts
+// reconcileRemovedWorkspaces marks workspaces missing from AWS as removed and notifies about them
+func (s *AWSService) reconcileRemovedWorkspaces(accountID int, region string, seen []string) {
+	removed, err := models.MarkRemovedWorkspaces(s.DB, accountID, region, seen)
+	if err != nil {
+		log.Printf("Failed to reconcile removed workspaces for account ID %d in %s: %v", accountID, region, err)
+		s.Progress.AddError(fmt.Sprintf("removed workspaces in %s: %v", region, err))
+		return
+	}
+
+	notificationService := &NotificationService{DB: s.DB}
+	for _, ws := range removed {
+		// A workspace seen as TERMINATED was already notified about by the sync that saw it
+		if ws.State == string(wstypes.WorkspaceStateTerminated) {
+			continue
+		}
+		log.Printf("WorkSpace %s no longer exists in AWS, marked as removed", ws.WorkspaceID)
+		notificationService.NotifyWorkspaceTerminated(ws.WorkspaceID, ws.UserName, ws.DisplayName)
+	}
+}
+
+// syncWorkspaceTags stores the current tags of a WorkSpace
+func (s *AWSService) syncWorkspaceTags(ctx context.Context, client *workspaces.Client, workspaceID string) error {
+	output, err := client.DescribeTags(ctx, &workspaces.DescribeTagsInput{
+		ResourceId: aws.String(workspaceID),
+	})
+	if err != nil {
+		return err
+	}
+
+	tags := make(map[string]string, len(output.TagList))
+	for _, tag := range output.TagList {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return models.UpdateWorkspaceTags(s.DB, workspaceID, tags)
+}
+
+// syncConnectionStatus records the last-known user connection time of every WorkSpace in the
+// region, and a snapshot of its connection state for usage calculation
+func (s *AWSService) syncConnectionStatus(ctx context.Context, client *workspaces.Client) error {
+	capturedAt := time.Now().UTC()
+	input := &workspaces.DescribeWorkspacesConnectionStatusInput{}
+	for {
+		output, err := client.DescribeWorkspacesConnectionStatus(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range output.WorkspacesConnectionStatus {
+			workspaceID := aws.ToString(status.WorkspaceId)
+			if status.ConnectionState != "" {
+				if err := models.InsertConnectionSnapshot(s.DB, workspaceID, string(status.ConnectionState), capturedAt); err != nil {
+					log.Printf("Failed to record connection state for workspace %s: %v", workspaceID, err)
+				}
+			}
+
+			if status.LastKnownUserConnectionTimestamp == nil {
+				continue
+			}
+			if err := models.UpdateWorkspaceLastConnection(s.DB, workspaceID, *status.LastKnownUserConnectionTimestamp); err != nil {
+				log.Printf("Failed to update last connection for workspace %s: %v", workspaceID, err)
+			}
+		}
+
+		if output.NextToken == nil {
+			return nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// isRegionDisabledError reports whether AWS rejected a call because the region is not enabled
+func isRegionDisabledError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "UnrecognizedClientException", "InvalidClientTokenId", "AuthFailure":
+		return true
+	}
+	return false
+}
+
+// SyncAllAccounts syncs WorkSpaces from all active AWS accounts, several accounts at a time
 func (s *AWSService) SyncAllAccounts(ctx context.Context) (int, error) {
 	// Get all active accounts
 	accounts, err := models.GetAllAWSAccounts(s.DB)
@@ -181,33 +362,55 @@ func (s *AWSService) SyncAllAccounts(ctx context.Context) (int, error) {
 		return 0, fmt.Errorf("failed to get AWS accounts: %w", err)
 	}
 
-	totalCount := 0
+	syncable := make([]models.AWSAccount, 0, len(accounts))
 	for _, account := range accounts {
 		if !account.IsActive || account.Status == "error" {
 			log.Printf("Skipping inactive or error account: %s", account.Name)
 			continue
 		}
+		syncable = append(syncable, account)
+	}
 
-		count, err := s.SyncWorkSpacesForAccount(ctx, account.ID)
-		if err != nil {
-			log.Printf("Failed to sync account %s: %v", account.Name, err)
-			models.UpdateAWSAccountStatus(s.DB, account.ID, "error")
-			continue
-		}
-
-		totalCount += count
-		models.UpdateAWSAccountStatus(s.DB, account.ID, "connected")
+	totalCount, err := s.runAccounts(ctx, syncable, s.syncAccountWorkSpaces)
+	if err != nil {
+		return totalCount, err
 	}
 
 	log.Printf("Successfully synced %d workspaces across all accounts", totalCount)
 	return totalCount, nil
 }
 
+// SyncSingleAccount syncs WorkSpaces for one account under the per-account timeout
+func (s *AWSService) SyncSingleAccount(ctx context.Context, accountID int) (int, error) {
+	account, err := models.GetAWSAccountByID(s.DB, accountID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get AWS account: %w", err)
+	}
+	return s.runAccounts(ctx, []models.AWSAccount{*account}, s.syncAccountWorkSpaces)
+}
+
+// syncAccountWorkSpaces syncs one account's WorkSpaces under runAccounts and records the
+// account's status
+func (s *AWSService) syncAccountWorkSpaces(ctx context.Context, account *models.AWSAccount) (int, error) {
+	count, err := s.SyncWorkSpacesForAccount(ctx, account.ID)
+	switch {
+	case err == nil:
+		models.UpdateAWSAccountStatus(s.DB, account.ID, "connected")
+	case errors.Is(context.Cause(ctx), errAccountTimeout):
+		// Timed out accounts are retried on the next sync, unlike accounts in error
+		models.UpdateAWSAccountStatus(s.DB, account.ID, "timeout")
+	case ctx.Err() != nil:
+		// The whole sync was cancelled; this account did nothing wrong
+	default:
+		models.UpdateAWSAccountStatus(s.DB, account.ID, "error")
+	}
+	return count, err
+}
+
 // upsertWorkspace inserts or updates a workspace in the database
-func (s *AWSService) upsertWorkspace(ws wstypes.Workspace, accountID int) error {
-	// Note: CreationTime, TerminationTime, and LastKnownUserConnectionTimestamp
-	// are not available in AWS SDK v2 Workspace struct, so we set them to nil
-	var createdAt, terminatedAt, lastConnection *time.Time
+func (s *AWSService) upsertWorkspace(ws wstypes.Workspace, accountID int, region string) error {
+	// Creation/termination times come from CloudTrail (ApplyWorkspaceLifecycleEvents) and
+	// last connection times from the connection status API, so they aren't set here
 
 	// Convert bundle properties
 	var rootVolSize, userVolSize *int32
@@ -224,12 +427,14 @@ func (s *AWSService) upsertWorkspace(ws wstypes.Workspace, accountID int) error
 	}
 
 	var runningMode *string
+	var autoStopTimeout *int32
 	if ws.WorkspaceProperties != nil {
 		// RunningMode is a RunningMode type (string-based), not a pointer
 		if ws.WorkspaceProperties.RunningMode != "" {
 			mode := string(ws.WorkspaceProperties.RunningMode)
 			runningMode = &mode
 		}
+		autoStopTimeout = ws.WorkspaceProperties.RunningModeAutoStopTimeoutInMinutes
 	}
 
 	var state *string
@@ -250,9 +455,8 @@ func (s *AWSService) upsertWorkspace(ws wstypes.Workspace, accountID int) error
 			workspace_id, user_name, display_name, directory_id, ip_address,
 			state, bundle_id, subnet_id, computer_name, running_mode,
 			root_volume_size_gib, user_volume_size_gib, compute_type_name,
-			created_at, terminated_at, last_known_user_connection_timestamp,
-			aws_account_id, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, NOW())
+			aws_account_id, region, auto_stop_timeout_minutes, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, NOW())
 		ON CONFLICT (workspace_id) DO UPDATE SET
 			user_name = $2,
 			display_name = $3,
@@ -266,7 +470,10 @@ func (s *AWSService) upsertWorkspace(ws wstypes.Workspace, accountID int) error
 			root_volume_size_gib = $11,
 			user_volume_size_gib = $12,
 			compute_type_name = $13,
-			aws_account_id = $17,
+			aws_account_id = $14,
+			region = $15,
+			auto_stop_timeout_minutes = $16,
+			removed_at = NULL,
 			updated_at = NOW()
 	`,
 		ws.WorkspaceId,
@@ -282,10 +489,9 @@ func (s *AWSService) upsertWorkspace(ws wstypes.Workspace, accountID int) error
 		rootVolSize,
 		userVolSize,
 		computeTypeName,
-		createdAt,
-		terminatedAt,
-		lastConnection,
 		accountIDPtr,
+		region,
+		autoStopTimeout,
 	)
 
 	return err
@@ -333,265 +539,177 @@ func (s *AWSService) TestConnection(ctx context.Context) error {
 	return err
 }
 
-// SyncCloudTrail fetches CloudTrail events for WorkSpaces and stores them
-func (s *AWSService) SyncCloudTrail(ctx context.Context) (int, error) {
-	cfg, err := s.GetAWSConfig(ctx)
-	if err != nil {
-		return 0, err
-	}
-
-	// Create CloudTrail client
-	client := cloudtrail.NewFromConfig(cfg)
+// cloudTrailLookups select WorkSpaces events. Creation and termination events don't always
+// reference the workspace as a resource, so they are looked up by name as well.
+var cloudTrailLookups = []cttypes.LookupAttribute{
+	{
+		AttributeKey:   cttypes.LookupAttributeKeyResourceType,
+		AttributeValue: aws.String("AWS::WorkSpaces::Workspace"),
+	},
+	{
+		AttributeKey:   cttypes.LookupAttributeKeyEventName,
+		AttributeValue: aws.String("CreateWorkspaces"),
+	},
+	{
+		AttributeKey:   cttypes.LookupAttributeKeyEventName,
+		AttributeValue: aws.String("TerminateWorkspaces"),
+	},
+}
 
-	// Calculate time range (last 7 days)
-	endTime := time.Now()
-	startTime := endTime.Add(-7 * 24 * time.Hour)
+// cloudTrailRetention is how far back LookupEvents can read
+const cloudTrailRetention = 90 * 24 * time.Hour
 
+// SyncCloudTrail fetches CloudTrail events for WorkSpaces in each account's regions (or only
+// accountID when set). Each region resumes from its stored cursor.
+func (s *AWSService) SyncCloudTrail(ctx context.Context, accountID int) (int, error) {
 	log.Println("Fetching CloudTrail events from AWS...")
 
-	// Lookup events for WorkSpaces
-	input := &cloudtrail.LookupEventsInput{
-		StartTime: &startTime,
-		EndTime:   &endTime,
-		LookupAttributes: []cttypes.LookupAttribute{
-			{
-				AttributeKey:   cttypes.LookupAttributeKeyResourceType,
-				AttributeValue: aws.String("AWS::WorkSpaces::Workspace"),
-			},
-		},
-		MaxResults: aws.Int32(50),
-	}
-
-	count := 0
-	paginator := cloudtrail.NewLookupEventsPaginator(client, input)
-
-	for paginator.HasMorePages() {
-		output, err := paginator.NextPage(ctx)
-		if err != nil {
-			log.Printf("Error fetching CloudTrail events: %v", err)
-			break
-		}
+	count, err := s.forEachAccountRegion(ctx, accountID, s.syncCloudTrailInRegion)
 
-		for _, event := range output.Events {
-			err := s.upsertCloudTrailEvent(&event)
-			if err != nil {
-				log.Printf("Failed to upsert CloudTrail event %s: %v", *event.EventId, err)
-				continue
-			}
-			count++
-		}
+	if _, err := models.ApplyWorkspaceLifecycleEvents(s.DB); err != nil {
+		log.Printf("Failed to apply workspace lifecycle events: %v", err)
 	}
 
-	log.Printf("Successfully synced %d CloudTrail events", count)
-	return count, nil
+	log.Printf("Synced %d CloudTrail events", count)
+	return count, err
 }
 
-// upsertCloudTrailEvent inserts or updates a CloudTrail event
-func (s *AWSService) upsertCloudTrailEvent(event *cttypes.Event) error {
-	// Extract workspace ID from resources
-	workspaceID := ""
-	for _, resource := range event.Resources {
-		if resource.ResourceType != nil && *resource.ResourceType == "AWS::WorkSpaces::Workspace" {
-			if resource.ResourceName != nil {
-				workspaceID = *resource.ResourceName
-			}
-			break
-		}
-	}
-
-	// Marshal JSON fields
-	userIdentityJSON, _ := json.Marshal(event.Username)
-	requestParamsJSON := []byte("{}")
-	if event.CloudTrailEvent != nil {
-		// Parse CloudTrailEvent to extract request parameters
-		var ctEvent map[string]interface{}
-		if err := json.Unmarshal([]byte(*event.CloudTrailEvent), &ctEvent); err == nil {
-			if reqParams, ok := ctEvent["requestParameters"]; ok {
-				requestParamsJSON, _ = json.Marshal(reqParams)
-			}
-		}
-	}
-	responseElementsJSON := []byte("{}")
-
-	ctEvent := &models.CloudTrailEvent{
-		EventID:            aws.ToString(event.EventId),
-		EventName:          aws.ToString(event.EventName),
-		EventTime:          aws.ToTime(event.EventTime),
-		EventSource:        aws.ToString(event.EventSource),
-		Username:           aws.ToString(event.Username),
-		UserIdentity:       userIdentityJSON,
-		WorkspaceID:        workspaceID,
-		RequestParameters:  requestParamsJSON,
-		ResponseElements:   responseElementsJSON,
-		EventRegion:        "us-east-1", // Default region
-	}
+// syncCloudTrailInRegion reads events since the region's cursor, less an overlap for events
+// CloudTrail delivers late, or the configured backfill on the first run. The cursor only
+// advances when every event in the window was stored.
+func (s *AWSService) syncCloudTrailInRegion(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error) {
+	client := cloudtrail.NewFromConfig(cfg)
 
-	return models.InsertCloudTrailEvent(s.DB, ctEvent)
-}
+	endTime := time.Now()
+	earliest := endTime.Add(-cloudTrailRetention)
 
-// SyncBillingData fetches cost data from AWS Cost Explorer
-func (s *AWSService) SyncBillingData(ctx context.Context) (int, error) {
-	cfg, err := s.GetAWSConfig(ctx)
+	cursor, err := models.GetCloudTrailCursor(s.DB, account.ID, cfg.Region)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("failed to read CloudTrail cursor: %w", err)
 	}
-
-	// Create Cost Explorer client
-	client := costexplorer.NewFromConfig(cfg)
-
-	// Calculate time range (last 30 days)
-	endDate := time.Now().Format("2006-01-02")
-	startDate := time.Now().Add(-30 * 24 * time.Hour).Format("2006-01-02")
-
-	log.Println("Fetching billing data from AWS Cost Explorer...")
-
-	// Get cost and usage
-	input := &costexplorer.GetCostAndUsageInput{
-		TimePeriod: &cetypes.DateInterval{
-			Start: &startDate,
-			End:   &endDate,
-		},
-		Granularity: cetypes.GranularityDaily,
-		Metrics:     []string{"UnblendedCost", "UsageQuantity"},
-		Filter: &cetypes.Expression{
-			Dimensions: &cetypes.DimensionValues{
-				Key:    cetypes.DimensionService,
-				Values: []string{"Amazon WorkSpaces"},
-			},
-		},
-		GroupBy: []cetypes.GroupDefinition{
-			{
-				Type: cetypes.GroupDefinitionTypeDimension,
-				Key:  aws.String("USAGE_TYPE"),
-			},
-		},
-	}
-
-	result, err := client.GetCostAndUsage(ctx, input)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get cost and usage: %w", err)
+	var startTime time.Time
+	if cursor != nil {
+		overlap := time.Duration(models.GetSettingInt(s.DB, "cloudtrail.overlap_minutes", 15)) * time.Minute
+		startTime = cursor.Add(-overlap)
+	} else {
+		backfill := time.Duration(models.GetSettingInt(s.DB, "cloudtrail.backfill_days", 7)) * 24 * time.Hour
+		startTime = endTime.Add(-backfill)
+	}
+	if startTime.Before(earliest) {
+		startTime = earliest
 	}
 
-	count := 0
-	for _, resultByTime := range result.ResultsByTime {
-		startDate, _ := time.Parse("2006-01-02", *resultByTime.TimePeriod.Start)
-		endDate, _ := time.Parse("2006-01-02", *resultByTime.TimePeriod.End)
-
-		for _, group := range resultByTime.Groups {
-			usageType := ""
-			if len(group.Keys) > 0 {
-				usageType = group.Keys[0]
-			}
+	count, failed := 0, 0
+	var lastEventTime *time.Time
+	for _, lookup := range cloudTrailLookups {
+		input := &cloudtrail.LookupEventsInput{
+			StartTime:        &startTime,
+			EndTime:          &endTime,
+			LookupAttributes: []cttypes.LookupAttribute{lookup},
+			MaxResults:       aws.Int32(50),
+		}
 
-			// Extract cost amount
-			var amount float64
-			if cost, ok := group.Metrics["UnblendedCost"]; ok && cost.Amount != nil {
-				amount, _ = strconv.ParseFloat(*cost.Amount, 64)
-			}
+		paginator := cloudtrail.NewLookupEventsPaginator(client, input)
 
-			// Extract workspace ID from usage type if possible
-			workspaceID := extractWorkspaceIDFromUsageType(usageType)
-
-			billingData := &models.BillingData{
-				WorkspaceID: workspaceID,
-				Service:     "Amazon WorkSpaces",
-				UsageType:   usageType,
-				StartDate:   startDate,
-				EndDate:     endDate,
-				Amount:      amount,
-				Unit:        "USD",
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				return count, fmt.Errorf("failed to look up %s events: %w", aws.ToString(lookup.AttributeValue), err)
 			}
 
-			if err := models.UpsertBillingData(s.DB, billingData); err != nil {
-				log.Printf("Failed to upsert billing data: %v", err)
-				continue
+			for _, event := range output.Events {
+				err := s.upsertCloudTrailEvent(&event, cfg.Region)
+				if err != nil {
+					log.Printf("Failed to upsert CloudTrail event %s: %v", aws.ToString(event.EventId), err)
+					failed++
+					continue
+				}
+				count++
+				if event.EventTime != nil && (lastEventTime == nil || event.EventTime.After(*lastEventTime)) {
+					lastEventTime = event.EventTime
+				}
 			}
-			count++
 		}
 	}
 
-	log.Printf("Successfully synced %d billing records", count)
-	return count, nil
-}
-
-// extractWorkspaceIDFromUsageType attempts to extract workspace ID from usage type
-func extractWorkspaceIDFromUsageType(usageType string) string {
-	// AWS Cost Explorer doesn't directly provide workspace IDs in usage types
-	// This is a placeholder - in production, you might need to correlate
-	// with workspace tags or other metadata
-	return ""
-}
-
-// CalculateUsageHours calculates monthly usage hours from workspace connection data
-func (s *AWSService) CalculateUsageHours(ctx context.Context) (int, error) {
-	// Get current month
-	now := time.Now()
-	currentMonth := now.Format("2006-01")
-
-	log.Printf("Calculating usage hours for month: %s", currentMonth)
-
-	// Get all active workspaces
-	query := `
-		SELECT workspace_id, created_at, terminated_at, state
-		FROM workspaces
-		WHERE state IN ('AVAILABLE', 'STOPPED', 'IMPAIRED')
-	`
-
-	rows, err := s.DB.Query(query)
-	if err != nil {
-		return 0, err
+	if failed > 0 {
+		return count, fmt.Errorf("failed to store %d CloudTrail events", failed)
 	}
-	defer rows.Close()
 
-	count := 0
-	for rows.Next() {
-		var workspaceID string
-		var createdAt, terminatedAt sql.NullTime
-		var state string
-
-		if err := rows.Scan(&workspaceID, &createdAt, &terminatedAt, &state); err != nil {
-			continue
-		}
+	// Without new events the cursor stays put, so the next run rereads the same window
+	if lastEventTime != nil && (cursor == nil || lastEventTime.After(*cursor)) {
+		cursor = lastEventTime
+	}
+	if err := models.SaveCloudTrailCursor(s.DB, account.ID, cfg.Region, cursor); err != nil {
+		return count, fmt.Errorf("failed to save CloudTrail cursor: %w", err)
+	}
+	return count, nil
+}
 
-		// Calculate hours for the month
-		// Simple calculation: assume 720 hours per month (30 days * 24 hours)
-		// In production, you would calculate based on actual connection logs from CloudTrail
-		var usageHours float64
-
-		if state == "AVAILABLE" {
-			// Running 24/7
-			usageHours = 720.0
-		} else if state == "STOPPED" {
-			// Stopped workspaces - minimal hours
-			usageHours = 0.0
+// upsertCloudTrailEvent stores a looked-up CloudTrail event, parsing its full record. The
+// lookup's own fields fill in anything the record doesn't have.
+func (s *AWSService) upsertCloudTrailEvent(event *cttypes.Event, region string) error {
+	ctEvent := &models.CloudTrailEvent{}
+	if event.CloudTrailEvent != nil {
+		parsed, err := parseCloudTrailRecord([]byte(*event.CloudTrailEvent))
+		if err != nil {
+			log.Printf("Failed to parse CloudTrail event %s: %v", aws.ToString(event.EventId), err)
 		} else {
-			// Default assumption
-			usageHours = 160.0 // ~40 hours per week
+			ctEvent = parsed
 		}
+	}
 
-		// Upsert usage data
-		if err := models.UpsertWorkspaceUsage(s.DB, workspaceID, currentMonth, usageHours); err != nil {
-			log.Printf("Failed to upsert usage for %s: %v", workspaceID, err)
-			continue
+	if ctEvent.EventID == "" {
+		ctEvent.EventID = aws.ToString(event.EventId)
+		ctEvent.EventName = aws.ToString(event.EventName)
+		ctEvent.EventTime = aws.ToTime(event.EventTime)
+		ctEvent.EventSource = aws.ToString(event.EventSource)
+		ctEvent.UserIdentity = json.RawMessage("{}")
+		ctEvent.RequestParameters = json.RawMessage("{}")
+		ctEvent.ResponseElements = json.RawMessage("{}")
+	}
+	if username := aws.ToString(event.Username); username != "" {
+		ctEvent.Username = username
+	}
+	if ctEvent.EventRegion == "" {
+		ctEvent.EventRegion = region
+	}
+	if ctEvent.ReadOnly == nil && event.ReadOnly != nil {
+		readOnly := *event.ReadOnly == "true"
+		ctEvent.ReadOnly = &readOnly
+	}
+	for _, resource := range event.Resources {
+		if aws.ToString(resource.ResourceType) == "AWS::WorkSpaces::Workspace" && resource.ResourceName != nil {
+			ctEvent.WorkspaceIDs = appendUnique(ctEvent.WorkspaceIDs, *resource.ResourceName)
 		}
-		count++
+	}
+	if ctEvent.WorkspaceID == "" && len(ctEvent.WorkspaceIDs) > 0 {
+		ctEvent.WorkspaceID = ctEvent.WorkspaceIDs[0]
 	}
 
-	log.Printf("Successfully calculated usage for %d workspaces", count)
-	return count, nil
+	return models.InsertCloudTrailEvent(s.DB, ctEvent)
 }
 
 // SyncActiveDirectoryUsers syncs user information from Active Directory
-// SyncActiveDirectoryUsersFromServer syncs users from a specific LDAP server
+// SyncActiveDirectoryUsersFromServer syncs users from a specific LDAP server. Users it
+// doesn't find may be in another server, so they are only marked not found by
+// SyncAllLDAPServers.
 func (s *AWSService) SyncActiveDirectoryUsersFromServer(ctx context.Context, serverID int) (int, error) {
+	count, _, err := s.syncLDAPServer(ctx, serverID)
+	return count, err
+}
+
+// syncLDAPServer syncs users from an LDAP server, returning the users it searched for
+// without finding
+func (s *AWSService) syncLDAPServer(ctx context.Context, serverID int) (int, map[string]bool, error) {
 	// Get LDAP server config
 	server, err := models.GetLDAPServerByID(s.DB, serverID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get LDAP server: %w", err)
+		return 0, nil, fmt.Errorf("failed to get LDAP server: %w", err)
 	}
 
 	if !server.IsActive {
-		return 0, fmt.Errorf("LDAP server is not active")
+		return 0, nil, fmt.Errorf("LDAP server is not active")
 	}
 
 	log.Printf("Connecting to LDAP server: %s (%s)", server.Name, server.ServerURL)
@@ -599,25 +717,26 @@ func (s *AWSService) SyncActiveDirectoryUsersFromServer(ctx context.Context, ser
 	// Connect to LDAP
 	l, err := ldap.DialURL(server.ServerURL)
 	if err != nil {
-		return 0, fmt.Errorf("failed to connect to LDAP: %w", err)
+		return 0, nil, fmt.Errorf("failed to connect to LDAP: %w", err)
 	}
 	defer l.Close()
 
 	// Bind with credentials
 	err = l.Bind(server.BindUsername, server.BindPassword)
 	if err != nil {
-		return 0, fmt.Errorf("failed to bind to LDAP: %w", err)
+		return 0, nil, fmt.Errorf("failed to bind to LDAP: %w", err)
 	}
 
-	// Get all workspace users
-	query := "SELECT DISTINCT user_name FROM workspaces WHERE user_name IS NOT NULL AND user_name != ''"
-	rows, err := s.DB.Query(query)
+	// Get the users to look up
+	rows, err := s.DB.Query(adSyncUsersQuery)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	defer rows.Close()
 
 	count := 0
+	notFound := map[string]bool{}
+	managerEmails := map[string]string{}
 	for rows.Next() {
 		var userName string
 		if err := rows.Scan(&userName); err != nil {
@@ -637,7 +756,7 @@ func (s *AWSService) SyncActiveDirectoryUsersFromServer(ctx context.Context, ser
 			server.BaseDN,
 			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 			searchFilter,
-			[]string{"displayName", "mail", "department", "title", "manager"},
+			adUserAttributes,
 			nil,
 		)
 
@@ -649,18 +768,14 @@ func (s *AWSService) SyncActiveDirectoryUsersFromServer(ctx context.Context, ser
 
 		if len(sr.Entries) == 0 {
 			log.Printf("User %s not found in LDAP server %s", userName, server.Name)
+			notFound[userName] = true
 			continue
 		}
 
-		// Get user attributes
-		entry := sr.Entries[0]
-		displayName := entry.GetAttributeValue("displayName")
-		email := entry.GetAttributeValue("mail")
-
-		// Update workspace with user info (assuming you have a function for this)
-		// For now, just log the information
-		log.Printf("Found user %s: %s <%s>", userName, displayName, email)
-		// TODO: Update workspace or user table with this information
+		if err := s.updateWorkspaceADInfo(l, userName, sr.Entries[0], managerEmails); err != nil {
+			log.Printf("Failed to update AD info for %s: %v", userName, err)
+			continue
+		}
 		count++
 	}
 
@@ -668,10 +783,11 @@ func (s *AWSService) SyncActiveDirectoryUsersFromServer(ctx context.Context, ser
 	models.UpdateLDAPServerLastSync(s.DB, serverID)
 
 	log.Printf("Successfully synced %d users from LDAP server %s", count, server.Name)
-	return count, nil
+	return count, notFound, nil
 }
 
-// SyncAllLDAPServers syncs users from all active LDAP servers
+// SyncAllLDAPServers syncs users from all active LDAP servers. Users none of them has are
+// marked not found, unless a server couldn't be searched.
 func (s *AWSService) SyncAllLDAPServers(ctx context.Context) (int, error) {
 	// Get all active LDAP servers
 	servers, err := models.GetAllLDAPServers(s.DB)
@@ -680,21 +796,41 @@ func (s *AWSService) SyncAllLDAPServers(ctx context.Context) (int, error) {
 	}
 
 	totalCount := 0
+	var notFound map[string]bool
+	searchedAll := true
 	for _, server := range servers {
 		if !server.IsActive || server.Status == "error" {
 			log.Printf("Skipping inactive or error LDAP server: %s", server.Name)
 			continue
 		}
 
-		count, err := s.SyncActiveDirectoryUsersFromServer(ctx, server.ID)
+		count, missing, err := s.syncLDAPServer(ctx, server.ID)
 		if err != nil {
 			log.Printf("Failed to sync LDAP server %s: %v", server.Name, err)
 			models.UpdateLDAPServerStatus(s.DB, server.ID, "error")
+			searchedAll = false
 			continue
 		}
 
 		totalCount += count
 		models.UpdateLDAPServerStatus(s.DB, server.ID, "connected")
+
+		// Keep the users missing from every server searched so far
+		if notFound == nil {
+			notFound = missing
+		} else {
+			for userName := range notFound {
+				if !missing[userName] {
+					delete(notFound, userName)
+				}
+			}
+		}
+	}
+
+	if searchedAll {
+		for userName := range notFound {
+			s.markADUserNotFound(userName)
+		}
 	}
 
 	log.Printf("Successfully synced %d users across all LDAP servers", totalCount)
@@ -751,15 +887,15 @@ func (s *AWSService) SyncActiveDirectoryUsers(ctx context.Context) (int, error)
 		return 0, fmt.Errorf("failed to bind to AD: %w", err)
 	}
 
-	// Get all workspace users
-	query := "SELECT DISTINCT user_name FROM workspaces WHERE user_name IS NOT NULL AND user_name != ''"
-	rows, err := s.DB.Query(query)
+	// Get the users to look up
+	rows, err := s.DB.Query(adSyncUsersQuery)
 	if err != nil {
 		return 0, err
 	}
 	defer rows.Close()
 
 	count := 0
+	managerEmails := map[string]string{}
 	for rows.Next() {
 		var userName string
 		if err := rows.Scan(&userName); err != nil {
@@ -771,7 +907,7 @@ func (s *AWSService) SyncActiveDirectoryUsers(ctx context.Context) (int, error)
 			baseDN.Value,
 			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 			fmt.Sprintf("(sAMAccountName=%s)", ldap.EscapeFilter(userName)),
-			[]string{"displayName", "mail", "department", "title", "manager"},
+			adUserAttributes,
 			nil,
 		)
 
@@ -783,33 +919,11 @@ func (s *AWSService) SyncActiveDirectoryUsers(ctx context.Context) (int, error)
 
 		if len(sr.Entries) == 0 {
 			log.Printf("User %s not found in AD", userName)
+			s.markADUserNotFound(userName)
 			continue
 		}
 
-		entry := sr.Entries[0]
-
-		// Update workspace with AD info
-		updateQuery := `
-			UPDATE workspaces
-			SET ad_full_name = $1,
-			    ad_email = $2,
-			    ad_department = $3,
-			    ad_job_title = $4,
-			    ad_manager = $5,
-			    ad_last_sync = CURRENT_TIMESTAMP
-			WHERE user_name = $6
-		`
-
-		_, err = s.DB.Exec(updateQuery,
-			entry.GetAttributeValue("displayName"),
-			entry.GetAttributeValue("mail"),
-			entry.GetAttributeValue("department"),
-			entry.GetAttributeValue("title"),
-			entry.GetAttributeValue("manager"),
-			userName,
-		)
-
-		if err != nil {
+		if err := s.updateWorkspaceADInfo(l, userName, sr.Entries[0], managerEmails); err != nil {
 			log.Printf("Failed to update AD info for %s: %v", userName, err)
 			continue
 		}
@@ -820,3 +934,94 @@ func (s *AWSService) SyncActiveDirectoryUsers(ctx context.Context) (int, error)
 	log.Printf("Successfully synced AD info for %d users", count)
 	return count, nil
 }
+
+// markADUserNotFound records that a user's workspaces have no directory account
+func (s *AWSService) markADUserNotFound(userName string) {
+	if _, err := s.DB.Exec(`UPDATE workspaces SET ad_status = $1, ad_last_sync = CURRENT_TIMESTAMP WHERE user_name = $2`,
+		models.ADStatusNotFound, userName); err != nil {
+		log.Printf("Failed to update AD status for %s: %v", userName, err)
+	}
+}
+
+// adSyncUsersQuery lists the users the AD sync looks up: those with workspaces, and those
+// waiting for approval of a workspace request
+const adSyncUsersQuery = `
+	SELECT user_name FROM workspaces WHERE user_name IS NOT NULL AND user_name != ''
+	UNION
+	SELECT user_name FROM workspace_requests WHERE status = 'pending'`
+
+// adUserAttributes are the directory attributes read for each workspace user
+var adUserAttributes = []string{"displayName", "mail", "department", "title", "manager", "userAccountControl"}
+
+// adAccountDisabled is the ACCOUNTDISABLE flag of userAccountControl
+const adAccountDisabled = 0x2
+
+// updateWorkspaceADInfo stores a user's directory entry on their workspaces, and routes their
+// pending workspace requests to the manager it names. managerEmails caches the email of each
+// manager DN looked up on l.
+func (s *AWSService) updateWorkspaceADInfo(l *ldap.Conn, userName string, entry *ldap.Entry, managerEmails map[string]string) error {
+	status := models.ADStatusActive
+	if flags, err := strconv.Atoi(entry.GetAttributeValue("userAccountControl")); err == nil && flags&adAccountDisabled != 0 {
+		status = models.ADStatusDisabled
+	}
+
+	// The manager attribute is a DN; look up their email once per manager
+	manager := entry.GetAttributeValue("manager")
+	managerEmail, ok := managerEmails[manager]
+	if !ok && manager != "" {
+		managerEmail = lookupADEmail(l, manager)
+		managerEmails[manager] = managerEmail
+	}
+
+	_, err := s.DB.Exec(`
+		UPDATE workspaces
+		SET ad_full_name = $1,
+		    ad_email = $2,
+		    ad_department = $3,
+		    ad_job_title = $4,
+		    ad_manager = $5,
+		    ad_manager_email = $6,
+		    ad_status = $7,
+		    ad_last_sync = CURRENT_TIMESTAMP
+		WHERE user_name = $8
+	`,
+		entry.GetAttributeValue("displayName"),
+		entry.GetAttributeValue("mail"),
+		entry.GetAttributeValue("department"),
+		entry.GetAttributeValue("title"),
+		manager,
+		managerEmail,
+		status,
+		userName,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Requests made before the sync knew the user's manager go to the manager now
+	info := models.UserADInfo{Department: entry.GetAttributeValue("department"), Manager: manager, ManagerEmail: managerEmail}
+	routed, err := models.SetWorkspaceRequestManager(s.DB, userName, info)
+	if err != nil {
+		return err
+	}
+	requests := &WorkspaceRequestService{DB: s.DB}
+	for i := range routed {
+		requests.notifyApprovers(&routed[i])
+	}
+	return nil
+}
+
+// lookupADEmail reads the mail attribute of the entry with the given DN, or "" if it can't
+func lookupADEmail(l *ldap.Conn, dn string) string {
+	sr, err := l.Search(ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"mail"},
+		nil,
+	))
+	if err != nil || len(sr.Entries) == 0 {
+		return ""
+	}
+	return sr.Entries[0].GetAttributeValue("mail")
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/workspaces"
+)
+
+// DefaultRoleSessionName is used when an assume-role account has no session name
+const DefaultRoleSessionName = "workspaces-inventory"
+
+// maxRoleChainDepth bounds how many source accounts a role may be chained through
+const maxRoleChainDepth = 3
+
+// roleSession caches assumed-role credentials for one account. The credentials cache
+// refreshes them shortly before they expire; the fingerprint detects config changes.
+type roleSession struct {
+	fingerprint string
+	cache       *aws.CredentialsCache
+}
+
+var (
+	roleSessionsMu sync.Mutex
+	roleSessions   = make(map[int]*roleSession)
+)
+
+// ResetRoleSessions drops every cached assumed-role session, e.g. after an account's
+// credentials change, since other accounts may chain through it
+func ResetRoleSessions() {
+	roleSessionsMu.Lock()
+	defer roleSessionsMu.Unlock()
+	roleSessions = make(map[int]*roleSession)
+}
+
+// accountConfig builds the AWS config for an account by following its credential chain.
+// mfaToken is only needed to start a new session for a role that requires MFA.
+func (s *AWSService) accountConfig(ctx context.Context, account *models.AWSAccount, mfaToken string, depth int) (aws.Config, error) {
+	if account.AuthType != models.AuthTypeAssumeRole {
+		if account.AccessKeyID == "" || account.SecretAccessKey == "" {
+			return aws.Config{}, fmt.Errorf("AWS credentials not configured for account %s", account.Name)
+		}
+		return config.LoadDefaultConfig(ctx,
+			config.WithRegion(account.Region),
+			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+				account.AccessKeyID,
+				account.SecretAccessKey,
+				"",
+			)),
+			s.retryerOption(),
+		)
+	}
+
+	if account.RoleARN == nil || *account.RoleARN == "" {
+		return aws.Config{}, fmt.Errorf("role ARN not configured for account %s", account.Name)
+	}
+	if depth >= maxRoleChainDepth {
+		return aws.Config{}, fmt.Errorf("role chain for account %s is longer than %d accounts", account.Name, maxRoleChainDepth)
+	}
+
+	source, err := s.sourceConfig(ctx, account, depth)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	cfg := source.Copy()
+	cfg.Region = account.Region
+	cfg.Credentials = s.roleCredentials(account, source, mfaToken)
+	return cfg, nil
+}
+
+// sourceConfig returns the config whose credentials assume the account's role: the
+// hub account it points at, or the ambient default credential chain
+func (s *AWSService) sourceConfig(ctx context.Context, account *models.AWSAccount, depth int) (aws.Config, error) {
+	if account.SourceAccountID == nil {
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(account.Region), s.retryerOption())
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("failed to load default credential chain: %w", err)
+		}
+		return cfg, nil
+	}
+
+	if *account.SourceAccountID == account.ID {
+		return aws.Config{}, fmt.Errorf("account %s cannot be its own source account", account.Name)
+	}
+	source, err := models.GetAWSAccountByID(s.DB, *account.SourceAccountID)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to get source account for %s: %w", account.Name, err)
+	}
+
+	cfg, err := s.accountConfig(ctx, source, "", depth+1)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("source account %s: %w", source.Name, err)
+	}
+	cfg.Region = account.Region
+	return cfg, nil
+}
+
+// roleCredentials returns the cached assumed-role session for an account, starting a
+// new one when none exists, the role config changed, or a fresh MFA code was supplied
+func (s *AWSService) roleCredentials(account *models.AWSAccount, source aws.Config, mfaToken string) aws.CredentialsProvider {
+	sessionName := DefaultRoleSessionName
+	if account.SessionName != nil && *account.SessionName != "" {
+		sessionName = *account.SessionName
+	}
+	mfaSerial := ""
+	if account.MFASerial != nil {
+		mfaSerial = *account.MFASerial
+	}
+	sourceID := ""
+	if account.SourceAccountID != nil {
+		sourceID = strconv.Itoa(*account.SourceAccountID)
+	}
+	duration := time.Duration(models.GetSettingInt(s.DB, "aws.assume_role_duration_minutes", 60)) * time.Minute
+
+	fingerprint := strings.Join([]string{
+		*account.RoleARN, account.ExternalID, sessionName, mfaSerial, sourceID, duration.String(),
+	}, "|")
+
+	roleSessionsMu.Lock()
+	defer roleSessionsMu.Unlock()
+
+	if session, ok := roleSessions[account.ID]; ok && session.fingerprint == fingerprint && mfaToken == "" {
+		return session.cache
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(source), *account.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		o.Duration = duration
+		if account.ExternalID != "" {
+			o.ExternalID = aws.String(account.ExternalID)
+		}
+		if mfaSerial != "" {
+			o.SerialNumber = aws.String(mfaSerial)
+			o.TokenProvider = mfaTokenProvider(account.Name, mfaToken)
+		}
+	})
+
+	cache := aws.NewCredentialsCache(provider)
+	roleSessions[account.ID] = &roleSession{fingerprint: fingerprint, cache: cache}
+	return cache
+}
+
+// mfaTokenProvider hands out a one-time MFA code. Background syncs can't prompt for a
+// code, so once the session it started expires the role must be re-tested with a new one.
+func mfaTokenProvider(accountName, token string) func() (string, error) {
+	var mu sync.Mutex
+	used := false
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token == "" || used {
+			return "", fmt.Errorf("MFA session for account %s has expired; test the connection with a new MFA code", accountName)
+		}
+		used = true
+		return token, nil
+	}
+}
+
+// ConnectionTest is the result of validating an account's credential chain
+type ConnectionTest struct {
+	Status    string `json:"status"` // connected, limited or error
+	Step      string `json:"step,omitempty"`
+	AccountID string `json:"accountId,omitempty"`
+	ARN       string `json:"arn,omitempty"`
+	SourceARN string `json:"sourceArn,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+// Connection test steps, reported in ConnectionTest.Step when one fails
+const (
+	TestStepSource      = "source"      // Credentials used to assume the role
+	TestStepCredentials = "credentials" // The account's own (or assumed) credentials
+	TestStepWorkSpaces  = "workspaces"  // WorkSpaces read permissions
+)
+
+// TestAccountConnection validates an account end to end: the source identity (for
+// assumed roles), the account identity, then WorkSpaces permissions. The account's
+// status and AWS account ID are updated from the result.
+func (s *AWSService) TestAccountConnection(ctx context.Context, account *models.AWSAccount, mfaToken string) *ConnectionTest {
+	result := &ConnectionTest{}
+	fail := func(step string, err error) *ConnectionTest {
+		result.Status = "error"
+		result.Step = step
+		result.Details = err.Error()
+		models.UpdateAWSAccountStatus(s.DB, account.ID, "error")
+		return result
+	}
+
+	if account.AuthType == models.AuthTypeAssumeRole {
+		source, err := s.sourceConfig(ctx, account, 0)
+		if err != nil {
+			return fail(TestStepSource, err)
+		}
+		identity, err := sts.NewFromConfig(source).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return fail(TestStepSource, err)
+		}
+		result.SourceARN = aws.ToString(identity.Arn)
+	}
+
+	cfg, err := s.accountConfig(ctx, account, mfaToken, 0)
+	if err != nil {
+		return fail(TestStepCredentials, err)
+	}
+	identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fail(TestStepCredentials, err)
+	}
+	result.AccountID = aws.ToString(identity.Account)
+	result.ARN = aws.ToString(identity.Arn)
+	if result.AccountID != "" {
+		models.UpdateAWSAccountID(s.DB, account.ID, result.AccountID)
+	}
+
+	_, err = workspaces.NewFromConfig(cfg).DescribeWorkspaces(ctx, &workspaces.DescribeWorkspacesInput{
+		Limit: aws.Int32(1),
+	})
+	if err != nil {
+		result.Status = "limited"
+		result.Step = TestStepWorkSpaces
+		result.Details = err.Error()
+		models.UpdateAWSAccountStatus(s.DB, account.ID, "limited")
+		return result
+	}
+
+	result.Status = "connected"
+	models.UpdateAWSAccountStatus(s.DB, account.ID, "connected")
+	return result
+}
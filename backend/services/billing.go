@@ -0,0 +1,316 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/costexplorer"
+	cetypes "github.com/aws/aws-sdk-go-v2/service/costexplorer/types"
+)
+
+// costExplorerRegion is the region the Cost Explorer API is served from
+const costExplorerRegion = "us-east-1"
+
+// costExplorerMetrics maps cost types to the Cost Explorer metric that reports them
+var costExplorerMetrics = map[string]string{
+	models.CostTypeUnblended: "UnblendedCost",
+	models.CostTypeAmortized: "AmortizedCost",
+	models.CostTypeNet:       "NetUnblendedCost",
+}
+
+// billingSyncOptions are the configured date range, granularity and cost types of a
+// billing sync
+type billingSyncOptions struct {
+	start       time.Time
+	end         time.Time // Exclusive
+	granularity cetypes.Granularity
+	costTypes   []string
+}
+
+// billingKey groups Cost Explorer results into one billing row
+type billingKey struct {
+	accountID int // 0 for linked accounts that aren't configured
+	usageType string
+	start     time.Time
+	end       time.Time
+}
+
+// billingCosts holds the cost of each billing row, per cost type
+type billingCosts map[string]map[billingKey]float64
+
+// SyncBillingData fetches WorkSpaces costs from Cost Explorer for each active account (or
+// only accountID when set). When billing.payer_account_id holds the 12-digit account number
+// of the organisation's payer account, costs of every linked account are fetched once
+// through it instead.
+func (s *AWSService) SyncBillingData(ctx context.Context, accountID int) (int, error) {
+	opts, err := s.billingSyncOptions()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Fetching %s billing data from %s to %s from AWS Cost Explorer...",
+		opts.granularity, opts.start.Format("2006-01-02"), opts.end.Format("2006-01-02"))
+
+	if payerNumber := strings.TrimSpace(models.GetSettingString(s.DB, "billing.payer_account_id", "")); payerNumber != "" {
+		payer, err := models.GetAWSAccountByAccountID(s.DB, payerNumber)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("billing.payer_account_id %s is not an active configured AWS account", payerNumber)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to get payer AWS account: %w", err)
+		}
+
+		var only *models.AWSAccount
+		if accountID > 0 {
+			only, err = models.GetAWSAccountByID(s.DB, accountID)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get AWS account: %w", err)
+			}
+		}
+		return s.forEachAccount(ctx, payer.ID, func(ctx context.Context, payer *models.AWSAccount) (int, error) {
+			return s.syncPayerBilling(ctx, payer, only, opts)
+		})
+	}
+
+	return s.forEachAccount(ctx, accountID, func(ctx context.Context, account *models.AWSAccount) (int, error) {
+		return s.syncAccountBilling(ctx, account, opts)
+	})
+}
+
+// billingSyncOptions reads the billing.lookback_days, billing.granularity and
+// billing.metrics settings
+func (s *AWSService) billingSyncOptions() (*billingSyncOptions, error) {
+	opts := &billingSyncOptions{}
+
+	granularity := strings.ToUpper(models.GetSettingString(s.DB, "billing.granularity", "DAILY"))
+	switch cetypes.Granularity(granularity) {
+	case cetypes.GranularityDaily, cetypes.GranularityMonthly:
+		opts.granularity = cetypes.Granularity(granularity)
+	default:
+		return nil, fmt.Errorf("invalid billing.granularity %q: use DAILY or MONTHLY", granularity)
+	}
+
+	for _, costType := range strings.Split(models.GetSettingString(s.DB, "billing.metrics", models.CostTypeUnblended), ",") {
+		costType = strings.ToLower(strings.TrimSpace(costType))
+		if costType == "" {
+			continue
+		}
+		if _, ok := costExplorerMetrics[costType]; !ok {
+			return nil, fmt.Errorf("invalid billing.metrics entry %q: use unblended, amortized or net", costType)
+		}
+		opts.costTypes = append(opts.costTypes, costType)
+	}
+	if len(opts.costTypes) == 0 {
+		opts.costTypes = []string{models.CostTypeUnblended}
+	}
+
+	// Today is partial, so the range ends with yesterday. Monthly ranges start on the
+	// first of a month so that no month is stored half-fetched.
+	lookback := 30
+	if value := strings.TrimSpace(models.GetSettingString(s.DB, "billing.lookback_days", "")); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid billing.lookback_days %q: use a whole number of days, at least 1", value)
+		}
+		lookback = days
+	}
+	now := time.Now().UTC()
+	opts.end = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	opts.start = opts.end.AddDate(0, 0, -lookback)
+	if opts.granularity == cetypes.GranularityMonthly {
+		opts.start = time.Date(opts.start.Year(), opts.start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return opts, nil
+}
+
+// syncAccountBilling stores an account's own WorkSpaces costs
+func (s *AWSService) syncAccountBilling(ctx context.Context, account *models.AWSAccount, opts *billingSyncOptions) (int, error) {
+	cfg, err := s.GetAWSConfigForAccount(ctx, account.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// The account number keeps a payer account to its own costs rather than its
+	// organisation's
+	linkedAccount := ""
+	if account.AccountID != nil {
+		linkedAccount = *account.AccountID
+	}
+
+	costs, err := s.fetchWorkSpacesCosts(ctx, cfg, opts, linkedAccount, false, func(string) int { return account.ID })
+	if err != nil {
+		return 0, err
+	}
+	return s.storeBillingCosts(costs, account.ID, true, opts)
+}
+
+// syncPayerBilling stores the WorkSpaces costs of every account linked to a payer account,
+// or only those of one configured account when only is set
+func (s *AWSService) syncPayerBilling(ctx context.Context, payer, only *models.AWSAccount, opts *billingSyncOptions) (int, error) {
+	cfg, err := s.GetAWSConfigForAccount(ctx, payer.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	accounts, err := models.GetAllAWSAccounts(s.DB)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get AWS accounts: %w", err)
+	}
+	accountIDs := map[string]int{}
+	for _, account := range accounts {
+		if account.AccountID != nil {
+			accountIDs[*account.AccountID] = account.ID
+		}
+	}
+
+	linkedAccount, scope := "", 0
+	if only != nil {
+		if only.AccountID == nil {
+			return 0, fmt.Errorf("account %s has no AWS account number to look up its costs by", only.Name)
+		}
+		linkedAccount, scope = *only.AccountID, only.ID
+	}
+
+	costs, err := s.fetchWorkSpacesCosts(ctx, cfg, opts, linkedAccount, true, func(number string) int { return accountIDs[number] })
+	if err != nil {
+		return 0, err
+	}
+	return s.storeBillingCosts(costs, scope, false, opts)
+}
+
+// fetchWorkSpacesCosts pages through WorkSpaces costs grouped by usage type, and by linked
+// account when byAccount is set, limited to linkedAccount when it isn't empty. accountFor
+// maps a linked account number to its aws_accounts ID.
+func (s *AWSService) fetchWorkSpacesCosts(ctx context.Context, cfg aws.Config, opts *billingSyncOptions,
+	linkedAccount string, byAccount bool, accountFor func(number string) int) (billingCosts, error) {
+	cfg = cfg.Copy()
+	cfg.Region = costExplorerRegion
+	client := costexplorer.NewFromConfig(cfg)
+
+	filter := &cetypes.Expression{
+		Dimensions: &cetypes.DimensionValues{
+			Key:    cetypes.DimensionService,
+			Values: []string{"Amazon WorkSpaces"},
+		},
+	}
+	if linkedAccount != "" {
+		filter = &cetypes.Expression{And: []cetypes.Expression{*filter, {
+			Dimensions: &cetypes.DimensionValues{
+				Key:    cetypes.DimensionLinkedAccount,
+				Values: []string{linkedAccount},
+			},
+		}}}
+	}
+
+	groupBy := []cetypes.GroupDefinition{}
+	if byAccount {
+		groupBy = append(groupBy, cetypes.GroupDefinition{
+			Type: cetypes.GroupDefinitionTypeDimension,
+			Key:  aws.String(string(cetypes.DimensionLinkedAccount)),
+		})
+	}
+	groupBy = append(groupBy, cetypes.GroupDefinition{
+		Type: cetypes.GroupDefinitionTypeDimension,
+		Key:  aws.String(string(cetypes.DimensionUsageType)),
+	})
+
+	metrics := make([]string, 0, len(opts.costTypes))
+	costs := billingCosts{}
+	for _, costType := range opts.costTypes {
+		metrics = append(metrics, costExplorerMetrics[costType])
+		costs[costType] = map[billingKey]float64{}
+	}
+
+	input := &costexplorer.GetCostAndUsageInput{
+		TimePeriod: &cetypes.DateInterval{
+			Start: aws.String(opts.start.Format("2006-01-02")),
+			End:   aws.String(opts.end.Format("2006-01-02")),
+		},
+		Granularity: opts.granularity,
+		Metrics:     metrics,
+		Filter:      filter,
+		GroupBy:     groupBy,
+	}
+
+	for {
+		output, err := client.GetCostAndUsage(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cost and usage: %w", err)
+		}
+
+		for _, resultByTime := range output.ResultsByTime {
+			startDate, _ := time.Parse("2006-01-02", aws.ToString(resultByTime.TimePeriod.Start))
+			endDate, _ := time.Parse("2006-01-02", aws.ToString(resultByTime.TimePeriod.End))
+
+			for _, group := range resultByTime.Groups {
+				key := billingKey{start: startDate, end: endDate}
+				if byAccount && len(group.Keys) == 2 {
+					key.accountID = accountFor(group.Keys[0])
+					key.usageType = group.Keys[1]
+				} else if len(group.Keys) > 0 {
+					key.accountID = accountFor(linkedAccount)
+					key.usageType = group.Keys[0]
+				}
+
+				for _, costType := range opts.costTypes {
+					metric, ok := group.Metrics[costExplorerMetrics[costType]]
+					if !ok || metric.Amount == nil {
+						continue
+					}
+					amount, err := strconv.ParseFloat(*metric.Amount, 64)
+					if err != nil {
+						log.Printf("Invalid %s amount %q: %v", costType, *metric.Amount, err)
+						continue
+					}
+					costs[costType][key] += amount
+				}
+			}
+		}
+
+		if output.NextPageToken == nil {
+			return costs, nil
+		}
+		input.NextPageToken = output.NextPageToken
+	}
+}
+
+// storeBillingCosts replaces the stored Cost Explorer rows in the synced range with costs,
+// for accountID's rows or, when 0, every account's. withUnassigned also replaces rows with
+// no account (see models.ReplaceCostExplorerBillingData).
+func (s *AWSService) storeBillingCosts(costs billingCosts, accountID int, withUnassigned bool, opts *billingSyncOptions) (int, error) {
+	count := 0
+	for _, costType := range opts.costTypes {
+		rows := make([]models.BillingData, 0, len(costs[costType]))
+		for key, amount := range costs[costType] {
+			// Cost Explorer has no per-resource costs, so these rows are account-wide.
+			// Per-workspace costs come from Cost and Usage Report imports.
+			row := models.BillingData{
+				WorkspaceID: "",
+				Service:     "Amazon WorkSpaces",
+				UsageType:   key.usageType,
+				StartDate:   key.start,
+				EndDate:     key.end,
+				Amount:      amount,
+				Unit:        "USD",
+			}
+			if key.accountID > 0 {
+				id := key.accountID
+				row.AWSAccountID = &id
+			}
+			rows = append(rows, row)
+		}
+
+		if err := models.ReplaceCostExplorerBillingData(s.DB, costType, accountID, withUnassigned, opts.start, opts.end, rows); err != nil {
+			return count, fmt.Errorf("failed to store %s billing data: %w", costType, err)
+		}
+		count += len(rows)
+	}
+	return count, nil
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/workspaces"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// describeBundlesBatch is the most bundle IDs DescribeWorkspaceBundles accepts per call
+const describeBundlesBatch = 25
+
+// regionSyncFunc syncs one kind of resource for an account in the config's region
+type regionSyncFunc func(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error)
+
+// accountSyncFunc syncs one kind of resource for an account
+type accountSyncFunc func(ctx context.Context, account *models.AWSAccount) (int, error)
+
+// forEachAccountRegion runs fn for every region of every active account (or only accountID
+// when set), recording per-account outcomes. Errors don't stop the remaining accounts.
+func (s *AWSService) forEachAccountRegion(ctx context.Context, accountID int, fn regionSyncFunc) (int, error) {
+	return s.forEachAccount(ctx, accountID, func(ctx context.Context, account *models.AWSAccount) (int, error) {
+		return s.syncAccountRegions(ctx, account, fn)
+	})
+}
+
+// forEachAccount runs fn once for every active account (or only accountID when set) through
+// runAccounts
+func (s *AWSService) forEachAccount(ctx context.Context, accountID int, fn accountSyncFunc) (int, error) {
+	var accounts []models.AWSAccount
+	if accountID > 0 {
+		account, err := models.GetAWSAccountByID(s.DB, accountID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get AWS account: %w", err)
+		}
+		accounts = []models.AWSAccount{*account}
+	} else {
+		var err error
+		accounts, err = models.GetAllAWSAccounts(s.DB)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get AWS accounts: %w", err)
+		}
+	}
+
+	return s.runAccounts(ctx, accounts, fn)
+}
+
+// errAccountTimeout is the cancellation cause of an account's context once it has run for
+// sync.account_timeout_minutes
+var errAccountTimeout = errors.New("account sync timed out")
+
+// runAccounts runs fn for each account, sync.account_concurrency accounts at a time and each
+// under sync.account_timeout_minutes, recording per-account outcomes. Errors don't stop the
+// remaining accounts.
+func (s *AWSService) runAccounts(ctx context.Context, accounts []models.AWSAccount, fn accountSyncFunc) (int, error) {
+	concurrency := models.GetSettingInt(s.DB, "sync.account_concurrency", 5)
+	accountTimeout := time.Duration(models.GetSettingInt(s.DB, "sync.account_timeout_minutes", 15)) * time.Minute
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	total, attempted, failed := 0, 0, 0
+	var lastErr error
+	sem := make(chan struct{}, concurrency)
+
+	for i := range accounts {
+		// Wait for a free worker slot
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return total, ctx.Err()
+		}
+
+		attempted++
+		wg.Add(1)
+		go func(account *models.AWSAccount) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			accountCtx, cancel := context.WithTimeoutCause(ctx, accountTimeout, errAccountTimeout)
+			defer cancel()
+
+			count, err := fn(accountCtx, account)
+			if err != nil && ctx.Err() == nil {
+				if errors.Is(context.Cause(accountCtx), errAccountTimeout) {
+					// Timed out accounts are picked up again by the next sync
+					log.Printf("Sync of account %s timed out after %s", account.Name, accountTimeout)
+					err = fmt.Errorf("timed out after %s: %w", accountTimeout, err)
+				} else {
+					log.Printf("Failed to sync account %s: %v", account.Name, err)
+				}
+			}
+			s.Progress.RecordAccount(account.ID, account.Name, count, err)
+
+			mu.Lock()
+			total += count
+			if err != nil {
+				failed++
+				lastErr = err
+			}
+			mu.Unlock()
+		}(&accounts[i])
+	}
+
+	wg.Wait()
+	if ctx.Err() != nil {
+		return total, ctx.Err()
+	}
+	if attempted == 1 && failed == 1 {
+		return total, lastErr
+	}
+	if failed > 0 {
+		return total, fmt.Errorf("%d of %d accounts failed to sync", failed, attempted)
+	}
+	return total, nil
+}
+
+// syncAccountRegions runs fn in each of an account's regions
+func (s *AWSService) syncAccountRegions(ctx context.Context, account *models.AWSAccount, fn regionSyncFunc) (int, error) {
+	cfg, err := s.GetAWSConfigForAccount(ctx, account.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var regionErrs []error
+	for _, region := range account.SyncRegions() {
+		regionCfg := cfg.Copy()
+		regionCfg.Region = region
+
+		regionCount, err := fn(ctx, regionCfg, account)
+		count += regionCount
+		if err != nil {
+			if account.DiscoversAllRegions() && isRegionDisabledError(err) {
+				continue
+			}
+			regionErrs = append(regionErrs, fmt.Errorf("%s: %w", region, err))
+		}
+	}
+	return count, errors.Join(regionErrs...)
+}
+
+// SyncBundles stores the bundles owned by each account, plus any Amazon-owned bundles
+// its workspaces use
+func (s *AWSService) SyncBundles(ctx context.Context, accountID int) (int, error) {
+	return s.forEachAccountRegion(ctx, accountID, func(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error) {
+		client := workspaces.NewFromConfig(cfg)
+
+		count := 0
+		paginator := workspaces.NewDescribeWorkspaceBundlesPaginator(client, &workspaces.DescribeWorkspaceBundlesInput{})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return count, fmt.Errorf("failed to describe bundles: %w", err)
+			}
+			count += s.upsertBundles(page.Bundles, account.ID, cfg.Region)
+		}
+
+		// Public bundles are owned by Amazon and only listed when asked for by ID
+		unknown, err := models.ListUnknownBundleIDs(s.DB, account.ID, cfg.Region)
+		if err != nil {
+			return count, err
+		}
+		for start := 0; start < len(unknown); start += describeBundlesBatch {
+			end := start + describeBundlesBatch
+			if end > len(unknown) {
+				end = len(unknown)
+			}
+			output, err := client.DescribeWorkspaceBundles(ctx, &workspaces.DescribeWorkspaceBundlesInput{
+				BundleIds: unknown[start:end],
+			})
+			if err != nil {
+				return count, fmt.Errorf("failed to describe public bundles: %w", err)
+			}
+			count += s.upsertBundles(output.Bundles, account.ID, cfg.Region)
+		}
+
+		return count, nil
+	})
+}
+
+func (s *AWSService) upsertBundles(bundles []wstypes.WorkspaceBundle, accountID int, region string) int {
+	count := 0
+	for _, b := range bundles {
+		bundle := &models.WorkspaceBundle{
+			BundleID:        aws.ToString(b.BundleId),
+			Name:            aws.ToString(b.Name),
+			Description:     aws.ToString(b.Description),
+			Owner:           aws.ToString(b.Owner),
+			ImageID:         aws.ToString(b.ImageId),
+			State:           string(b.State),
+			BundleCreatedAt: b.CreationTime,
+			BundleUpdatedAt: b.LastUpdatedTime,
+			AWSAccountID:    &accountID,
+			Region:          region,
+		}
+		if b.ComputeType != nil {
+			bundle.ComputeType = string(b.ComputeType.Name)
+		}
+		if b.RootStorage != nil {
+			bundle.RootVolumeSizeGib, _ = strconv.Atoi(aws.ToString(b.RootStorage.Capacity))
+		}
+		if b.UserStorage != nil {
+			bundle.UserVolumeSizeGib, _ = strconv.Atoi(aws.ToString(b.UserStorage.Capacity))
+		}
+
+		if err := models.UpsertWorkspaceBundle(s.DB, bundle); err != nil {
+			log.Printf("Failed to upsert bundle %s: %v", bundle.BundleID, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// SyncDirectories stores the directories registered with WorkSpaces in each account
+func (s *AWSService) SyncDirectories(ctx context.Context, accountID int) (int, error) {
+	return s.forEachAccountRegion(ctx, accountID, func(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error) {
+		client := workspaces.NewFromConfig(cfg)
+
+		count := 0
+		paginator := workspaces.NewDescribeWorkspaceDirectoriesPaginator(client, &workspaces.DescribeWorkspaceDirectoriesInput{})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return count, fmt.Errorf("failed to describe directories: %w", err)
+			}
+
+			for _, d := range page.Directories {
+				directory := &models.WorkspaceDirectory{
+					DirectoryID:      aws.ToString(d.DirectoryId),
+					Alias:            aws.ToString(d.Alias),
+					DirectoryName:    aws.ToString(d.DirectoryName),
+					DirectoryType:    string(d.DirectoryType),
+					RegistrationCode: aws.ToString(d.RegistrationCode),
+					State:            string(d.State),
+					CustomerUserName: aws.ToString(d.CustomerUserName),
+					DNSIPAddresses:   d.DnsIpAddresses,
+					SubnetIDs:        d.SubnetIds,
+					SecurityGroupID:  aws.ToString(d.WorkspaceSecurityGroupId),
+					IAMRoleID:        aws.ToString(d.IamRoleId),
+					Tenancy:          string(d.Tenancy),
+					AWSAccountID:     &account.ID,
+					Region:           cfg.Region,
+				}
+				if err := models.UpsertWorkspaceDirectory(s.DB, directory); err != nil {
+					log.Printf("Failed to upsert directory %s: %v", directory.DirectoryID, err)
+					continue
+				}
+				count++
+			}
+		}
+
+		return count, nil
+	})
+}
+
+// SyncImages stores the custom WorkSpaces images in each account
+func (s *AWSService) SyncImages(ctx context.Context, accountID int) (int, error) {
+	return s.forEachAccountRegion(ctx, accountID, func(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error) {
+		client := workspaces.NewFromConfig(cfg)
+
+		count := 0
+		input := &workspaces.DescribeWorkspaceImagesInput{}
+		for {
+			output, err := client.DescribeWorkspaceImages(ctx, input)
+			if err != nil {
+				return count, fmt.Errorf("failed to describe images: %w", err)
+			}
+
+			for _, i := range output.Images {
+				image := &models.WorkspaceImage{
+					ImageID:         aws.ToString(i.ImageId),
+					Name:            aws.ToString(i.Name),
+					Description:     aws.ToString(i.Description),
+					OwnerAccountID:  aws.ToString(i.OwnerAccountId),
+					State:           string(i.State),
+					RequiredTenancy: string(i.RequiredTenancy),
+					ErrorMessage:    aws.ToString(i.ErrorMessage),
+					ImageCreatedAt:  i.Created,
+					AWSAccountID:    &account.ID,
+					Region:          cfg.Region,
+				}
+				if i.OperatingSystem != nil {
+					image.OperatingSystem = string(i.OperatingSystem.Type)
+				}
+				if err := models.UpsertWorkspaceImage(s.DB, image); err != nil {
+					log.Printf("Failed to upsert image %s: %v", image.ImageID, err)
+					continue
+				}
+				count++
+			}
+
+			if output.NextToken == nil {
+				return count, nil
+			}
+			input.NextToken = output.NextToken
+		}
+	})
+}
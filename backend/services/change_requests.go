@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// approvalComputeUpgrade in approvals.required_for covers modifications that move a workspace
+// to a larger compute type
+const approvalComputeUpgrade = "compute_upgrade"
+
+// computeTypeOrder ranks compute types from smallest to largest
+var computeTypeOrder = []wstypes.Compute{
+	wstypes.ComputeValue,
+	wstypes.ComputeStandard,
+	wstypes.ComputePerformance,
+	wstypes.ComputePower,
+	wstypes.ComputePowerpro,
+	wstypes.ComputeGraphics,
+	wstypes.ComputeGraphicsG4dn,
+	wstypes.ComputeGraphicspro,
+	wstypes.ComputeGraphicsproG4dn,
+}
+
+// changeRequestTitles titles the notifications sent when a change request reaches a status
+var changeRequestTitles = map[string]string{
+	models.ChangeApproved:  "Change Request Approved",
+	models.ChangeRejected:  "Change Request Rejected",
+	models.ChangeCancelled: "Change Request Cancelled",
+	models.ChangeCompleted: "Change Request Completed",
+	models.ChangeFailed:    "Change Request Failed",
+}
+
+// ChangeRequestService gates destructive and costly operations behind change requests, which
+// approvers decide on and the sync worker then runs
+type ChangeRequestService struct {
+	DB *sql.DB
+}
+
+// RequiresApproval reports whether running action, or for modify applying change to ws, needs
+// an approved change request. approvals.required_for lists the actions that do, plus
+// compute_upgrade for moves to a larger compute type.
+func (s *ChangeRequestService) RequiresApproval(action string, ws *models.Workspace, change *WorkspacePropertyChange) bool {
+	required := make(map[string]bool)
+	for _, name := range strings.Split(models.GetSettingString(s.DB, "approvals.required_for", ""), ",") {
+		required[strings.TrimSpace(name)] = true
+	}
+
+	if required[action] {
+		return true
+	}
+	return action == WorkspaceActionModify && required[approvalComputeUpgrade] && change != nil &&
+		change.ComputeTypeName != nil && isComputeUpgrade(ws.ComputeTypeName, *change.ComputeTypeName)
+}
+
+// isComputeUpgrade reports whether moving from one compute type to another is an upgrade.
+// Types missing from computeTypeOrder are treated as the largest, so moves to them count.
+func isComputeUpgrade(from, to string) bool {
+	rank := func(name string) int {
+		for i, compute := range computeTypeOrder {
+			if string(compute) == name {
+				return i
+			}
+		}
+		return len(computeTypeOrder)
+	}
+	return rank(to) > rank(from)
+}
+
+// Validate checks a change request can run on targets: the action is known and its
+// parameters are valid, and for modify each workspace accepts the change
+func (s *ChangeRequestService) Validate(cr *models.ChangeRequest, targets []models.Workspace) error {
+	if cr.Action == WorkspaceActionModify {
+		var change WorkspacePropertyChange
+		if err := decodeChangeParameters(cr, &change); err != nil {
+			return fmt.Errorf("invalid parameters: %w", err)
+		}
+		for i := range targets {
+			if err := change.Validate(&targets[i]); err != nil {
+				return fmt.Errorf("%s: %w", targets[i].WorkspaceID, err)
+			}
+		}
+		return nil
+	}
+
+	if !IsWorkspaceAction(cr.Action) {
+		return fmt.Errorf("unknown action %s", cr.Action)
+	}
+	var params WorkspaceActionParams
+	if err := decodeChangeParameters(cr, &params); err != nil {
+		return fmt.Errorf("invalid parameters: %w", err)
+	}
+	return params.Validate(cr.Action)
+}
+
+func decodeChangeParameters(cr *models.ChangeRequest, v interface{}) error {
+	if len(cr.Parameters) == 0 {
+		return nil
+	}
+	return json.Unmarshal(cr.Parameters, v)
+}
+
+// Create stores a validated change request, expiring after approvals.expiry_hours, and
+// notifies the users who may approve it
+func (s *ChangeRequestService) Create(cr *models.ChangeRequest) error {
+	hours := models.GetSettingInt(s.DB, "approvals.expiry_hours", 72)
+	if err := models.CreateChangeRequest(s.DB, cr, time.Duration(hours)*time.Hour); err != nil {
+		return err
+	}
+
+	recipients := []string{}
+	roles, err := s.ApproverRoles(cr)
+	if err == nil && len(roles) > 0 {
+		recipients, err = models.ListUserEmailsByRole(s.DB, roles)
+	}
+	if err != nil {
+		log.Printf("Failed to find approvers of change request %d: %v", cr.ID, err)
+	}
+	// Requesters can't approve their own changes, so they aren't asked to
+	if requester := userEmail(s.DB, cr.RequestedBy); requester != "" {
+		recipients = removeString(recipients, requester)
+	}
+
+	notificationService := &NotificationService{DB: s.DB}
+	notificationService.NotifyChangeRequest(models.EventChangeRequested, cr, "Change Request Awaiting Approval",
+		fmt.Sprintf("%s requested %s on %s: %s", cr.RequestedBy, cr.Action, describeWorkspaces(cr), cr.Justification),
+		models.SeverityInfo, recipients)
+	return nil
+}
+
+// ApproverRoles returns the roles that may approve cr: those with a rule covering its action
+// in the AD department of every target workspace
+func (s *ChangeRequestService) ApproverRoles(cr *models.ChangeRequest) ([]string, error) {
+	rules, err := models.ListApprovalRules(s.DB)
+	if err != nil {
+		return nil, err
+	}
+	departments, err := models.ListWorkspaceDepartments(s.DB, cr.WorkspaceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	covers := func(role, department string) bool {
+		for _, rule := range rules {
+			if rule.ApproverRole == role && (rule.Action == "*" || rule.Action == cr.Action) &&
+				(rule.Department == "" || strings.EqualFold(rule.Department, department)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	roles := []string{}
+	for _, rule := range rules {
+		covered := true
+		for _, id := range cr.WorkspaceIDs {
+			if !covers(rule.ApproverRole, departments[id]) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			roles = appendUnique(roles, rule.ApproverRole)
+		}
+	}
+	return roles, nil
+}
+
+// CanApprove reports whether a user may approve or reject cr. Nobody decides on their own
+// change requests.
+func (s *ChangeRequestService) CanApprove(cr *models.ChangeRequest, username, role string) (bool, error) {
+	if username == cr.RequestedBy {
+		return false, nil
+	}
+	roles, err := s.ApproverRoles(cr)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Decide approves, rejects or cancels a pending change request and tells its requester when
+// someone else made the decision. It returns sql.ErrNoRows if the request is no longer
+// pending.
+func (s *ChangeRequestService) Decide(id int, status, decidedBy, note string) (*models.ChangeRequest, error) {
+	cr, err := models.DecideChangeRequest(s.DB, id, status, decidedBy, note)
+	if err != nil {
+		return nil, err
+	}
+
+	if decidedBy != cr.RequestedBy {
+		message := fmt.Sprintf("%s %s your request to %s %s", decidedBy, cr.Status, cr.Action, describeWorkspaces(cr))
+		if note != "" {
+			message += ": " + note
+		}
+		severity := models.SeverityInfo
+		if cr.Status != models.ChangeApproved {
+			severity = models.SeverityWarning
+		}
+		notificationService := &NotificationService{DB: s.DB}
+		notificationService.NotifyChangeRequest(models.EventChangeDecided, cr, changeRequestTitles[cr.Status],
+			message, severity, userEmails(s.DB, cr.RequestedBy))
+	}
+	return cr, nil
+}
+
+// RunApproved expires overdue change requests and fails those an earlier run left executing,
+// then runs the approved ones and returns how many ran. It is the "changes" sync stage.
+func (s *ChangeRequestService) RunApproved(ctx context.Context) (int, error) {
+	notificationService := &NotificationService{DB: s.DB}
+
+	expired, err := models.ExpireChangeRequests(s.DB)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire change requests: %w", err)
+	}
+	for i := range expired {
+		cr := &expired[i]
+		notificationService.NotifyChangeRequest(models.EventChangeExpired, cr, "Change Request Expired",
+			fmt.Sprintf("Your request to %s %s expired without a decision", cr.Action, describeWorkspaces(cr)),
+			models.SeverityWarning, userEmails(s.DB, cr.RequestedBy))
+	}
+
+	// A sync can't outlive its job timeout, so requests still executing from before then
+	// were interrupted by a crash, cancellation or timeout
+	jobTimeout := time.Duration(models.GetSettingInt(s.DB, "sync.job_timeout_minutes", 60)) * time.Minute
+	stale, err := models.ListStaleChangeRequests(s.DB, time.Now().Add(-jobTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("failed to check executing change requests: %w", err)
+	}
+	for i := range stale {
+		cr := &stale[i]
+		log.Printf("Change request %d was interrupted while executing", cr.ID)
+		if err := s.complete(cr, failWorkspaceActions(cr.WorkspaceIDs, errChangeInterrupted)); err != nil {
+			log.Printf("Failed to fail interrupted change request %d: %v", cr.ID, err)
+		}
+	}
+
+	awsService := &AWSService{DB: s.DB}
+	executed := 0
+	for ctx.Err() == nil {
+		cr, err := models.ClaimApprovedChangeRequest(s.DB)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return executed, fmt.Errorf("failed to claim change request: %w", err)
+		}
+
+		results := s.execute(ctx, awsService, cr)
+		if err := s.complete(cr, results); err != nil {
+			return executed, err
+		}
+		executed++
+	}
+	return executed, nil
+}
+
+// errChangeInterrupted is the result of each workspace of a change request whose run stopped
+// before recording its outcome
+var errChangeInterrupted = errors.New("the sync running this change stopped before it finished; check the workspace's state")
+
+// complete records the results of an executing change request and tells its requester and
+// approver how it went
+func (s *ChangeRequestService) complete(cr *models.ChangeRequest, results []WorkspaceActionResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Status != models.ActionSucceeded {
+			failed++
+		}
+	}
+	cr.Status = models.ChangeCompleted
+	if failed > 0 {
+		cr.Status = models.ChangeFailed
+	}
+	cr.Results, _ = json.Marshal(results)
+	if err := models.CompleteChangeRequest(s.DB, cr.ID, cr.Status, cr.Results); err != nil {
+		return fmt.Errorf("failed to record change request %d: %w", cr.ID, err)
+	}
+
+	severity := models.SeveritySuccess
+	if failed > 0 {
+		severity = models.SeverityError
+	}
+	notificationService := &NotificationService{DB: s.DB}
+	notificationService.NotifyChangeRequest(models.EventChangeExecuted, cr, changeRequestTitles[cr.Status],
+		fmt.Sprintf("Change request %d to %s %s ran: %d succeeded, %d failed",
+			cr.ID, cr.Action, describeWorkspaces(cr), len(results)-failed, failed),
+		severity, userEmails(s.DB, cr.RequestedBy, cr.DecidedBy))
+	return nil
+}
+
+// execute runs an approved change request, returning one result per workspace
+func (s *ChangeRequestService) execute(ctx context.Context, awsService *AWSService, cr *models.ChangeRequest) []WorkspaceActionResult {
+	requestedBy := fmt.Sprintf("%s (change request #%d)", cr.RequestedBy, cr.ID)
+	results := []WorkspaceActionResult{}
+
+	targets := []models.Workspace{}
+	for _, id := range cr.WorkspaceIDs {
+		ws, err := models.GetWorkspaceByID(s.DB, id)
+		if err == sql.ErrNoRows || (err == nil && ws.RemovedAt != nil) {
+			err = fmt.Errorf("workspace no longer exists")
+		}
+		if err != nil {
+			results = append(results, failWorkspaceActions([]string{id}, err)...)
+			continue
+		}
+		targets = append(targets, *ws)
+	}
+	if len(targets) == 0 {
+		return results
+	}
+
+	if cr.Action == WorkspaceActionModify {
+		var change WorkspacePropertyChange
+		if err := decodeChangeParameters(cr, &change); err != nil {
+			return append(results, failWorkspaceActions(workspaceIDs(targets), err)...)
+		}
+		for i := range targets {
+			// The workspace may have changed since the request was made
+			err := change.Validate(&targets[i])
+			if err == nil {
+				_, err = awsService.ModifyWorkspaceProperties(ctx, &targets[i], change, requestedBy)
+			}
+			result := WorkspaceActionResult{WorkspaceID: targets[i].WorkspaceID, Status: models.ActionSucceeded}
+			if err != nil {
+				result.Status, result.Error = models.ActionFailed, err.Error()
+			}
+			results = append(results, result)
+		}
+		return results
+	}
+
+	var params WorkspaceActionParams
+	if err := decodeChangeParameters(cr, &params); err != nil {
+		return append(results, failWorkspaceActions(workspaceIDs(targets), err)...)
+	}
+	return append(results, awsService.RunWorkspaceAction(ctx, cr.Action, targets, params, requestedBy, len(cr.WorkspaceIDs) > 1)...)
+}
+
+// userEmails returns the email addresses of the given users that have one
+func userEmails(db *sql.DB, usernames ...string) []string {
+	emails := []string{}
+	for _, username := range usernames {
+		if email := userEmail(db, username); email != "" {
+			emails = appendUnique(emails, email)
+		}
+	}
+	return emails
+}
+
+func userEmail(db *sql.DB, username string) string {
+	if username == "" {
+		return ""
+	}
+	user, err := models.GetUserByUsername(db, username)
+	if err != nil {
+		return ""
+	}
+	return user.Email
+}
+
+func describeWorkspaces(cr *models.ChangeRequest) string {
+	if len(cr.WorkspaceIDs) == 1 {
+		return "workspace " + cr.WorkspaceIDs[0]
+	}
+	return fmt.Sprintf("%d workspaces", len(cr.WorkspaceIDs))
+}
+
+func workspaceIDs(targets []models.Workspace) []string {
+	ids := make([]string, len(targets))
+	for i, ws := range targets {
+		ids[i] = ws.WorkspaceID
+	}
+	return ids
+}
+
+func removeString(values []string, value string) []string {
+	kept := values[:0]
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+)
+
+// WorkSpacesEventSource is the CloudTrail event source of WorkSpaces API calls
+const WorkSpacesEventSource = "workspaces.amazonaws.com"
+
+// maxImportErrors bounds how many error messages an import result keeps
+const maxImportErrors = 20
+
+// CloudTrailImporter loads CloudTrail log files delivered by a trail, which reach back
+// further than the 90 days LookupEvents covers
+type CloudTrailImporter struct {
+	DB *sql.DB
+}
+
+// CloudTrailImportResult summarises an import
+type CloudTrailImportResult struct {
+	Files    int      `json:"files"`    // Log files read
+	Records  int      `json:"records"`  // Records in those files
+	Imported int      `json:"imported"` // WorkSpaces events stored (or refreshed, if already stored)
+	Failed   int      `json:"failed"`   // Files or WorkSpaces events that couldn't be read or stored
+	Errors   []string `json:"errors"`   // The first few failures
+}
+
+func (r *CloudTrailImportResult) addError(err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// cloudTrailLogFile is the layout of a log file delivered by a trail
+type cloudTrailLogFile struct {
+	Records []json.RawMessage `json:"Records"`
+}
+
+// cloudTrailRecord is the part of a CloudTrail record that is stored
+type cloudTrailRecord struct {
+	EventID           string          `json:"eventID"`
+	EventName         string          `json:"eventName"`
+	EventTime         time.Time       `json:"eventTime"`
+	EventSource       string          `json:"eventSource"`
+	AWSRegion         string          `json:"awsRegion"`
+	SourceIPAddress   string          `json:"sourceIPAddress"`
+	UserAgent         string          `json:"userAgent"`
+	ErrorCode         string          `json:"errorCode"`
+	ErrorMessage      string          `json:"errorMessage"`
+	ReadOnly          *bool           `json:"readOnly"`
+	UserIdentity      json.RawMessage `json:"userIdentity"`
+	RequestParameters json.RawMessage `json:"requestParameters"`
+	ResponseElements  json.RawMessage `json:"responseElements"`
+}
+
+// cloudTrailIdentity holds the userIdentity fields used to name who made a call
+type cloudTrailIdentity struct {
+	Type           string `json:"type"`
+	UserName       string `json:"userName"`
+	ARN            string `json:"arn"`
+	SessionContext struct {
+		SessionIssuer struct {
+			UserName string `json:"userName"`
+		} `json:"sessionIssuer"`
+	} `json:"sessionContext"`
+}
+
+// parseCloudTrailRecord converts a raw CloudTrail record, from a log file or the
+// CloudTrailEvent field of LookupEvents, into a stored event
+func parseCloudTrailRecord(raw []byte) (*models.CloudTrailEvent, error) {
+	var record cloudTrailRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, err
+	}
+	if record.EventID == "" {
+		return nil, fmt.Errorf("record has no eventID")
+	}
+
+	event := &models.CloudTrailEvent{
+		EventID:           record.EventID,
+		EventName:         record.EventName,
+		EventTime:         record.EventTime,
+		EventSource:       record.EventSource,
+		UserIdentity:      jsonOrEmpty(record.UserIdentity),
+		RequestParameters: jsonOrEmpty(record.RequestParameters),
+		ResponseElements:  jsonOrEmpty(record.ResponseElements),
+		EventRegion:       record.AWSRegion,
+		SourceIPAddress:   record.SourceIPAddress,
+		UserAgent:         record.UserAgent,
+		ErrorCode:         record.ErrorCode,
+		ErrorMessage:      record.ErrorMessage,
+		ReadOnly:          record.ReadOnly,
+	}
+
+	var identity cloudTrailIdentity
+	if json.Unmarshal(record.UserIdentity, &identity) == nil {
+		event.Username = identityUserName(&identity)
+		event.PrincipalARN = identity.ARN
+		event.PrincipalType = identity.Type
+	}
+
+	// Calls naming workspaces carry their IDs in the request; CreateWorkspaces only
+	// returns them in the response
+	event.WorkspaceIDs = collectWorkspaceIDs(nil, record.RequestParameters)
+	event.WorkspaceIDs = collectWorkspaceIDs(event.WorkspaceIDs, record.ResponseElements)
+	if len(event.WorkspaceIDs) > 0 {
+		event.WorkspaceID = event.WorkspaceIDs[0]
+	}
+	return event, nil
+}
+
+// identityUserName names a caller the way LookupEvents does: the IAM user, or for assumed
+// roles the session name at the end of the ARN, falling back to the role itself
+func identityUserName(identity *cloudTrailIdentity) string {
+	if identity.UserName != "" {
+		return identity.UserName
+	}
+	if i := strings.LastIndex(identity.ARN, "/"); i >= 0 {
+		return identity.ARN[i+1:]
+	}
+	if name := identity.SessionContext.SessionIssuer.UserName; name != "" {
+		return name
+	}
+	return identity.Type
+}
+
+// collectWorkspaceIDs appends every workspaceId in a request or response that isn't already
+// in ids, searching nested objects and lists in order
+func collectWorkspaceIDs(ids []string, raw json.RawMessage) []string {
+	var value interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil {
+		return ids
+	}
+	return searchWorkspaceIDs(ids, value)
+}
+
+func searchWorkspaceIDs(ids []string, value interface{}) []string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if id, ok := v["workspaceId"].(string); ok && id != "" {
+			ids = appendUnique(ids, id)
+		}
+		// Sort keys so the first ID is stable between runs
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ids = searchWorkspaceIDs(ids, v[key])
+		}
+	case []interface{}:
+		for _, child := range v {
+			ids = searchWorkspaceIDs(ids, child)
+		}
+	}
+	return ids
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func jsonOrEmpty(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 || string(raw) == "null" {
+		return json.RawMessage("{}")
+	}
+	return raw
+}
+
+// isCloudTrailLogFile reports whether a file name looks like a CloudTrail log file
+func isCloudTrailLogFile(name string) bool {
+	return strings.HasSuffix(name, ".json.gz") || strings.HasSuffix(name, ".json")
+}
+
+// ImportDirectory imports every CloudTrail log file under dir
+func (i *CloudTrailImporter) ImportDirectory(dir string) (*CloudTrailImportResult, error) {
+	result := &CloudTrailImportResult{Errors: []string{}}
+
+	err := walkDirectory(dir, isCloudTrailLogFile, func(name string, r io.Reader) error {
+		i.importLogFile(name, r, result)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	i.finish(result)
+	return result, nil
+}
+
+// ImportArchive imports an uploaded .zip, .tar.gz/.tgz or .tar archive of log files, or a
+// single log file
+func (i *CloudTrailImporter) ImportArchive(name string, r io.ReaderAt, size int64) (*CloudTrailImportResult, error) {
+	result := &CloudTrailImportResult{Errors: []string{}}
+
+	err := walkArchive(name, r, size, isCloudTrailLogFile, func(name string, r io.Reader) error {
+		i.importLogFile(name, r, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	i.finish(result)
+	return result, nil
+}
+
+// importLogFile stores the WorkSpaces events in one log file, gunzipping .gz files
+func (i *CloudTrailImporter) importLogFile(name string, r io.Reader, result *CloudTrailImportResult) {
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			result.addError(fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var logFile cloudTrailLogFile
+	if err := json.NewDecoder(r).Decode(&logFile); err != nil {
+		result.addError(fmt.Errorf("%s: %w", name, err))
+		return
+	}
+	result.Files++
+	result.Records += len(logFile.Records)
+
+	for _, raw := range logFile.Records {
+		// Cheap check before parsing the whole record; most of a trail isn't WorkSpaces
+		var source struct {
+			EventSource string `json:"eventSource"`
+		}
+		if json.Unmarshal(raw, &source) != nil || source.EventSource != WorkSpacesEventSource {
+			continue
+		}
+
+		event, err := parseCloudTrailRecord(raw)
+		if err != nil {
+			result.addError(fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if err := models.InsertCloudTrailEvent(i.DB, event); err != nil {
+			result.addError(fmt.Errorf("%s: event %s: %w", name, event.EventID, err))
+			continue
+		}
+		result.Imported++
+	}
+}
+
+// finish applies imported creation and termination events to the inventory
+func (i *CloudTrailImporter) finish(result *CloudTrailImportResult) {
+	if _, err := models.ApplyWorkspaceLifecycleEvents(i.DB); err != nil {
+		log.Printf("Failed to apply workspace lifecycle events: %v", err)
+	}
+	log.Printf("Imported %d WorkSpaces events from %d CloudTrail log files (%d failures)",
+		result.Imported, result.Files, result.Failed)
+}
@@ -0,0 +1,532 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/parquet-go/parquet-go"
+)
+
+// WorkSpacesProductCode is the lineItem/ProductCode of WorkSpaces charges
+const WorkSpacesProductCode = "AmazonWorkSpaces"
+
+// CURImporter loads AWS Cost and Usage Report files, which unlike Cost Explorer itemise
+// WorkSpaces charges by resource, into per-workspace billing rows
+type CURImporter struct {
+	DB       *sql.DB
+	CostType string // unblended (default), amortized or net
+}
+
+// CURImportResult summarises an import
+type CURImportResult struct {
+	Files      int      `json:"files"`      // Report files read
+	LineItems  int      `json:"line_items"` // WorkSpaces line items in those files
+	Rows       int      `json:"rows"`       // Daily billing rows written
+	Workspaces int      `json:"workspaces"` // Workspaces with costs
+	Failed     int      `json:"failed"`     // Files or line items that couldn't be read
+	Errors     []string `json:"errors"`     // The first few failures
+}
+
+func (r *CURImportResult) addError(err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// curKey groups line items into one billing row
+type curKey struct {
+	accountID   string
+	workspaceID string
+	usageType   string
+	start       time.Time
+	end         time.Time
+}
+
+// curImport accumulates the costs read from every file of an import
+type curImport struct {
+	costType string
+	amounts  map[curKey]float64
+	units    map[curKey]string
+	periods  map[models.CURPeriod]bool
+	result   *CURImportResult
+}
+
+// isCURFile reports whether a file name looks like a Cost and Usage Report data file
+func isCURFile(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".csv") || strings.HasSuffix(lower, ".csv.gz") ||
+		strings.HasSuffix(lower, ".parquet")
+}
+
+// ImportDirectory imports every report file under dir, e.g. a synced copy of the report's
+// S3 prefix
+func (i *CURImporter) ImportDirectory(dir string) (*CURImportResult, error) {
+	imp, err := i.newImport()
+	if err != nil {
+		return nil, err
+	}
+	if err := walkDirectory(dir, isCURFile, imp.readFile); err != nil {
+		return imp.result, err
+	}
+	return i.finish(imp)
+}
+
+// ImportArchive imports an uploaded .zip, .tar.gz/.tgz or .tar archive of report files, or a
+// single report file
+func (i *CURImporter) ImportArchive(name string, r io.ReaderAt, size int64) (*CURImportResult, error) {
+	imp, err := i.newImport()
+	if err != nil {
+		return nil, err
+	}
+	if err := walkArchive(name, r, size, isCURFile, imp.readFile); err != nil {
+		return nil, err
+	}
+	return i.finish(imp)
+}
+
+func (i *CURImporter) newImport() (*curImport, error) {
+	costType := i.CostType
+	if costType == "" {
+		costType = models.CostTypeUnblended
+	}
+	if !models.ValidCostType(costType) {
+		return nil, fmt.Errorf("invalid cost type %q: use unblended, amortized or net", costType)
+	}
+	return newCURImport(costType, &CURImportResult{Errors: []string{}}), nil
+}
+
+func newCURImport(costType string, result *CURImportResult) *curImport {
+	return &curImport{
+		costType: costType,
+		amounts:  map[curKey]float64{},
+		units:    map[curKey]string{},
+		periods:  map[models.CURPeriod]bool{},
+		result:   result,
+	}
+}
+
+// finish replaces the stored report rows of every usage account's billing period seen with
+// the imported ones
+func (i *CURImporter) finish(imp *curImport) (*CURImportResult, error) {
+	accounts, err := models.GetAllAWSAccounts(i.DB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS accounts: %w", err)
+	}
+	accountIDs := map[string]int{}
+	for _, account := range accounts {
+		if account.AccountID != nil {
+			accountIDs[*account.AccountID] = account.ID
+		}
+	}
+
+	rows := make([]models.BillingData, 0, len(imp.amounts))
+	workspaces := map[string]bool{}
+	for key, amount := range imp.amounts {
+		row := models.BillingData{
+			WorkspaceID:    key.workspaceID,
+			Service:        "Amazon WorkSpaces",
+			UsageType:      key.usageType,
+			StartDate:      key.start,
+			EndDate:        key.end,
+			Amount:         amount,
+			Unit:           imp.units[key],
+			UsageAccountID: key.accountID,
+		}
+		if id, ok := accountIDs[key.accountID]; ok {
+			row.AWSAccountID = &id
+		}
+		if key.workspaceID != "" {
+			workspaces[key.workspaceID] = true
+		}
+		rows = append(rows, row)
+	}
+
+	periods := make([]models.CURPeriod, 0, len(imp.periods))
+	for period := range imp.periods {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(a, b int) bool {
+		if !periods[a].Start.Equal(periods[b].Start) {
+			return periods[a].Start.Before(periods[b].Start)
+		}
+		return periods[a].UsageAccountID < periods[b].UsageAccountID
+	})
+
+	if err := models.ReplaceCURBillingData(i.DB, imp.costType, periods, rows); err != nil {
+		return nil, fmt.Errorf("failed to store billing data: %w", err)
+	}
+
+	imp.result.Rows = len(rows)
+	imp.result.Workspaces = len(workspaces)
+	log.Printf("Imported %d %s cost rows for %d workspaces from %d Cost and Usage Report files (%d failures)",
+		imp.result.Rows, imp.costType, imp.result.Workspaces, imp.result.Files, imp.result.Failed)
+	return imp.result, nil
+}
+
+// readFile reads one CSV (optionally gzipped) or Parquet report file. Unreadable files are
+// recorded in the result rather than stopping the import, and none of a file's costs or
+// billing periods are kept unless all of it could be read, so a truncated file can't
+// replace a period with partial data.
+func (imp *curImport) readFile(name string, r io.Reader) error {
+	file := newCURImport(imp.costType, imp.result)
+	var err error
+	if strings.HasSuffix(strings.ToLower(name), ".parquet") {
+		err = file.readParquet(r)
+	} else {
+		err = file.readCSV(name, r)
+	}
+	if err != nil {
+		imp.result.addError(fmt.Errorf("%s: %w", name, err))
+		return nil
+	}
+	imp.merge(file)
+	imp.result.Files++
+	return nil
+}
+
+// merge adds the costs and billing periods read from one file to the import
+func (imp *curImport) merge(file *curImport) {
+	for key, amount := range file.amounts {
+		imp.amounts[key] += amount
+		if unit := file.units[key]; unit != "" {
+			imp.units[key] = unit
+		}
+	}
+	for period := range file.periods {
+		imp.periods[period] = true
+	}
+}
+
+func (imp *curImport) readCSV(name string, r io.Reader) error {
+	if strings.HasSuffix(strings.ToLower(name), ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = curColumnName(name)
+	}
+
+	item := map[string]string{}
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, value := range record {
+			if i < len(columns) {
+				item[columns[i]] = value
+			}
+		}
+		if err := imp.addLineItem(item); err != nil {
+			imp.result.addError(fmt.Errorf("%s: row %d: %w", name, n, err))
+		}
+	}
+}
+
+func (imp *curImport) readParquet(r io.Reader) error {
+	var readerAt io.ReaderAt
+	var size int64
+	switch f := r.(type) {
+	case *os.File:
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		readerAt, size = f, info.Size()
+	case *io.SectionReader:
+		readerAt, size = f, f.Size()
+	default:
+		// Archive entries can't be read at random, so buffer them
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		readerAt, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	file, err := parquet.OpenFile(readerAt, size)
+	if err != nil {
+		return err
+	}
+
+	// Line item fields are top-level columns; nested ones such as resource tags are skipped
+	schema := file.Schema()
+	columns := map[int]string{}
+	nodes := map[int]parquet.Node{}
+	for _, path := range schema.Columns() {
+		if len(path) != 1 {
+			continue
+		}
+		leaf, ok := schema.Lookup(path...)
+		if !ok {
+			continue
+		}
+		columns[leaf.ColumnIndex] = curColumnName(path[0])
+		nodes[leaf.ColumnIndex] = leaf.Node
+	}
+
+	buffer := make([]parquet.Row, 256)
+	for _, group := range file.RowGroups() {
+		rows := group.Rows()
+		for {
+			n, err := rows.ReadRows(buffer)
+			for _, row := range buffer[:n] {
+				item := map[string]string{}
+				for _, value := range row {
+					if name, ok := columns[value.Column()]; ok {
+						item[name] = parquetValueString(nodes[value.Column()], value)
+					}
+				}
+				if err := imp.addLineItem(item); err != nil {
+					imp.result.addError(err)
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// parquetValueString formats a Parquet value the way the CSV report would
+func parquetValueString(node parquet.Node, value parquet.Value) string {
+	if value.IsNull() {
+		return ""
+	}
+
+	if logical := node.Type().LogicalType(); logical != nil {
+		switch {
+		case logical.Timestamp != nil:
+			unit := logical.Timestamp.Unit
+			var t time.Time
+			switch {
+			case unit.Millis != nil:
+				t = time.UnixMilli(value.Int64())
+			case unit.Micros != nil:
+				t = time.UnixMicro(value.Int64())
+			default:
+				t = time.Unix(0, value.Int64())
+			}
+			return t.UTC().Format(time.RFC3339)
+		case logical.Date != nil:
+			return time.Unix(int64(value.Int32())*86400, 0).UTC().Format("2006-01-02")
+		}
+	}
+
+	switch value.Kind() {
+	case parquet.Double:
+		return strconv.FormatFloat(value.Double(), 'f', -1, 64)
+	case parquet.Float:
+		return strconv.FormatFloat(float64(value.Float()), 'f', -1, 32)
+	case parquet.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10)
+	case parquet.Int64:
+		return strconv.FormatInt(value.Int64(), 10)
+	case parquet.Boolean:
+		return strconv.FormatBool(value.Boolean())
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return string(value.ByteArray())
+	}
+	return value.String()
+}
+
+// curColumnName normalises a report column name, so the CSV "lineItem/ResourceId" and the
+// Parquet "line_item_resource_id" are both "lineitemresourceid"
+func curColumnName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// addLineItem adds the cost of a WorkSpaces line item to its workspace's daily total
+func (imp *curImport) addLineItem(item map[string]string) error {
+	if item["lineitemproductcode"] != WorkSpacesProductCode && item["productproductname"] != "Amazon WorkSpaces" {
+		return nil
+	}
+	imp.result.LineItems++
+
+	start, err := parseCURTime(item["lineitemusagestartdate"])
+	if err != nil {
+		return fmt.Errorf("invalid usage start date: %w", err)
+	}
+	end, err := parseCURTime(item["lineitemusageenddate"])
+	if err != nil {
+		end = start
+	}
+
+	amount, err := curLineItemCost(item, imp.costType)
+	if err != nil {
+		return err
+	}
+
+	period, err := parseCURTime(item["billbillingperiodstartdate"])
+	if err != nil {
+		period = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	imp.periods[models.CURPeriod{
+		Start:          period.Truncate(24 * time.Hour),
+		UsageAccountID: item["lineitemusageaccountid"],
+	}] = true
+
+	if amount == 0 {
+		return nil
+	}
+
+	// Hourly items roll up into days; items spanning longer, such as monthly fees and
+	// credits, keep their own range
+	startDay := start.Truncate(24 * time.Hour)
+	endDay := end.Truncate(24 * time.Hour)
+	if !endDay.After(startDay) {
+		endDay = startDay.AddDate(0, 0, 1)
+	}
+
+	// Fees, credits and discounts are kept apart from usage so they stay visible
+	usageType := item["lineitemusagetype"]
+	switch lineItemType := item["lineitemlineitemtype"]; lineItemType {
+	case "", "Usage", "DiscountedUsage", "SavingsPlanCoveredUsage":
+	default:
+		usageType = lineItemType + ": " + usageType
+	}
+
+	key := curKey{
+		accountID:   item["lineitemusageaccountid"],
+		workspaceID: curWorkspaceID(item["lineitemresourceid"]),
+		usageType:   usageType,
+		start:       startDay,
+		end:         endDay,
+	}
+	imp.amounts[key] += amount
+	if unit := item["lineitemcurrencycode"]; unit != "" {
+		imp.units[key] = unit
+	} else {
+		imp.units[key] = "USD"
+	}
+	return nil
+}
+
+// curLineItemCost returns the unblended cost of a line item, its net cost after discounts,
+// or its amortized cost, which spreads Savings Plan and reservation commitments over the
+// usage they cover
+func curLineItemCost(item map[string]string, costType string) (float64, error) {
+	switch costType {
+	case models.CostTypeNet:
+		// Reports only have net columns for accounts with discounts
+		if _, ok := item["lineitemnetunblendedcost"]; ok {
+			return curAmount(item, "lineitemnetunblendedcost")
+		}
+		return curAmount(item, "lineitemunblendedcost")
+	case models.CostTypeUnblended:
+		return curAmount(item, "lineitemunblendedcost")
+	}
+
+	switch item["lineitemlineitemtype"] {
+	case "SavingsPlanCoveredUsage":
+		return curAmount(item, "savingsplansavingsplaneffectivecost")
+	case "SavingsPlanNegation", "SavingsPlanUpfrontFee":
+		// Covered usage already carries its share of the commitment
+		return 0, nil
+	case "SavingsPlanRecurringFee":
+		// Only the unused part of the commitment is left to charge
+		total, err := curAmount(item, "savingsplantotalcommitmenttodate")
+		if err != nil {
+			return 0, err
+		}
+		used, err := curAmount(item, "savingsplanusedcommitment")
+		if err != nil {
+			return 0, err
+		}
+		return total - used, nil
+	case "DiscountedUsage":
+		return curAmount(item, "reservationeffectivecost")
+	case "RIFee":
+		upfront, err := curAmount(item, "reservationunusedamortizedupfrontfeeforbillingperiod")
+		if err != nil {
+			return 0, err
+		}
+		recurring, err := curAmount(item, "reservationunusedrecurringfee")
+		if err != nil {
+			return 0, err
+		}
+		return upfront + recurring, nil
+	case "Fee":
+		// Upfront reservation fees are amortized over the reservation's usage
+		if item["reservationreservationarn"] != "" {
+			return 0, nil
+		}
+	}
+	return curAmount(item, "lineitemunblendedcost")
+}
+
+func curAmount(item map[string]string, column string) (float64, error) {
+	value := item[column]
+	if value == "" {
+		return 0, nil
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", column, value)
+	}
+	return amount, nil
+}
+
+// curWorkspaceID extracts the workspace ID from a line item's resource ID, which is either
+// the ID itself or a workspace ARN. Items not tied to a workspace return "".
+func curWorkspaceID(resourceID string) string {
+	if i := strings.LastIndex(resourceID, "/"); i >= 0 {
+		resourceID = resourceID[i+1:]
+	}
+	if strings.HasPrefix(resourceID, "ws-") {
+		return resourceID
+	}
+	return ""
+}
+
+// curTimeLayouts are the timestamp formats used by CSV reports and by formatted Parquet values
+var curTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02 15:04:05", "2006-01-02"}
+
+func parseCURTime(value string) (time.Time, error) {
+	for _, layout := range curTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", value)
+}
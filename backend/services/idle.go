@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+)
+
+// IdleDetector finds workspaces nobody uses, warns their owners and managers, and tracks
+// their reclamation
+type IdleDetector struct {
+	DB *sql.DB
+}
+
+// IdleWorkspace is a workspace found idle or abandoned
+type IdleWorkspace struct {
+	WorkspaceID      string              `json:"workspace_id"`
+	UserName         string              `json:"user_name"`
+	FullName         string              `json:"ad_full_name"`
+	Email            string              `json:"ad_email"`
+	Department       string              `json:"ad_department"`
+	Manager          string              `json:"ad_manager"`
+	ManagerEmail     string              `json:"ad_manager_email"`
+	ADStatus         string              `json:"ad_status"`
+	AWSAccountID     *int                `json:"aws_account_id"`
+	Region           string              `json:"region"`
+	RunningMode      string              `json:"running_mode"`
+	State            string              `json:"state"`
+	LastConnection   *time.Time          `json:"last_known_user_connection_timestamp"`
+	IdleDays         int                 `json:"idle_days"`       // Since the last connection, or creation if never connected
+	ConnectedHours   float64             `json:"connected_hours"` // Over the last idle.days days
+	Classification   string              `json:"classification"`  // idle or abandoned
+	Reasons          string              `json:"reasons"`
+	ReclamationState string              `json:"reclamation_state"`
+	Reclamation      *models.Reclamation `json:"reclamation,omitempty"`
+}
+
+// idlePolicy is what makes a workspace idle
+type idlePolicy struct {
+	days              int     // Days without a connection
+	minConnectedHours float64 // Connected hours over those days below which it is idle anyway
+}
+
+func (d *IdleDetector) policy() idlePolicy {
+	return idlePolicy{
+		days:              models.GetSettingInt(d.DB, "idle.days", 30),
+		minConnectedHours: float64(models.GetSettingInt(d.DB, "idle.min_connected_hours", 2)),
+	}
+}
+
+// Detect classifies every active workspace and returns those that are idle or abandoned
+func (d *IdleDetector) Detect(now time.Time) ([]IdleWorkspace, error) {
+	policy := d.policy()
+	candidates, err := models.ListIdleCandidates(d.DB, idleWindowStart(now, policy))
+	if err != nil {
+		return nil, err
+	}
+
+	idle := []IdleWorkspace{}
+	for _, c := range candidates {
+		if ws := classifyIdle(c, policy, now); ws != nil {
+			idle = append(idle, *ws)
+		}
+	}
+	return idle, nil
+}
+
+// Run is the idle sync stage. Newly idle workspaces are marked warned and their owner and
+// manager notified; warned and approved workspaces in use again are cleared, and approved
+// ones since terminated are marked reclaimed.
+func (d *IdleDetector) Run(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	policy := d.policy()
+
+	if _, err := models.MarkReclaimedWorkspaces(d.DB); err != nil {
+		return 0, fmt.Errorf("failed to mark reclaimed workspaces: %w", err)
+	}
+
+	candidates, err := models.ListIdleCandidates(d.DB, idleWindowStart(now, policy))
+	if err != nil {
+		return 0, err
+	}
+
+	notify := models.GetSettingString(d.DB, "idle.notify_enabled", "true") == "true"
+	notificationService := &NotificationService{DB: d.DB}
+
+	count := 0
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		ws := classifyIdle(c, policy, now)
+		r := c.Reclamation
+		if ws == nil {
+			if r != nil && (r.State == models.ReclamationWarned || r.State == models.ReclamationApproved) {
+				log.Printf("WorkSpace %s is in use again; clearing its %s reclamation", c.WorkspaceID, r.State)
+				if err := models.DeleteReclamation(d.DB, c.WorkspaceID); err != nil {
+					log.Printf("Failed to clear reclamation of %s: %v", c.WorkspaceID, err)
+				}
+			}
+			continue
+		}
+		count++
+
+		if r != nil && !exemptionExpired(r, now) {
+			// Already handled; keep the reasons current
+			if r.State != models.ReclamationExempt && (r.Classification != ws.Classification || r.Reasons != ws.Reasons) {
+				r.Classification, r.Reasons = ws.Classification, ws.Reasons
+				if err := models.UpsertReclamation(d.DB, r); err != nil {
+					log.Printf("Failed to update reclamation of %s: %v", c.WorkspaceID, err)
+				}
+			}
+			continue
+		}
+
+		recipients := []string{}
+		if notify {
+			// The owner of an abandoned workspace is gone, so only their manager is told
+			if ws.Classification == models.IdleClassIdle && ws.Email != "" {
+				recipients = append(recipients, ws.Email)
+			}
+			if ws.ManagerEmail != "" {
+				recipients = appendUnique(recipients, ws.ManagerEmail)
+			}
+			notificationService.NotifyWorkspaceIdle(ws.WorkspaceID, ws.UserName, ws.FullName, ws.Classification, ws.Reasons, recipients)
+		}
+
+		reclamation := &models.Reclamation{
+			WorkspaceID:    ws.WorkspaceID,
+			State:          models.ReclamationWarned,
+			Classification: ws.Classification,
+			Reasons:        ws.Reasons,
+			WarnedAt:       &now,
+			Notified:       recipients,
+			UpdatedBy:      "system",
+		}
+		if r != nil {
+			reclamation.Note = r.Note
+		}
+		if err := models.UpsertReclamation(d.DB, reclamation); err != nil {
+			log.Printf("Failed to record reclamation of %s: %v", ws.WorkspaceID, err)
+		}
+	}
+
+	log.Printf("Found %d idle or abandoned workspaces", count)
+	return count, nil
+}
+
+// idleWindowStart is the first day whose connected hours count towards idleness
+func idleWindowStart(now time.Time, policy idlePolicy) time.Time {
+	return now.Truncate(24*time.Hour).AddDate(0, 0, -policy.days)
+}
+
+// exemptionExpired reports whether an exemption with an end date has run out
+func exemptionExpired(r *models.Reclamation, now time.Time) bool {
+	return r.State == models.ReclamationExempt && r.ExemptUntil != nil && r.ExemptUntil.Before(now)
+}
+
+// classifyIdle returns the workspace as idle or abandoned, or nil if it is in use
+func classifyIdle(c models.IdleCandidate, policy idlePolicy, now time.Time) *IdleWorkspace {
+	reasons := []string{}
+
+	// Workspaces younger than the window can't have been idle for it
+	since := c.LastConnection
+	if since == nil {
+		since = c.CreatedAt
+	}
+	idleDays := 0
+	if since != nil {
+		idleDays = int(math.Floor(now.Sub(*since).Hours() / 24))
+	}
+	oldEnough := c.CreatedAt == nil || now.Sub(*c.CreatedAt) >= time.Duration(policy.days)*24*time.Hour
+
+	switch {
+	case c.LastConnection == nil && oldEnough:
+		reasons = append(reasons, "never connected")
+	case c.LastConnection != nil && idleDays >= policy.days:
+		reasons = append(reasons, fmt.Sprintf("no connection for %d days", idleDays))
+	case oldEnough && c.MeasuredDays >= policy.days && c.ConnectedHours < policy.minConnectedHours:
+		reasons = append(reasons, fmt.Sprintf("connected %.0f hours in %d days", c.ConnectedHours, policy.days))
+	}
+
+	// A disabled owner can't sign in, so the workspace is abandoned whatever its usage. An
+	// owner missing from the directory may be a local user, so only confirms idleness.
+	classification := models.IdleClassIdle
+	switch {
+	case c.ADStatus == models.ADStatusDisabled:
+		classification = models.IdleClassAbandoned
+		reasons = append(reasons, "owner's directory account is disabled")
+	case c.ADStatus == models.ADStatusNotFound && len(reasons) > 0:
+		classification = models.IdleClassAbandoned
+		reasons = append(reasons, "owner not found in the directory")
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	ws := &IdleWorkspace{
+		WorkspaceID:    c.WorkspaceID,
+		UserName:       c.UserName,
+		FullName:       c.ADFullName,
+		Email:          c.ADEmail,
+		Department:     c.ADDepartment,
+		Manager:        c.ADManager,
+		ManagerEmail:   c.ADManagerEmail,
+		ADStatus:       c.ADStatus,
+		AWSAccountID:   c.AWSAccountID,
+		Region:         c.Region,
+		RunningMode:    c.RunningMode,
+		State:          c.State,
+		LastConnection: c.LastConnection,
+		IdleDays:       idleDays,
+		ConnectedHours: c.ConnectedHours,
+		Classification: classification,
+		Reasons:        strings.Join(reasons, "; "),
+		Reclamation:    c.Reclamation,
+	}
+	if c.Reclamation != nil {
+		ws.ReclamationState = c.Reclamation.State
+	}
+	return ws
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// workspaceMetric is an AWS/WorkSpaces metric that is collected, with the statistic kept
+type workspaceMetric struct {
+	Name string
+	Stat string
+}
+
+// workspaceMetrics are the metrics collected for every workspace. CPU, memory and disk
+// metrics are only published for some bundles and protocols, so may have no data.
+var workspaceMetrics = []workspaceMetric{
+	{"Available", "Maximum"},
+	{"Unhealthy", "Maximum"},
+	{"UserConnected", "Maximum"},
+	{"ConnectionAttempt", "Sum"},
+	{"ConnectionSuccess", "Sum"},
+	{"ConnectionFailure", "Sum"},
+	{"SessionLaunchTime", "Average"},
+	{"InSessionLatency", "Average"},
+	{"CPUUsage", "Average"},
+	{"MemoryUsage", "Average"},
+	{"RootVolumeDiskUsage", "Average"},
+	{"UserVolumeDiskUsage", "Average"},
+}
+
+// metricsQueryLimit is how many queries a GetMetricData call accepts
+const metricsQueryLimit = 500
+
+// metricsOverlap is how far before a workspace's newest stored sample collection restarts, so samples
+// CloudWatch published late are picked up
+const metricsOverlap = 15 * time.Minute
+
+// maxMetricsBackfillHours is how far back 5 minute CloudWatch data is kept (63 days)
+const maxMetricsBackfillHours = 63 * 24
+
+// SyncWorkspaceMetrics collects 5 minute CloudWatch metrics for every workspace since its
+// last collected sample, at most metrics.backfill_hours ago, then rolls them up to hourly and
+// daily values and prunes each resolution past its retention.
+func (s *AWSService) SyncWorkspaceMetrics(ctx context.Context, accountID int) (int, error) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	backfill := models.GetSettingInt(s.DB, "metrics.backfill_hours", 24)
+	if backfill > maxMetricsBackfillHours {
+		backfill = maxMetricsBackfillHours
+	}
+	earliest := now.Add(-time.Duration(backfill) * time.Hour)
+
+	count, err := s.forEachAccountRegion(ctx, accountID, func(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error) {
+		return s.syncMetricsInRegion(ctx, cfg, account, earliest, now)
+	})
+
+	if err := models.RollUpMetrics(s.DB, earliest); err != nil {
+		log.Printf("Failed to roll up metrics: %v", err)
+		s.Progress.AddError(err.Error())
+	}
+	s.pruneMetrics(now)
+
+	log.Printf("Collected metrics for %d workspaces", count)
+	return count, err
+}
+
+// syncMetricsInRegion collects each workspace's metrics from its own newest stored sample,
+// so a failed batch or a newly added workspace is backfilled on the next run rather than
+// skipped by the progress of the others
+func (s *AWSService) syncMetricsInRegion(ctx context.Context, cfg aws.Config, account *models.AWSAccount, earliest, now time.Time) (int, error) {
+	latest, err := models.LatestMetricSamples(s.DB, account.ID, cfg.Region)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read latest metrics: %w", err)
+	}
+
+	usageWorkspaces, err := models.ListUsageWorkspaces(s.DB, account.ID, cfg.Region, earliest)
+	if err != nil {
+		return 0, err
+	}
+
+	type pendingWorkspace struct {
+		id    string
+		start time.Time
+	}
+	workspaces := make([]pendingWorkspace, 0, len(usageWorkspaces))
+	for _, ws := range usageWorkspaces {
+		start := earliest
+		if sample, ok := latest[ws.WorkspaceID]; ok && sample.Add(-metricsOverlap).After(start) {
+			start = sample.Add(-metricsOverlap)
+		}
+		// Workspaces that ended before their newest samples have nothing left to collect
+		if ws.EndedAt != nil && ws.EndedAt.Before(start) {
+			continue
+		}
+		workspaces = append(workspaces, pendingWorkspace{ws.WorkspaceID, start})
+	}
+	if len(workspaces) == 0 {
+		return 0, nil
+	}
+
+	// Batches share a start time, so workspaces resuming from the same point are fetched
+	// together and each batch starts from its furthest-behind workspace
+	sort.SliceStable(workspaces, func(a, b int) bool { return workspaces[a].start.Before(workspaces[b].start) })
+
+	client := cloudwatch.NewFromConfig(cfg)
+	batchSize := metricsQueryLimit / len(workspaceMetrics)
+
+	for from := 0; from < len(workspaces); from += batchSize {
+		to := from + batchSize
+		if to > len(workspaces) {
+			to = len(workspaces)
+		}
+		ids := make([]string, 0, to-from)
+		for _, ws := range workspaces[from:to] {
+			ids = append(ids, ws.id)
+		}
+
+		samples, err := fetchMetricSamples(ctx, client, ids, workspaces[from].start, now)
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch CloudWatch metrics: %w", err)
+		}
+		if err := models.UpsertMetricSamples(s.DB, samples); err != nil {
+			return 0, fmt.Errorf("failed to store metrics: %w", err)
+		}
+	}
+	return len(workspaces), nil
+}
+
+// fetchMetricSamples reads every collected metric of the given workspaces at 5 minute periods
+func fetchMetricSamples(ctx context.Context, client *cloudwatch.Client, ids []string, start, end time.Time) ([]models.MetricSample, error) {
+	// Query IDs are "m<workspace index>_<metric index>"
+	queries := make([]cwtypes.MetricDataQuery, 0, len(ids)*len(workspaceMetrics))
+	for i, id := range ids {
+		for j, metric := range workspaceMetrics {
+			queries = append(queries, workspaceMetricQuery(fmt.Sprintf("m%d_%d", i, j), id, metric.Name, metric.Stat, models.MetricResolutionRaw))
+		}
+	}
+
+	samples := []models.MetricSample{}
+	paginator := cloudwatch.NewGetMetricDataPaginator(client, &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(start),
+		EndTime:           aws.Time(end),
+		MetricDataQueries: queries,
+		ScanBy:            cwtypes.ScanByTimestampAscending,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range page.MetricDataResults {
+			i, j, ok := parseMetricQueryID(aws.ToString(result.Id))
+			if !ok || i >= len(ids) || j >= len(workspaceMetrics) {
+				continue
+			}
+			for k, timestamp := range result.Timestamps {
+				if k >= len(result.Values) {
+					break
+				}
+				samples = append(samples, models.MetricSample{
+					WorkspaceID: ids[i],
+					MetricName:  workspaceMetrics[j].Name,
+					Stat:        workspaceMetrics[j].Stat,
+					PeriodStart: timestamp.UTC(),
+					Value:       result.Values[k],
+				})
+			}
+		}
+	}
+	return samples, nil
+}
+
+// parseMetricQueryID splits a "m<workspace index>_<metric index>" query ID
+func parseMetricQueryID(id string) (int, int, bool) {
+	workspace, metric, ok := strings.Cut(strings.TrimPrefix(id, "m"), "_")
+	if !ok {
+		return 0, 0, false
+	}
+	i, err := strconv.Atoi(workspace)
+	if err != nil {
+		return 0, 0, false
+	}
+	j, err := strconv.Atoi(metric)
+	if err != nil {
+		return 0, 0, false
+	}
+	return i, j, true
+}
+
+// pruneMetrics drops metrics older than each resolution's retention setting
+func (s *AWSService) pruneMetrics(now time.Time) {
+	retention := []struct {
+		resolution  int
+		key         string
+		defaultDays int
+	}{
+		{models.MetricResolutionRaw, "metrics.raw_retention_days", 7},
+		{models.MetricResolutionHourly, "metrics.hourly_retention_days", 90},
+		{models.MetricResolutionDaily, "metrics.daily_retention_days", 730},
+	}
+
+	for _, r := range retention {
+		days := models.GetSettingInt(s.DB, r.key, r.defaultDays)
+		if _, err := models.PruneMetrics(s.DB, r.resolution, now.AddDate(0, 0, -days)); err != nil {
+			log.Printf("Failed to prune metrics at %ds resolution: %v", r.resolution, err)
+		}
+	}
+}
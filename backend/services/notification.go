@@ -162,6 +162,119 @@ func (s *NotificationService) NotifyWorkspaceStateChange(workspaceID, userName,
 	return nil
 }
 
+// NotifyWorkspaceIdle sends notification that a workspace is idle or abandoned, emailing the
+// given recipients (its owner and their manager) as well as admins
+func (s *NotificationService) NotifyWorkspaceIdle(workspaceID, userName, adFullName, classification, reasons string, recipients []string) error {
+	displayName := userName
+	if adFullName != "" {
+		displayName = adFullName
+	}
+
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"workspace_id":   workspaceID,
+		"user_name":      userName,
+		"full_name":      displayName,
+		"classification": classification,
+		"reasons":        reasons,
+		"recipients":     recipients,
+	})
+
+	notification := &models.Notification{
+		EventType:     models.EventWorkspaceIdle,
+		WorkspaceID:   workspaceID,
+		WorkspaceUser: userName,
+		Title:         "Idle WorkSpace",
+		Message: fmt.Sprintf("WorkSpace %s for user %s is %s (%s) and may be reclaimed unless it is still needed",
+			workspaceID, displayName, classification, reasons),
+		Severity: models.SeverityWarning,
+		Metadata: metadata,
+	}
+
+	if err := models.CreateNotification(s.DB, notification); err != nil {
+		log.Printf("Failed to create notification: %v", err)
+		return err
+	}
+
+	// Send email notification if enabled
+	s.sendEmailNotification(notification)
+	s.sendEmail(notification, recipients)
+
+	log.Printf("Notification created: WorkSpace %s is %s", workspaceID, classification)
+	return nil
+}
+
+// NotifyChangeRequest sends notification about a step in a change request's life (requested,
+// decided or executed), emailing the given recipients
+func (s *NotificationService) NotifyChangeRequest(eventType string, cr *models.ChangeRequest, title, message, severity string, recipients []string) error {
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"change_request_id": cr.ID,
+		"action":            cr.Action,
+		"workspace_ids":     cr.WorkspaceIDs,
+		"requested_by":      cr.RequestedBy,
+		"status":            cr.Status,
+		"recipients":        recipients,
+	})
+
+	workspaceID := ""
+	if len(cr.WorkspaceIDs) == 1 {
+		workspaceID = cr.WorkspaceIDs[0]
+	}
+
+	notification := &models.Notification{
+		EventType:     eventType,
+		WorkspaceID:   workspaceID,
+		WorkspaceUser: "",
+		Title:         title,
+		Message:       message,
+		Severity:      severity,
+		Metadata:      metadata,
+	}
+
+	if err := models.CreateNotification(s.DB, notification); err != nil {
+		log.Printf("Failed to create notification: %v", err)
+		return err
+	}
+
+	s.sendEmail(notification, recipients)
+
+	log.Printf("Notification created: Change request %d is %s", cr.ID, cr.Status)
+	return nil
+}
+
+// NotifyWorkspaceRequest sends notification about a step in a self-service workspace
+// request (requested, decided, expired or provisioned), emailing the given recipients
+func (s *NotificationService) NotifyWorkspaceRequest(eventType string, wr *models.WorkspaceRequest, title, message, severity string, recipients []string) error {
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"workspace_request_id": wr.ID,
+		"user_name":            wr.UserName,
+		"bundle_id":            wr.BundleID,
+		"directory_id":         wr.DirectoryID,
+		"requested_by":         wr.RequestedBy,
+		"status":               wr.Status,
+		"recipients":           recipients,
+	})
+
+	notification := &models.Notification{
+		EventType:     eventType,
+		WorkspaceID:   wr.WorkspaceID,
+		WorkspaceUser: wr.UserName,
+		Title:         title,
+		Message:       message,
+		Severity:      severity,
+		Metadata:      metadata,
+	}
+
+	if err := models.CreateNotification(s.DB, notification); err != nil {
+		log.Printf("Failed to create notification: %v", err)
+		return err
+	}
+
+	s.sendEmail(notification, recipients)
+
+	log.Printf("Notification created: Workspace request %d is %s", wr.ID, wr.Status)
+	return nil
+}
+
 // NotifySyncCompleted sends notification when a sync completes successfully
 func (s *NotificationService) NotifySyncCompleted(syncType string, recordsProcessed int) error {
 	metadata, _ := json.Marshal(map[string]interface{}{
@@ -216,6 +329,18 @@ func (s *NotificationService) NotifySyncFailed(syncType, errorMessage string) er
 
 // sendEmailNotification sends an email notification if configured
 func (s *NotificationService) sendEmailNotification(notification *models.Notification) {
+	// Get admin emails, honouring each admin's notification preferences
+	recipients, err := models.ListNotificationEmailRecipients(s.DB, notification.EventType)
+	if err != nil {
+		log.Printf("Failed to get admin emails: %v", err)
+		return
+	}
+
+	s.sendEmail(notification, recipients)
+}
+
+// sendEmail emails a notification to the given addresses if email is configured
+func (s *NotificationService) sendEmail(notification *models.Notification, recipients []string) {
 	// Check if email notifications are enabled
 	emailEnabled, err := models.GetSetting(s.DB, "notifications.email_enabled")
 	if err != nil || emailEnabled.Value != "true" {
@@ -248,23 +373,6 @@ func (s *NotificationService) sendEmailNotification(notification *models.Notific
 		return
 	}
 
-	// Get admin emails (users with ADMIN role)
-	query := "SELECT email FROM users WHERE role = 'ADMIN' AND email IS NOT NULL AND email != ''"
-	rows, err := s.DB.Query(query)
-	if err != nil {
-		log.Printf("Failed to get admin emails: %v", err)
-		return
-	}
-	defer rows.Close()
-
-	recipients := []string{}
-	for rows.Next() {
-		var email string
-		if err := rows.Scan(&email); err == nil {
-			recipients = append(recipients, email)
-		}
-	}
-
 	if len(recipients) == 0 {
 		return
 	}
@@ -308,21 +416,32 @@ func (s *NotificationService) sendEmailNotification(notification *models.Notific
 	}
 }
 
-// DetectWorkspaceChanges detects changes between old and new workspace states
+// DetectWorkspaceChanges detects changes between old and new workspace states. State
+// transitions are left out since they get their own notification.
 func (s *NotificationService) DetectWorkspaceChanges(oldState, newState map[string]interface{}) []string {
 	changes := []string{}
 
 	// Compare key fields
-	if oldState["state"] != newState["state"] {
-		changes = append(changes, fmt.Sprintf("State changed from %v to %v", oldState["state"], newState["state"]))
+	fields := []struct {
+		key   string
+		label string
+	}{
+		{"running_mode", "Running mode"},
+		{"compute_type_name", "Compute type"},
+		{"bundle_id", "Bundle"},
+		{"root_volume_size_gib", "Root volume size (GiB)"},
+		{"user_volume_size_gib", "User volume size (GiB)"},
+		{"user_name", "User"},
+		{"ip_address", "IP address"},
 	}
-
-	if oldState["running_mode"] != newState["running_mode"] {
-		changes = append(changes, fmt.Sprintf("Running mode changed from %v to %v", oldState["running_mode"], newState["running_mode"]))
-	}
-
-	if oldState["compute_type_name"] != newState["compute_type_name"] {
-		changes = append(changes, fmt.Sprintf("Compute type changed from %v to %v", oldState["compute_type_name"], newState["compute_type_name"]))
+	for _, field := range fields {
+		// A field filled in for the first time (e.g. the IP once provisioning finishes) isn't a modification
+		if old := oldState[field.key]; old == nil || old == "" || old == 0 {
+			continue
+		}
+		if oldState[field.key] != newState[field.key] {
+			changes = append(changes, fmt.Sprintf("%s changed from %v to %v", field.label, oldState[field.key], newState[field.key]))
+		}
 	}
 
 	return changes
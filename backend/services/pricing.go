@@ -0,0 +1,118 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+)
+
+// priceColumns are the columns of a price table file; the three price columns are required
+var priceColumns = []string{
+	"region", "bundle_id", "compute_type", "root_volume_size_gib", "user_volume_size_gib",
+	"always_on_monthly", "auto_stop_monthly", "auto_stop_hourly",
+}
+
+// ParseWorkspacePrices reads a price table from CSV with a header row naming priceColumns.
+// Other columns, such as notes or currency, are ignored.
+func ParseWorkspacePrices(r io.Reader) ([]models.WorkspacePrice, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("price table is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price table: %w", err)
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"always_on_monthly", "auto_stop_monthly", "auto_stop_hourly"} {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("price table has no %s column", name)
+		}
+	}
+
+	prices := []models.WorkspacePrice{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read price table: %w", err)
+		}
+
+		values := map[string]string{}
+		for _, name := range priceColumns {
+			if i, ok := index[name]; ok && i < len(record) {
+				values[name] = strings.TrimSpace(record[i])
+			}
+		}
+
+		numbers := map[string]float64{}
+		for _, name := range priceColumns[3:] {
+			if values[name] == "" {
+				continue
+			}
+			n, err := strconv.ParseFloat(values[name], 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, name, values[name])
+			}
+			numbers[name] = n
+		}
+		if values["always_on_monthly"] == "" || values["auto_stop_monthly"] == "" || values["auto_stop_hourly"] == "" {
+			return nil, fmt.Errorf("line %d: always_on_monthly, auto_stop_monthly and auto_stop_hourly are required", line)
+		}
+
+		prices = append(prices, models.WorkspacePrice{
+			Region:            values["region"],
+			BundleID:          values["bundle_id"],
+			ComputeType:       strings.ToUpper(values["compute_type"]),
+			RootVolumeSizeGib: int(numbers["root_volume_size_gib"]),
+			UserVolumeSizeGib: int(numbers["user_volume_size_gib"]),
+			AlwaysOnMonthly:   numbers["always_on_monthly"],
+			AutoStopMonthly:   numbers["auto_stop_monthly"],
+			AutoStopHourly:    numbers["auto_stop_hourly"],
+		})
+	}
+	return prices, nil
+}
+
+// matchWorkspacePrice returns the most specific price for a workspace configuration, or nil
+// if none matches. Bundle prices only apply when bundleID is given.
+func matchWorkspacePrice(prices []models.WorkspacePrice, region, bundleID, computeType string, rootGib, userGib int) *models.WorkspacePrice {
+	var best *models.WorkspacePrice
+	bestScore := -1
+	for i := range prices {
+		p := &prices[i]
+		if (p.BundleID != "" && p.BundleID != bundleID) ||
+			(p.Region != "" && p.Region != region) ||
+			(p.ComputeType != "" && p.ComputeType != computeType) ||
+			(p.RootVolumeSizeGib != 0 && p.RootVolumeSizeGib != rootGib) ||
+			(p.UserVolumeSizeGib != 0 && p.UserVolumeSizeGib != userGib) {
+			continue
+		}
+
+		score := 0
+		for _, specific := range []bool{p.BundleID != "", p.Region != "", p.ComputeType != "", p.RootVolumeSizeGib != 0, p.UserVolumeSizeGib != 0} {
+			score <<= 1
+			if specific {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
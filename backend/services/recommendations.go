@@ -0,0 +1,222 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// computeTypeLadder orders the general purpose compute types from smallest to largest.
+// Graphics compute types are never downsized.
+var computeTypeLadder = []string{"VALUE", "STANDARD", "PERFORMANCE", "POWER", "POWERPRO"}
+
+// RecommendationEngine works out which workspaces should switch running mode or move to a
+// smaller compute type, from the price table, measured usage and CloudWatch metrics
+type RecommendationEngine struct {
+	DB *sql.DB
+}
+
+// Recommendation is the cheapest running mode and compute type for a workspace
+type Recommendation struct {
+	WorkspaceID             string   `json:"workspace_id"`
+	UserName                string   `json:"user_name"`
+	AWSAccountID            *int     `json:"aws_account_id"`
+	Region                  string   `json:"region"`
+	BundleID                string   `json:"bundle_id"`
+	RunningMode             string   `json:"running_mode"`
+	ComputeType             string   `json:"compute_type"`
+	MonthsMeasured          int      `json:"months_measured"`
+	AvgMonthlyHours         float64  `json:"avg_monthly_hours"` // Hours billed, or that would be billed, under AutoStop
+	BreakEvenHours          float64  `json:"break_even_hours"`  // Monthly hours above which AlwaysOn is cheaper
+	CPUP95                  *float64 `json:"cpu_p95"`
+	MemoryP95               *float64 `json:"memory_p95"`
+	SwitchRunningMode       bool     `json:"switch_running_mode"`
+	Downsize                bool     `json:"downsize"`
+	RecommendedRunningMode  string   `json:"recommended_running_mode"`
+	RecommendedComputeType  string   `json:"recommended_compute_type"`
+	CurrentMonthlyCost      float64  `json:"current_monthly_cost"`
+	RecommendedMonthlyCost  float64  `json:"recommended_monthly_cost"`
+	EstimatedMonthlySavings float64  `json:"estimated_monthly_savings"`
+	ActualMonthlyCost       *float64 `json:"actual_monthly_cost"` // From Cost and Usage Reports
+	Reason                  string   `json:"reason"`
+}
+
+// RecommendationResult holds recommendations, most savings first, and how many workspaces
+// couldn't be assessed
+type RecommendationResult struct {
+	Recommendations []Recommendation `json:"recommendations"`
+	Unpriced        int              `json:"unpriced"`   // No price matches the workspace
+	Unmeasured      int              `json:"unmeasured"` // No usage measured in the lookback months
+}
+
+// Recommend assesses the workspaces matching filters (see
+// models.ListRecommendationCandidates). Workspaces that are already rightsized are only
+// included when includeAll is set.
+func (e *RecommendationEngine) Recommend(filters map[string]interface{}, includeAll bool) (*RecommendationResult, error) {
+	prices, err := models.ListWorkspacePrices(e.DB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prices: %w", err)
+	}
+
+	now := time.Now().UTC()
+	lookback := models.GetSettingInt(e.DB, "recommendations.lookback_months", 3)
+	monthTo := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthFrom := monthTo.AddDate(0, -lookback, 0)
+	metricsSince := now.AddDate(0, 0, -models.GetSettingInt(e.DB, "metrics.hourly_retention_days", 90))
+
+	candidates, err := models.ListRecommendationCandidates(e.DB, filters, monthFrom.Format("2006-01"), monthTo.Format("2006-01"), metricsSince)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+
+	settings := recommendationSettings{
+		margin:         float64(models.GetSettingInt(e.DB, "recommendations.switch_margin_percent", 10)) / 100,
+		cpuPercent:     float64(models.GetSettingInt(e.DB, "recommendations.downsize_cpu_percent", 30)),
+		memoryPercent:  float64(models.GetSettingInt(e.DB, "recommendations.downsize_memory_percent", 50)),
+		minMetricDays:  models.GetSettingInt(e.DB, "recommendations.min_metric_days", 7),
+		defaultTimeout: models.GetSettingInt(e.DB, "usage.auto_stop_timeout_minutes", 60),
+		includeAll:     includeAll,
+	}
+
+	result := &RecommendationResult{Recommendations: []Recommendation{}}
+	for _, c := range candidates {
+		if c.RunningMode != string(wstypes.RunningModeAutoStop) && c.RunningMode != string(wstypes.RunningModeAlwaysOn) {
+			continue
+		}
+		current := matchWorkspacePrice(prices, c.Region, c.BundleID, c.ComputeType, c.RootVolumeSizeGib, c.UserVolumeSizeGib)
+		if current == nil {
+			result.Unpriced++
+			continue
+		}
+		// AlwaysOn workspaces run around the clock, so their AutoStop hours can only be
+		// estimated from measured connections
+		if c.MonthsMeasured == 0 || (c.RunningMode == string(wstypes.RunningModeAlwaysOn) && c.ConnectionDays == 0) {
+			result.Unmeasured++
+			continue
+		}
+
+		if r := recommend(c, current, prices, settings); r != nil {
+			result.Recommendations = append(result.Recommendations, *r)
+		}
+	}
+
+	sort.SliceStable(result.Recommendations, func(i, j int) bool {
+		return result.Recommendations[i].EstimatedMonthlySavings > result.Recommendations[j].EstimatedMonthlySavings
+	})
+	return result, nil
+}
+
+// recommendationSettings are the thresholds recommendations are made with
+type recommendationSettings struct {
+	margin         float64 // Fraction past the break-even needed to switch running mode
+	cpuPercent     float64
+	memoryPercent  float64
+	minMetricDays  int
+	defaultTimeout int // AutoStop timeout in minutes for workspaces that don't report one
+	includeAll     bool
+}
+
+// recommend works out one workspace's recommendation, or nil if it is rightsized and
+// settings.includeAll isn't set
+func recommend(c models.RecommendationCandidate, current *models.WorkspacePrice, prices []models.WorkspacePrice, settings recommendationSettings) *Recommendation {
+	hours := c.RunningHours
+	if c.RunningMode == string(wstypes.RunningModeAlwaysOn) {
+		// Under AutoStop it would run while connected, plus a timeout after each day's use
+		timeout := c.AutoStopTimeoutMinutes
+		if timeout <= 0 {
+			timeout = settings.defaultTimeout
+		}
+		hours = c.ConnectedHours + c.ConnectedDays*math.Ceil(float64(timeout)/60)
+	}
+
+	r := &Recommendation{
+		WorkspaceID:            c.WorkspaceID,
+		UserName:               c.UserName,
+		AWSAccountID:           c.AWSAccountID,
+		Region:                 c.Region,
+		BundleID:               c.BundleID,
+		RunningMode:            c.RunningMode,
+		ComputeType:            c.ComputeType,
+		MonthsMeasured:         c.MonthsMeasured,
+		AvgMonthlyHours:        round2(hours),
+		CPUP95:                 c.CPUP95,
+		MemoryP95:              c.MemoryP95,
+		RecommendedRunningMode: c.RunningMode,
+		RecommendedComputeType: c.ComputeType,
+		ActualMonthlyCost:      c.ActualMonthlyCost,
+	}
+	reasons := []string{}
+
+	target := current
+	if smaller, ok := downsizeTarget(c, settings); ok {
+		// A price that doesn't name the compute type says nothing about what downsizing saves
+		price := matchWorkspacePrice(prices, c.Region, "", smaller, c.RootVolumeSizeGib, c.UserVolumeSizeGib)
+		if price != nil && price.ComputeType == smaller {
+			target = price
+			r.Downsize = true
+			r.RecommendedComputeType = smaller
+			reasons = append(reasons, fmt.Sprintf("95th percentile CPU %.0f%% and memory %.0f%% over %d days",
+				*c.CPUP95, *c.MemoryP95, c.MetricDays))
+		}
+	}
+
+	breakEven := math.Inf(1)
+	if target.AutoStopHourly > 0 {
+		breakEven = (target.AlwaysOnMonthly - target.AutoStopMonthly) / target.AutoStopHourly
+		r.BreakEvenHours = round2(breakEven)
+	}
+	switch {
+	case c.RunningMode == string(wstypes.RunningModeAutoStop) && hours > breakEven*(1+settings.margin):
+		r.RecommendedRunningMode = string(wstypes.RunningModeAlwaysOn)
+		reasons = append(reasons, fmt.Sprintf("runs %.0f hours a month, above the %.0f hour break-even", hours, breakEven))
+	case c.RunningMode == string(wstypes.RunningModeAlwaysOn) && hours < breakEven*(1-settings.margin):
+		r.RecommendedRunningMode = string(wstypes.RunningModeAutoStop)
+		reasons = append(reasons, fmt.Sprintf("would run %.0f hours a month under AutoStop, below the %.0f hour break-even", hours, breakEven))
+	}
+	r.SwitchRunningMode = r.RecommendedRunningMode != c.RunningMode
+
+	if !r.SwitchRunningMode && !r.Downsize && !settings.includeAll {
+		return nil
+	}
+
+	r.CurrentMonthlyCost = round2(monthlyCost(current, c.RunningMode, hours))
+	r.RecommendedMonthlyCost = round2(monthlyCost(target, r.RecommendedRunningMode, hours))
+	r.EstimatedMonthlySavings = round2(r.CurrentMonthlyCost - r.RecommendedMonthlyCost)
+	r.Reason = strings.Join(reasons, "; ")
+	return r
+}
+
+// downsizeTarget returns the next smaller compute type when the workspace's CPU and memory
+// have stayed low for long enough
+func downsizeTarget(c models.RecommendationCandidate, settings recommendationSettings) (string, bool) {
+	if c.CPUP95 == nil || c.MemoryP95 == nil || c.MetricDays < settings.minMetricDays {
+		return "", false
+	}
+	if *c.CPUP95 >= settings.cpuPercent || *c.MemoryP95 >= settings.memoryPercent {
+		return "", false
+	}
+	for i, computeType := range computeTypeLadder {
+		if computeType == c.ComputeType && i > 0 {
+			return computeTypeLadder[i-1], true
+		}
+	}
+	return "", false
+}
+
+// monthlyCost prices a month of hours running hours in a running mode
+func monthlyCost(price *models.WorkspacePrice, runningMode string, hours float64) float64 {
+	if runningMode == string(wstypes.RunningModeAlwaysOn) {
+		return price.AlwaysOnMonthly
+	}
+	return price.AutoStopMonthly + price.AutoStopHourly*hours
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
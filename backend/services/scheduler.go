@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/robfig/cron/v3"
+)
+
+// SyncScheduler triggers syncs on cron schedules read from the settings table. Sync types
+// without their own schedule run every sync.interval_minutes, or on DefaultSchedule when
+// that is blank. Settings are re-read on every tick so changes apply without a restart.
+type SyncScheduler struct {
+	DB *sql.DB
+
+	// DefaultSchedule is used for sync types without their own schedule (SYNC_SCHEDULE)
+	DefaultSchedule string
+
+	// Trigger starts a sync of the given type
+	Trigger func(syncType, triggerSource string) error
+
+	mu        sync.Mutex
+	schedules map[string]scheduleEntry
+}
+
+type scheduleEntry struct {
+	expr     string
+	schedule cron.Schedule
+	next     time.Time
+}
+
+// ValidateSchedule reports whether a cron expression can be parsed
+func ValidateSchedule(expr string) error {
+	_, err := cron.ParseStandard(expr)
+	return err
+}
+
+// Start runs the scheduler loop until the context is cancelled
+func (s *SyncScheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	s.schedules = make(map[string]scheduleEntry)
+	s.mu.Unlock()
+
+	go func() {
+		// Align ticks to the start of each minute, the resolution of cron expressions
+		time.Sleep(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		s.tick(time.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Sync scheduler stopped")
+				return
+			case now := <-ticker.C:
+				s.tick(now)
+			}
+		}
+	}()
+
+	log.Printf("Sync scheduler started (default schedule: %s)", s.DefaultSchedule)
+}
+
+// tick triggers every sync type whose next run time has passed
+func (s *SyncScheduler) tick(now time.Time) {
+	enabled, err := models.GetSetting(s.DB, "sync.auto_sync_enabled")
+	if err != nil || enabled.Value != "true" {
+		// Forget computed run times so re-enabling starts from the next occurrence
+		s.mu.Lock()
+		s.schedules = make(map[string]scheduleEntry)
+		s.mu.Unlock()
+		return
+	}
+
+	due := []string{}
+	defaultSchedule := s.CurrentDefaultSchedule()
+
+	s.mu.Lock()
+	for _, syncType := range SyncStages {
+		expr := defaultSchedule
+		if setting, err := models.GetSetting(s.DB, "sync.schedule."+syncType); err == nil && setting.Value != "" {
+			expr = setting.Value
+		}
+
+		entry, ok := s.schedules[syncType]
+		if !ok || entry.expr != expr {
+			schedule, err := cron.ParseStandard(expr)
+			if err != nil {
+				log.Printf("Invalid sync schedule %q for %s: %v", expr, syncType, err)
+				delete(s.schedules, syncType)
+				continue
+			}
+			entry = scheduleEntry{expr: expr, schedule: schedule, next: schedule.Next(now)}
+			s.schedules[syncType] = entry
+			log.Printf("Scheduled %s sync (%s), next run at %s", syncType, expr, entry.next.Format(time.RFC3339))
+			continue
+		}
+
+		if !now.Before(entry.next) {
+			due = append(due, syncType)
+			entry.next = entry.schedule.Next(now)
+			s.schedules[syncType] = entry
+		}
+	}
+	s.mu.Unlock()
+
+	for _, syncType := range due {
+		log.Printf("Starting scheduled %s sync", syncType)
+		err := s.Trigger(syncType, models.SyncTriggerScheduled)
+		if errors.Is(err, ErrSyncInProgress) {
+			log.Printf("Skipping scheduled %s sync: previous run still in progress", syncType)
+		} else if err != nil {
+			log.Printf("Failed to start scheduled %s sync: %v", syncType, err)
+		}
+	}
+}
+
+// CurrentDefaultSchedule returns the schedule of sync types without their own: every
+// sync.interval_minutes when set, otherwise DefaultSchedule
+func (s *SyncScheduler) CurrentDefaultSchedule() string {
+	setting, err := models.GetSetting(s.DB, "sync.interval_minutes")
+	if err != nil || strings.TrimSpace(setting.Value) == "" {
+		return s.DefaultSchedule
+	}
+	minutes, err := strconv.Atoi(strings.TrimSpace(setting.Value))
+	if err != nil || minutes <= 0 {
+		log.Printf("Invalid sync.interval_minutes %q, using %s", setting.Value, s.DefaultSchedule)
+		return s.DefaultSchedule
+	}
+	return fmt.Sprintf("@every %dm", minutes)
+}
+
+// NextRuns returns the next scheduled run time for each sync type
+func (s *SyncScheduler) NextRuns() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := make(map[string]time.Time, len(s.schedules))
+	for syncType, entry := range s.schedules {
+		runs[syncType] = entry.next
+	}
+	return runs
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+)
+
+// Sync stage statuses
+const (
+	StagePending   = "pending"
+	StageRunning   = "running"
+	StageCompleted = "completed"
+	StageFailed    = "failed"
+	StageCancelled = "cancelled"
+)
+
+// SyncProgress tracks the stages of a running sync and persists them to sync_history.
+// All methods are safe to call on a nil receiver so services can report unconditionally.
+type SyncProgress struct {
+	mu     sync.Mutex
+	db     *sql.DB
+	syncID int
+
+	Stages []*StageProgress `json:"stages"`
+	Errors []string         `json:"errors"`
+}
+
+// StageProgress is the outcome of one sync stage
+type StageProgress struct {
+	Name        string             `json:"name"`
+	Status      string             `json:"status"`
+	Records     int                `json:"records"`
+	StartedAt   *time.Time         `json:"started_at,omitempty"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+	Accounts    []*AccountProgress `json:"accounts,omitempty"`
+	Errors      []string           `json:"errors,omitempty"`
+}
+
+// AccountProgress is the outcome of a stage for one AWS account
+type AccountProgress struct {
+	AccountID   int    `json:"account_id"`
+	AccountName string `json:"account_name"`
+	Status      string `json:"status"`
+	Records     int    `json:"records"`
+	Error       string `json:"error,omitempty"`
+}
+
+// NewSyncProgress creates a tracker with every stage pending
+func NewSyncProgress(db *sql.DB, syncID int, stages []string) *SyncProgress {
+	p := &SyncProgress{db: db, syncID: syncID, Stages: []*StageProgress{}, Errors: []string{}}
+	for _, name := range stages {
+		p.Stages = append(p.Stages, &StageProgress{Name: name, Status: StagePending})
+	}
+	p.save()
+	return p
+}
+
+// StartStage marks a stage as running
+func (p *SyncProgress) StartStage(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if stage := p.stage(name); stage != nil {
+		now := time.Now()
+		stage.Status = StageRunning
+		stage.StartedAt = &now
+	}
+	p.save()
+}
+
+// CompleteStage records the result of a stage
+func (p *SyncProgress) CompleteStage(name string, records int, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stage := p.stage(name)
+	if stage == nil {
+		return
+	}
+
+	now := time.Now()
+	stage.CompletedAt = &now
+	stage.Records = records
+	stage.Status = StageCompleted
+	if err != nil {
+		stage.Status = StageFailed
+		stage.Errors = append(stage.Errors, err.Error())
+		p.Errors = append(p.Errors, name+": "+err.Error())
+	}
+	p.save()
+}
+
+// CancelPending marks every stage that has not finished as cancelled
+func (p *SyncProgress) CancelPending() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, stage := range p.Stages {
+		if stage.Status == StagePending || stage.Status == StageRunning {
+			stage.Status = StageCancelled
+			stage.CompletedAt = &now
+		}
+	}
+	p.save()
+}
+
+// RecordAccount records the outcome of the running stage for one account
+func (p *SyncProgress) RecordAccount(accountID int, accountName string, records int, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stage := p.runningStage()
+	if stage == nil {
+		return
+	}
+
+	account := &AccountProgress{
+		AccountID:   accountID,
+		AccountName: accountName,
+		Status:      StageCompleted,
+		Records:     records,
+	}
+	if err != nil {
+		account.Status = StageFailed
+		account.Error = err.Error()
+		stage.Errors = append(stage.Errors, accountName+": "+err.Error())
+		p.Errors = append(p.Errors, stage.Name+": "+accountName+": "+err.Error())
+	}
+	stage.Accounts = append(stage.Accounts, account)
+	stage.Records += records
+	p.save()
+}
+
+// AddError records a non-fatal error against the running stage
+func (p *SyncProgress) AddError(message string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if stage := p.runningStage(); stage != nil {
+		stage.Errors = append(stage.Errors, message)
+		p.Errors = append(p.Errors, stage.Name+": "+message)
+	} else {
+		p.Errors = append(p.Errors, message)
+	}
+	p.save()
+}
+
+func (p *SyncProgress) stage(name string) *StageProgress {
+	for _, stage := range p.Stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+func (p *SyncProgress) runningStage() *StageProgress {
+	for _, stage := range p.Stages {
+		if stage.Status == StageRunning {
+			return stage
+		}
+	}
+	return nil
+}
+
+// save persists the progress document; callers must hold the lock
+func (p *SyncProgress) save() {
+	if p.db == nil || p.syncID == 0 {
+		return
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Failed to encode progress for sync %d: %v", p.syncID, err)
+		return
+	}
+	if err := models.UpdateSyncProgress(p.db, p.syncID, data); err != nil {
+		log.Printf("Failed to save progress for sync %d: %v", p.syncID, err)
+	}
+}
@@ -0,0 +1,466 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys used by the sync queue
+const (
+	syncQueueKey           = "sync:queue"
+	syncProcessingPrefix   = "sync:processing:"
+	syncConsumerPrefix     = "sync:consumer:"
+	syncLockPrefix         = "sync:lock:"
+	syncLockAccountsPrefix = "sync:lock-accounts:"
+	syncCancelPrefix       = "sync:cancel:"
+	syncCancelChannel      = "sync:cancel"
+	cancelRequestTTL       = 24 * time.Hour
+	consumerHeartbeatTTL   = 30 * time.Second
+	consumerHeartbeatEvery = 10 * time.Second
+	queuedLockTTL          = 6 * time.Hour
+	runningLockTTL         = 10 * time.Minute
+	runningLockRefresh     = time.Minute
+)
+
+// SyncStages lists the stages a full ("all") sync runs, in order
+var SyncStages = []string{"workspaces", "bundles", "directories", "images", "cloudtrail", "billing", "metrics", "usage", "ad", "idle", "changes", "requests"}
+
+// ErrSyncInProgress is returned when a conflicting sync is already queued or running
+var ErrSyncInProgress = errors.New("a sync of this type is already queued or running")
+
+// ErrSyncCancelled is the cancellation cause of a job's context when a user cancels it
+var ErrSyncCancelled = errors.New("sync cancelled")
+
+// SyncJob is a unit of work on the sync queue
+type SyncJob struct {
+	ID            int       `json:"id"` // sync_history ID
+	SyncType      string    `json:"sync_type"`
+	AccountID     int       `json:"account_id,omitempty"`
+	TriggerSource string    `json:"trigger_source"`
+	LockToken     string    `json:"lock_token"`
+	EnqueuedAt    time.Time `json:"enqueued_at"`
+}
+
+// globalSyncStages ignore the job's account, so they are always locked for every account
+var globalSyncStages = map[string]bool{"ad": true, "idle": true, "changes": true, "requests": true}
+
+// lockKeys returns the single-flight locks a job holds: one per stage it runs, scoped to
+// its account (or "all" for every account). Each lock is followed by the stage's "all"
+// lock and the set of its held account locks, so that a sync of every account and a
+// sync of one account never run a stage at the same time.
+func (j *SyncJob) lockKeys() []string {
+	stages := []string{NormalizeSyncType(j.SyncType)}
+	if stages[0] == "all" {
+		stages = SyncStages
+	}
+
+	keys := make([]string, 0, len(stages)*3)
+	for _, stage := range stages {
+		scope := "all"
+		if j.AccountID > 0 && !globalSyncStages[stage] {
+			scope = strconv.Itoa(j.AccountID)
+		}
+		keys = append(keys,
+			syncLockPrefix+stage+":"+scope,
+			syncLockPrefix+stage+":all",
+			syncLockAccountsPrefix+stage)
+	}
+	return keys
+}
+
+// NormalizeSyncType maps sync type aliases to their canonical name
+func NormalizeSyncType(syncType string) string {
+	if syncType == "active_directory" {
+		return "ad"
+	}
+	return syncType
+}
+
+// acquireLocksScript sets every lock key to the token unless it, or a conflicting lock, is
+// held by another token. KEYS come in threes from lockKeys: an account lock conflicts with
+// its stage's "all" lock, and an "all" lock with every account lock in the stage's set.
+var acquireLocksScript = redis.NewScript(`
+for i = 1, #KEYS, 3 do
+	local lock, all, accounts = KEYS[i], KEYS[i + 1], KEYS[i + 2]
+	local holder = redis.call("GET", lock)
+	if holder and holder ~= ARGV[1] then
+		return 0
+	end
+	if lock ~= all then
+		local allHolder = redis.call("GET", all)
+		if allHolder and allHolder ~= ARGV[1] then
+			return 0
+		end
+	else
+		for _, key in ipairs(redis.call("SMEMBERS", accounts)) do
+			local accountHolder = redis.call("GET", key)
+			if not accountHolder then
+				redis.call("SREM", accounts, key)
+			elseif accountHolder ~= ARGV[1] then
+				return 0
+			end
+		end
+	end
+end
+for i = 1, #KEYS, 3 do
+	redis.call("SET", KEYS[i], ARGV[1], "PX", ARGV[2])
+	if KEYS[i] ~= KEYS[i + 1] then
+		redis.call("SADD", KEYS[i + 2], KEYS[i])
+	end
+end
+return 1
+`)
+
+// releaseLocksScript deletes the lock keys still held by the token
+var releaseLocksScript = redis.NewScript(`
+for i = 1, #KEYS, 3 do
+	if redis.call("GET", KEYS[i]) == ARGV[1] then
+		redis.call("DEL", KEYS[i])
+		redis.call("SREM", KEYS[i + 2], KEYS[i])
+	end
+end
+return 1
+`)
+
+// SyncQueue distributes sync jobs through Redis to a pool of workers.
+// Jobs in flight are tracked per consumer so they can be resumed after a crash.
+type SyncQueue struct {
+	DB      *sql.DB
+	Redis   *redis.Client
+	Workers int
+
+	// Handler runs a job; it is called by a worker once the job's locks are held
+	Handler func(ctx context.Context, job *SyncJob)
+
+	consumerID string
+
+	mu      sync.Mutex
+	running map[int]context.CancelCauseFunc
+}
+
+// Enqueue records a sync history entry and queues the job.
+// ErrSyncInProgress is returned if a conflicting job already holds the lock.
+func (q *SyncQueue) Enqueue(ctx context.Context, syncType string, accountID int, triggerSource string) (*models.SyncHistory, error) {
+	job := &SyncJob{
+		SyncType:      syncType,
+		AccountID:     accountID,
+		TriggerSource: triggerSource,
+		LockToken:     newToken(),
+		EnqueuedAt:    time.Now(),
+	}
+
+	acquired, err := q.acquireLocks(ctx, job, queuedLockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire sync lock: %w", err)
+	}
+	if !acquired {
+		return nil, ErrSyncInProgress
+	}
+
+	syncHistory, err := models.CreateSyncHistory(q.DB, syncType, triggerSource, accountID)
+	if err != nil {
+		q.releaseLocks(job)
+		return nil, err
+	}
+	job.ID = syncHistory.ID
+
+	payload, err := json.Marshal(job)
+	if err != nil {
+		q.releaseLocks(job)
+		return nil, err
+	}
+
+	if err := q.Redis.LPush(ctx, syncQueueKey, payload).Err(); err != nil {
+		q.releaseLocks(job)
+		models.UpdateSyncHistory(q.DB, job.ID, "failed", 0, "failed to enqueue sync job")
+		return nil, fmt.Errorf("failed to enqueue sync job: %w", err)
+	}
+
+	log.Printf("Queued sync job %d (type: %s, account: %d, trigger: %s)", job.ID, syncType, accountID, triggerSource)
+	return syncHistory, nil
+}
+
+// Start launches the worker pool, consumer heartbeat and crash recovery loop
+func (q *SyncQueue) Start(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	q.consumerID = fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), newToken()[:8])
+	q.running = make(map[int]context.CancelCauseFunc)
+
+	// Register before recovering so other consumers don't reclaim our (empty) list
+	q.heartbeat(ctx)
+	q.recoverOrphanedJobs(ctx)
+
+	go func() {
+		heartbeatTicker := time.NewTicker(consumerHeartbeatEvery)
+		recoveryTicker := time.NewTicker(time.Minute)
+		defer heartbeatTicker.Stop()
+		defer recoveryTicker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeatTicker.C:
+				q.heartbeat(ctx)
+			case <-recoveryTicker.C:
+				q.recoverOrphanedJobs(ctx)
+			}
+		}
+	}()
+
+	go q.listenForCancellations(ctx)
+
+	workers := q.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.work(ctx)
+	}
+
+	log.Printf("Sync queue started with %d workers (consumer: %s)", workers, q.consumerID)
+}
+
+// work consumes jobs until the context is cancelled
+func (q *SyncQueue) work(ctx context.Context) {
+	processingKey := syncProcessingPrefix + q.consumerID
+
+	for {
+		payload, err := q.Redis.BLMove(ctx, syncQueueKey, processingKey, "RIGHT", "LEFT", 5*time.Second).Result()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read from sync queue: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var job SyncJob
+		if err := json.Unmarshal([]byte(payload), &job); err != nil {
+			log.Printf("Dropping malformed sync job: %v", err)
+		} else {
+			q.process(ctx, &job)
+		}
+
+		if err := q.Redis.LRem(context.Background(), processingKey, 1, payload).Err(); err != nil {
+			log.Printf("Failed to acknowledge sync job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// process runs a single job while holding (and refreshing) its locks
+func (q *SyncQueue) process(ctx context.Context, job *SyncJob) {
+	// Re-assert the locks; a resumed job may have lost them to a newer one
+	acquired, err := q.acquireLocks(ctx, job, runningLockTTL)
+	if err != nil {
+		log.Printf("Failed to lock sync job %d: %v", job.ID, err)
+		models.UpdateSyncHistory(q.DB, job.ID, "failed", 0, "failed to acquire sync lock")
+		return
+	}
+	if !acquired {
+		log.Printf("Skipping sync job %d: superseded by another %s sync", job.ID, job.SyncType)
+		models.UpdateSyncHistory(q.DB, job.ID, "failed", 0, "superseded by another sync of the same type")
+		return
+	}
+	defer q.releaseLocks(job)
+
+	if q.cancelRequested(ctx, job.ID) {
+		log.Printf("Skipping sync job %d: cancelled before it started", job.ID)
+		models.UpdateSyncHistory(q.DB, job.ID, "cancelled", 0, "")
+		return
+	}
+
+	if err := models.MarkSyncHistoryRunning(q.DB, job.ID); err != nil {
+		log.Printf("Failed to mark sync job %d as running: %v", job.ID, err)
+	}
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	q.mu.Lock()
+	q.running[job.ID] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, job.ID)
+		q.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(runningLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := q.acquireLocks(context.Background(), job, runningLockTTL); err != nil {
+					log.Printf("Failed to refresh lock for sync job %d: %v", job.ID, err)
+				}
+				// Fallback in case the cancellation message was missed
+				if q.cancelRequested(context.Background(), job.ID) {
+					cancel(ErrSyncCancelled)
+				}
+			}
+		}
+	}()
+
+	log.Printf("Running sync job %d (type: %s, account: %d)", job.ID, job.SyncType, job.AccountID)
+	q.Handler(jobCtx, job)
+
+	close(done)
+	wg.Wait()
+}
+
+// Cancel requests cancellation of a queued or running job.
+// Queued jobs are removed immediately; running jobs are signalled on every consumer.
+// It reports whether the job was still queued.
+func (q *SyncQueue) Cancel(ctx context.Context, jobID int) (bool, error) {
+	if err := q.Redis.Set(ctx, syncCancelPrefix+strconv.Itoa(jobID), 1, cancelRequestTTL).Err(); err != nil {
+		return false, err
+	}
+
+	payloads, err := q.Redis.LRange(ctx, syncQueueKey, 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, payload := range payloads {
+		var job SyncJob
+		if json.Unmarshal([]byte(payload), &job) != nil || job.ID != jobID {
+			continue
+		}
+		removed, err := q.Redis.LRem(ctx, syncQueueKey, 1, payload).Result()
+		if err != nil {
+			return false, err
+		}
+		if removed > 0 {
+			q.releaseLocks(&job)
+			return true, nil
+		}
+	}
+
+	return false, q.Redis.Publish(ctx, syncCancelChannel, jobID).Err()
+}
+
+// listenForCancellations cancels local jobs when a cancellation is published
+func (q *SyncQueue) listenForCancellations(ctx context.Context) {
+	pubsub := q.Redis.Subscribe(ctx, syncCancelChannel)
+	defer pubsub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			jobID, err := strconv.Atoi(msg.Payload)
+			if err != nil {
+				continue
+			}
+			q.mu.Lock()
+			cancel, running := q.running[jobID]
+			q.mu.Unlock()
+			if running {
+				log.Printf("Cancelling sync job %d", jobID)
+				cancel(ErrSyncCancelled)
+			}
+		}
+	}
+}
+
+// cancelRequested reports whether a job has been cancelled
+func (q *SyncQueue) cancelRequested(ctx context.Context, jobID int) bool {
+	exists, err := q.Redis.Exists(ctx, syncCancelPrefix+strconv.Itoa(jobID)).Result()
+	return err == nil && exists > 0
+}
+
+// heartbeat marks this consumer as alive
+func (q *SyncQueue) heartbeat(ctx context.Context) {
+	if err := q.Redis.Set(ctx, syncConsumerPrefix+q.consumerID, time.Now().Unix(), consumerHeartbeatTTL).Err(); err != nil {
+		log.Printf("Failed to send sync consumer heartbeat: %v", err)
+	}
+}
+
+// recoverOrphanedJobs requeues jobs held by consumers that stopped heartbeating
+func (q *SyncQueue) recoverOrphanedJobs(ctx context.Context) {
+	var cursor uint64
+	for {
+		keys, next, err := q.Redis.Scan(ctx, cursor, syncProcessingPrefix+"*", 100).Result()
+		if err != nil {
+			log.Printf("Failed to scan for orphaned sync jobs: %v", err)
+			return
+		}
+
+		for _, key := range keys {
+			consumerID := strings.TrimPrefix(key, syncProcessingPrefix)
+			alive, err := q.Redis.Exists(ctx, syncConsumerPrefix+consumerID).Result()
+			if err != nil || alive > 0 {
+				continue
+			}
+
+			// Move back to the consuming end of the queue so they run next
+			for {
+				payload, err := q.Redis.LMove(ctx, key, syncQueueKey, "RIGHT", "RIGHT").Result()
+				if err != nil {
+					break
+				}
+				var job SyncJob
+				if json.Unmarshal([]byte(payload), &job) == nil {
+					log.Printf("Resuming sync job %d from stopped consumer %s", job.ID, consumerID)
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// acquireLocks takes (or refreshes) every lock the job needs, all or nothing
+func (q *SyncQueue) acquireLocks(ctx context.Context, job *SyncJob, ttl time.Duration) (bool, error) {
+	result, err := acquireLocksScript.Run(ctx, q.Redis, job.lockKeys(), job.LockToken, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// releaseLocks frees the job's locks if it still holds them
+func (q *SyncQueue) releaseLocks(job *SyncJob) {
+	if err := releaseLocksScript.Run(context.Background(), q.Redis, job.lockKeys(), job.LockToken).Err(); err != nil {
+		log.Printf("Failed to release locks for sync job %d: %v", job.ID, err)
+	}
+}
+
+// newToken returns a random hex token
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
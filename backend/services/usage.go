@@ -0,0 +1,319 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// Signals recorded in the sources of daily usage
+const (
+	usageSourceCloudWatch = "cloudwatch"
+	usageSourceSnapshots  = "connection_status"
+	usageSourceCloudTrail = "cloudtrail"
+	usageSourceAlwaysOn   = "always_on"
+)
+
+// usageMetricsBatch is how many workspaces are queried per GetMetricData call, which
+// accepts 500 queries (two per workspace)
+const usageMetricsBatch = 250
+
+// maxSnapshotGap is the longest gap between two connected snapshots that is assumed to be
+// one session
+const maxSnapshotGap = 2 * time.Hour
+
+// workspaceSignals are the usage signals gathered for one workspace
+type workspaceSignals struct {
+	metricsReported bool               // CloudWatch returned data for the workspace
+	connectedHours  map[time.Time]bool // UTC hours CloudWatch saw a user connected or a session launch
+	snapshots       []models.ConnectionSnapshot
+	events          []models.PowerEvent
+}
+
+// CalculateUsageHours derives each workspace's running and connected hours per day, for the
+// current month and the usage.backfill_months before it, and totals them per month.
+//
+// Connected hours come from CloudWatch UserConnected and SessionLaunchTime, or from the
+// connection states recorded by each sync when CloudWatch has no data for a workspace.
+// AlwaysOn workspaces run around the clock; AutoStop workspaces run while connected, after
+// start events in CloudTrail, and for their AutoStop timeout afterwards, until stopped.
+func (s *AWSService) CalculateUsageHours(ctx context.Context, accountID int) (int, error) {
+	now := time.Now().UTC()
+	backfill := models.GetSettingInt(s.DB, "usage.backfill_months", 2)
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -backfill, 0)
+
+	retention := models.GetSettingInt(s.DB, "usage.snapshot_retention_days", 400)
+	if _, err := models.PruneConnectionSnapshots(s.DB, now.AddDate(0, 0, -retention)); err != nil {
+		log.Printf("Failed to prune connection snapshots: %v", err)
+	}
+
+	log.Printf("Calculating usage hours since %s", since.Format("2006-01-02"))
+
+	count, err := s.forEachAccountRegion(ctx, accountID, func(ctx context.Context, cfg aws.Config, account *models.AWSAccount) (int, error) {
+		return s.calculateUsageInRegion(ctx, cfg, account, since, now)
+	})
+
+	log.Printf("Calculated usage for %d workspaces", count)
+	return count, err
+}
+
+func (s *AWSService) calculateUsageInRegion(ctx context.Context, cfg aws.Config, account *models.AWSAccount, since, now time.Time) (int, error) {
+	workspaces, err := models.ListUsageWorkspaces(s.DB, account.ID, cfg.Region, since)
+	if err != nil {
+		return 0, err
+	}
+	if len(workspaces) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, len(workspaces))
+	signals := make(map[string]*workspaceSignals, len(workspaces))
+	for i, ws := range workspaces {
+		ids[i] = ws.WorkspaceID
+		signals[ws.WorkspaceID] = &workspaceSignals{connectedHours: map[time.Time]bool{}}
+	}
+
+	// Missing CloudWatch permissions shouldn't stop the other signals being used
+	if err := s.fetchConnectedHours(ctx, cfg, ids, since, now, signals); err != nil {
+		log.Printf("Failed to fetch CloudWatch metrics in %s: %v", cfg.Region, err)
+		s.Progress.AddError(fmt.Sprintf("CloudWatch metrics in %s: %v", cfg.Region, err))
+	}
+
+	snapshots, err := models.ListConnectionSnapshots(s.DB, ids, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read connection snapshots: %w", err)
+	}
+	for _, snapshot := range snapshots {
+		signals[snapshot.WorkspaceID].snapshots = append(signals[snapshot.WorkspaceID].snapshots, snapshot)
+	}
+
+	events, err := models.ListPowerEvents(s.DB, ids, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read CloudTrail events: %w", err)
+	}
+	for _, event := range events {
+		signals[event.WorkspaceID].events = append(signals[event.WorkspaceID].events, event)
+	}
+
+	defaultTimeout := models.GetSettingInt(s.DB, "usage.auto_stop_timeout_minutes", 60)
+	usage := []models.DailyUsage{}
+	for _, ws := range workspaces {
+		usage = append(usage, dailyUsage(ws, signals[ws.WorkspaceID], since, now, defaultTimeout)...)
+	}
+
+	if err := models.ReplaceDailyUsage(s.DB, ids, since, usage); err != nil {
+		return 0, fmt.Errorf("failed to store usage: %w", err)
+	}
+	return len(workspaces), nil
+}
+
+// fetchConnectedHours reads hourly UserConnected maximums and SessionLaunchTime counts from
+// CloudWatch into signals
+func (s *AWSService) fetchConnectedHours(ctx context.Context, cfg aws.Config, ids []string, since, now time.Time, signals map[string]*workspaceSignals) error {
+	client := cloudwatch.NewFromConfig(cfg)
+
+	for start := 0; start < len(ids); start += usageMetricsBatch {
+		end := start + usageMetricsBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+
+		queries := make([]cwtypes.MetricDataQuery, 0, 2*len(batch))
+		for i, id := range batch {
+			queries = append(queries,
+				workspaceMetricQuery(fmt.Sprintf("c%d", i), id, "UserConnected", "Maximum", 3600),
+				workspaceMetricQuery(fmt.Sprintf("s%d", i), id, "SessionLaunchTime", "SampleCount", 3600))
+		}
+
+		paginator := cloudwatch.NewGetMetricDataPaginator(client, &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(since),
+			EndTime:           aws.Time(now),
+			MetricDataQueries: queries,
+			ScanBy:            cwtypes.ScanByTimestampAscending,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, result := range page.MetricDataResults {
+				queryID := aws.ToString(result.Id)
+				i, err := strconv.Atoi(queryID[1:])
+				if err != nil || i >= len(batch) {
+					continue
+				}
+				ws := signals[batch[i]]
+				if len(result.Timestamps) > 0 {
+					ws.metricsReported = true
+				}
+				for j, timestamp := range result.Timestamps {
+					if j < len(result.Values) && result.Values[j] > 0 {
+						ws.connectedHours[timestamp.UTC().Truncate(time.Hour)] = true
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// workspaceMetricQuery queries one AWS/WorkSpaces metric of a workspace
+func workspaceMetricQuery(id, workspaceID, metricName, stat string, period int32) cwtypes.MetricDataQuery {
+	return cwtypes.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cwtypes.MetricStat{
+			Metric: &cwtypes.Metric{
+				Namespace:  aws.String("AWS/WorkSpaces"),
+				MetricName: aws.String(metricName),
+				Dimensions: []cwtypes.Dimension{{
+					Name:  aws.String("WorkspaceId"),
+					Value: aws.String(workspaceID),
+				}},
+			},
+			Period: aws.Int32(period),
+			Stat:   aws.String(stat),
+		},
+		ReturnData: aws.Bool(true),
+	}
+}
+
+// dailyUsage works out which whole UTC hours a workspace was connected and running between
+// since and now, and totals them per day
+func dailyUsage(ws models.UsageWorkspace, signals *workspaceSignals, since, now time.Time, defaultTimeout int) []models.DailyUsage {
+	start := since
+	if ws.CreatedAt != nil && ws.CreatedAt.After(start) {
+		start = ws.CreatedAt.UTC().Truncate(time.Hour)
+	}
+	end := now.Truncate(time.Hour)
+	if ws.EndedAt != nil {
+		if ended := ws.EndedAt.UTC().Add(time.Hour - time.Nanosecond).Truncate(time.Hour); ended.Before(end) {
+			end = ended
+		}
+	}
+	if !end.After(start) {
+		return nil
+	}
+
+	hours := int(end.Sub(start) / time.Hour)
+	hourOf := func(t time.Time) int {
+		if t.Before(start) {
+			return -1
+		}
+		return int(t.Sub(start) / time.Hour)
+	}
+	connected := make([]bool, hours)
+	running := make([]bool, hours)
+	sources := []string{}
+
+	if signals.metricsReported {
+		sources = append(sources, usageSourceCloudWatch)
+		for hour := range signals.connectedHours {
+			if i := hourOf(hour); i >= 0 && i < hours {
+				connected[i] = true
+			}
+		}
+	} else if len(signals.snapshots) > 0 {
+		// Snapshots are only as frequent as syncs, so consecutive connected snapshots
+		// close together count as one session
+		sources = append(sources, usageSourceSnapshots)
+		for k, snapshot := range signals.snapshots {
+			if snapshot.ConnectionState != string(wstypes.ConnectionStateConnected) {
+				continue
+			}
+			from, to := hourOf(snapshot.CapturedAt), hourOf(snapshot.CapturedAt)
+			if k+1 < len(signals.snapshots) {
+				next := signals.snapshots[k+1]
+				if next.ConnectionState == string(wstypes.ConnectionStateConnected) && next.CapturedAt.Sub(snapshot.CapturedAt) <= maxSnapshotGap {
+					to = hourOf(next.CapturedAt)
+				}
+			}
+			for i := from; i <= to; i++ {
+				if i >= 0 && i < hours {
+					connected[i] = true
+				}
+			}
+		}
+	}
+
+	if ws.RunningMode == string(wstypes.RunningModeAlwaysOn) {
+		sources = append(sources, usageSourceAlwaysOn)
+		for i := range running {
+			running[i] = true
+		}
+	} else {
+		started := make([]bool, hours)
+		stopped := make([]bool, hours)
+		for _, event := range signals.events {
+			i := hourOf(event.EventTime)
+			if i < 0 || i >= hours {
+				continue
+			}
+			switch event.EventName {
+			case "StopWorkspaces", "TerminateWorkspaces":
+				stopped[i] = true
+			default:
+				started[i] = true
+			}
+		}
+		if len(signals.events) > 0 {
+			sources = append(sources, usageSourceCloudTrail)
+		}
+
+		timeout := ws.AutoStopTimeoutMinutes
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+		timeoutHours := (timeout + 59) / 60
+
+		// A workspace runs through each connected or started hour, then until its AutoStop
+		// timeout passes or it is stopped
+		runUntil := -1
+		for i := 0; i < hours; i++ {
+			if connected[i] || started[i] {
+				if i+timeoutHours > runUntil {
+					runUntil = i + timeoutHours
+				}
+			}
+			// Only running workspaces can be stopped
+			running[i] = i <= runUntil || stopped[i]
+			if stopped[i] && !connected[i] {
+				runUntil = i
+			}
+		}
+	}
+
+	byDay := map[time.Time]*models.DailyUsage{}
+	sourceList := strings.Join(sources, ",")
+	for i := 0; i < hours; i++ {
+		day := start.Add(time.Duration(i) * time.Hour).Truncate(24 * time.Hour)
+		u, ok := byDay[day]
+		if !ok {
+			u = &models.DailyUsage{WorkspaceID: ws.WorkspaceID, UsageDate: day, Sources: sourceList}
+			byDay[day] = u
+		}
+		if running[i] {
+			u.RunningHours++
+		}
+		if connected[i] {
+			u.ConnectedHours++
+		}
+	}
+
+	usage := make([]models.DailyUsage, 0, len(byDay))
+	for _, u := range byDay {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(a, b int) bool { return usage[a].UsageDate.Before(usage[b].UsageDate) })
+	return usage
+}
@@ -0,0 +1,364 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/workspaces"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// Workspace lifecycle actions
+const (
+	WorkspaceActionStart     = "start"
+	WorkspaceActionStop      = "stop"
+	WorkspaceActionReboot    = "reboot"
+	WorkspaceActionRebuild   = "rebuild"
+	WorkspaceActionRestore   = "restore"
+	WorkspaceActionTerminate = "terminate"
+	WorkspaceActionMigrate   = "migrate"
+)
+
+// workspaceActionBatch is the most workspaces the batch WorkSpaces actions accept per call
+const workspaceActionBatch = 25
+
+// workspaceActionSpec describes who may run an action and what it does to a workspace
+type workspaceActionSpec struct {
+	roles       []string // Roles allowed to run it
+	destructive bool     // Loses data or the workspace, so needs a confirmation token
+	state       string   // State the workspace moves to once AWS accepts it
+}
+
+var workspaceActionSpecs = map[string]workspaceActionSpec{
+	WorkspaceActionStart:     {roles: []string{models.RoleAdmin, models.RoleOperator}, state: string(wstypes.WorkspaceStateStarting)},
+	WorkspaceActionStop:      {roles: []string{models.RoleAdmin, models.RoleOperator}, state: string(wstypes.WorkspaceStateStopping)},
+	WorkspaceActionReboot:    {roles: []string{models.RoleAdmin, models.RoleOperator}, state: string(wstypes.WorkspaceStateRebooting)},
+	WorkspaceActionRebuild:   {roles: []string{models.RoleAdmin}, destructive: true, state: string(wstypes.WorkspaceStateRebuilding)},
+	WorkspaceActionRestore:   {roles: []string{models.RoleAdmin}, destructive: true, state: string(wstypes.WorkspaceStateRestoring)},
+	WorkspaceActionTerminate: {roles: []string{models.RoleAdmin}, destructive: true, state: string(wstypes.WorkspaceStateTerminating)},
+	// Migration creates a new workspace and terminates this one once it is done
+	WorkspaceActionMigrate: {roles: []string{models.RoleAdmin}, destructive: true},
+}
+
+// IsWorkspaceAction reports whether action is a known lifecycle action
+func IsWorkspaceAction(action string) bool {
+	_, ok := workspaceActionSpecs[action]
+	return ok
+}
+
+// WorkspaceActionAllowed reports whether a user with role may run action
+func WorkspaceActionAllowed(action, role string) bool {
+	for _, allowed := range workspaceActionSpecs[action].roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkspaceActionDestructive reports whether action needs a confirmation token
+func WorkspaceActionDestructive(action string) bool {
+	return workspaceActionSpecs[action].destructive
+}
+
+// WorkspaceActionParams are the extra inputs some actions take
+type WorkspaceActionParams struct {
+	BundleID string `json:"bundle_id,omitempty"` // Target bundle, for migrate
+}
+
+// Validate checks the parameters action needs are present
+func (p WorkspaceActionParams) Validate(action string) error {
+	if action == WorkspaceActionMigrate && p.BundleID == "" {
+		return fmt.Errorf("bundle_id is required to migrate a workspace")
+	}
+	return nil
+}
+
+// RequestActionConfirmation stores a pending destructive action and returns the token that
+// confirms it. The token only runs the action on these workspaces, for this user.
+func (s *AWSService) RequestActionConfirmation(username, action string, workspaceIDs []string, params WorkspaceActionParams) (*models.ActionConfirmation, error) {
+	confirmation := &models.ActionConfirmation{
+		Token:        newToken(),
+		Username:     username,
+		Action:       action,
+		WorkspaceIDs: workspaceIDs,
+	}
+	if params != (WorkspaceActionParams{}) {
+		confirmation.Parameters, _ = json.Marshal(params)
+	}
+
+	ttl := time.Duration(models.GetSettingInt(s.DB, "actions.confirmation_ttl_minutes", 5)) * time.Minute
+	if err := models.CreateActionConfirmation(s.DB, confirmation, ttl); err != nil {
+		return nil, err
+	}
+	return confirmation, nil
+}
+
+// ConfirmWorkspaceAction consumes a confirmation token, returning the workspaces and
+// parameters it was issued for. Unknown, expired or used tokens return sql.ErrNoRows.
+func (s *AWSService) ConfirmWorkspaceAction(token, username, action string) ([]string, WorkspaceActionParams, error) {
+	var params WorkspaceActionParams
+	confirmation, err := models.ConsumeActionConfirmation(s.DB, token, username, action)
+	if err != nil {
+		return nil, params, err
+	}
+	if len(confirmation.Parameters) > 0 {
+		if err := json.Unmarshal(confirmation.Parameters, &params); err != nil {
+			return nil, params, err
+		}
+	}
+	return confirmation.WorkspaceIDs, params, nil
+}
+
+// WorkspaceActionResult is the outcome of an action on one workspace
+type WorkspaceActionResult struct {
+	WorkspaceID       string `json:"workspace_id"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+	TargetWorkspaceID string `json:"target_workspace_id,omitempty"` // The new workspace, for migrate
+}
+
+// actionTarget is an account and region whose workspaces share a client
+type actionTarget struct {
+	accountID int
+	region    string
+}
+
+// RunWorkspaceAction runs action against the workspaces with the credentials of the account
+// that owns each one, and records every outcome with requestedBy. Failures are reported per
+// workspace and don't stop the others.
+func (s *AWSService) RunWorkspaceAction(ctx context.Context, action string, targets []models.Workspace, params WorkspaceActionParams, requestedBy string, bulk bool) []WorkspaceActionResult {
+	groups := make(map[actionTarget][]models.Workspace)
+	order := []actionTarget{}
+	for _, ws := range targets {
+		key := actionTarget{region: ws.Region}
+		if ws.AWSAccountID != nil {
+			key.accountID = *ws.AWSAccountID
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], ws)
+	}
+
+	var parameters json.RawMessage
+	if params != (WorkspaceActionParams{}) {
+		parameters, _ = json.Marshal(params)
+	}
+
+	results := []WorkspaceActionResult{}
+	for _, key := range order {
+		group := groups[key]
+		ids := make([]string, len(group))
+		for i, ws := range group {
+			ids[i] = ws.WorkspaceID
+		}
+
+		var groupResults []WorkspaceActionResult
+		client, err := s.actionClient(ctx, key)
+		if err != nil {
+			groupResults = failWorkspaceActions(ids, err)
+		} else {
+			groupResults = callWorkspaceAction(ctx, client, action, ids, params)
+		}
+
+		for i, result := range groupResults {
+			s.recordWorkspaceAction(group[i], action, result, parameters, requestedBy, bulk)
+		}
+		results = append(results, groupResults...)
+	}
+	return results
+}
+
+// actionClient returns a WorkSpaces client for an account's region. Workspaces without an
+// account were synced with the legacy settings credentials.
+func (s *AWSService) actionClient(ctx context.Context, key actionTarget) (*workspaces.Client, error) {
+	var cfg aws.Config
+	var err error
+	if key.accountID > 0 {
+		cfg, err = s.GetAWSConfigForAccount(ctx, key.accountID)
+	} else {
+		cfg, err = s.GetAWSConfig(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key.region != "" {
+		cfg = cfg.Copy()
+		cfg.Region = key.region
+	}
+	return workspaces.NewFromConfig(cfg), nil
+}
+
+// callWorkspaceAction calls the WorkSpaces API for action, returning a result per ID in order
+func callWorkspaceAction(ctx context.Context, client *workspaces.Client, action string, ids []string, params WorkspaceActionParams) []WorkspaceActionResult {
+	switch action {
+	case WorkspaceActionStart:
+		return batchWorkspaceAction(ids, func(batch []string) ([]wstypes.FailedWorkspaceChangeRequest, error) {
+			requests := make([]wstypes.StartRequest, len(batch))
+			for i, id := range batch {
+				requests[i] = wstypes.StartRequest{WorkspaceId: aws.String(id)}
+			}
+			out, err := client.StartWorkspaces(ctx, &workspaces.StartWorkspacesInput{StartWorkspaceRequests: requests})
+			if err != nil {
+				return nil, err
+			}
+			return out.FailedRequests, nil
+		})
+	case WorkspaceActionStop:
+		return batchWorkspaceAction(ids, func(batch []string) ([]wstypes.FailedWorkspaceChangeRequest, error) {
+			requests := make([]wstypes.StopRequest, len(batch))
+			for i, id := range batch {
+				requests[i] = wstypes.StopRequest{WorkspaceId: aws.String(id)}
+			}
+			out, err := client.StopWorkspaces(ctx, &workspaces.StopWorkspacesInput{StopWorkspaceRequests: requests})
+			if err != nil {
+				return nil, err
+			}
+			return out.FailedRequests, nil
+		})
+	case WorkspaceActionReboot:
+		return batchWorkspaceAction(ids, func(batch []string) ([]wstypes.FailedWorkspaceChangeRequest, error) {
+			requests := make([]wstypes.RebootRequest, len(batch))
+			for i, id := range batch {
+				requests[i] = wstypes.RebootRequest{WorkspaceId: aws.String(id)}
+			}
+			out, err := client.RebootWorkspaces(ctx, &workspaces.RebootWorkspacesInput{RebootWorkspaceRequests: requests})
+			if err != nil {
+				return nil, err
+			}
+			return out.FailedRequests, nil
+		})
+	case WorkspaceActionTerminate:
+		return batchWorkspaceAction(ids, func(batch []string) ([]wstypes.FailedWorkspaceChangeRequest, error) {
+			requests := make([]wstypes.TerminateRequest, len(batch))
+			for i, id := range batch {
+				requests[i] = wstypes.TerminateRequest{WorkspaceId: aws.String(id)}
+			}
+			out, err := client.TerminateWorkspaces(ctx, &workspaces.TerminateWorkspacesInput{TerminateWorkspaceRequests: requests})
+			if err != nil {
+				return nil, err
+			}
+			return out.FailedRequests, nil
+		})
+	}
+
+	// Rebuild, restore and migrate take one workspace per call
+	results := make([]WorkspaceActionResult, len(ids))
+	for i, id := range ids {
+		result := WorkspaceActionResult{WorkspaceID: id, Status: models.ActionSucceeded}
+		var err error
+		switch action {
+		case WorkspaceActionRebuild:
+			var out *workspaces.RebuildWorkspacesOutput
+			out, err = client.RebuildWorkspaces(ctx, &workspaces.RebuildWorkspacesInput{
+				RebuildWorkspaceRequests: []wstypes.RebuildRequest{{WorkspaceId: aws.String(id)}},
+			})
+			if err == nil && len(out.FailedRequests) > 0 {
+				err = failedRequestError(out.FailedRequests[0])
+			}
+		case WorkspaceActionRestore:
+			_, err = client.RestoreWorkspace(ctx, &workspaces.RestoreWorkspaceInput{WorkspaceId: aws.String(id)})
+		case WorkspaceActionMigrate:
+			var out *workspaces.MigrateWorkspaceOutput
+			out, err = client.MigrateWorkspace(ctx, &workspaces.MigrateWorkspaceInput{
+				SourceWorkspaceId: aws.String(id),
+				BundleId:          aws.String(params.BundleID),
+			})
+			if err == nil {
+				result.TargetWorkspaceID = aws.ToString(out.TargetWorkspaceId)
+			}
+		default:
+			err = fmt.Errorf("unknown action %q", action)
+		}
+		if err != nil {
+			result.Status, result.Error = models.ActionFailed, err.Error()
+		}
+		results[i] = result
+	}
+	return results
+}
+
+// batchWorkspaceAction calls a batch action over ids in batches, matching the requests AWS
+// reports as failed back to their workspaces
+func batchWorkspaceAction(ids []string, call func(batch []string) ([]wstypes.FailedWorkspaceChangeRequest, error)) []WorkspaceActionResult {
+	results := []WorkspaceActionResult{}
+	for start := 0; start < len(ids); start += workspaceActionBatch {
+		end := start + workspaceActionBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+
+		failedRequests, err := call(batch)
+		if err != nil {
+			results = append(results, failWorkspaceActions(batch, err)...)
+			continue
+		}
+
+		failed := make(map[string]error)
+		for _, f := range failedRequests {
+			failed[aws.ToString(f.WorkspaceId)] = failedRequestError(f)
+		}
+		for _, id := range batch {
+			result := WorkspaceActionResult{WorkspaceID: id, Status: models.ActionSucceeded}
+			if err, ok := failed[id]; ok {
+				result.Status, result.Error = models.ActionFailed, err.Error()
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// failWorkspaceActions fails every workspace in ids with err
+func failWorkspaceActions(ids []string, err error) []WorkspaceActionResult {
+	results := make([]WorkspaceActionResult, len(ids))
+	for i, id := range ids {
+		results[i] = WorkspaceActionResult{WorkspaceID: id, Status: models.ActionFailed, Error: err.Error()}
+	}
+	return results
+}
+
+func failedRequestError(f wstypes.FailedWorkspaceChangeRequest) error {
+	return fmt.Errorf("%s: %s", aws.ToString(f.ErrorCode), aws.ToString(f.ErrorMessage))
+}
+
+// recordWorkspaceAction stores the audit record of an action and, once AWS has accepted it,
+// moves the workspace to its transitional state until the next sync
+func (s *AWSService) recordWorkspaceAction(ws models.Workspace, action string, result WorkspaceActionResult, parameters json.RawMessage, requestedBy string, bulk bool) {
+	log.Printf("%s of WorkSpace %s by %s %s %s", action, ws.WorkspaceID, requestedBy, result.Status, result.Error)
+
+	record := &models.WorkspaceAction{
+		WorkspaceID:  ws.WorkspaceID,
+		AWSAccountID: ws.AWSAccountID,
+		Region:       ws.Region,
+		Action:       action,
+		Status:       result.Status,
+		Error:        result.Error,
+		Parameters:   parameters,
+		RequestedBy:  requestedBy,
+		Bulk:         bulk,
+	}
+	if err := models.CreateWorkspaceAction(s.DB, record); err != nil {
+		log.Printf("Failed to record %s of %s: %v", action, ws.WorkspaceID, err)
+	}
+
+	state := workspaceActionSpecs[action].state
+	if result.Status != models.ActionSucceeded || state == "" {
+		return
+	}
+	if err := models.UpdateWorkspaceState(s.DB, ws.WorkspaceID, state); err != nil {
+		log.Printf("Failed to update state of %s: %v", ws.WorkspaceID, err)
+		return
+	}
+	if err := models.RecordWorkspaceVersion(s.DB, ws.WorkspaceID); err != nil {
+		log.Printf("Failed to record version of %s: %v", ws.WorkspaceID, err)
+	}
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"log"
+	"strings"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// workspaceChangeFields returns the stored fields DetectWorkspaceChanges compares
+func workspaceChangeFields(ws *models.Workspace) map[string]interface{} {
+	return map[string]interface{}{
+		"state":                ws.State,
+		"running_mode":         ws.RunningMode,
+		"compute_type_name":    ws.ComputeTypeName,
+		"bundle_id":            ws.BundleID,
+		"root_volume_size_gib": ws.RootVolumeSizeGib,
+		"user_volume_size_gib": ws.UserVolumeSizeGib,
+		"user_name":            ws.UserName,
+		"ip_address":           ws.IPAddress,
+	}
+}
+
+// awsWorkspaceChangeFields returns the same fields as workspaceChangeFields for a workspace
+// read from AWS
+func awsWorkspaceChangeFields(ws wstypes.Workspace) map[string]interface{} {
+	fields := map[string]interface{}{
+		"state":                string(ws.State),
+		"running_mode":         "",
+		"compute_type_name":    "",
+		"bundle_id":            aws.ToString(ws.BundleId),
+		"root_volume_size_gib": 0,
+		"user_volume_size_gib": 0,
+		"user_name":            aws.ToString(ws.UserName),
+		"ip_address":           aws.ToString(ws.IpAddress),
+	}
+	if props := ws.WorkspaceProperties; props != nil {
+		fields["running_mode"] = string(props.RunningMode)
+		fields["compute_type_name"] = string(props.ComputeTypeName)
+		fields["root_volume_size_gib"] = int(aws.ToInt32(props.RootVolumeSizeGib))
+		fields["user_volume_size_gib"] = int(aws.ToInt32(props.UserVolumeSizeGib))
+	}
+	return fields
+}
+
+// notifyWorkspaceChanges compares the stored workspace (nil when new) with the one read from
+// AWS and sends a notification for each kind of change. New workspaces are only announced
+// when notifyCreated is set, so the first sync of an account doesn't announce everything.
+func (s *AWSService) notifyWorkspaceChanges(previous *models.Workspace, ws wstypes.Workspace, notifyCreated bool) {
+	notificationService := &NotificationService{DB: s.DB}
+	workspaceID := aws.ToString(ws.WorkspaceId)
+	userName := aws.ToString(ws.UserName)
+
+	if previous == nil {
+		if notifyCreated {
+			notificationService.NotifyWorkspaceCreated(workspaceID, userName, "")
+		}
+		return
+	}
+
+	adFullName := previous.ADFullName
+	oldFields := workspaceChangeFields(previous)
+	newFields := awsWorkspaceChangeFields(ws)
+
+	oldState, newState := previous.State, newFields["state"].(string)
+	if oldState != "" && newState != "" && oldState != newState {
+		if newState == string(wstypes.WorkspaceStateTerminated) {
+			notificationService.NotifyWorkspaceTerminated(workspaceID, userName, adFullName)
+		} else {
+			notificationService.NotifyWorkspaceStateChange(workspaceID, userName, adFullName, oldState, newState)
+		}
+	}
+
+	if changes := notificationService.DetectWorkspaceChanges(oldFields, newFields); len(changes) > 0 {
+		log.Printf("WorkSpace %s changed: %s", workspaceID, strings.Join(changes, "; "))
+		notificationService.NotifyWorkspaceModified(workspaceID, userName, adFullName, strings.Join(changes, "; "))
+	}
+}
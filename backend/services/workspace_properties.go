@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/workspaces"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// WorkspaceActionModify is the audit action recorded for property changes
+const WorkspaceActionModify = "modify"
+
+// WorkspacePropertyChange is a change to a workspace's properties. Fields left nil keep their
+// current value.
+type WorkspacePropertyChange struct {
+	RunningMode            *string `json:"running_mode,omitempty"`
+	ComputeTypeName        *string `json:"compute_type_name,omitempty"`
+	RootVolumeSizeGib      *int    `json:"root_volume_size_gib,omitempty"`
+	UserVolumeSizeGib      *int    `json:"user_volume_size_gib,omitempty"`
+	AutoStopTimeoutMinutes *int    `json:"auto_stop_timeout_minutes,omitempty"`
+}
+
+// Validate checks the change can be applied to ws. Running mode and compute type must be
+// known values, volumes can only grow, and the AutoStop timeout comes in whole hours.
+func (p WorkspacePropertyChange) Validate(ws *models.Workspace) error {
+	if p == (WorkspacePropertyChange{}) {
+		return fmt.Errorf("no properties to change")
+	}
+	if ws.State != string(wstypes.WorkspaceStateAvailable) && ws.State != string(wstypes.WorkspaceStateStopped) {
+		return fmt.Errorf("workspace must be AVAILABLE or STOPPED to be modified, not %s", ws.State)
+	}
+
+	runningMode := ws.RunningMode
+	if p.RunningMode != nil {
+		runningMode = *p.RunningMode
+		if runningMode != string(wstypes.RunningModeAutoStop) && runningMode != string(wstypes.RunningModeAlwaysOn) {
+			return fmt.Errorf("running_mode must be %s or %s", wstypes.RunningModeAutoStop, wstypes.RunningModeAlwaysOn)
+		}
+	}
+
+	if p.ComputeTypeName != nil && !validComputeType(*p.ComputeTypeName) {
+		return fmt.Errorf("unknown compute_type_name %q", *p.ComputeTypeName)
+	}
+
+	if p.RootVolumeSizeGib != nil && *p.RootVolumeSizeGib <= ws.RootVolumeSizeGib {
+		return fmt.Errorf("root_volume_size_gib can only grow from %d GiB", ws.RootVolumeSizeGib)
+	}
+	if p.UserVolumeSizeGib != nil && *p.UserVolumeSizeGib <= ws.UserVolumeSizeGib {
+		return fmt.Errorf("user_volume_size_gib can only grow from %d GiB", ws.UserVolumeSizeGib)
+	}
+
+	if p.AutoStopTimeoutMinutes != nil {
+		if runningMode != string(wstypes.RunningModeAutoStop) {
+			return fmt.Errorf("auto_stop_timeout_minutes only applies to %s workspaces", wstypes.RunningModeAutoStop)
+		}
+		if *p.AutoStopTimeoutMinutes <= 0 || *p.AutoStopTimeoutMinutes%60 != 0 {
+			return fmt.Errorf("auto_stop_timeout_minutes must be a whole number of hours, such as 60 or 120")
+		}
+	}
+	return nil
+}
+
+func validComputeType(name string) bool {
+	for _, compute := range wstypes.Compute("").Values() {
+		if string(compute) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifyWorkspaceProperties applies a validated change through the credentials of the
+// account that owns the workspace. The stored workspace is updated to match and a
+// workspace_modified notification sent; every attempt is recorded with requestedBy.
+func (s *AWSService) ModifyWorkspaceProperties(ctx context.Context, ws *models.Workspace, change WorkspacePropertyChange, requestedBy string) (*models.Workspace, error) {
+	props := &wstypes.WorkspaceProperties{}
+	if change.RunningMode != nil {
+		props.RunningMode = wstypes.RunningMode(*change.RunningMode)
+	}
+	if change.ComputeTypeName != nil {
+		props.ComputeTypeName = wstypes.Compute(*change.ComputeTypeName)
+	}
+	if change.RootVolumeSizeGib != nil {
+		props.RootVolumeSizeGib = aws.Int32(int32(*change.RootVolumeSizeGib))
+	}
+	if change.UserVolumeSizeGib != nil {
+		props.UserVolumeSizeGib = aws.Int32(int32(*change.UserVolumeSizeGib))
+	}
+	if change.AutoStopTimeoutMinutes != nil {
+		props.RunningModeAutoStopTimeoutInMinutes = aws.Int32(int32(*change.AutoStopTimeoutMinutes))
+	}
+
+	key := actionTarget{region: ws.Region}
+	if ws.AWSAccountID != nil {
+		key.accountID = *ws.AWSAccountID
+	}
+	client, err := s.actionClient(ctx, key)
+	if err == nil {
+		_, err = client.ModifyWorkspaceProperties(ctx, &workspaces.ModifyWorkspacePropertiesInput{
+			WorkspaceId:         aws.String(ws.WorkspaceID),
+			WorkspaceProperties: props,
+		})
+	}
+
+	result := WorkspaceActionResult{WorkspaceID: ws.WorkspaceID, Status: models.ActionSucceeded}
+	if err != nil {
+		result.Status, result.Error = models.ActionFailed, err.Error()
+	}
+	parameters, _ := json.Marshal(change)
+	s.recordWorkspaceAction(*ws, WorkspaceActionModify, result, parameters, requestedBy, false)
+	if err != nil {
+		return nil, err
+	}
+
+	modified := *ws
+	if change.RunningMode != nil {
+		modified.RunningMode = *change.RunningMode
+	}
+	if change.ComputeTypeName != nil {
+		modified.ComputeTypeName = *change.ComputeTypeName
+	}
+	if change.RootVolumeSizeGib != nil {
+		modified.RootVolumeSizeGib = *change.RootVolumeSizeGib
+	}
+	if change.UserVolumeSizeGib != nil {
+		modified.UserVolumeSizeGib = *change.UserVolumeSizeGib
+	}
+	if change.AutoStopTimeoutMinutes != nil {
+		modified.AutoStopTimeoutMinutes = *change.AutoStopTimeoutMinutes
+	}
+
+	// AWS has accepted the change, so a failure to store it is only logged; the next sync
+	// reads it back anyway
+	if err := models.UpdateWorkspaceProperties(s.DB, &modified); err != nil {
+		log.Printf("Failed to store properties of %s: %v", ws.WorkspaceID, err)
+	} else if err := models.RecordWorkspaceVersion(s.DB, ws.WorkspaceID); err != nil {
+		log.Printf("Failed to record version of %s: %v", ws.WorkspaceID, err)
+	}
+
+	notificationService := &NotificationService{DB: s.DB}
+	changes := notificationService.DetectWorkspaceChanges(workspaceChangeFields(ws), workspaceChangeFields(&modified))
+	if ws.AutoStopTimeoutMinutes != modified.AutoStopTimeoutMinutes {
+		changes = append(changes, fmt.Sprintf("AutoStop timeout (minutes) changed from %d to %d",
+			ws.AutoStopTimeoutMinutes, modified.AutoStopTimeoutMinutes))
+	}
+	if len(changes) > 0 {
+		description := fmt.Sprintf("%s (by %s)", strings.Join(changes, "; "), requestedBy)
+		notificationService.NotifyWorkspaceModified(ws.WorkspaceID, ws.UserName, ws.ADFullName, description)
+	}
+
+	return &modified, nil
+}
@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4syedalihassan/workspaces-inventory/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/workspaces"
+	wstypes "github.com/aws/aws-sdk-go-v2/service/workspaces/types"
+)
+
+// ErrWorkspaceRequestOpen is returned when a user already has an open request for a directory
+var ErrWorkspaceRequestOpen = errors.New("an open request for this directory already exists")
+
+// workspaceRequestTag is the tag that ties a workspace to the request it was created for
+const workspaceRequestTag = "WorkspaceRequestId"
+
+// orphanedClaimAge is how long a claimed request may go without a workspace ID before
+// another run claims it again
+const orphanedClaimAge = 15 * time.Minute
+
+// invalidTagChars are the characters AWS doesn't allow in tag values
+var invalidTagChars = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+
+// WorkspaceRequestService runs the self-service portal: users request a workspace, their
+// manager approves it, and the sync worker creates it and tracks it until it appears
+type WorkspaceRequestService struct {
+	DB *sql.DB
+}
+
+// Validate checks wr names an available bundle and a registered directory in the same
+// account and region, and a known running mode
+func (s *WorkspaceRequestService) Validate(wr *models.WorkspaceRequest, bundle *models.WorkspaceBundle, directory *models.WorkspaceDirectory) error {
+	if wr.RunningMode != string(wstypes.RunningModeAutoStop) && wr.RunningMode != string(wstypes.RunningModeAlwaysOn) {
+		return fmt.Errorf("running_mode must be %s or %s", wstypes.RunningModeAutoStop, wstypes.RunningModeAlwaysOn)
+	}
+	if bundle.State != "" && bundle.State != string(wstypes.WorkspaceBundleStateAvailable) {
+		return fmt.Errorf("bundle %s is %s", bundle.BundleID, bundle.State)
+	}
+	if directory.State != string(wstypes.WorkspaceDirectoryStateRegistered) {
+		return fmt.Errorf("directory %s is not registered with WorkSpaces", directory.DirectoryID)
+	}
+	if bundle.Region != directory.Region {
+		return fmt.Errorf("bundle %s is in %s but directory %s is in %s",
+			bundle.BundleID, bundle.Region, directory.DirectoryID, directory.Region)
+	}
+	// Amazon-owned bundles are listed under every account; custom ones must be the directory's
+	if bundle.Owner != "AMAZON" && bundle.AWSAccountID != nil && directory.AWSAccountID != nil &&
+		*bundle.AWSAccountID != *directory.AWSAccountID {
+		return fmt.Errorf("bundle %s belongs to a different AWS account than directory %s", bundle.BundleID, directory.DirectoryID)
+	}
+	return nil
+}
+
+// Create stores a validated request and routes it to the user's manager, as recorded by the
+// AD sync. Requests for users the AD sync doesn't know yet go to admins until it does.
+func (s *WorkspaceRequestService) Create(wr *models.WorkspaceRequest) error {
+	info, err := models.GetUserADInfo(s.DB, wr.UserName)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if info != nil {
+		wr.Department, wr.Manager, wr.ManagerEmail = info.Department, info.Manager, info.ManagerEmail
+	}
+
+	hours := models.GetSettingInt(s.DB, "portal.expiry_hours", 168)
+	if err := models.CreateWorkspaceRequest(s.DB, wr, time.Duration(hours)*time.Hour); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrWorkspaceRequestOpen
+		}
+		return err
+	}
+
+	s.notifyApprovers(wr)
+	return nil
+}
+
+// notifyApprovers asks the request's manager, or admins when it has none, to decide on it
+func (s *WorkspaceRequestService) notifyApprovers(wr *models.WorkspaceRequest) {
+	recipients := []string{}
+	if wr.ManagerEmail != "" {
+		recipients = append(recipients, wr.ManagerEmail)
+	} else {
+		admins, err := models.ListUserEmailsByRole(s.DB, []string{"ADMIN"})
+		if err != nil {
+			log.Printf("Failed to find approvers of workspace request %d: %v", wr.ID, err)
+		}
+		recipients = append(recipients, admins...)
+	}
+	if requester := userEmail(s.DB, wr.RequestedBy); requester != "" {
+		recipients = removeString(recipients, requester)
+	}
+
+	notificationService := &NotificationService{DB: s.DB}
+	notificationService.NotifyWorkspaceRequest(models.EventWorkspaceRequested, wr, "Workspace Request Awaiting Approval",
+		fmt.Sprintf("%s requested a workspace for %s from bundle %s in directory %s: %s",
+			wr.RequestedBy, wr.UserName, wr.BundleID, wr.DirectoryID, wr.Justification),
+		models.SeverityInfo, recipients)
+}
+
+// CanDecide reports whether a user may approve or reject wr: the requester's manager, or an
+// admin. Nobody decides on their own request.
+func (s *WorkspaceRequestService) CanDecide(wr *models.WorkspaceRequest, username, role string) bool {
+	if username == wr.RequestedBy {
+		return false
+	}
+	if role == "ADMIN" {
+		return true
+	}
+	email := userEmail(s.DB, username)
+	return email != "" && strings.EqualFold(email, wr.ManagerEmail)
+}
+
+// Decide approves, rejects or cancels a pending request and tells its requester when someone
+// else made the decision. It returns sql.ErrNoRows if the request is no longer pending.
+func (s *WorkspaceRequestService) Decide(id int, status, decidedBy, note string) (*models.WorkspaceRequest, error) {
+	wr, err := models.DecideWorkspaceRequest(s.DB, id, status, decidedBy, note)
+	if err != nil {
+		return nil, err
+	}
+
+	if decidedBy != wr.RequestedBy {
+		message := fmt.Sprintf("%s %s your request for a workspace for %s", decidedBy, wr.Status, wr.UserName)
+		if note != "" {
+			message += ": " + note
+		}
+		severity := models.SeverityInfo
+		if wr.Status != models.RequestApproved {
+			severity = models.SeverityWarning
+		}
+		notificationService := &NotificationService{DB: s.DB}
+		notificationService.NotifyWorkspaceRequest(models.EventWorkspaceRequestDecided, wr,
+			workspaceRequestTitles[wr.Status], message, severity, userEmails(s.DB, wr.RequestedBy))
+	}
+	return wr, nil
+}
+
+// workspaceRequestTitles titles the notifications sent when a request reaches a status
+var workspaceRequestTitles = map[string]string{
+	models.RequestApproved:  "Workspace Request Approved",
+	models.RequestRejected:  "Workspace Request Rejected",
+	models.RequestCancelled: "Workspace Request Cancelled",
+	models.RequestCompleted: "Workspace Provisioned",
+	models.RequestFailed:    "Workspace Provisioning Failed",
+}
+
+// Run expires overdue requests, creates the workspaces of approved ones and fails those that
+// never appeared, returning how many workspaces it created. It is the "requests" sync stage.
+func (s *WorkspaceRequestService) Run(ctx context.Context) (int, error) {
+	notificationService := &NotificationService{DB: s.DB}
+
+	expired, err := models.ExpireWorkspaceRequests(s.DB)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire workspace requests: %w", err)
+	}
+	for i := range expired {
+		wr := &expired[i]
+		notificationService.NotifyWorkspaceRequest(models.EventWorkspaceRequestExpired, wr, "Workspace Request Expired",
+			fmt.Sprintf("Your request for a workspace for %s expired without a decision", wr.UserName),
+			models.SeverityWarning, userEmails(s.DB, wr.RequestedBy))
+	}
+
+	// Requests created by an earlier run may have been synced since
+	s.TrackProvisioning()
+
+	hours := models.GetSettingInt(s.DB, "portal.provisioning_timeout_hours", 24)
+	stalled, err := models.FailStalledWorkspaceRequests(s.DB, time.Duration(hours)*time.Hour)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check provisioning workspace requests: %w", err)
+	}
+	for i := range stalled {
+		s.notifyProvisioned(&stalled[i])
+	}
+
+	awsService := &AWSService{DB: s.DB}
+	created := 0
+	for ctx.Err() == nil {
+		wr, err := models.ClaimApprovedWorkspaceRequest(s.DB, time.Now().Add(-orphanedClaimAge))
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return created, fmt.Errorf("failed to claim workspace request: %w", err)
+		}
+
+		workspaceID, err := s.provision(ctx, awsService, wr)
+		if err != nil {
+			log.Printf("Failed to create workspace for request %d: %v", wr.ID, err)
+			failed, failErr := models.FailWorkspaceRequest(s.DB, wr.ID, err.Error())
+			if failErr != nil {
+				return created, fmt.Errorf("failed to record workspace request %d: %w", wr.ID, failErr)
+			}
+			s.notifyProvisioned(failed)
+			continue
+		}
+
+		// A request left without its workspace ID is claimed again later, and provision
+		// finds the tagged workspace instead of creating another
+		if _, err := models.MarkWorkspaceRequestProvisioned(s.DB, wr.ID, workspaceID); err != nil {
+			return created, fmt.Errorf("failed to record workspace %s for request %d: %w", workspaceID, wr.ID, err)
+		}
+		log.Printf("Creating workspace %s for request %d (%s)", workspaceID, wr.ID, wr.UserName)
+		created++
+	}
+	return created, nil
+}
+
+// provision calls CreateWorkspaces for a claimed request and returns the new workspace's ID.
+// A workspace already tagged with the request, created by a run that stopped before
+// recording it, is returned instead of creating a second one.
+func (s *WorkspaceRequestService) provision(ctx context.Context, awsService *AWSService, wr *models.WorkspaceRequest) (string, error) {
+	key := actionTarget{region: wr.Region}
+	if wr.AWSAccountID != nil {
+		key.accountID = *wr.AWSAccountID
+	}
+	client, err := awsService.actionClient(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := s.findRequestedWorkspace(ctx, client, wr)
+	if err != nil || existing != "" {
+		return existing, err
+	}
+
+	output, err := client.CreateWorkspaces(ctx, &workspaces.CreateWorkspacesInput{
+		Workspaces: []wstypes.WorkspaceRequest{{
+			BundleId:    aws.String(wr.BundleID),
+			DirectoryId: aws.String(wr.DirectoryID),
+			UserName:    aws.String(wr.UserName),
+			WorkspaceProperties: &wstypes.WorkspaceProperties{
+				RunningMode: wstypes.RunningMode(wr.RunningMode),
+			},
+			Tags: s.workspaceTags(wr),
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(output.FailedRequests) > 0 {
+		f := output.FailedRequests[0]
+		return "", fmt.Errorf("%s: %s", aws.ToString(f.ErrorCode), aws.ToString(f.ErrorMessage))
+	}
+	if len(output.PendingRequests) == 0 || aws.ToString(output.PendingRequests[0].WorkspaceId) == "" {
+		return "", fmt.Errorf("AWS did not return the new workspace")
+	}
+	return aws.ToString(output.PendingRequests[0].WorkspaceId), nil
+}
+
+// findRequestedWorkspace returns the ID of the user's workspace in the request's directory
+// if it is tagged with the request's ID, or "" if the user has none. A workspace created
+// some other way is an error, as AWS allows one per user and directory.
+func (s *WorkspaceRequestService) findRequestedWorkspace(ctx context.Context, client *workspaces.Client, wr *models.WorkspaceRequest) (string, error) {
+	output, err := client.DescribeWorkspaces(ctx, &workspaces.DescribeWorkspacesInput{
+		DirectoryId: aws.String(wr.DirectoryID),
+		UserName:    aws.String(wr.UserName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to check for an existing workspace: %w", err)
+	}
+
+	requestID := strconv.Itoa(wr.ID)
+	for _, ws := range output.Workspaces {
+		if ws.State == wstypes.WorkspaceStateTerminating || ws.State == wstypes.WorkspaceStateTerminated {
+			continue
+		}
+		workspaceID := aws.ToString(ws.WorkspaceId)
+		tags, err := client.DescribeTags(ctx, &workspaces.DescribeTagsInput{ResourceId: aws.String(workspaceID)})
+		if err != nil {
+			return "", fmt.Errorf("failed to read tags of workspace %s: %w", workspaceID, err)
+		}
+		for _, tag := range tags.TagList {
+			if aws.ToString(tag.Key) == workspaceRequestTag && aws.ToString(tag.Value) == requestID {
+				return workspaceID, nil
+			}
+		}
+		return "", fmt.Errorf("%s already has workspace %s in directory %s", wr.UserName, workspaceID, wr.DirectoryID)
+	}
+	return "", nil
+}
+
+// workspaceTags tags a requested workspace with the request, who asked for and approved it,
+// and the user's department, on top of the portal.tags setting (Key=Value pairs)
+func (s *WorkspaceRequestService) workspaceTags(wr *models.WorkspaceRequest) []wstypes.Tag {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(models.GetSettingString(s.DB, "portal.tags", ""), ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(key) != "" {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	values[workspaceRequestTag] = strconv.Itoa(wr.ID)
+	values["RequestedBy"] = wr.RequestedBy
+	values["ApprovedBy"] = wr.DecidedBy
+	if wr.Department != "" {
+		values["Department"] = wr.Department
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := make([]wstypes.Tag, 0, len(keys))
+	for _, key := range keys {
+		tags = append(tags, wstypes.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(invalidTagChars.ReplaceAllString(values[key], "-")),
+		})
+	}
+	return tags
+}
+
+// TrackProvisioning finishes the requests whose workspace a sync has now stored and notifies
+// their requesters. It returns how many it finished.
+func (s *WorkspaceRequestService) TrackProvisioning() int {
+	finished, err := models.CompleteSyncedWorkspaceRequests(s.DB)
+	if err != nil {
+		log.Printf("Failed to track provisioning workspace requests: %v", err)
+		return 0
+	}
+	for i := range finished {
+		s.notifyProvisioned(&finished[i])
+	}
+	return len(finished)
+}
+
+// notifyProvisioned tells the requester and approver how provisioning ended
+func (s *WorkspaceRequestService) notifyProvisioned(wr *models.WorkspaceRequest) {
+	message := fmt.Sprintf("Workspace %s for %s is ready", wr.WorkspaceID, wr.UserName)
+	severity := models.SeveritySuccess
+	if wr.Status == models.RequestFailed {
+		message = fmt.Sprintf("The workspace requested for %s could not be created: %s", wr.UserName, wr.Error)
+		severity = models.SeverityError
+	}
+
+	notificationService := &NotificationService{DB: s.DB}
+	notificationService.NotifyWorkspaceRequest(models.EventWorkspaceProvisioned, wr, workspaceRequestTitles[wr.Status],
+		message, severity, userEmails(s.DB, wr.RequestedBy, wr.DecidedBy))
+}